@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// abandonVars counts the requests abandoned by their clients and the outcomes of their cleanups, served by /debug/vars.
+var abandonVars = expvar.NewMap("abandoned")
+
+// abandonCleanupsKey is the context key of the [abandonCleanups] of a request.
+type abandonCleanupsKey struct{}
+
+// abandonCleanups holds the cleanups registered by [onAbandon] during a request.
+type abandonCleanups struct {
+	timeout time.Duration
+
+	mu    sync.Mutex
+	stops []func() bool
+}
+
+// cleanupAbandoned is a middleware counting the requests whose clients went away before the handler returned,
+// and running the cleanups registered for them by [onAbandon] with the timeout, so that canceled clients
+// do not leak server work such as running queries or held locks. Cleanups of requests completed normally never run.
+func cleanupAbandoned(next http.Handler, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cleanups := &abandonCleanups{timeout: timeout}
+		r = r.WithContext(context.WithValue(r.Context(), abandonCleanupsKey{}, cleanups))
+
+		next.ServeHTTP(w, r)
+
+		if errors.Is(r.Context().Err(), context.Canceled) {
+			abandonVars.Add("requests", 1)
+			addLogAttrs(r.Context(), slog.Bool("abandoned", true))
+			return
+		}
+		cleanups.mu.Lock()
+		defer cleanups.mu.Unlock()
+		for _, stop := range cleanups.stops {
+			stop()
+		}
+	})
+}
+
+// onAbandon registers the cleanup named name to run if the client of the request of ctx goes away before the handler returns,
+// such as to cancel a query on another connection or release a lock. The cleanup is passed a context with the values of ctx
+// that is canceled after the -abandon-cleanup-timeout, and its failures, panics, and timeouts are logged and counted.
+// It returns a function to unregister the cleanup, reporting whether it did before the cleanup started.
+// It does nothing outside of [cleanupAbandoned].
+//
+//	stop := onAbandon(r.Context(), "release-lock", func(ctx context.Context) error { return lock.Release(ctx) })
+//	defer stop()
+func onAbandon(ctx context.Context, name string, cleanup func(ctx context.Context) error) (stop func() bool) {
+	cleanups, ok := ctx.Value(abandonCleanupsKey{}).(*abandonCleanups)
+	if !ok {
+		return func() bool { return false }
+	}
+	stop = context.AfterFunc(ctx, func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanups.timeout)
+		defer cancel()
+		start := time.Now()
+		done := make(chan error, 1)
+		go func() {
+			defer func() {
+				if v := recover(); v != nil {
+					done <- fmt.Errorf("panic: %v", v)
+				}
+			}()
+			done <- cleanup(ctx)
+		}()
+
+		abandonVars.Add("cleanups", 1)
+		var err error
+		select {
+		case err = <-done:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			abandonVars.Add("cleanup_timeouts", 1)
+			err = fmt.Errorf("timed out after %s", cleanups.timeout)
+		}
+		if err != nil {
+			abandonVars.Add("cleanup_failures", 1)
+			slog.WarnContext(ctx, "abandoned request cleanup failed", slog.String("cleanup", name),
+				slog.Duration("duration", time.Since(start)), slog.Any("error", err))
+		}
+	})
+	cleanups.mu.Lock()
+	cleanups.stops = append(cleanups.stops, stop)
+	cleanups.mu.Unlock()
+	return stop
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestCleanupAbandoned tests that cleanups run only for requests abandoned by their clients, within the timeout.
+func TestCleanupAbandoned(t *testing.T) {
+	ran := make(chan string, 10)
+	handler := cleanupAbandoned(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		onAbandon(r.Context(), "release", func(ctx context.Context) error {
+			ran <- "release"
+			return nil
+		})
+		onAbandon(r.Context(), "hang", func(ctx context.Context) error {
+			<-ctx.Done()
+			ran <- "hang"
+			return ctx.Err()
+		})
+		if r.URL.Query().Has("wait") {
+			<-r.Context().Done()
+		}
+	}), 10*time.Millisecond)
+	timeouts := func() int64 {
+		if v := abandonVars.Get("cleanup_timeouts"); v != nil {
+			return v.(*expvar.Int).Value()
+		}
+		return 0
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	cancel()
+	select {
+	case name := <-ran:
+		t.Fatalf("cleanup %s of a completed request ran", name)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	before := timeouts()
+	ctx, cancel = context.WithCancel(context.Background())
+	r = httptest.NewRequest(http.MethodGet, "/?wait", nil).WithContext(ctx)
+	time.AfterFunc(10*time.Millisecond, cancel)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	got := map[string]bool{<-ran: true, <-ran: true}
+	testEqual(t, true, got["release"] && got["hang"])
+	for deadline := time.Now().Add(time.Second); timeouts() == before && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	testEqual(t, before+1, timeouts())
+
+	stop := onAbandon(context.Background(), "outside", func(context.Context) error { return errors.New("never") })
+	testEqual(t, false, stop())
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// adminState holds the runtime toggles changed through the /admin/ API, see [handleAdmin].
+// Handlers read them with [adminState.flag] and [adminState.rateLimit] on every request, so changes apply immediately.
+type adminState struct {
+	level       slog.LevelVar // level of the logger, set as [slog.HandlerOptions.Level] in run
+	maintenance atomic.Bool   // responds 503 to every request but health checks and the admin API, see [maintenance]
+	cordoned    atomic.Bool   // fails /readyz so that the instance is drained of traffic, while still serving requests
+
+	mu         sync.Mutex
+	flags      map[string]bool
+	rateLimits map[string]int64
+}
+
+// flag reports whether the feature flag is enabled, false if it was never set.
+func (s *adminState) flag(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flags[name]
+}
+
+// rateLimit returns the override of the rate limit, or def if it is not overridden.
+func (s *adminState) rateLimit(name string, def int64) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if limit, ok := s.rateLimits[name]; ok {
+		return limit
+	}
+	return def
+}
+
+// levelAudit is the level of the audit entries of the admin API, above [slog.LevelError] so that raising the log level,
+// such as through the admin API itself, never filters them out. Log outputs print it as AUDIT, see [levelName].
+const levelAudit = slog.LevelError + 2
+
+// adminDeps are the dependencies of [handleAdmin]. Only log, state, and token are required, since the routes
+// of the other fields are left out or respond with 404 if they are nil, such as in tests not exercising them.
+type adminDeps struct {
+	log         *slog.Logger
+	state       *adminState
+	token       string
+	metrics     *metrics
+	store       store      // lists the trash, wrapped by [logQueries], nil unless -store is set
+	backups     *fileStore // backed up and restored, nil unless -store is set
+	backupTo    string     // empty unless -backup-to is set
+	lifecycle   *lifecycle // emits every change as a config-reloaded event
+	drain       *drainer
+	diagnostics http.Handler
+	scheduler   *scheduler
+	bus         *eventBus
+	reloader    *reloader
+}
+
+// handleAdmin returns an [http.Handler] serving the admin API under /admin/, authenticated by the bearer token of d.
+// Every change is written to log as an audit entry with the old and new values and who made it, at [levelAudit].
+//
+//	GET    /admin/                  responds with the current state
+//	PUT    /admin/log-level         {"Level": "debug"}
+//	PUT    /admin/maintenance       {"Enabled": true}
+//	PUT    /admin/cordon            {"Enabled": true}
+//	PUT    /admin/flags/{name}      {"Enabled": true}
+//	PUT    /admin/rate-limits/{name} {"Limit": 100}
+//	DELETE /admin/rate-limits/{name} removes the override
+//	GET    /admin/largest-responses responds with the largest recent responses, empty unless -metrics is set
+//	GET    /admin/backup            responds with a backup of the store, if -store is set
+//	PUT    /admin/backup            restores the store from a backup
+//	POST   /admin/backups           writes a backup of the store to backupTo, such as blob storage, see [uploadBackup]
+//	GET    /admin/lifecycle         streams the lifecycle events as Server-Sent Events, see [handleGetLifecycle]
+//	POST   /admin/diagnostics       responds with a diagnostic bundle, see [handlePostDiagnostics]
+//	GET    /admin/jobs              responds with the scheduled jobs, their last outcome, and next run
+//	POST   /admin/jobs/{name}/run   runs the job now in the background, responding with 202
+//	GET    /admin/dead-letters      responds with the event deliveries that failed for good, see [eventBus.nack]
+//	POST   /admin/dead-letters/redrive?id= queues the dead letter of the ID again, or every one without it, 404 if unknown
+//	GET    /admin/reload            responds with the outcome of the last reload of the config, see [reloader]
+//	POST   /admin/reload            reloads the config like SIGHUP, responding with 422 if it is invalid
+//
+// Every change of a setting is also emitted as a config-reloaded event of the lifecycle, see [adminDeps],
+// while running jobs, redriving dead letters, and restoring or uploading backups are only audited,
+// and reloads are emitted by the [reloader].
+func handleAdmin(d adminDeps) http.Handler {
+	type stateBody struct {
+		LogLevel    string           `json:"LogLevel"`
+		Maintenance bool             `json:"Maintenance"`
+		Cordoned    bool             `json:"Cordoned"`
+		Flags       map[string]bool  `json:"Flags"`
+		RateLimits  map[string]int64 `json:"RateLimits"`
+	}
+	type requestBody struct {
+		Level   *string `json:"Level"`
+		Enabled *bool   `json:"Enabled"`
+		Limit   *int64  `json:"Limit"`
+	}
+
+	writeState := func(w http.ResponseWriter, r *http.Request) {
+		d.state.mu.Lock()
+		res := stateBody{
+			LogLevel:    d.state.level.Level().String(),
+			Maintenance: d.state.maintenance.Load(),
+			Cordoned:    d.state.cordoned.Load(),
+			Flags:       maps.Clone(d.state.flags),
+			RateLimits:  maps.Clone(d.state.rateLimits),
+		}
+		d.state.mu.Unlock()
+		if res.Flags == nil {
+			res.Flags = map[string]bool{}
+		}
+		if res.RateLimits == nil {
+			res.RateLimits = map[string]int64{}
+		}
+
+		if err := writeBody(w, r, 200, res); err != nil {
+			slog.ErrorContext(r.Context(), "failed to write admin state", slog.Any("error", err))
+		}
+	}
+	// logAudit writes the audit entry of an action through the admin API, at [levelAudit] so that it is never filtered out.
+	logAudit := func(r *http.Request, setting string, from, to any) {
+		d.log.Log(r.Context(), levelAudit, "admin changed",
+			slog.String("setting", setting),
+			slog.Any("old", from),
+			slog.Any("new", to),
+			slog.String("ip", r.RemoteAddr),
+			slog.String("request_id", requestIDFrom(r.Context())))
+	}
+	// audit writes the audit entry of a change of a setting and emits it as a config-reloaded event.
+	audit := func(r *http.Request, setting string, from, to any) {
+		logAudit(r, setting, from, to)
+		d.lifecycle.emit(r.Context(), stateConfigReloaded, setting)
+	}
+	// change decodes the request body, applies it with apply, and responds with the new state.
+	change := func(apply func(r *http.Request, body requestBody) error) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			var body requestBody
+			if r.Method != http.MethodDelete {
+				if err := decodeBody(r, &body); errors.Is(err, errUnsupportedMediaType) {
+					writeProblem(w, r, http.StatusUnsupportedMediaType, err)
+					return
+				} else if err != nil {
+					writeProblem(w, r, http.StatusBadRequest, fmt.Errorf("invalid body: %w", err))
+					return
+				}
+			}
+			if err := apply(r, body); err != nil {
+				writeProblem(w, r, http.StatusBadRequest, err)
+				return
+			}
+			writeState(w, r)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/{$}", writeState)
+	mux.HandleFunc("GET /admin/largest-responses", func(w http.ResponseWriter, r *http.Request) {
+		if err := writeBody(w, r, 200, d.metrics.largestResponses()); err != nil {
+			slog.ErrorContext(r.Context(), "failed to write largest responses", slog.Any("error", err))
+		}
+	})
+	if d.lifecycle != nil {
+		mux.HandleFunc("GET /admin/lifecycle", handleGetLifecycle(d.lifecycle, d.drain))
+	}
+	if d.diagnostics != nil {
+		mux.Handle("POST /admin/diagnostics", d.diagnostics)
+	}
+	mux.HandleFunc("GET /admin/jobs", func(w http.ResponseWriter, r *http.Request) {
+		if err := writeBody(w, r, 200, d.scheduler.status()); err != nil {
+			slog.ErrorContext(r.Context(), "failed to write jobs", slog.Any("error", err))
+		}
+	})
+	mux.HandleFunc("POST /admin/jobs/{name}/run", func(w http.ResponseWriter, r *http.Request) {
+		if d.scheduler == nil {
+			writeProblem(w, r, http.StatusNotFound, errUnknownJob)
+			return
+		}
+		switch err := d.scheduler.runNow(r.PathValue("name")); {
+		case errors.Is(err, errUnknownJob):
+			writeProblem(w, r, http.StatusNotFound, err)
+		case errors.Is(err, errJobRunning):
+			writeProblem(w, r, http.StatusConflict, err)
+		default:
+			logAudit(r, "jobs."+r.PathValue("name")+".run", nil, true)
+			w.WriteHeader(http.StatusAccepted)
+		}
+	})
+	if d.bus != nil {
+		mux.HandleFunc("GET /admin/dead-letters", func(w http.ResponseWriter, r *http.Request) {
+			if err := writeBody(w, r, 200, d.bus.deadLetters.list()); err != nil {
+				slog.ErrorContext(r.Context(), "failed to write dead letters", slog.Any("error", err))
+			}
+		})
+		mux.HandleFunc("POST /admin/dead-letters/redrive", func(w http.ResponseWriter, r *http.Request) {
+			type responseBody struct {
+				Redriven int `json:"Redriven"`
+			}
+
+			id := 0
+			if s := r.URL.Query().Get("id"); s != "" {
+				var err error
+				if id, err = strconv.Atoi(s); err != nil || id <= 0 {
+					writeProblem(w, r, http.StatusBadRequest, fmt.Errorf("invalid id %q", s))
+					return
+				}
+			}
+			n, err := d.bus.deadLetters.redrive(id)
+			if err != nil {
+				writeProblem(w, r, http.StatusNotFound, err)
+				return
+			}
+			logAudit(r, "events.redrive", id, n)
+			if err := writeBody(w, r, 200, responseBody{Redriven: n}); err != nil {
+				slog.ErrorContext(r.Context(), "failed to write redriven", slog.Any("error", err))
+			}
+		})
+	}
+	if d.reloader != nil {
+		mux.HandleFunc("GET /admin/reload", handleGetReload(d.reloader))
+		mux.HandleFunc("POST /admin/reload", func(w http.ResponseWriter, r *http.Request) {
+			// NOTE: the reloader emits the config-reloaded event, the same as on SIGHUP
+			status := d.reloader.reload(r.Context())
+			logAudit(r, "config", nil, status.OK)
+			code := http.StatusOK
+			if !status.OK {
+				code = http.StatusUnprocessableEntity
+			}
+			if err := writeBody(w, r, code, status); err != nil {
+				slog.ErrorContext(r.Context(), "failed to write reload status", slog.Any("error", err))
+			}
+		})
+	}
+	mux.HandleFunc("GET /admin/backup", func(w http.ResponseWriter, r *http.Request) {
+		if d.backups == nil {
+			writeProblem(w, r, http.StatusNotFound, errors.New("no store to back up, -store is not set"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="backup.json"`)
+		w.WriteHeader(200)
+		if err := d.backups.backup(w); err != nil {
+			slog.ErrorContext(r.Context(), "failed to write backup", slog.Any("error", err))
+		}
+	})
+	mux.HandleFunc("PUT /admin/backup", func(w http.ResponseWriter, r *http.Request) {
+		if d.backups == nil {
+			writeProblem(w, r, http.StatusNotFound, errors.New("no store to restore, -store is not set"))
+			return
+		}
+		keys, _ := d.backups.List(r.Context(), "")
+		n, err := d.backups.restore(r.Body)
+		if errors.Is(err, errInvalidBackup) {
+			writeProblem(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to restore backup", slog.Any("error", err))
+			writeProblem(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		logAudit(r, "store.keys", len(keys), n)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /admin/trash", func(w http.ResponseWriter, r *http.Request) {
+		if d.store == nil {
+			writeProblem(w, r, http.StatusNotFound, errors.New("no store to list, -store is not set"))
+			return
+		}
+		handleGetList[trashEntry](d.store, trashPrefix, trashListSpec)(w, r)
+	})
+	mux.HandleFunc("POST /admin/backups", func(w http.ResponseWriter, r *http.Request) {
+		type responseBody struct {
+			Target string `json:"Target"`
+		}
+
+		if d.backups == nil || d.backupTo == "" {
+			writeProblem(w, r, http.StatusNotFound, errors.New("no backup target, -store and -backup-to are not set"))
+			return
+		}
+		target, err := uploadBackup(r.Context(), d.log, d.backups, d.backupTo)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadGateway, fmt.Errorf("backup failed: %w", err))
+			return
+		}
+		logAudit(r, "store.backup", nil, target)
+		if err := writeBody(w, r, http.StatusCreated, responseBody{Target: target}); err != nil {
+			slog.ErrorContext(r.Context(), "failed to write backup target", slog.Any("error", err))
+		}
+	})
+	mux.Handle("PUT /admin/log-level", change(func(r *http.Request, body requestBody) error {
+		if body.Level == nil {
+			return errors.New("the Level field is required")
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(*body.Level)); err != nil {
+			return err
+		}
+		audit(r, "log-level", d.state.level.Level().String(), level.String())
+		d.state.level.Set(level)
+		return nil
+	}))
+	mux.Handle("PUT /admin/maintenance", change(func(r *http.Request, body requestBody) error {
+		if body.Enabled == nil {
+			return errors.New("the Enabled field is required")
+		}
+		audit(r, "maintenance", d.state.maintenance.Swap(*body.Enabled), *body.Enabled)
+		return nil
+	}))
+	mux.Handle("PUT /admin/cordon", change(func(r *http.Request, body requestBody) error {
+		if body.Enabled == nil {
+			return errors.New("the Enabled field is required")
+		}
+		audit(r, "cordon", d.state.cordoned.Swap(*body.Enabled), *body.Enabled)
+		return nil
+	}))
+	mux.Handle("PUT /admin/flags/{name}", change(func(r *http.Request, body requestBody) error {
+		if body.Enabled == nil {
+			return errors.New("the Enabled field is required")
+		}
+		name := r.PathValue("name")
+		d.state.mu.Lock()
+		old := d.state.flags[name]
+		if d.state.flags == nil {
+			d.state.flags = map[string]bool{}
+		}
+		d.state.flags[name] = *body.Enabled
+		d.state.mu.Unlock()
+		audit(r, "flags."+name, old, *body.Enabled)
+		return nil
+	}))
+	mux.Handle("PUT /admin/rate-limits/{name}", change(func(r *http.Request, body requestBody) error {
+		if body.Limit == nil || *body.Limit < 0 {
+			return errors.New("the Limit field is required and must not be negative")
+		}
+		name := r.PathValue("name")
+		var old any // nil if not overridden yet
+		d.state.mu.Lock()
+		if limit, ok := d.state.rateLimits[name]; ok {
+			old = limit
+		}
+		if d.state.rateLimits == nil {
+			d.state.rateLimits = map[string]int64{}
+		}
+		d.state.rateLimits[name] = *body.Limit
+		d.state.mu.Unlock()
+		audit(r, "rate-limits."+name, old, *body.Limit)
+		return nil
+	}))
+	mux.Handle("DELETE /admin/rate-limits/{name}", change(func(r *http.Request, _ requestBody) error {
+		name := r.PathValue("name")
+		d.state.mu.Lock()
+		old, ok := d.state.rateLimits[name]
+		delete(d.state.rateLimits, name)
+		d.state.mu.Unlock()
+		if ok {
+			audit(r, "rate-limits."+name, old, nil)
+		}
+		return nil
+	}))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(d.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeProblem(w, r, http.StatusUnauthorized, errors.New("valid bearer token is required"))
+			return
+		}
+		setPrincipal(r.Context(), "admin")
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// maintenance is a middleware that responds with 503 to every request while the maintenance mode is enabled
+// through the admin API, except for health checks and the admin API itself so that it can be disabled again.
+func maintenance(next http.Handler, state *adminState) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if state.maintenance.Load() && !isHealthCheck(r.URL.Path) && !strings.HasPrefix(r.URL.Path, "/admin/") {
+			w.Header().Set("Retry-After", "60")
+			writeProblem(w, r, http.StatusServiceUnavailable, errors.New("under maintenance"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// TestAdmin tests that the admin API requires the token, changes the state, and audits the changes.
+func TestAdmin(t *testing.T) {
+	type response struct {
+		LogLevel    string           `json:"LogLevel"`
+		Maintenance bool             `json:"Maintenance"`
+		Flags       map[string]bool  `json:"Flags"`
+		RateLimits  map[string]int64 `json:"RateLimits"`
+	}
+
+	var buf bytes.Buffer
+	state := &adminState{}
+	logHandler, _, err := newLogHandler(&buf, "json", nil, &state.level)
+	testNil(t, err)
+	admin := handleAdmin(adminDeps{log: slog.New(logHandler), state: state, token: "secret"})
+	handler := maintenance(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/admin/") {
+			admin.ServeHTTP(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}), state)
+	do := func(method, path, token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	testEqual(t, http.StatusUnauthorized, do(http.MethodGet, "/admin/", "", "").Code)
+	testEqual(t, http.StatusUnauthorized, do(http.MethodGet, "/admin/", "wrong", "").Code)
+	testEqual(t, http.StatusBadRequest, do(http.MethodPut, "/admin/log-level", "secret", `{"Level":"loud"}`).Code)
+
+	testEqual(t, http.StatusOK, do(http.MethodPut, "/admin/log-level", "secret", `{"Level":"debug"}`).Code)
+	testEqual(t, http.StatusOK, do(http.MethodPut, "/admin/flags/new-checkout", "secret", `{"Enabled":true}`).Code)
+	testEqual(t, http.StatusOK, do(http.MethodPut, "/admin/rate-limits/search", "secret", `{"Limit":5}`).Code)
+	testEqual(t, http.StatusOK, do(http.MethodPut, "/admin/maintenance", "secret", `{"Enabled":true}`).Code)
+	testEqual(t, slog.LevelDebug, state.level.Level())
+	testEqual(t, true, state.flag("new-checkout"))
+	testEqual(t, int64(5), state.rateLimit("search", 10))
+	testEqual(t, int64(10), state.rateLimit("upload", 10))
+	testEqual(t, http.StatusServiceUnavailable, do(http.MethodGet, "/users", "", "").Code)
+
+	w := do(http.MethodGet, "/admin/", "secret", "")
+	testEqual(t, http.StatusOK, w.Code)
+	var res response
+	testNil(t, json.NewDecoder(w.Body).Decode(&res))
+	testEqual(t, "DEBUG", res.LogLevel)
+	testEqual(t, true, res.Maintenance)
+	testEqual(t, true, res.Flags["new-checkout"])
+	testEqual(t, int64(5), res.RateLimits["search"])
+
+	var ready atomic.Bool
+	ready.Store(true)
+	readyz := httptest.NewRecorder()
+	handleGetReadyz(&ready, &state.cordoned, nil).ServeHTTP(readyz, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	testEqual(t, http.StatusOK, readyz.Code)
+	testEqual(t, http.StatusOK, do(http.MethodPut, "/admin/cordon", "secret", `{"Enabled":true}`).Code)
+	readyz = httptest.NewRecorder()
+	handleGetReadyz(&ready, &state.cordoned, nil).ServeHTTP(readyz, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	testEqual(t, http.StatusServiceUnavailable, readyz.Code)
+	testContains(t, `"Cordoned":true`, readyz.Body.String())
+	testEqual(t, http.StatusOK, do(http.MethodPut, "/admin/cordon", "secret", `{"Enabled":false}`).Code)
+
+	testEqual(t, http.StatusOK, do(http.MethodDelete, "/admin/rate-limits/search", "secret", "").Code)
+	testEqual(t, http.StatusOK, do(http.MethodPut, "/admin/maintenance", "secret", `{"Enabled":false}`).Code)
+	testEqual(t, int64(10), state.rateLimit("search", 10))
+	testEqual(t, http.StatusNoContent, do(http.MethodGet, "/users", "", "").Code)
+
+	testEqual(t, http.StatusOK, do(http.MethodPut, "/admin/log-level", "secret", `{"Level":"error"}`).Code)
+	testEqual(t, http.StatusOK, do(http.MethodPut, "/admin/flags/new-checkout", "secret", `{"Enabled":false}`).Code)
+
+	testEqual(t, 10, strings.Count(buf.String(), `"level":"AUDIT","msg":"admin changed"`))
+	testContains(t, `"setting":"flags.new-checkout","old":false,"new":true`, buf.String())
+	testContains(t, `"setting":"flags.new-checkout","old":true,"new":false`, buf.String())
+}
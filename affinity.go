@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Sources of the affinity key of a request, set by the -affinity flag.
+const (
+	affinityCookie = "cookie" // issued by the server on the first request
+	affinityHeader = "header" // sent by the client, such as a session or tenant ID
+)
+
+// maxAffinityBindings is the number of bindings an [affinity] holds before evicting the least recently used.
+const maxAffinityBindings = 65536
+
+// affinity pins the requests sharing an affinity key to the same target for the TTL since the last request,
+// so that sessions held in memory by a proxied upstream, or by a stateful feature of this instance such as a long-poll hub,
+// keep being served by it. A target is rebound if it is unavailable, such as an ejected upstream.
+type affinity struct {
+	source string
+	name   string
+	ttl    time.Duration
+	// keyring encrypts the issued cookies, so that clients cannot forge the key of another session, nil if unset
+	keyring *keyring
+
+	bindings *ttlMap[string, string] // of affinity keys to targets
+}
+
+// parseAffinity parses the -affinity flag in the form of '<source>:<name>', such as 'cookie:lb' or 'header:X-Session-ID'.
+func parseAffinity(s string) (source, name string, err error) {
+	source, name, ok := strings.Cut(s, ":")
+	if !ok || name == "" || (source != affinityCookie && source != affinityHeader) {
+		return "", "", fmt.Errorf("affinity %q is not in the form of 'cookie:<name>' or 'header:<name>'", s)
+	}
+	return source, name, nil
+}
+
+// newAffinity returns an [affinity] keyed by the cookie or header of the name, or nil if source is empty, which disables it.
+// The cookies are encrypted by kr, unless it is nil.
+func newAffinity(source, name string, ttl time.Duration, kr *keyring) *affinity {
+	if source == "" {
+		return nil
+	}
+	return &affinity{source: source, name: name, ttl: ttl, keyring: kr, bindings: newTTLMap[string, string]("affinity", maxAffinityBindings)}
+}
+
+// key returns the affinity key of the request, or "" if a is nil or the request has none.
+// With a cookie source, it issues a new key to requests without one and extends the cookie for the TTL.
+func (a *affinity) key(w http.ResponseWriter, r *http.Request) string {
+	if a == nil {
+		return ""
+	}
+	if a.source == affinityHeader {
+		return r.Header.Get(a.name)
+	}
+	key := newRequestID()
+	cookie := &http.Cookie{
+		Name: a.name, Path: "/", MaxAge: int(a.ttl.Seconds()),
+		HttpOnly: true, Secure: r.TLS != nil, SameSite: http.SameSiteLaxMode,
+	}
+	if a.keyring != nil {
+		// NOTE: a cookie failing to decrypt, such as one issued before the keyring was set, is replaced by a new key
+		if v, err := readEncryptedCookie(r, a.keyring, a.name); err == nil && v != "" {
+			key = v
+		}
+		cookie.Value = key
+		if err := setEncryptedCookie(w, a.keyring, cookie); err != nil {
+			slog.ErrorContext(r.Context(), "failed to encrypt affinity cookie", slog.Any("error", err))
+		}
+		return key
+	}
+	if c, err := r.Cookie(a.name); err == nil && c.Value != "" {
+		key = c.Value
+	}
+	cookie.Value = key
+	http.SetCookie(w, cookie)
+	return key
+}
+
+// target returns the target the key is pinned to, or "" if it is not pinned or the binding expired.
+func (a *affinity) target(key string, now time.Time) string {
+	if a == nil || key == "" {
+		return ""
+	}
+	target, _ := a.bindings.get(key, now)
+	return target
+}
+
+// bind pins the key to the target for the TTL from now.
+func (a *affinity) bind(key, target string, now time.Time) {
+	if a == nil || key == "" {
+		return
+	}
+	a.bindings.put(key, target, now.Add(a.ttl))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestParseAffinity tests parsing the -affinity flag.
+func TestParseAffinity(t *testing.T) {
+	source, name, err := parseAffinity("header:X-Session-ID")
+	testNil(t, err)
+	testEqual(t, affinityHeader, source)
+	testEqual(t, "X-Session-ID", name)
+	for _, s := range []string{"cookie", "cookie:", "query:lb"} {
+		if _, _, err := parseAffinity(s); err == nil {
+			t.Errorf("parseAffinity(%q) succeeded, want error", s)
+		}
+	}
+}
+
+// TestAffinity tests that affinity keys stay pinned to their targets until the TTL since the last request.
+func TestAffinity(t *testing.T) {
+	var a *affinity
+	testEqual(t, "", a.key(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil)))
+	a.bind("k", "a", time.Now())
+	testEqual(t, "", a.target("k", time.Now()))
+
+	a = newAffinity(affinityCookie, "lb", time.Minute, nil)
+	w := httptest.NewRecorder()
+	key := a.key(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	testEqual(t, 32, len(key))
+	cookie := w.Result().Cookies()[0]
+	testEqual(t, "lb", cookie.Name)
+	testEqual(t, 60, cookie.MaxAge)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(cookie)
+	testEqual(t, key, a.key(httptest.NewRecorder(), r))
+
+	now := time.Now()
+	a.bind(key, "a", now)
+	testEqual(t, "a", a.target(key, now.Add(time.Minute)))
+	testEqual(t, "", a.target(key, now.Add(time.Minute+time.Second)))
+
+	for range maxAffinityBindings {
+		a.bind(newRequestID(), "b", now)
+	}
+	testEqual(t, maxAffinityBindings, a.bindings.len())
+	testEqual(t, "", a.target(key, now))
+
+	// with a keyring, the cookies are encrypted, and forged ones are replaced by a new key
+	kr, err := parseKeyring("k1:MDEyMzQ1Njc4OWFiY2RlZg==")
+	testNil(t, err)
+	a = newAffinity(affinityCookie, "lb", time.Minute, kr)
+	w = httptest.NewRecorder()
+	key = a.key(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	cookie = w.Result().Cookies()[0]
+	testEqual(t, false, cookie.Value == key)
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(cookie)
+	testEqual(t, key, a.key(httptest.NewRecorder(), r))
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: "lb", Value: key})
+	testEqual(t, false, a.key(httptest.NewRecorder(), r) == key)
+}
+
+// TestUpstreamPoolAffinity tests that the pool keeps picking the upstream a key is pinned to until it is ejected.
+func TestUpstreamPoolAffinity(t *testing.T) {
+	rt, err := parseProxyRoute("/=http://a,http://b,http://c")
+	testNil(t, err)
+	pool := newUpstreamPool(rt, balanceWeighted, 1, time.Minute, nil)
+	pool.affinity = newAffinity(affinityHeader, "X-Session-ID", time.Hour, nil)
+
+	now := time.Now()
+	pinned := pool.pick("session", now)
+	for range 5 {
+		testEqual(t, pinned, pool.pick("session", now))
+	}
+	testEqual(t, false, pool.pick("", now) == pool.pick("", now))
+
+	pool.report(pinned, true, now)
+	rebound := pool.pick("session", now)
+	testEqual(t, false, rebound == pinned)
+	testEqual(t, rebound, pool.pick("session", now.Add(2*time.Minute)))
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"cmp"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	rtmetrics "runtime/metrics"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// allocStats holds the heap allocations of sampled requests by route, recorded by [accountAllocs].
+type allocStats struct {
+	inflight atomic.Int64  // requests being handled, so that only requests handled alone are measured
+	started  atomic.Uint64 // requests started, so that requests overlapped by another one are discarded
+
+	mu     sync.Mutex
+	routes map[string]*allocStat
+}
+
+// allocStat is the heap allocations of the sampled requests of a route.
+type allocStat struct {
+	requests uint64
+	bytes    uint64
+	objects  uint64
+	maxBytes uint64
+}
+
+// accountAllocs is a middleware that records heap allocations of a fraction of requests by route matched in mux,
+// so that expensive handlers can be tracked down at /debug/allocs. It is meant for debug profiles only.
+//
+// Allocations are measured as the difference of the process-wide counters of [runtime/metrics] before and after the request,
+// so a sampled request is only recorded if no other request was in flight while it was handled, leaving out the
+// allocations of concurrent requests. Background work such as scheduled jobs is still included, so treat them as estimates.
+// Under steady load, few requests are handled alone and the routes are recorded rarely.
+func accountAllocs(next http.Handler, mux *http.ServeMux, stats *allocStats, rate float64) http.Handler {
+	if rate <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := stats.started.Add(1)
+		alone := stats.inflight.Add(1) == 1
+		defer stats.inflight.Add(-1)
+		if !alone || rand.Float64() >= rate {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		samples := []rtmetrics.Sample{{Name: "/gc/heap/allocs:bytes"}, {Name: "/gc/heap/allocs:objects"}}
+		rtmetrics.Read(samples)
+		bytes, objects := samples[0].Value.Uint64(), samples[1].Value.Uint64()
+		next.ServeHTTP(w, r)
+		rtmetrics.Read(samples)
+		bytes, objects = samples[0].Value.Uint64()-bytes, samples[1].Value.Uint64()-objects
+		if stats.started.Load() != started {
+			return // another request started while this one was handled
+		}
+
+		_, pattern := mux.Handler(r)
+		if pattern == "" {
+			pattern = "unmatched"
+		}
+		stats.mu.Lock()
+		defer stats.mu.Unlock()
+		if stats.routes == nil {
+			stats.routes = map[string]*allocStat{}
+		}
+		stat, ok := stats.routes[pattern]
+		if !ok {
+			stat = &allocStat{}
+			stats.routes[pattern] = stat
+		}
+		stat.requests++
+		stat.bytes += bytes
+		stat.objects += objects
+		stat.maxBytes = max(stat.maxBytes, bytes)
+	})
+}
+
+// handleGetAllocs returns an [http.HandlerFunc] that responds with the routes allocating the most bytes per request on average.
+// The number of routes is limited by the ?n= query parameter, defaulting to 10.
+func handleGetAllocs(stats *allocStats) http.HandlerFunc {
+	type responseBody struct {
+		Route      string `json:"Route"`
+		Requests   uint64 `json:"Requests"`
+		AvgBytes   uint64 `json:"AvgBytes"`
+		AvgObjects uint64 `json:"AvgObjects"`
+		MaxBytes   uint64 `json:"MaxBytes"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(r.URL.Query().Get("n"))
+		if err != nil || n <= 0 {
+			n = 10
+		}
+
+		res := []responseBody{}
+		stats.mu.Lock()
+		for route, stat := range stats.routes {
+			res = append(res, responseBody{
+				Route:      route,
+				Requests:   stat.requests,
+				AvgBytes:   stat.bytes / stat.requests,
+				AvgObjects: stat.objects / stat.requests,
+				MaxBytes:   stat.maxBytes,
+			})
+		}
+		stats.mu.Unlock()
+		slices.SortFunc(res, func(a, b responseBody) int { return cmp.Compare(b.AvgBytes, a.AvgBytes) })
+		res = res[:min(n, len(res))]
+
+		if err := writeBody(w, r, 200, res); err != nil {
+			slog.ErrorContext(r.Context(), "failed to write allocs", slog.Any("error", err))
+		}
+	}
+}
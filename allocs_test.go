@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestAccountAllocs tests that the routes allocating the most bytes are listed first.
+func TestAccountAllocs(t *testing.T) {
+	type response struct {
+		Route    string `json:"Route"`
+		Requests uint64 `json:"Requests"`
+	}
+
+	var sink []byte
+	var stats allocStats
+	mux := http.NewServeMux()
+	mux.Handle("GET /small", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	mux.Handle("GET /large", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sink = make([]byte, 1<<20)
+	}))
+	handler := accountAllocs(mux, mux, &stats, 1)
+	for _, path := range []string{"/small", "/large", "/large"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	_ = sink
+
+	w := httptest.NewRecorder()
+	handleGetAllocs(&stats).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/allocs?n=1", nil))
+	var body []response
+	testNil(t, json.NewDecoder(w.Body).Decode(&body))
+	testEqual(t, 1, len(body))
+	testEqual(t, response{Route: "GET /large", Requests: 2}, body[0])
+
+	// requests overlapping another one are not recorded, since their allocations cannot be told apart
+	started, release := make(chan struct{}), make(chan struct{})
+	mux.Handle("GET /slow", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow", nil))
+	}()
+	<-started
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/large", nil))
+	close(release)
+	<-done
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	testEqual(t, uint64(2), stats.routes["GET /large"].requests)
+	testEqual(t, (*allocStat)(nil), stats.routes["GET /slow"])
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"expvar"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// attackVars counts requests and connections dropped by protections that otherwise leave no trace,
+// served by /debug/vars, so that operators can spot attack patterns such as Slowloris:
+//
+//   - oversized_headers: requests rejected with 431 by net/http because of -max-header-bytes, before any handler runs
+//   - slow_bodies: request bodies stalled for longer than -body-read-timeout, see [limitBodyStalls]
+//   - connection_resets: connections reset by clients
+var attackVars = expvar.NewMap("attacks")
+
+// watchConns returns a listener counting into [attackVars] the connections reset by clients
+// and, if plain is set, the responses rejecting oversized headers.
+// Responses over TLS are encrypted at this layer, so oversized headers are only counted on plain HTTP listeners.
+func watchConns(ln net.Listener, plain bool) net.Listener {
+	return &watchedListener{Listener: ln, plain: plain}
+}
+
+// watchedListener is a [net.Listener] returning [watchedConn], see [watchConns].
+type watchedListener struct {
+	net.Listener
+	plain bool
+}
+
+// Accept implements the [net.Listener] interface.
+func (l *watchedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &watchedConn{Conn: conn, plain: l.plain}, nil
+}
+
+// headerTooLarge is the start of the response written by net/http when request headers exceed [http.Server.MaxHeaderBytes].
+var headerTooLarge = []byte("HTTP/1.1 431 ")
+
+// watchedConn is a [net.Conn] counting its reset and the oversized headers it rejects, see [watchConns].
+type watchedConn struct {
+	net.Conn
+	plain bool
+	reset atomic.Bool
+}
+
+// Read implements the [net.Conn] interface.
+func (c *watchedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.count(err)
+	return n, err
+}
+
+// Write implements the [net.Conn] interface.
+func (c *watchedConn) Write(b []byte) (int, error) {
+	if c.plain && bytes.HasPrefix(b, headerTooLarge) {
+		attackVars.Add("oversized_headers", 1)
+	}
+	n, err := c.Conn.Write(b)
+	c.count(err)
+	return n, err
+}
+
+// count counts the error if it is the first reset of the connection.
+func (c *watchedConn) count(err error) {
+	if err != nil && errors.Is(err, syscall.ECONNRESET) && c.reset.CompareAndSwap(false, true) {
+		attackVars.Add("connection_resets", 1)
+	}
+}
+
+// limitBodyStalls is a middleware that fails reads of request bodies stalled for longer than timeout,
+// refreshing the read deadline on every read, so that clients trickling bodies cannot hold handlers forever
+// while slow but steady uploads still succeed. Stalls are counted into [attackVars].
+// It does nothing if timeout is zero.
+func limitBodyStalls(next http.Handler, timeout time.Duration) http.Handler {
+	if timeout <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil || r.Body == http.NoBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rc := http.NewResponseController(w)
+		r.Body = &stallReader{ReadCloser: r.Body, rc: rc, timeout: timeout}
+		defer func() { _ = rc.SetReadDeadline(time.Time{}) }()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// stallReader is an [io.ReadCloser] refreshing the read deadline of the connection before every read, see [limitBodyStalls].
+type stallReader struct {
+	io.ReadCloser
+	rc      *http.ResponseController
+	timeout time.Duration
+	stalled bool
+}
+
+// Read implements the [io.Reader] interface.
+func (s *stallReader) Read(b []byte) (int, error) {
+	if err := s.rc.SetReadDeadline(time.Now().Add(s.timeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return 0, err
+	}
+	n, err := s.ReadCloser.Read(b)
+	if errors.Is(err, os.ErrDeadlineExceeded) && !s.stalled {
+		s.stalled = true
+		attackVars.Add("slow_bodies", 1)
+	}
+	return n, err
+}
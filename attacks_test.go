@@ -0,0 +1,72 @@
+package main
+
+import (
+	"expvar"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestAttackVars tests that oversized headers, stalled bodies, and reset connections are counted.
+func TestAttackVars(t *testing.T) {
+	count := func(name string) int64 {
+		if v, ok := attackVars.Get(name).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	eventually := func(name string, want int64) {
+		t.Helper()
+		for range 100 {
+			if count(name) == want {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		testEqual(t, want, count(name))
+	}
+
+	readErr := make(chan error, 1)
+	server := httptest.NewUnstartedServer(limitBodyStalls(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.ReadAll(r.Body)
+		readErr <- err
+	}), 50*time.Millisecond))
+	server.Listener = watchConns(server.Listener, true)
+	server.Config.MaxHeaderBytes = 1 << 10
+	server.Start()
+	defer server.Close()
+
+	oversized := count("oversized_headers")
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	testNil(t, err)
+	req.Header.Set("X-Large", strings.Repeat("x", 8<<10))
+	res, err := http.DefaultClient.Do(req)
+	testNil(t, err)
+	res.Body.Close()
+	testEqual(t, http.StatusRequestHeaderFieldsTooLarge, res.StatusCode)
+	eventually("oversized_headers", oversized+1)
+
+	slow := count("slow_bodies")
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	testNil(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "POST / HTTP/1.1\r\nHost: test\r\nContent-Length: 10\r\n\r\nabc")
+	testNil(t, err)
+	testEqual(t, true, (<-readErr) != nil)
+	eventually("slow_bodies", slow+1)
+
+	resets := count("connection_resets")
+	conn, err = net.Dial("tcp", server.Listener.Addr().String())
+	testNil(t, err)
+	_, err = io.WriteString(conn, "POST / HTTP/1.1\r\nHost: test\r\nContent-Length: 10\r\n\r\nabc")
+	testNil(t, err)
+	time.Sleep(10 * time.Millisecond)
+	testNil(t, conn.(*net.TCPConn).SetLinger(0))
+	testNil(t, conn.Close())
+	<-readErr
+	eventually("connection_resets", resets+1)
+}
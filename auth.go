@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Methods of [authenticator], in the order they are usually chained by the -auth flag.
+const (
+	authMTLS      = "mtls"
+	authJWT       = "jwt"
+	authAPIKey    = "apikey"
+	authAnonymous = "anonymous"
+)
+
+// scopeImpersonate is the scope allowing support staff to act as another principal, see [impersonate].
+const scopeImpersonate = "impersonate"
+
+// errNoCredentials is returned by an [authenticator] when the request carries no credentials of its kind,
+// so that [authenticate] tries the next one.
+var errNoCredentials = errors.New("no credentials")
+
+// authenticator authenticates requests by one method, such as client certificates or API keys.
+// authenticate returns the name of the principal and the scopes carried by the credentials,
+// [errNoCredentials] if the request carries no credentials of the method,
+// or another error if the credentials are invalid, which fails the request instead of trying the next authenticator.
+type authenticator struct {
+	method       string
+	authenticate func(r *http.Request) (string, []string, error)
+}
+
+// newAuthenticators returns the chain of authenticators of the -auth flag, in order.
+func newAuthenticators(cfg config) []authenticator {
+	var chain []authenticator
+	for _, method := range cfg.auth {
+		switch method {
+		case authMTLS:
+			chain = append(chain, authenticator{method: method, authenticate: authenticateMTLS})
+		case authJWT:
+			chain = append(chain, authenticator{method: method, authenticate: authenticateJWT([]byte(cfg.jwtSecret), time.Now)})
+		case authAPIKey:
+			chain = append(chain, authenticator{method: method, authenticate: authenticateAPIKey(cfg.apiKeys)})
+		case authAnonymous:
+			chain = append(chain, authenticator{method: method, authenticate: func(*http.Request) (string, []string, error) {
+				return authAnonymous, nil, nil
+			}})
+		}
+	}
+	return chain
+}
+
+// authenticate is a middleware that authenticates requests by the first authenticator of the chain
+// the request carries credentials for, recording the principal, the method, and the scopes with [setAuthentication].
+// The scopes are those of the credentials and those granted to the principal by -grant.
+// Invalid credentials are rejected with 401, while requests without any credentials are let through unauthenticated,
+// so that public routes such as health checks keep working. Protect routes with [requireAuth].
+// It must be placed inside [recovery], which holds the principal of the request, and inside [accesslog] and [measure],
+// so that the principal and rejected requests are logged and measured.
+func authenticate(next http.Handler, chain []authenticator, grants map[string][]string) http.Handler {
+	if len(chain) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, a := range chain {
+			name, scopes, err := a.authenticate(r)
+			if errors.Is(err, errNoCredentials) {
+				continue
+			}
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+				writeProblem(w, r, http.StatusUnauthorized, fmt.Errorf("invalid %s credentials: %w", a.method, err))
+				return
+			}
+			if a.method != authAnonymous {
+				scopes = append(scopes, grants[name]...)
+			}
+			setAuthentication(r.Context(), name, a.method, scopes)
+			break
+		}
+		if target := r.Header.Get("X-Impersonate-User"); target != "" {
+			if status, err := impersonate(r.Context(), target, grants); err != nil {
+				writeProblem(w, r, status, err)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireAuth wraps the handler of a route to respond with 401 unless the request was authenticated by [authenticate]
+// with one of the methods, or any method but anonymous if none is given.
+//
+//	handle(mux, "GET /orders", requireAuth(handleGetOrders(st)), routeMeta{Summary: "List orders", Auth: "jwt, apikey"})
+func requireAuth(next http.Handler, methods ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method := authMethodFrom(r.Context())
+		if method == "" || (len(methods) == 0 && method == authAnonymous) || (len(methods) > 0 && !slices.Contains(methods, method)) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+			writeProblem(w, r, http.StatusUnauthorized, errors.New("authentication is required"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// setAuthentication records the principal of the request of ctx like [setPrincipal],
+// with the method it was authenticated by and the scopes it is granted.
+func setAuthentication(ctx context.Context, name, method string, scopes []string) {
+	if p, ok := ctx.Value(principalKey).(*principal); ok {
+		p.mu.Lock()
+		p.method = method
+		p.scopes = scopes
+		p.mu.Unlock()
+	}
+	setPrincipal(ctx, name)
+	addLogAttrs(ctx, slog.String("auth", method))
+}
+
+// impersonate makes the target the effective principal of the request of ctx on behalf of the authenticated principal,
+// such as support staff reproducing the issue of a user, returning the status to respond with if it is not allowed.
+// The principal must be granted [scopeImpersonate], and the target must not be, so that staff cannot act as each other.
+// The target gets only the scopes granted to it by -grant. Every impersonated request is audit-logged,
+// and its access log has both identities, so that every action is recorded with who really did it.
+func impersonate(ctx context.Context, target string, grants map[string][]string) (int, error) {
+	method := authMethodFrom(ctx)
+	if method == "" || method == authAnonymous {
+		return http.StatusUnauthorized, errors.New("authentication is required to impersonate")
+	}
+	if !hasScope(ctx, scopeImpersonate) {
+		return http.StatusForbidden, fmt.Errorf("missing scope %s", scopeImpersonate)
+	}
+	if slices.Contains(grants[target], scopeImpersonate) {
+		return http.StatusForbidden, fmt.Errorf("cannot impersonate %s, who can impersonate", target)
+	}
+	actor := principalFrom(ctx)
+	if p, ok := ctx.Value(principalKey).(*principal); ok {
+		p.mu.Lock()
+		p.name, p.scopes, p.impersonator = target, slices.Clone(grants[target]), actor
+		p.mu.Unlock()
+	}
+	// NOTE: the access log already has the impersonator as the principal, set by authentication
+	addLogAttrs(ctx, slog.String("impersonating", target))
+	slog.InfoContext(ctx, "impersonated",
+		slog.String("impersonator", actor),
+		slog.String("principal", target),
+		slog.String("request_id", requestIDFrom(ctx)))
+	return 0, nil
+}
+
+// impersonatorFrom returns who impersonates the principal of the request of ctx, empty if nobody does, see [impersonate].
+func impersonatorFrom(ctx context.Context) string {
+	p, ok := ctx.Value(principalKey).(*principal)
+	if !ok {
+		return ""
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.impersonator
+}
+
+// authMethodFrom returns the method the request was authenticated by, empty if it is not authenticated.
+func authMethodFrom(ctx context.Context) string {
+	p, ok := ctx.Value(principalKey).(*principal)
+	if !ok {
+		return ""
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.method
+}
+
+// hasScope reports whether the principal of the request of ctx is granted the scope,
+// for handlers checking permissions finer than the scopes of their route, see [authorize].
+func hasScope(ctx context.Context, scope string) bool {
+	p, ok := ctx.Value(principalKey).(*principal)
+	if !ok {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Contains(p.scopes, scope)
+}
+
+// authorize is a middleware that enforces the scopes declared by the route matched in mux, see [routeMeta].
+// It responds with 401 if the request is not authenticated or only anonymously, and with 403 if a scope is missing,
+// so that permissions are declared next to the registration of routes instead of checked by every handler.
+// It must be placed inside [authenticate].
+//
+//	handle(mux, "DELETE /users/{id}", handleDeleteUser(st), routeMeta{Summary: "Delete a user", Scopes: []string{"users:write"}})
+func authorize(next http.Handler, mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		value, ok := routes.Load(pattern)
+		if !ok || len(value.(routeMeta).Scopes) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if method := authMethodFrom(r.Context()); method == "" || method == authAnonymous {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+			writeProblem(w, r, http.StatusUnauthorized, errors.New("authentication is required"))
+			return
+		}
+		for _, scope := range value.(routeMeta).Scopes {
+			if !hasScope(r.Context(), scope) {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="api", error="insufficient_scope", scope=%q`, scope))
+				writeProblem(w, r, http.StatusForbidden, fmt.Errorf("missing scope %s", scope))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authenticateMTLS authenticates the request by the client certificate verified against -tls-client-ca,
+// returning the common name of its subject.
+func authenticateMTLS(r *http.Request) (string, []string, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", nil, errNoCredentials
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	if cert.Subject.CommonName == "" {
+		return "", nil, errors.New("client certificate has no common name")
+	}
+	return cert.Subject.CommonName, nil, nil
+}
+
+// authenticateJWT returns the authenticate function of JSON Web Tokens in the Authorization header signed with HS256
+// by the secret, returning the sub claim and the space-separated scopes of the scope claim.
+// Tokens must not be expired nor used before their nbf claim.
+// Bearer tokens which are not JWTs, such as the token of the admin API, are not considered credentials of this method.
+func authenticateJWT(secret []byte, now func() time.Time) func(r *http.Request) (string, []string, error) {
+	type header struct {
+		Alg string `json:"alg"`
+	}
+	type claims struct {
+		Sub   string   `json:"sub"`
+		Scope string   `json:"scope"`
+		Exp   *float64 `json:"exp"`
+		Nbf   *float64 `json:"nbf"`
+	}
+
+	return func(r *http.Request) (string, []string, error) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		parts := strings.Split(token, ".")
+		if !ok || len(parts) != 3 {
+			return "", nil, errNoCredentials
+		}
+		var h header
+		if err := decodeJWTPart(parts[0], &h); err != nil {
+			return "", nil, err
+		}
+		if h.Alg != "HS256" {
+			return "", nil, fmt.Errorf("unsupported alg %q", h.Alg)
+		}
+		sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+		if err != nil {
+			return "", nil, errors.New("malformed signature")
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(parts[0] + "." + parts[1]))
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return "", nil, errors.New("invalid signature")
+		}
+		var c claims
+		if err := decodeJWTPart(parts[1], &c); err != nil {
+			return "", nil, err
+		}
+		t := float64(now().Unix())
+		switch {
+		case c.Exp != nil && t >= *c.Exp:
+			return "", nil, errors.New("token expired")
+		case c.Nbf != nil && t < *c.Nbf:
+			return "", nil, errors.New("token not valid yet")
+		case c.Sub == "":
+			return "", nil, errors.New("token has no sub claim")
+		}
+		return c.Sub, strings.Fields(c.Scope), nil
+	}
+}
+
+// decodeJWTPart decodes the base64url-encoded JSON part of a JWT into v.
+func decodeJWTPart(part string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
+
+// authenticateAPIKey returns the authenticate function of API keys in the X-API-Key header,
+// returning the name of the key. keys maps the names of the keys to the keys.
+func authenticateAPIKey(keys map[string]string) func(r *http.Request) (string, []string, error) {
+	return func(r *http.Request) (string, []string, error) {
+		got := r.Header.Get("X-API-Key")
+		if got == "" {
+			return "", nil, errNoCredentials
+		}
+		var found string
+		for name, key := range keys {
+			// NOTE: every key is compared in constant time, so that the timing reveals neither the key nor its position
+			if subtle.ConstantTimeCompare([]byte(got), []byte(key)) == 1 {
+				found = name
+			}
+		}
+		if found == "" {
+			return "", nil, errors.New("unknown API key")
+		}
+		return found, nil, nil
+	}
+}
+
+// parseAPIKeys parses API keys in the form "name:key,...".
+func parseAPIKeys(s string) (map[string]string, error) {
+	keys := map[string]string{}
+	for _, entry := range strings.Split(s, ",") {
+		name, key, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || name == "" || key == "" {
+			return nil, fmt.Errorf("API key %q must be in the form name:key", entry)
+		}
+		if _, ok := keys[name]; ok {
+			return nil, fmt.Errorf("API key %q is duplicated", name)
+		}
+		keys[name] = key
+	}
+	return keys, nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestAuthenticate tests that the first authenticator with credentials authenticates the request.
+func TestAuthenticate(t *testing.T) {
+	secret := strings.Repeat("s", 32)
+	now := time.Unix(1_700_000_000, 0)
+	chain := []authenticator{
+		{method: authMTLS, authenticate: authenticateMTLS},
+		{method: authJWT, authenticate: authenticateJWT([]byte(secret), func() time.Time { return now })},
+		{method: authAPIKey, authenticate: authenticateAPIKey(map[string]string{"ci": "key-1"})},
+		{method: authAnonymous, authenticate: func(*http.Request) (string, []string, error) { return authAnonymous, nil, nil }},
+	}
+	handler := recovery(authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, authMethodFrom(r.Context())+":"+principalFrom(r.Context()))
+	}), chain, nil), slog.New(slog.NewTextHandler(io.Discard, nil)), false)
+
+	sign := func(payload string) string {
+		unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + base64.RawURLEncoding.EncodeToString([]byte(payload))
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(unsigned))
+		return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
+	tests := []struct {
+		name   string
+		header http.Header
+		tls    *tls.ConnectionState
+		status int
+		body   string
+	}{
+		{"anonymous", nil, nil, http.StatusOK, "anonymous:anonymous"},
+		{"api key", http.Header{"X-Api-Key": {"key-1"}}, nil, http.StatusOK, "apikey:ci"},
+		{"unknown api key", http.Header{"X-Api-Key": {"key-2"}}, nil, http.StatusUnauthorized, "unknown API key"},
+		{"jwt", http.Header{"Authorization": {"Bearer " + sign(`{"sub":"user-1","exp":1700000060}`)}}, nil, http.StatusOK, "jwt:user-1"},
+		{"jwt first", http.Header{"Authorization": {"Bearer " + sign(`{"sub":"user-1"}`)}, "X-Api-Key": {"key-1"}}, nil, http.StatusOK, "jwt:user-1"},
+		{"expired jwt", http.Header{"Authorization": {"Bearer " + sign(`{"sub":"user-1","exp":1699999999}`)}}, nil, http.StatusUnauthorized, "token expired"},
+		{"forged jwt", http.Header{"Authorization": {"Bearer " + sign(`{"sub":"user-1"}`) + "x"}}, nil, http.StatusUnauthorized, "invalid signature"},
+		{"opaque bearer", http.Header{"Authorization": {"Bearer admin-token"}}, nil, http.StatusOK, "anonymous:anonymous"},
+		{"mtls", nil, &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "billing"}}}}}, http.StatusOK, "mtls:billing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			for name, values := range tt.header {
+				r.Header[name] = values
+			}
+			r.TLS = tt.tls
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			testEqual(t, tt.status, w.Code)
+			testContains(t, tt.body, w.Body.String())
+		})
+	}
+}
+
+// TestRequireAuth tests that protected routes reject unauthenticated and anonymous requests.
+func TestRequireAuth(t *testing.T) {
+	protected := requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	apiKeyOnly := requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), authAPIKey)
+	serve := func(handler http.Handler, name, method string) int {
+		w := httptest.NewRecorder()
+		recovery(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if method != "" {
+				setAuthentication(r.Context(), name, method, nil)
+			}
+			handler.ServeHTTP(w, r)
+		}), slog.New(slog.NewTextHandler(io.Discard, nil)), false).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		return w.Code
+	}
+	testEqual(t, http.StatusUnauthorized, serve(protected, "", ""))
+	testEqual(t, http.StatusUnauthorized, serve(protected, authAnonymous, authAnonymous))
+	testEqual(t, http.StatusOK, serve(protected, "user-1", authJWT))
+	testEqual(t, http.StatusUnauthorized, serve(apiKeyOnly, "user-1", authJWT))
+	testEqual(t, http.StatusOK, serve(apiKeyOnly, "ci", authAPIKey))
+
+	_, err := parseConfig(io.Discard, []string{"testapp", "--auth", "anonymous,jwt,ldap", "--jwt-secret", "short"})
+	testContains(t, "anonymous must be the last authenticator", err.Error())
+	testContains(t, "jwt requires -jwt-secret of at least 32 bytes", err.Error())
+	testContains(t, `unknown authenticator "ldap"`, err.Error())
+	cfg, err := parseConfig(io.Discard, []string{"testapp", "--auth", "apikey,anonymous", "--api-keys", "ci:key-1, cd:key-2"})
+	testNil(t, err)
+	testEqual(t, "key-2", cfg.apiKeys["cd"])
+}
+
+// TestAuthorize tests that the scopes declared by routes are enforced.
+func TestAuthorize(t *testing.T) {
+	secret := strings.Repeat("s", 32)
+	mux := http.NewServeMux()
+	handle(mux, "DELETE /test-authorize/{id}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}), routeMeta{Summary: "Delete", Scopes: []string{"users:write"}})
+	handle(mux, "GET /test-authorize/{id}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), routeMeta{Summary: "Get"})
+	chain := newAuthenticators(config{auth: []string{authJWT, authAPIKey, authAnonymous}, jwtSecret: secret, apiKeys: map[string]string{"ci": "key-1", "cd": "key-2"}})
+	handler := recovery(authenticate(authorize(mux, mux), chain, map[string][]string{"cd": {"users:write"}}),
+		slog.New(slog.NewTextHandler(io.Discard, nil)), false)
+
+	token := func(payload string) string {
+		unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256"}`)) + "." + base64.RawURLEncoding.EncodeToString([]byte(payload))
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(unsigned))
+		return "Bearer " + unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
+	serve := func(method, header, value string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/test-authorize/1", nil)
+		if header != "" {
+			r.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	testEqual(t, http.StatusOK, serve(http.MethodGet, "", "").Code)
+	testEqual(t, http.StatusUnauthorized, serve(http.MethodDelete, "", "").Code)
+	w := serve(http.MethodDelete, "Authorization", token(`{"sub":"user-1","scope":"users:read"}`))
+	testEqual(t, http.StatusForbidden, w.Code)
+	testContains(t, "missing scope users:write", w.Body.String())
+	testContains(t, `error="insufficient_scope"`, w.Header().Get("WWW-Authenticate"))
+	testEqual(t, http.StatusNoContent, serve(http.MethodDelete, "Authorization", token(`{"sub":"user-1","scope":"users:read users:write"}`)).Code)
+	testEqual(t, http.StatusForbidden, serve(http.MethodDelete, "X-API-Key", "key-1").Code)
+	testEqual(t, http.StatusNoContent, serve(http.MethodDelete, "X-API-Key", "key-2").Code)
+
+	doc := string(routesOpenapi("v1", []string{authJWT, authAnonymous}))
+	testNil(t, lintOpenapi("routes.yaml", []byte(doc)))
+	testContains(t, "  \"/test-authorize/{id}\":\n    delete:\n      operationId: deleteTestAuthorizeId\n", doc)
+	testContains(t, "      security:\n        - bearer:\n            - \"users:write\"\n      responses:", doc)
+	testContains(t, "    bearer:\n      type: http\n", doc)
+	testEqual(t, false, strings.Contains(doc, "mutualTLS"))
+}
+
+// TestImpersonate tests that support staff can act as users, but not as each other, with both identities logged.
+func TestImpersonate(t *testing.T) {
+	chain := newAuthenticators(config{auth: []string{authAPIKey, authAnonymous}, apiKeys: map[string]string{"support": "key-1", "ci": "key-2"}})
+	grants := map[string][]string{"support": {scopeImpersonate}, "lead": {scopeImpersonate}, "user-1": {"orders:read"}}
+	var logs bytes.Buffer
+	log := slog.New(slog.NewTextHandler(&logs, nil))
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(log)
+	handler := accesslog(recovery(authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s by %s %v", principalFrom(r.Context()), impersonatorFrom(r.Context()), hasScope(r.Context(), "orders:read"))
+	}), chain, grants), log, false), log)
+	serve := func(key, target string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/health", nil)
+		r.Header.Set("X-API-Key", key)
+		r.Header.Set("X-Impersonate-User", target)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve("key-1", "user-1")
+	testEqual(t, http.StatusOK, w.Code)
+	testEqual(t, "user-1 by support true", w.Body.String())
+	testContains(t, "msg=impersonated impersonator=support principal=user-1", logs.String())
+	testContains(t, "principal=support auth=apikey impersonating=user-1", logs.String())
+
+	testEqual(t, http.StatusForbidden, serve("key-1", "lead").Code)
+	testEqual(t, http.StatusForbidden, serve("key-2", "user-1").Code)
+	testEqual(t, http.StatusUnauthorized, serve("", "user-1").Code)
+
+	logs.Reset()
+	handler = newTestRoute(t, log, "-auth", "apikey,anonymous", "-api-keys", "support:key-1,ci:key-2", "-grant", "support="+scopeImpersonate)
+	testEqual(t, http.StatusOK, serve("key-1", "user-1").Code)
+	testContains(t, "principal=support auth=apikey impersonating=user-1", logs.String())
+	testEqual(t, http.StatusUnauthorized, serve("key-3", "").Code)
+	testContains(t, "status=401", logs.String())
+}
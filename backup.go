@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// backupProgressBytes is how often the progress of a backup or a restore is logged.
+const backupProgressBytes = 1 << 20
+
+// backupClient uploads and downloads backups from http(s) URLs, with a timeout so that a stalled blob storage
+// does not hang a backup forever.
+var backupClient = &http.Client{Timeout: 10 * time.Minute}
+
+// redactURL returns the URL without its query string and fragment if it is an http(s) URL, or s otherwise,
+// so that the signatures of presigned URLs are never logged, audited, or included in diagnostics.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return s
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = "REDACTED"
+	}
+	u.Fragment, u.RawFragment = "", ""
+	u.User = nil
+	return u.String()
+}
+
+// redactURLError redacts the URL of the [url.Error] in the chain of err with [redactURL], as returned by [http.Client.Do].
+func redactURLError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		urlErr.URL = redactURL(urlErr.URL)
+	}
+	return err
+}
+
+// uploadBackup writes a consistent backup of the store to the target and returns where it was written.
+// The target is either a directory, where a file named by the time of the backup is created,
+// or an http(s) URL such as a presigned URL of blob storage, which the backup is PUT to, returned with its query redacted.
+func uploadBackup(ctx context.Context, log *slog.Logger, st *fileStore, target string) (string, error) {
+	// NOTE: the backup is buffered, so that the store is not locked while it is uploaded
+	var buf bytes.Buffer
+	if err := st.backup(&buf); err != nil {
+		return "", err
+	}
+	size := buf.Len()
+	log.InfoContext(ctx, "backup started", slog.String("target", redactURL(target)), slog.Int("bytes", size))
+	body := &progressReader{r: &buf, ctx: ctx, log: log, msg: "backup progress", total: size}
+
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, target, body)
+		if err != nil {
+			return "", err
+		}
+		req.ContentLength = int64(size)
+		req.Header.Set("Content-Type", "application/json")
+		res, err := backupClient.Do(req)
+		if err != nil {
+			return "", redactURLError(err)
+		}
+		res.Body.Close()
+		if res.StatusCode >= 300 {
+			return "", fmt.Errorf("uploading backup: %s", res.Status)
+		}
+		log.InfoContext(ctx, "backup done", slog.String("target", redactURL(target)), slog.Int("bytes", size))
+		return redactURL(target), nil
+	}
+
+	path := filepath.Join(target, "backup-"+time.Now().UTC().Format("20060102T150405Z")+".json")
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	log.InfoContext(ctx, "backup done", slog.String("target", path), slog.Int("bytes", size))
+	return path, nil
+}
+
+// restoreBackup replaces the data of the store with the backup at source, a file path or an http(s) URL,
+// returning the number of keys restored.
+func restoreBackup(ctx context.Context, log *slog.Logger, st *fileStore, source string) (int, error) {
+	var r io.ReadCloser
+	total := -1 // unknown
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+		if err != nil {
+			return 0, err
+		}
+		res, err := backupClient.Do(req)
+		if err != nil {
+			return 0, redactURLError(err)
+		}
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			return 0, fmt.Errorf("downloading backup: %s", res.Status)
+		}
+		r, total = res.Body, int(res.ContentLength)
+	} else {
+		f, err := os.Open(source)
+		if err != nil {
+			return 0, err
+		}
+		if info, err := f.Stat(); err == nil {
+			total = int(info.Size())
+		}
+		r = f
+	}
+	defer r.Close()
+
+	log.InfoContext(ctx, "restore started", slog.String("source", redactURL(source)), slog.Int("bytes", total))
+	n, err := st.restore(&progressReader{r: r, ctx: ctx, log: log, msg: "restore progress", total: total})
+	if err != nil {
+		return 0, fmt.Errorf("restoring %s: %w", redactURL(source), err)
+	}
+	log.InfoContext(ctx, "restore done", slog.String("source", redactURL(source)), slog.Int("keys", n))
+	return n, nil
+}
+
+// restoreEmpty restores the backup at source like [restoreBackup] only if the store is empty, as with -store-restore
+// seeding a new instance, so that restarting it does not overwrite the data written since with the old backup.
+func restoreEmpty(ctx context.Context, log *slog.Logger, st *fileStore, source string) (int, error) {
+	keys, err := st.List(ctx, "")
+	if err != nil {
+		return 0, err
+	}
+	if len(keys) > 0 {
+		log.InfoContext(ctx, "restore skipped, the store is not empty", slog.String("source", redactURL(source)), slog.Int("keys", len(keys)))
+		return 0, nil
+	}
+	return restoreBackup(ctx, log, st, source)
+}
+
+// progressReader is an [io.Reader] logging the bytes read every [backupProgressBytes].
+type progressReader struct {
+	r     io.Reader
+	ctx   context.Context
+	log   *slog.Logger
+	msg   string
+	total int // -1 if unknown
+	read  int
+}
+
+// Read implements the [io.Reader] interface.
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if p.read/backupProgressBytes != (p.read+n)/backupProgressBytes {
+		p.log.InfoContext(p.ctx, p.msg, slog.Int("bytes", p.read+n), slog.Int("total", p.total))
+	}
+	p.read += n
+	return n, err
+}
+
+// backupCommand runs the backup and restore subcommands, such as "app backup -store store.json -to backups/",
+// which work on the store file of a stopped server. Restore a running server through /admin/backup instead.
+func backupCommand(ctx context.Context, w io.Writer, args []string) error {
+	fs := flag.NewFlagSet(args[0]+" "+args[1], flag.ExitOnError)
+	fs.SetOutput(w)
+	path := fs.String("store", "", "file of the embedded key-value store")
+	to := fs.String("to", ".", "directory or http(s) URL to write the backup to, for backup")
+	from := fs.String("from", "", "file or http(s) URL of the backup to restore, for restore")
+	if err := fs.Parse(args[2:]); err != nil {
+		return &exitError{code: exitConfig, err: err}
+	}
+	if *path == "" || (args[1] == "restore" && *from == "") {
+		return &exitError{code: exitConfig, err: fmt.Errorf("usage: %s backup -store file [-to dir|url], or %s restore -store file -from file|url", filepath.Base(args[0]), filepath.Base(args[0]))}
+	}
+
+	log := slog.New(slog.NewTextHandler(w, nil))
+	st, err := newFileStore(*path)
+	if err != nil {
+		return err
+	}
+	if args[1] == "restore" {
+		_, err := restoreBackup(ctx, log, st, *from)
+		return err
+	}
+	_, err = uploadBackup(ctx, log, st, *to)
+	return err
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestBackup tests that backups are written to directories and URLs, and restored from them.
+func TestBackup(t *testing.T) {
+	ctx := context.Background()
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dir := t.TempDir()
+	st, err := newFileStore(filepath.Join(dir, "store.json"))
+	testNil(t, err)
+	testNil(t, st.Put(ctx, "users/1", []byte("a")))
+
+	var uploaded []byte
+	blob := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			uploaded, _ = io.ReadAll(r.Body)
+			return
+		}
+		w.Write(uploaded)
+	}))
+	defer blob.Close()
+
+	path, err := uploadBackup(ctx, log, st, dir)
+	testNil(t, err)
+	testContains(t, filepath.Join(dir, "backup-"), path)
+	var logs strings.Builder
+	target, err := uploadBackup(ctx, slog.New(slog.NewTextHandler(&logs, nil)), st, blob.URL+"/backup.json?X-Amz-Signature=secret")
+	testNil(t, err)
+	testEqual(t, blob.URL+"/backup.json?REDACTED", target)
+	testEqual(t, false, strings.Contains(logs.String(), "secret"))
+	testContains(t, "users/1", string(uploaded))
+
+	testNil(t, st.Put(ctx, "users/2", []byte("b")))
+	n, err := restoreBackup(ctx, log, st, path)
+	testNil(t, err)
+	testEqual(t, 1, n)
+	testNil(t, st.Put(ctx, "users/2", []byte("b")))
+	n, err = restoreBackup(ctx, log, st, blob.URL+"/backup.json")
+	testNil(t, err)
+	testEqual(t, 1, n)
+	keys, err := st.List(ctx, "")
+	testNil(t, err)
+	testEqual(t, "users/1", strings.Join(keys, ","))
+
+	testNil(t, st.Put(ctx, "users/2", []byte("b")))
+	n, err = restoreEmpty(ctx, log, st, path)
+	testNil(t, err)
+	testEqual(t, 0, n)
+	empty, err := newFileStore(filepath.Join(dir, "empty.json"))
+	testNil(t, err)
+	n, err = restoreEmpty(ctx, log, empty, path)
+	testNil(t, err)
+	testEqual(t, 1, n)
+
+	lc := newLifecycle(log)
+	events, unsubscribe := lc.subscribe()
+	defer unsubscribe()
+	admin := handleAdmin(adminDeps{log: log, state: &adminState{}, token: "secret", backups: st, backupTo: dir, lifecycle: lc})
+	r := httptest.NewRequest(http.MethodPost, "/admin/backups", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, r)
+	testEqual(t, http.StatusCreated, w.Code)
+	testContains(t, `"Target":`, w.Body.String())
+
+	restore := func(body string) int {
+		r := httptest.NewRequest(http.MethodPut, "/admin/backup", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, r)
+		return w.Code
+	}
+	testEqual(t, http.StatusBadRequest, restore("not json"))
+	testEqual(t, http.StatusNoContent, restore(`{"users/1":"YQ=="}`))
+	testEqual(t, 0, len(events)) // store operations are audited, but nothing was reloaded
+	testNil(t, os.Chmod(dir, 0o500))
+	defer os.Chmod(dir, 0o700)
+	if os.Getuid() != 0 { // NOTE: root can write to read-only directories
+		testEqual(t, http.StatusInternalServerError, restore(`{"users/3":"Yw=="}`))
+	}
+}
+
+// TestBackupCommand tests the backup and restore subcommands.
+func TestBackupCommand(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	st, err := newFileStore(filepath.Join(dir, "store.json"))
+	testNil(t, err)
+	testNil(t, st.Put(ctx, "users/1", []byte("a")))
+	out := filepath.Join(dir, "backups")
+	testNil(t, os.Mkdir(out, 0o755))
+
+	var buf strings.Builder
+	testNil(t, run(ctx, &buf, []string{"app", "backup", "-store", filepath.Join(dir, "store.json"), "-to", out}, ""))
+	testContains(t, "backup done", buf.String())
+	entries, err := os.ReadDir(out)
+	testNil(t, err)
+	testEqual(t, 1, len(entries))
+
+	restored := filepath.Join(dir, "restored.json")
+	testNil(t, run(ctx, &buf, []string{"app", "restore", "-store", restored, "-from", filepath.Join(out, entries[0].Name())}, ""))
+	st, err = newFileStore(restored)
+	testNil(t, err)
+	value, err := st.Get(ctx, "users/1")
+	testNil(t, err)
+	testEqual(t, "a", string(value))
+
+	err = run(ctx, &buf, []string{"app", "restore", "-store", restored}, "")
+	testEqual(t, exitConfig, err.(*exitError).code)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// routeAllocsBudget is the most allocations per request of the full chain for GET /health, checked by [TestRouteAllocs].
+// Raise it deliberately along with a change adding allocations, and lower it after a change removing some.
+const routeAllocsBudget = 64
+
+// BenchmarkRoute measures the overhead of the middleware chain per request, comparing the full chain of [route]
+// in the prod and dev profiles with the bare handler on a mux, such as by:
+//
+//	go test -run '^$' -bench BenchmarkRoute -benchmem
+func BenchmarkRoute(b *testing.B) {
+	bare := http.NewServeMux()
+	bare.Handle("GET /health", handleGetHealth(version))
+	benchmarks := []struct {
+		name    string
+		handler http.Handler
+	}{
+		{"bare", bare},
+		{"prod", newBenchRoute(b, "-env", "prod")},
+		{"dev", newBenchRoute(b, "-env", "dev")},
+		{"metrics", newBenchRoute(b, "-env", "prod", "-metrics")},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			benchmarkHandler(b, bm.handler)
+		})
+	}
+}
+
+// benchmarkHandler serves GET /health with the handler b.N times, failing on a response other than 200.
+func benchmarkHandler(b *testing.B, handler http.Handler) {
+	b.ReportAllocs()
+	for range b.N {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+		if w.Code != http.StatusOK {
+			b.Fatalf("want 200, got %d", w.Code)
+		}
+	}
+}
+
+// newBenchRoute returns the handler of [route] configured by the flags, with the access log discarded.
+func newBenchRoute(tb testing.TB, args ...string) http.Handler {
+	tb.Helper()
+	return newTestRoute(tb, slog.New(slog.NewJSONHandler(io.Discard, nil)), args...)
+}
+
+// newTestRoute returns the handler of [route] configured by the flags, logging to log.
+func newTestRoute(tb testing.TB, log *slog.Logger, args ...string) http.Handler {
+	tb.Helper()
+	cfg, err := parseConfig(io.Discard, append([]string{"bench"}, args...))
+	testNil(tb, err)
+	var m *metrics
+	if cfg.metrics {
+		m = newMetrics(false)
+	}
+	var ready atomic.Bool
+	ready.Store(true)
+	bus := newEventBus(log, m, 1, 1, cfg.eventWorkerIdle, 16)
+	sched := newScheduler(log)
+	tb.Cleanup(func() {
+		sched.Close()
+		bus.Close()
+	})
+	client := newClient(log, "", cfg.outboundTimeout, cfg.outboundChaos, m, nil, cfg.egress)
+	return route(routeDeps{
+		log:       log,
+		version:   version,
+		cfg:       cfg,
+		outbound:  client.Transport,
+		ready:     &ready,
+		metrics:   m,
+		drain:     newDrainer(),
+		admin:     &adminState{},
+		bus:       bus,
+		lifecycle: newLifecycle(log),
+		scheduler: sched,
+	})
+}
+
+// TestRouteAllocs checks the allocations per request of the full chain against [routeAllocsBudget], so that CI catches
+// regressions of the overhead of the middlewares. It only runs with ROUTE_ALLOCS_CHECK set, such as by "make bench-check",
+// since the race detector and coverage add allocations.
+func TestRouteAllocs(t *testing.T) {
+	if ok, _ := strconv.ParseBool(os.Getenv("ROUTE_ALLOCS_CHECK")); !ok {
+		t.Skip("ROUTE_ALLOCS_CHECK is not set")
+	}
+	handler := newBenchRoute(t, "-env", "prod")
+	res := testing.Benchmark(func(b *testing.B) { benchmarkHandler(b, handler) })
+	t.Logf("%s %d allocs/op %d B/op", res, res.AllocsPerOp(), res.AllocedBytesPerOp())
+	if allocs := res.AllocsPerOp(); allocs > routeAllocsBudget {
+		t.Fatalf("%d allocs per request, over the budget of %d", allocs, routeAllocsBudget)
+	}
+}
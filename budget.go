@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errOutboundBudget is returned by the client of [newClient] when an inbound request exhausted its [outboundBudget].
+var errOutboundBudget = errors.New("outbound budget exceeded")
+
+// outboundBudget limits the outbound calls of each inbound request, set by the -outbound-budget-* flags.
+// The zero value tracks the calls without limiting them.
+type outboundBudget struct {
+	calls    int           // outbound calls per inbound request, unlimited if zero
+	duration time.Duration // total duration of the outbound calls per inbound request, unlimited if zero
+}
+
+// outboundUsageKey is the context key of the [outboundUsage] of a request.
+type outboundUsageKey struct{}
+
+// outboundUsage is the number and total duration of the outbound calls of an inbound request, see [trackOutbound].
+type outboundUsage struct {
+	budget outboundBudget
+
+	mu       sync.Mutex
+	calls    int
+	duration time.Duration
+	exceeded bool
+}
+
+// trackOutbound is a middleware that counts the outbound calls each request makes through the client of [newClient]
+// and their total duration, added to its access log entry as outbound_calls and outbound_duration,
+// so that fan-out explosions such as a call per item of a list stand out.
+//
+// Once a request exhausts its budget, further calls fail fast with [errOutboundBudget] instead of being sent,
+// and the request is responded with 503 and a problem response whatever the handler writes afterwards.
+// Calls in flight when the budget runs out complete, and responses already written are left as is.
+func trackOutbound(next http.Handler, budget outboundBudget) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := &outboundUsage{budget: budget}
+		r = r.WithContext(context.WithValue(r.Context(), outboundUsageKey{}, u))
+		next.ServeHTTP(&budgetWriter{ResponseWriter: w, r: r, usage: u}, r)
+
+		u.mu.Lock()
+		calls, duration := u.calls, u.duration
+		u.mu.Unlock()
+		if calls > 0 {
+			addLogAttrs(r.Context(), slog.Int("outbound_calls", calls), slog.String("outbound_duration", duration.String()))
+		}
+	})
+}
+
+// spend reserves an outbound call from the budget, returning [errOutboundBudget] if it is exhausted.
+func (u *outboundUsage) spend() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if (u.budget.calls > 0 && u.calls >= u.budget.calls) || (u.budget.duration > 0 && u.duration >= u.budget.duration) {
+		u.exceeded = true
+		return fmt.Errorf("%w: %d calls in %s", errOutboundBudget, u.calls, u.duration)
+	}
+	u.calls++
+	return nil
+}
+
+// record adds the duration of an outbound call.
+func (u *outboundUsage) record(d time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.duration += d
+}
+
+// budgetTransport is an [http.RoundTripper] that charges outbound requests to the [outboundUsage] of the inbound request
+// in their context, see [trackOutbound]. Requests outside of inbound requests, such as from background jobs, are not charged.
+type budgetTransport struct {
+	next http.RoundTripper
+}
+
+// RoundTrip implements the [http.RoundTripper] interface.
+func (t *budgetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	u, ok := req.Context().Value(outboundUsageKey{}).(*outboundUsage)
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+	if err := u.spend(); err != nil {
+		closeBody(req)
+		return nil, err
+	}
+	start := time.Now()
+	defer func() { u.record(time.Since(start)) }()
+	return t.next.RoundTrip(req)
+}
+
+// budgetWriter is an [http.ResponseWriter] responding with 503 instead of the response of the handler
+// once the request exhausted its outbound budget, see [trackOutbound].
+type budgetWriter struct {
+	http.ResponseWriter
+	r         *http.Request
+	usage     *outboundUsage
+	written   bool
+	discarded bool
+}
+
+// WriteHeader implements the [http.ResponseWriter] interface.
+func (bw *budgetWriter) WriteHeader(statusCode int) {
+	if bw.written {
+		if !bw.discarded {
+			bw.ResponseWriter.WriteHeader(statusCode)
+		}
+		return
+	}
+	bw.written = true
+	bw.usage.mu.Lock()
+	exceeded := bw.usage.exceeded
+	bw.usage.mu.Unlock()
+	if !exceeded {
+		bw.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+	bw.discarded = true
+	bw.Header().Del("Content-Length")
+	bw.Header().Set("Retry-After", "1")
+	writeProblem(bw.ResponseWriter, bw.r, http.StatusServiceUnavailable, errOutboundBudget)
+}
+
+// Write implements the [http.ResponseWriter] interface.
+func (bw *budgetWriter) Write(b []byte) (int, error) {
+	if !bw.written {
+		bw.WriteHeader(http.StatusOK)
+	}
+	if bw.discarded {
+		return len(b), nil
+	}
+	return bw.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the original [http.ResponseWriter], so that [http.ResponseController] can reach it.
+func (bw *budgetWriter) Unwrap() http.ResponseWriter {
+	return bw.ResponseWriter
+}
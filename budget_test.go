@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestTrackOutbound tests that outbound calls are counted in the access log and fail fast with 503 once the budget is exhausted.
+func TestTrackOutbound(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	client := newClient(slog.New(slog.NewTextHandler(io.Discard, nil)), "", time.Second, chaosConfig{}, nil, nil, egressPolicy{})
+
+	var errs []error
+	fanOut := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for range 3 {
+			req, _ := http.NewRequestWithContext(r.Context(), http.MethodGet, upstream.URL, nil)
+			res, err := client.Do(req)
+			if err != nil {
+				errs = append(errs, err)
+				writeProblem(w, r, http.StatusBadGateway, err)
+				return
+			}
+			res.Body.Close()
+		}
+		w.Write([]byte("ok"))
+	})
+
+	var logs bytes.Buffer
+	handler := accesslog(trackOutbound(fanOut, outboundBudget{}), slog.New(slog.NewJSONHandler(&logs, nil)))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	testEqual(t, http.StatusOK, w.Code)
+	testContains(t, `"outbound_calls":3`, logs.String())
+	testContains(t, `"outbound_duration":`, logs.String())
+
+	logs.Reset()
+	handler = accesslog(trackOutbound(fanOut, outboundBudget{calls: 2}), slog.New(slog.NewJSONHandler(&logs, nil)))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	testEqual(t, http.StatusServiceUnavailable, w.Code)
+	testEqual(t, "1", w.Header().Get("Retry-After"))
+	testContains(t, "application/problem+json", w.Header().Get("Content-Type"))
+	testEqual(t, 1, len(errs))
+	testEqual(t, true, errors.Is(errs[0], errOutboundBudget))
+	testContains(t, `"outbound_calls":2`, logs.String())
+
+	req, _ := http.NewRequest(http.MethodGet, upstream.URL, nil)
+	res, err := client.Do(req)
+	testNil(t, err)
+	res.Body.Close()
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// cacheVars counts the hits, misses, and loads of each [cache] by its name, served by /debug/vars.
+var cacheVars = expvar.NewMap("cache")
+
+// cacheJitter is the fraction of the TTL by which the expiry of each entry varies, so that entries
+// loaded together, such as after a deploy, do not expire together and stampede the backend again.
+const cacheJitter = 0.1
+
+// maxCacheEntries is the number of entries a [cache] holds before evicting the least recently used.
+const maxCacheEntries = 16384
+
+// cache is a read-through cache of values of type T for expensive lookups, such as calls to upstream services.
+// Concurrent misses of a key share a single load, values expire after the TTL with jitter, and lookups failing
+// with [errNotFound] are cached for the negative TTL, so that missing keys do not hit the backend on every request.
+// Other errors are never cached. Entries are kept in a [ttlMap] of at most [maxCacheEntries].
+type cache[T any] struct {
+	name        string
+	ttl         time.Duration
+	negativeTTL time.Duration
+	metrics     *metrics
+
+	entries *ttlMap[string, cacheEntry[T]]
+	mu      sync.Mutex
+	loads   map[string]*cacheLoad[T]
+}
+
+// cacheEntry is a value or a not found error cached by a [cache].
+type cacheEntry[T any] struct {
+	value T
+	err   error
+}
+
+// cacheLoad is a load of a key in flight, shared by the concurrent misses of the key.
+type cacheLoad[T any] struct {
+	done  chan struct{}
+	value T
+	err   error
+}
+
+// newCache returns a [cache] named name in metrics, caching values for ttl and not found errors for negativeTTL,
+// which disables negative caching if zero. It records the duration of the loads into m as the
+// cache_load_duration_seconds histogram, see [handleGetMetrics].
+func newCache[T any](name string, ttl, negativeTTL time.Duration, m *metrics) *cache[T] {
+	return &cache[T]{
+		name: name, ttl: ttl, negativeTTL: negativeTTL, metrics: m,
+		entries: newTTLMap[string, cacheEntry[T]]("cache."+name, maxCacheEntries), loads: map[string]*cacheLoad[T]{},
+	}
+}
+
+// getOrLoad returns the cached value of the key, or loads it with load if it is missing or expired.
+// The load runs with a context that is not canceled with ctx, since other callers may be waiting for it,
+// while getOrLoad itself returns early if ctx is done.
+//
+//	users := newCache[user]("users", time.Minute, 10*time.Second, m)
+//	u, err := users.getOrLoad(r.Context(), id, func(ctx context.Context) (user, error) { return fetchUser(ctx, id) })
+func (c *cache[T]) getOrLoad(ctx context.Context, key string, load func(ctx context.Context) (T, error)) (T, error) {
+	now := time.Now()
+	c.mu.Lock()
+	if e, ok := c.entries.get(key, now); ok {
+		c.mu.Unlock()
+		if e.err != nil {
+			cacheVars.Add(c.name+".negative_hits", 1)
+		} else {
+			cacheVars.Add(c.name+".hits", 1)
+		}
+		return e.value, e.err
+	}
+	cacheVars.Add(c.name+".misses", 1)
+	l, shared := c.loads[key]
+	if !shared {
+		l = &cacheLoad[T]{done: make(chan struct{})}
+		c.loads[key] = l
+		go c.load(context.WithoutCancel(ctx), key, l, load)
+	}
+	c.mu.Unlock()
+	if shared {
+		cacheVars.Add(c.name+".shared_loads", 1)
+	}
+
+	select {
+	case <-l.done:
+		return l.value, l.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+// load runs the load of the key, caches its outcome, and wakes up the callers waiting for it.
+func (c *cache[T]) load(ctx context.Context, key string, l *cacheLoad[T], load func(ctx context.Context) (T, error)) {
+	start := time.Now()
+	defer close(l.done)
+	l.value, l.err = func() (value T, err error) {
+		defer func() {
+			if v := recover(); v != nil {
+				err = fmt.Errorf("panic: %v", v)
+			}
+		}()
+		return load(ctx)
+	}()
+	cacheVars.Add(c.name+".loads", 1)
+	tc, _ := traceFrom(ctx)
+	c.metrics.observe("cache_load_duration_seconds", "Duration of cache loads.", durationBuckets,
+		time.Since(start).Seconds(), tc, "cache", c.name)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.loads, key)
+	ttl := c.ttl
+	switch {
+	case errors.Is(l.err, errNotFound) && c.negativeTTL > 0:
+		ttl = c.negativeTTL
+	case errors.Is(l.err, errNotFound):
+		return // a miss is not a failure, it is only left uncached without negative caching
+	case l.err != nil:
+		cacheVars.Add(c.name+".load_failures", 1)
+		return
+	}
+	ttl += time.Duration((rand.Float64()*2 - 1) * cacheJitter * float64(ttl))
+	c.entries.put(key, cacheEntry[T]{value: l.value, err: l.err}, start.Add(ttl))
+}
+
+// invalidate removes the cached value of the key, such as after it is updated, so that the next lookup loads it.
+func (c *cache[T]) invalidate(key string) {
+	c.entries.delete(key)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestCache tests that concurrent misses share a load, values and not found errors are cached, and other errors are not.
+func TestCache(t *testing.T) {
+	c := newCache[string]("test-cache", time.Hour, time.Hour, newMetrics(false))
+	var loads atomic.Int64
+	release := make(chan struct{})
+	load := func(ctx context.Context) (string, error) {
+		loads.Add(1)
+		<-release
+		return "value", nil
+	}
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err := c.getOrLoad(context.Background(), "key", load)
+			testNil(t, err)
+			testEqual(t, "value", value)
+		}()
+	}
+	for cacheVars.Get("test-cache.misses") == nil || cacheVars.Get("test-cache.misses").String() != "10" {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	value, err := c.getOrLoad(context.Background(), "key", load)
+	testNil(t, err)
+	testEqual(t, "value", value)
+	testEqual(t, int64(1), loads.Load())
+	testEqual(t, "1", cacheVars.Get("test-cache.hits").String())
+	testEqual(t, "9", cacheVars.Get("test-cache.shared_loads").String())
+
+	missing := func(ctx context.Context) (string, error) {
+		loads.Add(1)
+		return "", fmt.Errorf("user 42: %w", errNotFound)
+	}
+	for range 2 {
+		_, err = c.getOrLoad(context.Background(), "missing", missing)
+		testEqual(t, true, errors.Is(err, errNotFound))
+	}
+	testEqual(t, int64(2), loads.Load())
+
+	failing := func(ctx context.Context) (string, error) {
+		loads.Add(1)
+		return "", errors.New("upstream unavailable")
+	}
+	for range 2 {
+		_, err = c.getOrLoad(context.Background(), "failing", failing)
+		testContains(t, "upstream unavailable", err.Error())
+	}
+	testEqual(t, int64(4), loads.Load())
+
+	c.invalidate("key")
+	release = make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = c.getOrLoad(ctx, "key", load)
+	testEqual(t, context.Canceled, err)
+	close(release)
+}
+
+// TestCacheExpiry tests that entries expire after the TTL within the jitter.
+func TestCacheExpiry(t *testing.T) {
+	c := newCache[int]("test-cache-expiry", 50*time.Millisecond, 0, nil)
+	var loads atomic.Int64
+	load := func(ctx context.Context) (int, error) { return int(loads.Add(1)), nil }
+
+	value, _ := c.getOrLoad(context.Background(), "key", load)
+	testEqual(t, 1, value)
+	time.Sleep(40 * time.Millisecond)
+	value, _ = c.getOrLoad(context.Background(), "key", load)
+	testEqual(t, 1, value)
+	time.Sleep(30 * time.Millisecond)
+	value, _ = c.getOrLoad(context.Background(), "key", load)
+	testEqual(t, 2, value)
+}
+
+// TestCacheNotFound tests that misses are not cached without a negative TTL, and are not counted as load failures.
+func TestCacheNotFound(t *testing.T) {
+	c := newCache[int]("test-cache-not-found", time.Hour, 0, nil)
+	var loads atomic.Int64
+	load := func(ctx context.Context) (int, error) { loads.Add(1); return 0, errNotFound }
+
+	for range 2 {
+		_, err := c.getOrLoad(context.Background(), "key", load)
+		testEqual(t, errNotFound, err)
+	}
+	testEqual(t, int64(2), loads.Load())
+	testEqual(t, nil, cacheVars.Get("test-cache-not-found.load_failures"))
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// cacheNoStore is the cache policy of routes whose responses must never be cached, such as health checks.
+const cacheNoStore = "no-store"
+
+// cachePrivate returns the cache policy of routes whose responses only the client may cache, for maxAge.
+func cachePrivate(maxAge time.Duration) string {
+	return fmt.Sprintf("private, max-age=%d", int(maxAge.Seconds()))
+}
+
+// cachePublic returns the cache policy of routes whose responses shared caches such as CDNs may cache for sMaxAge,
+// while clients revalidate them on every use.
+func cachePublic(sMaxAge time.Duration) string {
+	return fmt.Sprintf("public, max-age=0, s-maxage=%d", int(sMaxAge.Seconds()))
+}
+
+// cacheControl is a middleware that sets the Cache-Control header of the responses of a route to the policy
+// declared in its [routeMeta], unless the handler sets its own. Error responses are never cached, so they are sent
+// with no-store instead, and the policy is only set once the status is known, so that the 500 of a panic recovered
+// by an outer middleware never carries it. It is applied by [handle] to routes with meta.Cache set, and the policy is reflected into
+// the response headers of the operation by [routesOpenapi].
+func cacheControl(next http.Handler, policy string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&cacheControlWriter{ResponseWriter: w, policy: policy}, r)
+	})
+}
+
+// cacheControlWriter is an [http.ResponseWriter] replacing the cache policy of error responses with no-store, see [cacheControl].
+type cacheControlWriter struct {
+	http.ResponseWriter
+	policy      string
+	wroteHeader bool
+}
+
+// WriteHeader implements the [http.ResponseWriter] interface.
+func (cw *cacheControlWriter) WriteHeader(statusCode int) {
+	if !cw.wroteHeader {
+		cw.wroteHeader = true
+		if cw.Header().Get("Cache-Control") == "" {
+			policy := cw.policy
+			if statusCode >= 400 {
+				policy = cacheNoStore
+			}
+			cw.Header().Set("Cache-Control", policy)
+		}
+	}
+	cw.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write implements the [http.ResponseWriter] interface.
+func (cw *cacheControlWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the original [http.ResponseWriter], so that [http.ResponseController] can reach it.
+func (cw *cacheControlWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
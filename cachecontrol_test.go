@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestCacheControl tests that routes are served with their declared cache policy, except error responses,
+// and that the policy is reflected into the OpenAPI document generated from the routes.
+func TestCacheControl(t *testing.T) {
+	testEqual(t, "private, max-age=60", cachePrivate(time.Minute))
+	testEqual(t, "public, max-age=0, s-maxage=300", cachePublic(5*time.Minute))
+
+	mux := http.NewServeMux()
+	handle(mux, "GET /test-cache/{id}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.PathValue("id") {
+		case "missing":
+			writeProblem(w, r, http.StatusNotFound, nil)
+		case "panic":
+			panic("test")
+		case "own":
+			w.Header().Set("Cache-Control", "private, max-age=5")
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			_, _ = w.Write([]byte("ok"))
+		}
+	}), routeMeta{Summary: "Cached test route", Cache: cachePrivate(time.Minute)})
+	t.Cleanup(func() { routes.Delete("GET /test-cache/{id}") })
+	handler := recovery(mux, slog.New(slog.NewTextHandler(io.Discard, nil)), false)
+	serve := func(id string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/test-cache/"+id, nil))
+		return w
+	}
+
+	testEqual(t, "private, max-age=60", serve("1").Header().Get("Cache-Control"))
+	testEqual(t, "no-store", serve("missing").Header().Get("Cache-Control"))
+	testEqual(t, "private, max-age=5", serve("own").Header().Get("Cache-Control"))
+	w := serve("panic")
+	testEqual(t, http.StatusInternalServerError, w.Code)
+	testEqual(t, "", w.Header().Get("Cache-Control"))
+
+	doc := string(routesOpenapi("v1", nil))
+	testNil(t, lintOpenapi("routes.yaml", []byte(doc)))
+	testContains(t, "  \"/test-cache/{id}\":\n    get:\n", doc)
+	testContains(t, "          headers:\n            Cache-Control:\n", doc)
+	testContains(t, "                example: \"private, max-age=60\"\n", doc)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordCassettes makes [useCassette] record the interactions with upstream services instead of replaying them,
+// such as by "go test -run TestX -record" with the upstreams reachable.
+var recordCassettes = flag.Bool("record", false, "record the outbound interactions of tests to testdata/cassettes instead of replaying them")
+
+// interaction is an outbound request and its response, recorded by a [cassette].
+type interaction struct {
+	Method         string      `json:"Method"`
+	URL            string      `json:"URL"`
+	RequestBody    string      `json:"RequestBody,omitempty"`
+	Status         int         `json:"Status"`
+	ResponseHeader http.Header `json:"ResponseHeader,omitempty"`
+	ResponseBody   string      `json:"ResponseBody,omitempty"`
+}
+
+// unrecordedHeaders are the response headers not recorded by a [cassette], since they differ on every request or hold secrets.
+var unrecordedHeaders = []string{"Date", "Set-Cookie"}
+
+// cassette is an [http.RoundTripper] recording the interactions with upstream services to a file in record mode,
+// and replaying them from it otherwise, so that tests of handlers calling third-party APIs are deterministic
+// and run without network access in CI. Requests are matched by method, URL, and body, in the order they were recorded.
+type cassette struct {
+	path   string
+	record bool
+	next   http.RoundTripper
+
+	mu           sync.Mutex
+	interactions []interaction
+	replayed     []bool
+}
+
+// useCassette makes the client record to or replay from testdata/cassettes/<name>.json until the test ends,
+// recording if the -record flag is set. Replaying fails the test if the cassette does not exist.
+//
+//	client := newClient(...)
+//	useCassette(t, client, "github-user")
+func useCassette(t testing.TB, client *http.Client, name string) *cassette {
+	t.Helper()
+	c, err := newCassette(filepath.Join("testdata", "cassettes", name+".json"), *recordCassettes, client.Transport)
+	if err != nil {
+		t.Fatalf("cassette %s: %v, record it with -record", name, err)
+	}
+	client.Transport = c
+	t.Cleanup(func() {
+		client.Transport = c.next
+		if err := c.save(); err != nil {
+			t.Errorf("cassette %s: %v", name, err)
+		}
+	})
+	return c
+}
+
+// newCassette returns a [cassette] of the file at path, loading its interactions unless record is set.
+// It records through next, or [http.DefaultTransport] if nil.
+func newCassette(path string, record bool, next http.RoundTripper) (*cassette, error) {
+	c := &cassette{path: path, record: record, next: cmp.Or(next, http.DefaultTransport)}
+	if record {
+		return c, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &c.interactions); err != nil {
+		return nil, err
+	}
+	c.replayed = make([]bool, len(c.interactions))
+	return c, nil
+}
+
+// RoundTrip implements the [http.RoundTripper] interface.
+func (c *cassette) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+	if !c.record {
+		return c.replay(req, string(body))
+	}
+
+	out := req.Clone(req.Context())
+	out.Body = io.NopCloser(bytes.NewReader(body))
+	res, err := c.next.RoundTrip(out)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	header := res.Header.Clone()
+	for _, h := range unrecordedHeaders {
+		header.Del(h)
+	}
+	c.mu.Lock()
+	c.interactions = append(c.interactions, interaction{
+		Method: req.Method, URL: req.URL.String(), RequestBody: string(body),
+		Status: res.StatusCode, ResponseHeader: header, ResponseBody: string(resBody),
+	})
+	c.mu.Unlock()
+	res.Body = io.NopCloser(bytes.NewReader(resBody))
+	return res, nil
+}
+
+// replay responds with the first interaction matching the request that was not replayed yet.
+func (c *cassette) replay(req *http.Request, body string) (*http.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, in := range c.interactions {
+		if c.replayed[i] || in.Method != req.Method || in.URL != req.URL.String() || in.RequestBody != body {
+			continue
+		}
+		c.replayed[i] = true
+		return &http.Response{
+			Status: fmt.Sprintf("%d %s", in.Status, http.StatusText(in.Status)), StatusCode: in.Status,
+			Proto: "HTTP/1.1", ProtoMajor: 1, ProtoMinor: 1,
+			Header: in.ResponseHeader.Clone(), Body: io.NopCloser(strings.NewReader(in.ResponseBody)),
+			ContentLength: int64(len(in.ResponseBody)), Request: req,
+		}, nil
+	}
+	return nil, fmt.Errorf("cassette %s: no recorded interaction for %s %s, record it again with -record", c.path, req.Method, req.URL)
+}
+
+// save writes the recorded interactions to the file of the cassette, doing nothing when replaying.
+func (c *cassette) save() error {
+	if !c.record {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, err := json.MarshalIndent(c.interactions, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(c.path, append(b, '\n'), 0o644)
+}
+
+// TestCassette tests that interactions are recorded to a cassette and replayed from it without the upstream.
+func TestCassette(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Set-Cookie", "session=secret")
+		fmt.Fprintf(w, `{"path":%q,"body":%q}`, r.URL.Path, body)
+	}))
+	path := filepath.Join(t.TempDir(), "upstream.json")
+
+	recorder, err := newCassette(path, true, nil)
+	testNil(t, err)
+	client := &http.Client{Transport: recorder}
+	for _, body := range []string{"first", "second"} {
+		res, err := client.Post(upstream.URL+"/users", "text/plain", strings.NewReader(body))
+		testNil(t, err)
+		res.Body.Close()
+	}
+	testNil(t, recorder.save())
+	upstream.Close()
+
+	player, err := newCassette(path, false, nil)
+	testNil(t, err)
+	client = &http.Client{Transport: player}
+	res, err := client.Post(upstream.URL+"/users", "text/plain", strings.NewReader("second"))
+	testNil(t, err)
+	body, _ := io.ReadAll(res.Body)
+	testEqual(t, `{"path":"/users","body":"second"}`, string(body))
+	testEqual(t, "application/json", res.Header.Get("Content-Type"))
+	testEqual(t, "", res.Header.Get("Set-Cookie"))
+	_, err = client.Post(upstream.URL+"/users", "text/plain", strings.NewReader("second"))
+	testContains(t, "no recorded interaction for POST", err.Error())
+
+	if *recordCassettes {
+		return // NOTE: api.example.com is not a real upstream to record
+	}
+	client = &http.Client{}
+	useCassette(t, client, "example")
+	res, err = client.Get("https://api.example.com/users/1")
+	testNil(t, err)
+	body, _ = io.ReadAll(res.Body)
+	testEqual(t, http.StatusOK, res.StatusCode)
+	testEqual(t, `{"id":1,"name":"Kim"}`, string(body))
+}
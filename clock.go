@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// clockVars holds the offset of the host clock from the -ntp-server, served by /debug/vars.
+var clockVars = expvar.NewMap("clock")
+
+// ntpEpochOffset is the number of seconds from the NTP epoch in 1900 to the Unix epoch in 1970.
+const ntpEpochOffset = 2208988800
+
+// queryNTP returns the offset of the host clock from the clock of the NTP server at addr,
+// positive if the host clock is behind. It implements the client side of SNTP (RFC 4330)
+// with a single request, which is accurate to about half of the round trip.
+func queryNTP(ctx context.Context, addr string) (time.Duration, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(5 * time.Second)
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return 0, err
+	}
+
+	req := make([]byte, 48)
+	req[0] = 0x23 // NOTE: leap indicator 0, version 4, client mode 3
+	sent := time.Now()
+	binary.BigEndian.PutUint64(req[40:], toNTPTime(sent))
+	if _, err := conn.Write(req); err != nil {
+		return 0, err
+	}
+	res := make([]byte, 48)
+	n, err := conn.Read(res)
+	received := time.Now()
+	if err != nil {
+		return 0, err
+	}
+	if n < 48 || res[0]&0x7 != 4 {
+		return 0, errors.New("invalid NTP response")
+	}
+	if res[1] == 0 {
+		return 0, fmt.Errorf("NTP server refused with kiss code %q", res[12:16])
+	}
+	if !bytes.Equal(res[24:32], req[40:48]) {
+		return 0, errors.New("NTP response does not match the request")
+	}
+	serverReceived := fromNTPTime(binary.BigEndian.Uint64(res[32:]))
+	serverSent := fromNTPTime(binary.BigEndian.Uint64(res[40:]))
+	return (serverReceived.Sub(sent) + serverSent.Sub(received)) / 2, nil
+}
+
+// toNTPTime returns t as an NTP timestamp, seconds since 1900 in the upper 32 bits and the fraction in the lower.
+func toNTPTime(t time.Time) uint64 {
+	return uint64(t.Unix()+ntpEpochOffset)<<32 | uint64(t.Nanosecond())<<32/uint64(time.Second)
+}
+
+// fromNTPTime returns the time of the NTP timestamp ts, see [toNTPTime].
+func fromNTPTime(ts uint64) time.Time {
+	return time.Unix(int64(ts>>32)-ntpEpochOffset, int64((ts&0xffffffff)*uint64(time.Second)>>32))
+}
+
+// checkClock queries the offset of the host clock from the NTP server at addr into [clockVars],
+// warning if it is beyond the threshold, since tokens and signed URLs are rejected or accepted wrongly
+// on skewed clocks without any other sign. It is run at startup and by the "clock-skew" job of the [scheduler].
+func checkClock(ctx context.Context, log *slog.Logger, addr string, threshold time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	offset, err := queryNTP(ctx, addr)
+	if err != nil {
+		return fmt.Errorf("querying NTP server %s: %w", addr, err)
+	}
+	var v expvar.Float
+	v.Set(offset.Seconds())
+	clockVars.Set("offset_seconds", &v)
+	if offset.Abs() > threshold {
+		clockVars.Add("skewed", 1)
+		log.WarnContext(ctx, "clock skewed", slog.Duration("offset", offset), slog.Duration("threshold", threshold), slog.String("ntp_server", addr))
+	}
+	return nil
+}
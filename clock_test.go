@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestCheckClock tests that the offset from an NTP server is measured and warned about beyond the threshold.
+func TestCheckClock(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	testNil(t, err)
+	defer conn.Close()
+	const skew = 3 * time.Second
+	go func() {
+		req := make([]byte, 48)
+		for {
+			n, addr, err := conn.ReadFrom(req)
+			if err != nil {
+				return
+			}
+			if n < 48 {
+				continue
+			}
+			res := make([]byte, 48)
+			res[0], res[1] = 0x24, 2 // NOTE: version 4, server mode 4, stratum 2
+			copy(res[24:32], req[40:48])
+			binary.BigEndian.PutUint64(res[32:], toNTPTime(time.Now().Add(skew)))
+			binary.BigEndian.PutUint64(res[40:], toNTPTime(time.Now().Add(skew)))
+			conn.WriteTo(res, addr)
+		}
+	}()
+
+	offset, err := queryNTP(context.Background(), conn.LocalAddr().String())
+	testNil(t, err)
+	testEqual(t, true, (offset-skew).Abs() < 100*time.Millisecond)
+
+	var logs bytes.Buffer
+	testNil(t, checkClock(context.Background(), slog.New(slog.NewTextHandler(&logs, nil)), conn.LocalAddr().String(), time.Second))
+	testContains(t, "msg=\"clock skewed\"", logs.String())
+	testNil(t, checkClock(context.Background(), slog.New(slog.NewTextHandler(io.Discard, nil)), conn.LocalAddr().String(), time.Minute))
+
+	ts := time.Unix(1_700_000_000, 123_456_789)
+	testEqual(t, true, fromNTPTime(toNTPTime(ts)).Sub(ts).Abs() < time.Microsecond)
+
+	cfg, err := parseConfig(io.Discard, []string{"testapp", "--ntp-server", "pool.ntp.org"})
+	testNil(t, err)
+	testEqual(t, "pool.ntp.org:123", cfg.ntpServer)
+}
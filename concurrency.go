@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// concurrencyConfig configures the [limitConcurrency] middleware, set by the -concurrency-* flags. The zero value disables it.
+type concurrencyConfig struct {
+	limit     int64         // requests served at once, rejecting the others with 503, disabled if zero
+	slowStart time.Duration // window after readiness the limit ramps up to full over, disabled if zero
+}
+
+// slowStartFraction is the fraction of the limit served at once when the slow start begins, and before readiness.
+const slowStartFraction = 0.1
+
+// concurrencyLimiter counts the requests in flight against a limit ramping up after readiness, see [limitConcurrency].
+type concurrencyLimiter struct {
+	cfg      concurrencyConfig
+	ready    *atomic.Bool
+	readyAt  atomic.Int64 // unix nanoseconds the service was first seen ready, zero before
+	inFlight atomic.Int64
+}
+
+// capacity returns the requests that may be served at once at now, ramping linearly from [slowStartFraction]
+// of the limit to the full limit over the slow start window after the service is first seen ready.
+func (l *concurrencyLimiter) capacity(now time.Time) int64 {
+	if l.cfg.slowStart <= 0 {
+		return l.cfg.limit
+	}
+	readyAt := l.readyAt.Load()
+	if readyAt == 0 && l.ready.Load() {
+		l.readyAt.CompareAndSwap(0, now.UnixNano())
+		readyAt = l.readyAt.Load()
+	}
+	progress := 0.0
+	if readyAt != 0 {
+		progress = min(float64(now.UnixNano()-readyAt)/float64(l.cfg.slowStart), 1)
+	}
+	fraction := slowStartFraction + (1-slowStartFraction)*progress
+	return max(int64(float64(l.cfg.limit)*fraction), 1)
+}
+
+// limitConcurrency is a middleware that limits the requests served at once to the limit of the config,
+// shedding the others with 503 and a Retry-After header, so that an overloaded instance stays responsive.
+// With a slow start, the limit ramps up over a window once ready is set, protecting cold caches and lazily
+// initialized paths of a fresh instance from taking its full share of traffic at once. Health checks are not limited.
+func limitConcurrency(next http.Handler, cfg concurrencyConfig, ready *atomic.Bool) http.Handler {
+	if cfg.limit <= 0 {
+		return next
+	}
+	l := &concurrencyLimiter{cfg: cfg, ready: ready}
+	registerLimit("concurrency", cfg.limit, l.inFlight.Load)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isHealthCheck(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer l.inFlight.Add(-1)
+		if l.inFlight.Add(1) > l.capacity(time.Now()) {
+			w.Header().Set("Retry-After", "1")
+			writeProblem(w, r, http.StatusServiceUnavailable, errors.New("too many concurrent requests"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestConcurrencySlowStart tests that the limit ramps up from a tenth to full over the slow start window after readiness.
+func TestConcurrencySlowStart(t *testing.T) {
+	var ready atomic.Bool
+	l := &concurrencyLimiter{cfg: concurrencyConfig{limit: 100, slowStart: time.Minute}, ready: &ready}
+	now := time.Now()
+	testEqual(t, int64(10), l.capacity(now))
+	testEqual(t, int64(10), l.capacity(now.Add(time.Hour)))
+
+	ready.Store(true)
+	testEqual(t, int64(10), l.capacity(now))
+	testEqual(t, int64(55), l.capacity(now.Add(30*time.Second)))
+	testEqual(t, int64(100), l.capacity(now.Add(time.Minute)))
+	ready.Store(false)
+	testEqual(t, int64(100), l.capacity(now.Add(time.Hour)))
+
+	l = &concurrencyLimiter{cfg: concurrencyConfig{limit: 5, slowStart: time.Minute}, ready: &ready}
+	testEqual(t, int64(1), l.capacity(now))
+	l = &concurrencyLimiter{cfg: concurrencyConfig{limit: 100}, ready: &ready}
+	testEqual(t, int64(100), l.capacity(now))
+}
+
+// TestLimitConcurrency tests that requests over the limit are shed with 503, except health checks.
+func TestLimitConcurrency(t *testing.T) {
+	var ready atomic.Bool
+	ready.Store(true)
+	entered, release := make(chan struct{}), make(chan struct{})
+	handler := limitConcurrency(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			entered <- struct{}{}
+			<-release
+		}
+	}), concurrencyConfig{limit: 2}, &ready)
+
+	done := make(chan struct{})
+	for range 2 {
+		go func() {
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow", nil))
+			done <- struct{}{}
+		}()
+		<-entered
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	testEqual(t, http.StatusServiceUnavailable, w.Code)
+	testEqual(t, "1", w.Header().Get("Retry-After"))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	testEqual(t, http.StatusOK, w.Code)
+
+	close(release)
+	<-done
+	<-done
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	testEqual(t, http.StatusOK, w.Code)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"expvar"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// connVars counts the connections of each listener by state, served by /debug/vars and /debug/conns.
+// The new, active, and idle counts are the connections currently in the state, while hijacked, accepted,
+// closed, and forced are totals, since hijacked connections are no longer tracked by the server,
+// and forced are the connections still open when the shutdown deadline elapsed, see [connTracker.forceClose].
+var connVars = expvar.NewMap("conns")
+
+// connTrackerKey is the context key of the [trackedConn] of a request, set by [connTracker.connContext].
+type connTrackerKey struct{}
+
+// connTracker tracks the connections of the listener named name, counting them by state into [connVars],
+// to tell apart clients holding idle keep-alive connections from slow requests when file descriptors run out.
+// It also knows the route and start of the last request of each connection, recorded by [trackConnRoutes],
+// so that the connections force-closed on shutdown can be reported by what they were serving.
+type connTracker struct {
+	name  string
+	conns sync.Map // net.Conn to its *trackedConn
+}
+
+// trackedConn is a connection tracked by [connTracker].
+type trackedConn struct {
+	mu      sync.Mutex
+	state   http.ConnState
+	counted bool      // whether state is counted in connVars, since the connection is tracked before it is new
+	route   string    // pattern of the last request, empty until a request is routed
+	since   time.Time // when the connection was accepted or its last request started
+}
+
+// newConnTracker returns a [connTracker] of the listener named name, to set as the ConnState and ConnContext hooks of its server.
+func newConnTracker(name string) *connTracker {
+	return &connTracker{name: name}
+}
+
+// trackConns returns an [http.Server.ConnState] hook counting the connections of the listener named name into [connVars],
+// for servers that need no routes of the connections, see [connTracker].
+func trackConns(name string) func(net.Conn, http.ConnState) {
+	return newConnTracker(name).connState
+}
+
+// track returns the [trackedConn] of the connection, tracking it if it is not yet.
+func (t *connTracker) track(conn net.Conn) *trackedConn {
+	tc, _ := t.conns.LoadOrStore(conn, &trackedConn{since: time.Now()})
+	return tc.(*trackedConn)
+}
+
+// connContext implements the [http.Server.ConnContext] hook, adding the [trackedConn] of the connection to the context of its requests.
+func (t *connTracker) connContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connTrackerKey{}, t.track(conn))
+}
+
+// connState implements the [http.Server.ConnState] hook.
+func (t *connTracker) connState(conn net.Conn, state http.ConnState) {
+	tc := t.track(conn)
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if tc.counted {
+		connVars.Add(t.name+"."+tc.state.String(), -1)
+	}
+	switch state {
+	case http.StateNew:
+		connVars.Add(t.name+".accepted", 1)
+		fallthrough
+	case http.StateActive, http.StateIdle:
+		connVars.Add(t.name+"."+state.String(), 1)
+		tc.state, tc.counted = state, true
+	case http.StateHijacked, http.StateClosed:
+		connVars.Add(t.name+"."+state.String(), 1)
+		tc.counted = false
+		t.conns.Delete(conn)
+	}
+}
+
+// forceClose logs the connections still open, with the route and duration of the request each one is serving,
+// and counts them as forced into [connVars]. Call it when the shutdown deadline elapses, right before [http.Server.Close]
+// cuts them off, so that the requests cut off are known. It returns the number of connections.
+func (t *connTracker) forceClose(ctx context.Context, log *slog.Logger) int {
+	n := 0
+	now := time.Now()
+	t.conns.Range(func(key, value any) bool {
+		tc := value.(*trackedConn)
+		tc.mu.Lock()
+		state, route, since := tc.state, tc.route, tc.since
+		tc.mu.Unlock()
+		n++
+		log.WarnContext(ctx, "connection force-closed",
+			slog.String("listener", t.name),
+			slog.String("remote_addr", key.(net.Conn).RemoteAddr().String()),
+			slog.String("state", state.String()),
+			slog.String("route", route),
+			slog.Duration("duration", now.Sub(since)))
+		return true
+	})
+	connVars.Add(t.name+".forced", int64(n))
+	return n
+}
+
+// trackConnRoutes is a middleware that records the route matched in mux and the start of each request
+// on its connection, see [connTracker]. Connections of HTTP/2 record the last of their concurrent requests.
+func trackConnRoutes(next http.Handler, mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tc, ok := r.Context().Value(connTrackerKey{}).(*trackedConn); ok {
+			_, pattern := mux.Handler(r)
+			tc.mu.Lock()
+			tc.route, tc.since = cmp.Or(pattern, "unmatched"), time.Now()
+			tc.mu.Unlock()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleGetConns returns an [http.HandlerFunc] that responds with the connections of each listener by state, see [trackConns].
+func handleGetConns() http.HandlerFunc {
+	type listenerBody struct {
+		Listener string `json:"Listener"`
+		New      int64  `json:"New"`
+		Active   int64  `json:"Active"`
+		Idle     int64  `json:"Idle"`
+		Open     int64  `json:"Open"`
+		Hijacked int64  `json:"Hijacked"`
+		Accepted int64  `json:"Accepted"`
+		Closed   int64  `json:"Closed"`
+		Forced   int64  `json:"Forced"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		listeners := map[string]*listenerBody{}
+		connVars.Do(func(kv expvar.KeyValue) {
+			name, state, ok := strings.Cut(kv.Key, ".")
+			v, isInt := kv.Value.(*expvar.Int)
+			if !ok || !isInt {
+				return
+			}
+			l := listeners[name]
+			if l == nil {
+				l = &listenerBody{Listener: name}
+				listeners[name] = l
+			}
+			switch state {
+			case "new":
+				l.New = v.Value()
+			case "active":
+				l.Active = v.Value()
+			case "idle":
+				l.Idle = v.Value()
+			case "hijacked":
+				l.Hijacked = v.Value()
+			case "accepted":
+				l.Accepted = v.Value()
+			case "closed":
+				l.Closed = v.Value()
+			case "forced":
+				l.Forced = v.Value()
+			}
+		})
+		res := make([]listenerBody, 0, len(listeners))
+		for _, l := range listeners {
+			l.Open = l.New + l.Active + l.Idle
+			res = append(res, *l)
+		}
+		slices.SortFunc(res, func(a, b listenerBody) int { return strings.Compare(a.Listener, b.Listener) })
+
+		if err := writeBody(w, r, 200, res); err != nil {
+			slog.ErrorContext(r.Context(), "failed to write conns", slog.Any("error", err))
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestConns tests that connections are counted by state, including idle keep-alive and hijacked ones.
+func TestConns(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hijack" {
+			conn, _, err := http.NewResponseController(w).Hijack()
+			testNil(t, err)
+			conn.Close()
+		}
+	}))
+	server.Config.ConnState = trackConns("test-conns")
+	server.Start()
+	defer server.Close()
+
+	type listenerBody struct {
+		Listener                                            string
+		New, Active, Idle, Open, Hijacked, Accepted, Closed int64
+	}
+	conns := func() listenerBody {
+		w := httptest.NewRecorder()
+		handleGetConns()(w, httptest.NewRequest(http.MethodGet, "/debug/conns", nil))
+		var res []listenerBody
+		testNil(t, json.Unmarshal(w.Body.Bytes(), &res))
+		for _, l := range res {
+			if l.Listener == "test-conns" {
+				return l
+			}
+		}
+		return listenerBody{}
+	}
+	before := conns() // NOTE: totals are kept across runs of the test
+	waitConns := func(closed int64) {
+		for deadline := time.Now().Add(time.Second); conns().Closed-before.Closed < closed && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	client := server.Client()
+	res, err := client.Get(server.URL)
+	testNil(t, err)
+	res.Body.Close()
+	for deadline := time.Now().Add(time.Second); conns().Idle == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	got := conns()
+	testEqual(t, int64(1), got.Idle)
+	testEqual(t, int64(1), got.Open)
+	testEqual(t, int64(1), got.Accepted-before.Accepted)
+
+	client.CloseIdleConnections()
+	waitConns(1)
+	got = conns()
+	testEqual(t, int64(0), got.Open)
+	testEqual(t, int64(1), got.Closed-before.Closed)
+
+	_, err = client.Get(server.URL + "/hijack")
+	testEqual(t, true, err != nil)
+	got = conns()
+	testEqual(t, int64(1), got.Hijacked-before.Hijacked)
+	testEqual(t, int64(0), got.Open)
+	testEqual(t, int64(2), got.Accepted-before.Accepted)
+}
+
+// TestConnsForceClose tests that the connections open at the shutdown deadline are logged with the route and duration of their request.
+func TestConnsForceClose(t *testing.T) {
+	entered, release := make(chan struct{}), make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /slow/{id}", func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+	})
+	tracker := newConnTracker("test-forced")
+	server := httptest.NewUnstartedServer(trackConnRoutes(mux, mux))
+	server.Config.ConnState, server.Config.ConnContext = tracker.connState, tracker.connContext
+	server.Start()
+	defer server.Close()
+	defer close(release)
+
+	go func() {
+		if res, err := server.Client().Get(server.URL + "/slow/1"); err == nil {
+			res.Body.Close()
+		}
+	}()
+	<-entered
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	testEqual(t, true, errors.Is(server.Config.Shutdown(ctx), context.DeadlineExceeded))
+
+	var buf bytes.Buffer
+	forced := func() int64 {
+		if v, ok := connVars.Get("test-forced.forced").(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := forced() // NOTE: totals are kept across runs of the test
+	testEqual(t, 1, tracker.forceClose(context.Background(), slog.New(slog.NewJSONHandler(&buf, nil))))
+	testContains(t, `"msg":"connection force-closed","listener":"test-forced"`, buf.String())
+	testContains(t, `"state":"active","route":"GET /slow/{id}","duration":`, buf.String())
+	testEqual(t, int64(1), forced()-before)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// crashReport flushes what is buffered in memory when [run] panics or fails, so that the last moments before a crash
+// are not lost: the logs and spans buffered by the exporter are exported, the [journal] is written,
+// and the reason with the final metrics is appended to the file of -crash-output.
+// Its fields are set as [run] creates them, so that a crash at any point flushes whatever exists by then.
+//
+// Recovering in [run] only catches panics of its own goroutine. Panics of other goroutines and fatal runtime errors
+// cannot be recovered, so the file of -crash-output also receives their output with the stacks of every goroutine
+// where the toolchain supports it, see [setCrashOutput].
+type crashReport struct {
+	file     *os.File // nil unless -crash-output is set
+	timeout  time.Duration
+	exporter *otlpExporter
+	metrics  *metrics
+	journal  *journal
+
+	once sync.Once
+}
+
+// openCrashReport returns a [crashReport] appending to the file at path, unless it is empty,
+// which also receives the output of fatal crashes.
+func openCrashReport(path string, timeout time.Duration) (*crashReport, error) {
+	c := &crashReport{timeout: timeout}
+	if path == "" {
+		return c, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := setCrashOutput(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	c.file = f
+	return c, nil
+}
+
+// flush exports the buffered telemetry, writes the journal, and appends the reason, the stack if any,
+// and the final metrics to the crash output. Only the first call does anything, and each step is attempted
+// even if a previous one failed, within the timeout of -shutdown-telemetry-timeout.
+func (c *crashReport) flush(log *slog.Logger, reason string, stack []byte) {
+	c.once.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+		defer cancel()
+		if stack != nil {
+			log.ErrorContext(ctx, "crashed", slog.String("reason", reason), slog.String("stack", string(stack)))
+		}
+		if c.exporter != nil {
+			// NOTE: export instead of Close, since the telemetry phase of the shutdown may have closed it already
+			c.exporter.export(ctx)
+		}
+		if err := c.journal.flush(reason); err != nil {
+			log.ErrorContext(ctx, "failed to flush journal", slog.Any("error", err))
+		}
+		if c.file == nil {
+			return
+		}
+		fmt.Fprintf(c.file, "%s %s\n", time.Now().UTC().Format(time.RFC3339), reason)
+		if stack != nil {
+			fmt.Fprintf(c.file, "%s\n", stack)
+		}
+		if c.metrics != nil {
+			c.metrics.write(c.file)
+		}
+		if err := c.file.Sync(); err != nil {
+			log.ErrorContext(ctx, "failed to write crash output", slog.Any("error", err))
+		}
+	})
+}
+
+// Close closes the crash output.
+func (c *crashReport) Close() error {
+	if c.file == nil {
+		return nil
+	}
+	return c.file.Close()
+}
@@ -0,0 +1,11 @@
+//go:build !go1.23
+
+package main
+
+import "os"
+
+// setCrashOutput does nothing, since toolchains before Go 1.23 cannot duplicate the output of fatal crashes.
+// Only the panics recovered by [run] are written to f.
+func setCrashOutput(*os.File) error {
+	return nil
+}
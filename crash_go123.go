@@ -0,0 +1,14 @@
+//go:build go1.23
+
+package main
+
+import (
+	"os"
+	"runtime/debug"
+)
+
+// setCrashOutput makes the runtime write the output of fatal crashes to f in addition to standard error,
+// such as panics of goroutines other than the one of [run], see [debug.SetCrashOutput].
+func setCrashOutput(f *os.File) error {
+	return debug.SetCrashOutput(f, debug.CrashOptions{})
+}
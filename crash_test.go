@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestCrashReport tests that a crash flushes the telemetry, the journal, and the crash output once.
+func TestCrashReport(t *testing.T) {
+	var exported atomic.Int32
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		exported.Add(1)
+	}))
+	defer collector.Close()
+
+	dir := t.TempDir()
+	crash, err := openCrashReport(filepath.Join(dir, "crash.log"), time.Second)
+	testNil(t, err)
+	defer crash.Close()
+	crash.exporter = newOTLPExporter(collector.URL, "test", "v1", slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer crash.exporter.Close()
+	crash.metrics = newMetrics(false)
+	crash.metrics.observe("test_seconds", "Test.", durationBuckets, 0.1, traceContext{})
+	crash.journal = newJournal(filepath.Join(dir, "journal.json"), 10)
+
+	var logs bytes.Buffer
+	log := slog.New(teeHandler{slog.NewTextHandler(&logs, nil), &otlpHandler{exporter: crash.exporter}})
+	crash.flush(log, "panic: boom", []byte("goroutine 1 [running]:"))
+	crash.flush(log, "second", nil)
+
+	testContains(t, "msg=crashed", logs.String())
+	testEqual(t, int32(1), exported.Load())
+	_, err = os.Stat(filepath.Join(dir, "journal.json"))
+	testNil(t, err)
+	b, err := os.ReadFile(filepath.Join(dir, "crash.log"))
+	testNil(t, err)
+	testContains(t, "panic: boom\ngoroutine 1 [running]:\n", string(b))
+	testContains(t, "# TYPE test_seconds histogram", string(b))
+	testEqual(t, false, strings.Contains(string(b), "Z second\n"))
+
+	none, err := openCrashReport("", time.Second)
+	testNil(t, err)
+	none.flush(log, "error", nil)
+	testNil(t, none.Close())
+}
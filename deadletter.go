@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// errPoisonEvent marks an error of an asynchronous subscriber as permanent, such as an event that can never be handled,
+// so that the delivery is dead-lettered right away instead of being redelivered.
+//
+//	return fmt.Errorf("%w: unknown plan %q", errPoisonEvent, e.Plan)
+var errPoisonEvent = errors.New("poison event")
+
+// errUnknownDeadLetter is returned when redriving the dead letter of an ID that does not exist, such as one already redriven.
+var errUnknownDeadLetter = errors.New("unknown dead letter")
+
+// Redelivery of the failed deliveries of an [eventBus].
+const (
+	eventRedeliveryBackoff    = 100 * time.Millisecond // delay before the second delivery, doubled for every next one
+	maxEventRedeliveryBackoff = 30 * time.Second
+	maxDeadLetters            = 1000 // oldest dead letters are discarded above it
+)
+
+// deadLetter is an asynchronous delivery that failed -event-max-deliveries times or with [errPoisonEvent].
+type deadLetter struct {
+	ID         int             `json:"ID"`
+	Event      string          `json:"Event"`
+	Subscriber string          `json:"Subscriber"`
+	Payload    json.RawMessage `json:"Payload,omitempty"`
+	Deliveries int             `json:"Deliveries"`
+	Error      string          `json:"Error"`
+	FailedAt   time.Time       `json:"FailedAt"`
+
+	redrive func() bool
+}
+
+// deadLetters holds the dead letters of an [eventBus] in memory until they are redriven,
+// so they are lost on restart, like the deliveries still queued.
+type deadLetters struct {
+	mu      sync.Mutex
+	letters []deadLetter
+	nextID  int
+}
+
+// nack handles the failed delivery of the event to the asynchronous subscriber, redelivering it with exponential backoff
+// until the max deliveries of the bus, and dead-lettering it after that or if err is an [errPoisonEvent].
+// Deliveries are acknowledged by the subscriber returning nil, so they are delivered at least once while the server runs.
+func (b *eventBus) nack(ctx context.Context, t reflect.Type, s subscriber, event any, deliveries int, err error) {
+	if deliveries < b.maxDeliveries && !errors.Is(err, errPoisonEvent) {
+		// NOTE: the shift is clamped, since the backoff would overflow with a high -event-max-deliveries
+		backoff := min(eventRedeliveryBackoff<<min(deliveries-1, 30), maxEventRedeliveryBackoff)
+		eventVars.Add("redelivered", 1)
+		b.log.WarnContext(ctx, "event subscriber failed, redelivering", slog.String("event", t.String()), slog.String("subscriber", s.name),
+			slog.Int("deliveries", deliveries), slog.Duration("backoff", backoff), slog.Any("error", err))
+		time.AfterFunc(backoff, func() {
+			if !b.enqueue(ctx, t, s, event, deliveries+1) {
+				b.deadLetter(ctx, t, s, event, deliveries, errors.New("queue full or closed on redelivery"))
+			}
+		})
+		return
+	}
+	b.deadLetter(ctx, t, s, event, deliveries, err)
+}
+
+// deadLetter records the delivery as a dead letter, to be inspected and redriven through the admin API.
+func (b *eventBus) deadLetter(ctx context.Context, t reflect.Type, s subscriber, event any, deliveries int, err error) {
+	eventVars.Add("dead_lettered", 1)
+	b.log.ErrorContext(ctx, "event dead-lettered", slog.String("event", t.String()), slog.String("subscriber", s.name),
+		slog.Int("deliveries", deliveries), slog.Any("error", err))
+	payload, _ := json.Marshal(event) // NOTE: best effort, events are not required to marshal
+
+	d := &b.deadLetters
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.nextID++
+	d.letters = append(d.letters, deadLetter{
+		ID: d.nextID, Event: t.String(), Subscriber: s.name, Payload: payload, Deliveries: deliveries,
+		Error: err.Error(), FailedAt: time.Now(),
+		redrive: func() bool { return b.enqueue(ctx, t, s, event, 1) },
+	})
+	if len(d.letters) > maxDeadLetters {
+		d.letters = d.letters[len(d.letters)-maxDeadLetters:]
+	}
+}
+
+// list returns the dead letters, oldest first.
+func (d *deadLetters) list() []deadLetter {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]deadLetter{}, d.letters...)
+}
+
+// redrive queues the dead letter of the ID again with its deliveries reset, or every dead letter if id is 0,
+// returning how many were queued. Dead letters that do not fit in the queue are kept.
+// It returns [errUnknownDeadLetter] if there is no dead letter of the ID.
+func (d *deadLetters) redrive(id int) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	kept := d.letters[:0]
+	found, redriven := id == 0, 0
+	for _, l := range d.letters {
+		found = found || l.ID == id
+		if (id == 0 || l.ID == id) && l.redrive() {
+			redriven++
+			continue
+		}
+		kept = append(kept, l)
+	}
+	clear(d.letters[len(kept):])
+	d.letters = kept
+	if !found {
+		return 0, errUnknownDeadLetter
+	}
+	eventVars.Add("redriven", int64(redriven))
+	return redriven, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestDeadLetters tests that failed deliveries are redelivered, dead-lettered after the max deliveries or as poison,
+// and redriven through the admin API.
+func TestDeadLetters(t *testing.T) {
+	type invoiceIssued struct{ ID string }
+
+	bus := newEventBus(slog.New(slog.NewTextHandler(io.Discard, nil)), nil, 1, 1, time.Minute, 16)
+	defer bus.Close()
+	bus.maxDeliveries = 3
+	var deliveries atomic.Int64
+	var healthy atomic.Bool
+	acked := make(chan string, 10)
+	subscribe(bus, "ledger", true, func(ctx context.Context, e invoiceIssued) error {
+		n := deliveries.Add(1)
+		switch {
+		case e.ID == "poison":
+			return fmt.Errorf("%w: malformed invoice", errPoisonEvent)
+		case e.ID == "flaky" && n < 2:
+			return errors.New("ledger unavailable")
+		case e.ID == "broken" && !healthy.Load():
+			return errors.New("ledger rejected")
+		}
+		acked <- e.ID
+		return nil
+	})
+
+	testNil(t, publish(context.Background(), bus, invoiceIssued{ID: "flaky"}))
+	testEqual(t, "flaky", <-acked)
+	testEqual(t, int64(2), deliveries.Load())
+
+	testNil(t, publish(context.Background(), bus, invoiceIssued{ID: "poison"}))
+	testNil(t, publish(context.Background(), bus, invoiceIssued{ID: "broken"}))
+	for len(bus.deadLetters.list()) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	letters := bus.deadLetters.list()
+	testEqual(t, 1, letters[0].Deliveries)
+	testContains(t, "poison event", letters[0].Error)
+	testEqual(t, 3, letters[1].Deliveries)
+	testEqual(t, `{"ID":"broken"}`, string(letters[1].Payload))
+
+	admin := handleAdmin(adminDeps{log: slog.New(slog.NewTextHandler(io.Discard, nil)), state: &adminState{}, token: "secret", bus: bus})
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, r)
+		return w
+	}
+	var listed []deadLetter
+	testNil(t, json.NewDecoder(serve(http.MethodGet, "/admin/dead-letters").Body).Decode(&listed))
+	testEqual(t, 2, len(listed))
+	testEqual(t, "ledger", listed[1].Subscriber)
+
+	testEqual(t, http.StatusBadRequest, serve(http.MethodPost, "/admin/dead-letters/redrive?id=x").Code)
+	testEqual(t, http.StatusNotFound, serve(http.MethodPost, "/admin/dead-letters/redrive?id=1000").Code)
+	healthy.Store(true)
+	w := serve(http.MethodPost, fmt.Sprintf("/admin/dead-letters/redrive?id=%d", letters[1].ID))
+	testEqual(t, http.StatusOK, w.Code)
+	testEqual(t, `{"Redriven":1}`+"\n", w.Body.String())
+	testEqual(t, "broken", <-acked)
+	testEqual(t, 1, len(bus.deadLetters.list()))
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// debugConfig configures the protection of the debug routes by [protectDebug], set by the -debug-* flags.
+type debugConfig struct {
+	timeout     time.Duration // longest a debug request may take, including CPU profiles and traces
+	concurrency int           // debug requests served at once, rejecting the others with 429
+	gzip        bool          // compresses the text responses of the debug routes if the client accepts it
+}
+
+// protectDebug is a middleware that protects the service from the debug routes, so that a profile scrape
+// cannot starve the service of CPU or file descriptors. Debug requests are limited by the timeout of the config,
+// and requests over the concurrency of the config are rejected with 429, since profiles are expensive.
+// CPU profiles and traces asking for a duration longer than the timeout are rejected with 400.
+// Text responses such as /debug/vars are compressed with gzip if enabled, while binary profiles are already compressed.
+func protectDebug(next http.Handler, cfg debugConfig) http.Handler {
+	sem := make(chan struct{}, cfg.concurrency)
+	registerLimit("debug_concurrency", int64(cfg.concurrency), func() int64 { return int64(len(sem)) })
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s := r.URL.Query().Get("seconds"); s != "" {
+			if seconds, err := strconv.ParseFloat(s, 64); err == nil && time.Duration(seconds*float64(time.Second)) >= cfg.timeout {
+				writeProblem(w, r, http.StatusBadRequest, fmt.Errorf("seconds must be less than the debug timeout %s, got %s", cfg.timeout, s))
+				return
+			}
+		}
+		select {
+		case sem <- struct{}{}:
+			defer func() { <-sem }()
+		default:
+			w.Header().Set("Retry-After", "1")
+			writeProblem(w, r, http.StatusTooManyRequests, errors.New("too many concurrent debug requests"))
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), cfg.timeout)
+		defer cancel()
+		// NOTE: the write deadline cuts off clients reading slowly, which the context cannot; it is unsupported by recorders in tests
+		_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(cfg.timeout))
+		if cfg.gzip && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			gw := &gzipWriter{ResponseWriter: w}
+			defer gw.Close()
+			w = gw
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// gzipWriter is an [http.ResponseWriter] compressing the response with gzip unless it is binary,
+// decided right before the response header is written.
+type gzipWriter struct {
+	http.ResponseWriter
+	gz      *gzip.Writer
+	written bool
+}
+
+// WriteHeader implements the [http.ResponseWriter] interface.
+func (gw *gzipWriter) WriteHeader(statusCode int) {
+	if !gw.written {
+		gw.written = true
+		h := gw.Header()
+		h.Add("Vary", "Accept-Encoding")
+		if h.Get("Content-Encoding") == "" && h.Get("Content-Type") != "application/octet-stream" && statusCode != http.StatusNoContent {
+			h.Set("Content-Encoding", "gzip")
+			h.Del("Content-Length")
+			gw.gz = gzip.NewWriter(gw.ResponseWriter)
+		}
+	}
+	gw.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write implements the [http.ResponseWriter] interface.
+func (gw *gzipWriter) Write(b []byte) (int, error) {
+	if !gw.written {
+		if gw.Header().Get("Content-Type") == "" {
+			gw.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		gw.WriteHeader(http.StatusOK)
+	}
+	if gw.gz != nil {
+		return gw.gz.Write(b)
+	}
+	return gw.ResponseWriter.Write(b)
+}
+
+// Flush implements the [http.Flusher] interface, flushing the compressed data written so far.
+func (gw *gzipWriter) Flush() {
+	if gw.gz != nil {
+		gw.gz.Flush()
+	}
+	http.NewResponseController(gw.ResponseWriter).Flush()
+}
+
+// Close flushes the remaining compressed data.
+func (gw *gzipWriter) Close() error {
+	if gw.gz == nil {
+		return nil
+	}
+	return gw.gz.Close()
+}
+
+// Unwrap returns the original [http.ResponseWriter], so that [http.ResponseController] can reach it.
+func (gw *gzipWriter) Unwrap() http.ResponseWriter {
+	return gw.ResponseWriter
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestProtectDebug tests that debug requests are capped, bounded by the timeout, and compressed unless binary.
+func TestProtectDebug(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/block", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	mux.HandleFunc("/debug/text", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "hello")
+	})
+	mux.HandleFunc("/debug/binary", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		io.WriteString(w, "profile")
+	})
+	mux.HandleFunc("/debug/deadline", func(w http.ResponseWriter, r *http.Request) {
+		_, ok := r.Context().Deadline()
+		testEqual(t, true, ok)
+	})
+	handler := protectDebug(mux, debugConfig{timeout: 10 * time.Second, concurrency: 1, gzip: true})
+	do := func(path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		do("/debug/block")
+	}()
+	<-started
+	w := do("/debug/text")
+	testEqual(t, http.StatusTooManyRequests, w.Code)
+	testEqual(t, "1", w.Header().Get("Retry-After"))
+	close(release)
+	<-done
+
+	testEqual(t, http.StatusBadRequest, do("/debug/pprof/profile?seconds=30").Code)
+	testEqual(t, http.StatusOK, do("/debug/deadline").Code)
+
+	w = do("/debug/text")
+	testEqual(t, "gzip", w.Header().Get("Content-Encoding"))
+	gz, err := gzip.NewReader(w.Body)
+	testNil(t, err)
+	body, err := io.ReadAll(gz)
+	testNil(t, err)
+	testEqual(t, "hello", string(body))
+
+	w = do("/debug/binary")
+	testEqual(t, "", w.Header().Get("Content-Encoding"))
+	testEqual(t, "profile", w.Body.String())
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// deprecatedCallers is the number of callers tracked per deprecated route, counting the others as "other".
+const deprecatedCallers = 1000
+
+// deprecations holds the usage of every deprecated route registered by [handle], keyed by pattern.
+var deprecations sync.Map
+
+// deprecatedUsage is the usage of a deprecated route by caller, recorded by [deprecate].
+type deprecatedUsage struct {
+	meta routeMeta
+
+	mu      sync.Mutex
+	callers map[string]*callerUsage
+}
+
+// callerUsage is the usage of a deprecated route by a caller.
+type callerUsage struct {
+	calls    uint64
+	lastSeen time.Time
+}
+
+// deprecate is a middleware that marks the route of the pattern as deprecated since meta.Deprecated,
+// emitting the Deprecation header of RFC 9745 and the Sunset header of RFC 8594 if meta.Sunset is set,
+// so that clients can notice before it is removed. It is applied by [handle] to routes with meta.Deprecated set.
+//
+// Callers are counted by the principal set by [setPrincipal], or by the client IP for unauthenticated requests,
+// and reported at /debug/deprecations so that teams know who to chase and when it is safe to remove the route.
+func deprecate(next http.Handler, pattern string, meta routeMeta) http.Handler {
+	usage := &deprecatedUsage{meta: meta, callers: map[string]*callerUsage{}}
+	deprecations.Store(pattern, usage)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", fmt.Sprintf("@%d", meta.Deprecated.Unix()))
+		if !meta.Sunset.IsZero() {
+			w.Header().Set("Sunset", meta.Sunset.UTC().Format(http.TimeFormat))
+		}
+		next.ServeHTTP(w, r)
+
+		// NOTE: the principal is read after the handler, since authentication may run in it
+		caller := principalFrom(r.Context())
+		if caller == "" {
+			caller = r.RemoteAddr
+			if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+				caller = host
+			}
+		}
+		usage.mu.Lock()
+		defer usage.mu.Unlock()
+		c, ok := usage.callers[caller]
+		if !ok && len(usage.callers) >= deprecatedCallers {
+			caller = "other"
+			c, ok = usage.callers[caller]
+		}
+		if !ok {
+			c = &callerUsage{}
+			usage.callers[caller] = c
+		}
+		c.calls++
+		c.lastSeen = time.Now()
+	})
+}
+
+// handleGetDeprecations returns an [http.HandlerFunc] that responds with every deprecated route
+// and its remaining callers, the most frequent first.
+func handleGetDeprecations() http.HandlerFunc {
+	type callerBody struct {
+		Caller   string    `json:"Caller"`
+		Calls    uint64    `json:"Calls"`
+		LastSeen time.Time `json:"LastSeen"`
+	}
+	type routeBody struct {
+		Pattern    string       `json:"Pattern"`
+		Deprecated time.Time    `json:"Deprecated"`
+		Sunset     *time.Time   `json:"Sunset,omitempty"`
+		Calls      uint64       `json:"Calls"`
+		Callers    []callerBody `json:"Callers"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		res := []routeBody{}
+		deprecations.Range(func(key, value any) bool {
+			usage := value.(*deprecatedUsage)
+			body := routeBody{Pattern: key.(string), Deprecated: usage.meta.Deprecated, Callers: []callerBody{}}
+			if !usage.meta.Sunset.IsZero() {
+				body.Sunset = &usage.meta.Sunset
+			}
+			usage.mu.Lock()
+			for caller, c := range usage.callers {
+				body.Calls += c.calls
+				body.Callers = append(body.Callers, callerBody{Caller: caller, Calls: c.calls, LastSeen: c.lastSeen})
+			}
+			usage.mu.Unlock()
+			slices.SortFunc(body.Callers, func(a, b callerBody) int {
+				return cmp.Or(cmp.Compare(b.Calls, a.Calls), strings.Compare(a.Caller, b.Caller))
+			})
+			res = append(res, body)
+			return true
+		})
+		slices.SortFunc(res, func(a, b routeBody) int { return strings.Compare(a.Pattern, b.Pattern) })
+
+		if err := writeBody(w, r, 200, res); err != nil {
+			slog.ErrorContext(r.Context(), "failed to write deprecations", slog.Any("error", err))
+		}
+	}
+}
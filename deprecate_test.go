@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestDeprecate tests that deprecated routes emit the headers and report their callers.
+func TestDeprecate(t *testing.T) {
+	type caller struct {
+		Caller string `json:"Caller"`
+		Calls  uint64 `json:"Calls"`
+	}
+	type response struct {
+		Pattern string   `json:"Pattern"`
+		Calls   uint64   `json:"Calls"`
+		Callers []caller `json:"Callers"`
+	}
+
+	deprecated := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	sunset := time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC)
+	mux := http.NewServeMux()
+	handle(mux, "GET /v1/users", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			setPrincipal(r.Context(), "team-a")
+		}
+	}), routeMeta{Summary: "Users", Stability: "deprecated", Deprecated: deprecated, Sunset: sunset})
+	t.Cleanup(func() {
+		routes.Delete("GET /v1/users")
+		deprecations.Delete("GET /v1/users")
+	})
+	handler := recovery(mux, nil, false)
+
+	var w *httptest.ResponseRecorder
+	for _, token := range []string{"", "token", "token"} {
+		r := httptest.NewRequest(http.MethodGet, "/v1/users", nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+	}
+	testEqual(t, "@1735689600", w.Header().Get("Deprecation"))
+	testEqual(t, "Tue, 01 Jul 2025 00:00:00 GMT", w.Header().Get("Sunset"))
+
+	w = httptest.NewRecorder()
+	handleGetDeprecations().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/deprecations", nil))
+	var body []response
+	testNil(t, json.NewDecoder(w.Body).Decode(&body))
+	testEqual(t, 1, len(body))
+	testEqual(t, "GET /v1/users", body[0].Pattern)
+	testEqual(t, uint64(3), body[0].Calls)
+	testEqual(t, caller{Caller: "team-a", Calls: 2}, body[0].Callers[0])
+	testEqual(t, caller{Caller: "192.0.2.1", Calls: 1}, body[0].Callers[1])
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/pprof"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxDiagnosticsSeconds caps the duration of the CPU profile of a diagnostic bundle.
+const maxDiagnosticsSeconds = 120
+
+// handlePostDiagnostics returns an [http.HandlerFunc] that captures a diagnostic bundle as a zip archive,
+// so that incident data is collected in one step instead of by hand from several endpoints:
+//
+//	cpu.pprof       CPU profile over the ?seconds= query parameter, 30 by default
+//	heap.pprof      heap profile at the end of the CPU profile
+//	goroutines.txt  stacks of every goroutine
+//	journal.json    last requests of jrn, empty unless -journal is set
+//	config.txt      command line and effective flags of the server, with secrets redacted
+//
+// It responds with 409 if a CPU profile is already running, such as one of /debug/pprof/profile.
+func handlePostDiagnostics(jrn *journal, configDump []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		seconds := 30
+		if s := r.URL.Query().Get("seconds"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 || n > maxDiagnosticsSeconds {
+				writeProblem(w, r, http.StatusBadRequest, fmt.Errorf("seconds must be a number between 1 and %d", maxDiagnosticsSeconds))
+				return
+			}
+			seconds = n
+		}
+
+		var cpu bytes.Buffer
+		if err := pprof.StartCPUProfile(&cpu); err != nil {
+			writeProblem(w, r, http.StatusConflict, fmt.Errorf("failed to start CPU profile: %w", err))
+			return
+		}
+		timer := time.NewTimer(time.Duration(seconds) * time.Second)
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+		}
+		pprof.StopCPUProfile()
+		if r.Context().Err() != nil {
+			return // NOTE: the client went away, so there is no one to send the bundle to
+		}
+
+		journalBody, err := json.MarshalIndent(jrn.snapshot(), "", "  ")
+		if err != nil {
+			writeProblem(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="diagnostics-%s.zip"`, time.Now().UTC().Format("20060102T150405Z")))
+		w.WriteHeader(200)
+		zw := zip.NewWriter(w)
+		files := []struct {
+			name  string
+			write func(zw *zip.Writer, name string) error
+		}{
+			{"cpu.pprof", writeZipBytes(cpu.Bytes())},
+			{"heap.pprof", writeZipProfile("heap", 0)},
+			{"goroutines.txt", writeZipProfile("goroutine", 2)},
+			{"journal.json", writeZipBytes(journalBody)},
+			{"config.txt", writeZipBytes([]byte(strings.Join(configDump, "\n") + "\n"))},
+		}
+		for _, f := range files {
+			if err := f.write(zw, f.name); err != nil {
+				slog.ErrorContext(r.Context(), "failed to write diagnostics", slog.String("file", f.name), slog.Any("error", err))
+				return
+			}
+		}
+		if err := zw.Close(); err != nil {
+			slog.ErrorContext(r.Context(), "failed to write diagnostics", slog.Any("error", err))
+		}
+	}
+}
+
+// writeZipBytes returns a function adding a file with the content b to a zip archive.
+func writeZipBytes(b []byte) func(zw *zip.Writer, name string) error {
+	return func(zw *zip.Writer, name string) error {
+		f, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(b)
+		return err
+	}
+}
+
+// writeZipProfile returns a function adding the runtime profile of the name to a zip archive, in the format of debug,
+// see [pprof.Profile.WriteTo].
+func writeZipProfile(profile string, debug int) func(zw *zip.Writer, name string) error {
+	return func(zw *zip.Writer, name string) error {
+		f, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		return pprof.Lookup(profile).WriteTo(f, debug)
+	}
+}
+
+// secretFlags are the flags whose values are redacted from the config dump of diagnostic bundles.
+var secretFlags = []string{"admin-token", "api-keys", "encryption-keys", "jwt-secret"}
+
+// dumpConfig returns the command line args and the effective value of every flag of fs, with the values of [secretFlags] redacted,
+// and the query strings of URL values redacted by [redactURL], such as the signatures of presigned -backup-to URLs.
+// The values of flags parsed by functions, such as repeatable ones, are only in the command line.
+func dumpConfig(fs *flag.FlagSet, args []string) []string {
+	redacted := make([]string, 0, len(args))
+	secret := false
+	for _, arg := range args {
+		switch name, _, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "="); {
+		case secret:
+			arg, secret = "[redacted]", false
+		case strings.HasPrefix(arg, "-") && slices.Contains(secretFlags, name) && hasValue:
+			arg = arg[:strings.Index(arg, "=")+1] + "[redacted]"
+		case strings.HasPrefix(arg, "-") && slices.Contains(secretFlags, name):
+			secret = true
+		case strings.HasPrefix(arg, "-") && hasValue:
+			arg = arg[:strings.Index(arg, "=")+1] + redactURL(arg[strings.Index(arg, "=")+1:])
+		default:
+			arg = redactURL(arg)
+		}
+		redacted = append(redacted, arg)
+	}
+
+	dump := []string{"args: " + strings.Join(redacted, " ")}
+	fs.VisitAll(func(f *flag.Flag) {
+		value := redactURL(f.Value.String())
+		if slices.Contains(secretFlags, f.Name) && value != "" {
+			value = "[redacted]"
+		}
+		dump = append(dump, fmt.Sprintf("-%s=%s", f.Name, value))
+	})
+	return dump
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime/pprof"
+	"strings"
+	"testing"
+)
+
+// TestDiagnostics tests that diagnostic bundles hold every file, with secrets redacted from the config.
+func TestDiagnostics(t *testing.T) {
+	cfg, err := parseConfig(io.Discard, []string{"testapp", "--admin-token", "hunter2", "--jwt-secret=" + strings.Repeat("s", 32), "--warmup", "GET /health",
+		"--store", t.TempDir() + "/store.json", "--backup-to=https://blob.example/b?sig=s3cret", "--store-restore", "https://blob.example/r?sig=s3cret"})
+	testNil(t, err)
+	jrn := newJournal(t.TempDir()+"/journal.json", 10)
+	jrn.record(journalEntry{Method: http.MethodGet, Path: "/users", Status: 200})
+	handler := handlePostDiagnostics(jrn, cfg.dump)
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/admin/diagnostics?seconds=1", nil))
+	testEqual(t, http.StatusOK, w.Code)
+	testContains(t, "attachment; filename=\"diagnostics-", w.Header().Get("Content-Disposition"))
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	testNil(t, err)
+	files := map[string]string{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		testNil(t, err)
+		b, err := io.ReadAll(rc)
+		testNil(t, err)
+		files[f.Name] = string(b)
+	}
+	testEqual(t, 5, len(files))
+	testEqual(t, true, len(files["cpu.pprof"]) > 0 && len(files["heap.pprof"]) > 0)
+	testContains(t, "goroutine ", files["goroutines.txt"])
+	testContains(t, `"Path": "/users"`, files["journal.json"])
+	testContains(t, "args: --admin-token [redacted] --jwt-secret=[redacted] --warmup GET /health", files["config.txt"])
+	testContains(t, "-jwt-secret=[redacted]\n", files["config.txt"])
+	testEqual(t, false, strings.Contains(files["config.txt"], "hunter2"))
+	testContains(t, "--backup-to=https://blob.example/b?REDACTED --store-restore https://blob.example/r?REDACTED", files["config.txt"])
+	testContains(t, "-backup-to=https://blob.example/b?REDACTED\n", files["config.txt"])
+	testEqual(t, false, strings.Contains(files["config.txt"], "s3cret"))
+
+	testNil(t, pprof.StartCPUProfile(io.Discard))
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/admin/diagnostics", nil))
+	pprof.StopCPUProfile()
+	testEqual(t, http.StatusConflict, w.Code)
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/admin/diagnostics?seconds=600", nil))
+	testEqual(t, http.StatusBadRequest, w.Code)
+}
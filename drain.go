@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// drainer notifies long-lived connections, such as SSE streams and WebSockets, that the server is shutting down,
+// and waits for them to close, so that clients reconnect to another instance instead of being cut off.
+// [http.Server.Shutdown] neither interrupts active handlers nor waits for hijacked connections, hence this.
+//
+//	closing, done := drain.track()
+//	defer done()
+//	for {
+//		select {
+//		case event := <-events:
+//			...
+//		case <-closing:
+//			writeSSEClose(w, time.Second)
+//			return
+//		}
+//	}
+type drainer struct {
+	closing chan struct{}
+	once    sync.Once
+	wg      sync.WaitGroup
+}
+
+// newDrainer returns a [drainer] to be closed by [http.Server.RegisterOnShutdown].
+func newDrainer() *drainer {
+	return &drainer{closing: make(chan struct{})}
+}
+
+// track registers a long-lived connection.
+// It returns a channel closed when the server starts shutting down, and a function to call once the connection is closed.
+func (d *drainer) track() (<-chan struct{}, func()) {
+	d.wg.Add(1)
+	var once sync.Once
+	return d.closing, func() { once.Do(d.wg.Done) }
+}
+
+// close notifies the tracked connections that the server is shutting down. It is safe to call more than once.
+func (d *drainer) close() {
+	d.once.Do(func() { close(d.closing) })
+}
+
+// wait blocks until the tracked connections are closed or the context is done.
+func (d *drainer) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// writeSSEClose writes a close event to the Server-Sent Events stream and flushes it.
+// The retry field hints clients to reconnect after the delay, which EventSource does on its own.
+func writeSSEClose(w http.ResponseWriter, retry time.Duration) error {
+	if _, err := fmt.Fprintf(w, "event: close\nretry: %d\ndata: server shutting down\n\n", retry.Milliseconds()); err != nil {
+		return err
+	}
+	return http.NewResponseController(w).Flush()
+}
+
+// websocketCloseFrame returns an unmasked WebSocket close frame sent by servers, as defined by RFC 6455.
+// Use code 1012 (service restart) during shutdown to hint clients to reconnect.
+// The reason is truncated to fit the 125 bytes limit of control frames.
+func websocketCloseFrame(code uint16, reason string) []byte {
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	frame := []byte{0x88, byte(2 + len(reason))} // FIN and close opcode, payload length
+	frame = binary.BigEndian.AppendUint16(frame, code)
+	return append(frame, reason...)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestDrainer tests that long-lived connections are notified on shutdown and waited for.
+func TestDrainer(t *testing.T) {
+	drain := newDrainer()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		closing, done := drain.track()
+		defer done()
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(200)
+		http.NewResponseController(w).Flush()
+		<-closing
+		testNil(t, writeSSEClose(w, time.Second))
+	}))
+	defer server.Close()
+
+	res, err := http.Get(server.URL)
+	testNil(t, err)
+	defer res.Body.Close()
+	drain.close()
+	drain.close()
+	body, err := io.ReadAll(res.Body)
+	testNil(t, err)
+	testEqual(t, "event: close\nretry: 1000\ndata: server shutting down\n\n", string(body))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	testNil(t, drain.wait(ctx))
+
+	_, done := drain.track()
+	defer done()
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	testEqual(t, context.DeadlineExceeded, drain.wait(ctx))
+
+	testEqual(t, string([]byte{0x88, 4, 0x03, 0xf4, 'b', 'y'}), string(websocketCloseFrame(1012, "by")))
+}
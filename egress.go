@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// errEgressDenied is returned by the client of [newClient] when the destination is denied by the [egressPolicy].
+var errEgressDenied = errors.New("egress denied")
+
+// blockedNetworks are the networks outbound requests are never sent to, since they host cloud metadata services
+// handing out credentials, such as 169.254.169.254, and link-local services that are never meant to be called.
+var blockedNetworks = []netip.Prefix{
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("fd00:ec2::254/128"),
+	netip.MustParsePrefix("100.100.100.200/32"),
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("::/128"),
+}
+
+// egressPolicy restricts the destinations of outbound requests, protecting against SSRF
+// when handlers fetch user-supplied URLs. It is set by the repeatable -egress-allow flag.
+//
+// Destinations in [blockedNetworks] are always denied. If the policy allows nothing, every other destination is allowed.
+// Otherwise a destination is only allowed if its host matches one of the hosts, such as "api.example.com"
+// or "*.example.com" for its subdomains, or if every address it resolves to is in one of the networks.
+// The addresses are checked when connecting, so DNS answers changing between the check and the connection cannot
+// sneak a request through. With a proxy set by HTTPS_PROXY, the proxy itself must be allowed.
+type egressPolicy struct {
+	hosts      []string
+	networks   []netip.Prefix
+	publicOnly bool // denies private, loopback, and other non-public addresses unless they are in networks, see [fetcher]
+}
+
+// add adds the host, *.domain, or network in CIDR notation to the policy.
+func (p *egressPolicy) add(s string) error {
+	if prefix, err := netip.ParsePrefix(s); err == nil {
+		p.networks = append(p.networks, prefix)
+		return nil
+	}
+	if s == "" || strings.ContainsAny(s, "/: ") {
+		return fmt.Errorf("must be a host, *.domain, or network in CIDR notation, got %q", s)
+	}
+	p.hosts = append(p.hosts, strings.ToLower(s))
+	return nil
+}
+
+// allowsHost reports whether the host is allowed by name, regardless of its addresses.
+func (p egressPolicy) allowsHost(host string) bool {
+	if len(p.hosts) == 0 && len(p.networks) == 0 {
+		return true
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, h := range p.hosts {
+		if suffix, ok := strings.CutPrefix(h, "*"); (ok && strings.HasSuffix(host, suffix)) || h == host {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsAddr reports whether the address is allowed, given whether its host is allowed by name.
+func (p egressPolicy) allowsAddr(addr netip.Addr, hostAllowed bool) bool {
+	addr = addr.Unmap()
+	for _, prefix := range blockedNetworks {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	for _, prefix := range p.networks {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	if p.publicOnly && !isPublic(addr) {
+		return false
+	}
+	return hostAllowed
+}
+
+// sharedNetwork is the shared address space of carrier-grade NAT, which is not public but not reported by [netip.Addr.IsPrivate].
+var sharedNetwork = netip.MustParsePrefix("100.64.0.0/10")
+
+// isPublic reports whether the address is a public unicast address reachable over the internet.
+func isPublic(addr netip.Addr) bool {
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !sharedNetwork.Contains(addr)
+}
+
+// dialContext returns a dial function for [http.Transport] that resolves the host of the address
+// and connects to the first address allowed by the policy, failing with [errEgressDenied] if any address is denied.
+func (p egressPolicy) dialContext(dialer *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		hostAllowed := p.allowsHost(host)
+		addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			// NOTE: every address must be allowed, since a denied one could be picked by a retry or another client
+			if !p.allowsAddr(addr, hostAllowed) {
+				return nil, fmt.Errorf("%w: %s resolves to %s", errEgressDenied, host, addr)
+			}
+		}
+		var errs []error
+		for _, addr := range addrs {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(addr.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			errs = append(errs, err)
+		}
+		return nil, errors.Join(errs...)
+	}
+}
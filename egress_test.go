@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// TestEgressPolicy tests that destinations are allowed by host or network, and metadata addresses never are.
+func TestEgressPolicy(t *testing.T) {
+	var p egressPolicy
+	testEqual(t, true, p.allowsHost("example.com"))
+	testEqual(t, true, p.allowsAddr(netip.MustParseAddr("10.0.0.1"), true))
+	testEqual(t, false, p.allowsAddr(netip.MustParseAddr("169.254.169.254"), true))
+	testEqual(t, false, p.allowsAddr(netip.MustParseAddr("::ffff:169.254.169.254"), true))
+
+	testNil(t, p.add("api.example.com"))
+	testNil(t, p.add("*.internal.example.com"))
+	testNil(t, p.add("10.0.0.0/8"))
+	testEqual(t, true, p.add("http://example.com") != nil)
+	testEqual(t, true, p.allowsHost("API.example.com."))
+	testEqual(t, true, p.allowsHost("users.internal.example.com"))
+	testEqual(t, false, p.allowsHost("internal.example.com.evil.com"))
+	testEqual(t, false, p.allowsHost("example.com"))
+	testEqual(t, true, p.allowsAddr(netip.MustParseAddr("10.1.2.3"), false))
+	testEqual(t, false, p.allowsAddr(netip.MustParseAddr("192.168.0.1"), false))
+}
+
+// TestEgressClient tests that the client refuses to connect to denied destinations.
+func TestEgressClient(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	var p egressPolicy
+	testNil(t, p.add("api.example.com"))
+	_, err := newClient(log, "", time.Second, chaosConfig{}, nil, nil, p).Get(upstream.URL)
+	testEqual(t, true, errors.Is(err, errEgressDenied))
+
+	testNil(t, p.add("127.0.0.0/8"))
+	res, err := newClient(log, "", time.Second, chaosConfig{}, nil, nil, p).Get(upstream.URL)
+	testNil(t, err)
+	res.Body.Close()
+	testEqual(t, http.StatusOK, res.StatusCode)
+
+	_, err = newClient(log, "", time.Second, chaosConfig{}, nil, nil, egressPolicy{}).Get("http://169.254.169.254/latest/meta-data/")
+	testEqual(t, true, errors.Is(err, errEgressDenied))
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// keyring encrypts data with AES-GCM under its current key and decrypts data under any of its keys,
+// so that keys can be rotated without losing the data encrypted under the previous ones.
+// The ID of the key is embedded in the ciphertext, which is laid out as:
+//
+//	len(id) | id | nonce | sealed data
+//
+// To rotate, put a new key first in -encryption-keys and keep the previous ones after it until their data is gone,
+// such as when cookies expire or the store is re-encrypted.
+type keyring struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// errDecrypt is returned when the data was not encrypted by the keyring or was tampered with.
+var errDecrypt = errors.New("cannot decrypt")
+
+// parseKeyring parses the keys of a [keyring] in the form "id:base64key,...", the first of which encrypts.
+// Keys must be 16, 24, or 32 bytes long for AES-128, AES-192, or AES-256, such as generated by "openssl rand -base64 32".
+func parseKeyring(s string) (*keyring, error) {
+	kr := &keyring{keys: map[string]cipher.AEAD{}}
+	for _, entry := range strings.Split(s, ",") {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || id == "" || len(id) > 255 {
+			return nil, fmt.Errorf("key %q must be in the form id:base64key", entry)
+		}
+		if _, ok := kr.keys[id]; ok {
+			return nil, fmt.Errorf("key %q is duplicated", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+		kr.keys[id] = aead
+		if kr.current == "" {
+			kr.current = id
+		}
+	}
+	return kr, nil
+}
+
+// encrypt encrypts the plaintext under the current key. The additional data is authenticated but not encrypted,
+// such as the name of a cookie or the key of a stored value, so that ciphertexts cannot be swapped between them.
+func (kr *keyring) encrypt(plaintext, additional []byte) ([]byte, error) {
+	aead := kr.keys[kr.current]
+	out := make([]byte, 0, 1+len(kr.current)+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	out = append(out, byte(len(kr.current)))
+	out = append(out, kr.current...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, plaintext, additional), nil
+}
+
+// decrypt decrypts the ciphertext of [keyring.encrypt] under the key it was encrypted with,
+// returning [errDecrypt] if the key is unknown or the ciphertext or additional data do not match.
+func (kr *keyring) decrypt(ciphertext, additional []byte) ([]byte, error) {
+	if len(ciphertext) < 1 || len(ciphertext) < 1+int(ciphertext[0]) {
+		return nil, errDecrypt
+	}
+	id := string(ciphertext[1 : 1+ciphertext[0]])
+	aead, ok := kr.keys[id]
+	rest := ciphertext[1+len(id):]
+	if !ok || len(rest) < aead.NonceSize() {
+		return nil, errDecrypt
+	}
+	plaintext, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], additional)
+	if err != nil {
+		return nil, errDecrypt
+	}
+	return plaintext, nil
+}
+
+// setEncryptedCookie sets the cookie with its value encrypted by the keyring, so that clients can neither read nor forge it,
+// such as for sessions. Read it back with [readEncryptedCookie].
+func setEncryptedCookie(w http.ResponseWriter, kr *keyring, cookie *http.Cookie) error {
+	ciphertext, err := kr.encrypt([]byte(cookie.Value), []byte(cookie.Name))
+	if err != nil {
+		return err
+	}
+	c := *cookie
+	c.Value = base64.RawURLEncoding.EncodeToString(ciphertext)
+	http.SetCookie(w, &c)
+	return nil
+}
+
+// readEncryptedCookie returns the decrypted value of the cookie set by [setEncryptedCookie],
+// returning [http.ErrNoCookie] if there is none and [errDecrypt] if it was tampered with.
+func readEncryptedCookie(r *http.Request, kr *keyring, name string) (string, error) {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil {
+		return "", errDecrypt
+	}
+	plaintext, err := kr.decrypt(ciphertext, []byte(name))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// encryptedStore is a [store] encrypting the values of the underlying store with the keyring,
+// authenticated with their keys, for persisting sensitive data at rest.
+type encryptedStore struct {
+	store
+	keyring *keyring
+}
+
+// Get implements the [store] interface.
+func (s encryptedStore) Get(ctx context.Context, key string) ([]byte, error) {
+	ciphertext, err := s.store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return s.keyring.decrypt(ciphertext, []byte(key))
+}
+
+// Put implements the [store] interface.
+func (s encryptedStore) Put(ctx context.Context, key string, value []byte) error {
+	ciphertext, err := s.keyring.encrypt(value, []byte(key))
+	if err != nil {
+		return err
+	}
+	return s.store.Put(ctx, key, ciphertext)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// TestKeyring tests that data is decrypted under the key it was encrypted with after rotation.
+func TestKeyring(t *testing.T) {
+	old, err := parseKeyring("k1:MDEyMzQ1Njc4OWFiY2RlZg==")
+	testNil(t, err)
+	ciphertext, err := old.encrypt([]byte("secret"), []byte("session"))
+	testNil(t, err)
+
+	rotated, err := parseKeyring("k2:MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=, k1:MDEyMzQ1Njc4OWFiY2RlZg==")
+	testNil(t, err)
+	plaintext, err := rotated.decrypt(ciphertext, []byte("session"))
+	testNil(t, err)
+	testEqual(t, "secret", string(plaintext))
+	ciphertext, err = rotated.encrypt([]byte("secret"), []byte("session"))
+	testNil(t, err)
+	testEqual(t, "k2", string(ciphertext[1:3]))
+
+	_, err = rotated.decrypt(ciphertext, []byte("other"))
+	testEqual(t, errDecrypt, err)
+	_, err = old.decrypt(ciphertext, []byte("session"))
+	testEqual(t, errDecrypt, err)
+	_, err = old.decrypt([]byte{9}, nil)
+	testEqual(t, errDecrypt, err)
+
+	for _, keys := range []string{"", "k1", "k1:bm90IGEga2V5", "k1:MDEyMzQ1Njc4OWFiY2RlZg==,k1:MDEyMzQ1Njc4OWFiY2RlZg=="} {
+		_, err := parseKeyring(keys)
+		testEqual(t, true, err != nil)
+	}
+}
+
+// TestEncryptedCookie tests that encrypted cookies are read back and tampering is detected.
+func TestEncryptedCookie(t *testing.T) {
+	kr, err := parseKeyring("k1:MDEyMzQ1Njc4OWFiY2RlZg==")
+	testNil(t, err)
+	w := httptest.NewRecorder()
+	testNil(t, setEncryptedCookie(w, kr, &http.Cookie{Name: "session", Value: "user-1", HttpOnly: true}))
+	cookie := w.Result().Cookies()[0]
+	testEqual(t, true, cookie.Value != "user-1")
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(cookie)
+	value, err := readEncryptedCookie(r, kr, "session")
+	testNil(t, err)
+	testEqual(t, "user-1", value)
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: "session", Value: cookie.Value[:len(cookie.Value)-2] + "AA"})
+	_, err = readEncryptedCookie(r, kr, "session")
+	testEqual(t, errDecrypt, err)
+	_, err = readEncryptedCookie(httptest.NewRequest(http.MethodGet, "/", nil), kr, "session")
+	testEqual(t, http.ErrNoCookie, err)
+}
+
+// TestEncryptedStore tests that values are encrypted at rest and bound to their keys.
+func TestEncryptedStore(t *testing.T) {
+	ctx := context.Background()
+	kr, err := parseKeyring("k1:MDEyMzQ1Njc4OWFiY2RlZg==")
+	testNil(t, err)
+	fs, err := newFileStore(filepath.Join(t.TempDir(), "store.json"))
+	testNil(t, err)
+	s := encryptedStore{store: fs, keyring: kr}
+
+	testNil(t, s.Put(ctx, "users/1", []byte("a")))
+	value, err := s.Get(ctx, "users/1")
+	testNil(t, err)
+	testEqual(t, "a", string(value))
+	raw, err := fs.Get(ctx, "users/1")
+	testNil(t, err)
+	testEqual(t, true, string(raw) != "a")
+
+	testNil(t, fs.Put(ctx, "users/2", raw))
+	_, err = s.Get(ctx, "users/2")
+	testEqual(t, errDecrypt, err)
+	_, err = s.Get(ctx, "users/3")
+	testEqual(t, true, errors.Is(err, errNotFound))
+}
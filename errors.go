@@ -0,0 +1,153 @@
+package main
+
+import (
+	"cmp"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// errorWindow is how far back error responses are aggregated by [aggregateErrors].
+const errorWindow = 5 * time.Minute
+
+// errorSamples is the number of the latest request IDs kept for each kind of error response.
+const errorSamples = 3
+
+// errorStats holds the error responses of the last [errorWindow] by status and route, recorded by [aggregateErrors].
+// The zero value is ready to use.
+type errorStats struct {
+	mu         sync.Mutex
+	minutes    []errorMinute // one-minute buckets, oldest first
+	lastSummed time.Time     // when the summary was logged last
+}
+
+// errorMinute is the error responses of a minute, keyed by status and route.
+type errorMinute struct {
+	start  time.Time
+	counts map[errorKey]*errorCount
+}
+
+// errorKey is a kind of error response.
+type errorKey struct {
+	status int
+	route  string
+}
+
+// errorCount is the number of error responses of a kind, with the IDs of the latest requests to look up in the logs.
+type errorCount struct {
+	count      int
+	requestIDs []string
+}
+
+// errorSummary is a kind of error response with its count in the last [errorWindow], served by /debug/errors.
+type errorSummary struct {
+	Status     int      `json:"Status"`
+	Route      string   `json:"Route"`
+	Count      int      `json:"Count"`
+	RequestIDs []string `json:"RequestIDs"`
+}
+
+// aggregateErrors is a middleware that counts error responses with a status of 400 or above by status and route matched in mux,
+// so that the top errors can be seen at /debug/errors without grepping raw logs.
+// The top errors of the last [errorWindow] are also logged at most once per window, as errors keep coming.
+func aggregateErrors(next http.Handler, mux *http.ServeMux, stats *errorStats, log *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		if rec.status < 400 {
+			return
+		}
+
+		_, pattern := mux.Handler(r)
+		if pattern == "" {
+			pattern = "unmatched"
+		}
+		now := time.Now()
+		if stats.record(now, errorKey{status: rec.status, route: pattern}, requestIDFrom(r.Context())) {
+			top := stats.top(now, 5)
+			log.WarnContext(r.Context(), "top errors", slog.String("window", errorWindow.String()), slog.Any("errors", top))
+		}
+	})
+}
+
+// record counts the error response of the request, reporting whether the summary is due to be logged.
+func (s *errorStats) record(now time.Time, key errorKey, requestID string) (summarize bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	start := now.Truncate(time.Minute)
+	if len(s.minutes) == 0 || !s.minutes[len(s.minutes)-1].start.Equal(start) {
+		s.minutes = append(s.minutes, errorMinute{start: start, counts: map[errorKey]*errorCount{}})
+	}
+	s.minutes = slices.DeleteFunc(s.minutes, func(m errorMinute) bool { return now.Sub(m.start) >= errorWindow })
+
+	counts := s.minutes[len(s.minutes)-1].counts
+	c, ok := counts[key]
+	if !ok {
+		c = &errorCount{}
+		counts[key] = c
+	}
+	c.count++
+	if requestID != "" {
+		c.requestIDs = append(c.requestIDs, requestID)
+		c.requestIDs = c.requestIDs[max(len(c.requestIDs)-errorSamples, 0):]
+	}
+
+	if s.lastSummed.IsZero() {
+		// NOTE: the first summary waits for a window of errors, instead of being logged on the first error
+		s.lastSummed = now
+	}
+	if now.Sub(s.lastSummed) < errorWindow {
+		return false
+	}
+	s.lastSummed = now
+	return true
+}
+
+// top returns up to n kinds of error responses of the last [errorWindow] before now, the most frequent first.
+func (s *errorStats) top(now time.Time, n int) []errorSummary {
+	s.mu.Lock()
+	summaries := map[errorKey]*errorSummary{}
+	for _, m := range s.minutes {
+		if now.Sub(m.start) >= errorWindow {
+			continue
+		}
+		for key, c := range m.counts {
+			sum, ok := summaries[key]
+			if !ok {
+				sum = &errorSummary{Status: key.status, Route: key.route}
+				summaries[key] = sum
+			}
+			sum.Count += c.count
+			sum.RequestIDs = append(sum.RequestIDs, c.requestIDs...)
+		}
+	}
+	s.mu.Unlock()
+
+	res := make([]errorSummary, 0, len(summaries))
+	for _, sum := range summaries {
+		sum.RequestIDs = sum.RequestIDs[max(len(sum.RequestIDs)-errorSamples, 0):]
+		res = append(res, *sum)
+	}
+	slices.SortFunc(res, func(a, b errorSummary) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.Route, b.Route), cmp.Compare(a.Status, b.Status))
+	})
+	return res[:min(n, len(res))]
+}
+
+// handleGetErrors returns an [http.HandlerFunc] that responds with the most frequent error responses of the last [errorWindow],
+// with the IDs of their latest requests. The number of errors is limited by the ?n= query parameter, defaulting to 10.
+func handleGetErrors(stats *errorStats) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(r.URL.Query().Get("n"))
+		if err != nil || n <= 0 {
+			n = 10
+		}
+
+		if err := writeBody(w, r, 200, stats.top(time.Now(), n)); err != nil {
+			slog.ErrorContext(r.Context(), "failed to write errors", slog.Any("error", err))
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestAggregateErrors tests that error responses are counted by status and route, the most frequent first.
+func TestAggregateErrors(t *testing.T) {
+	var stats errorStats
+	mux := http.NewServeMux()
+	mux.Handle("GET /users/{id}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeProblem(w, r, http.StatusNotFound, nil)
+	}))
+	mux.Handle("GET /ok", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	handler := aggregateErrors(mux, mux, &stats, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	for i, path := range []string{"/users/1", "/users/2", "/missing", "/users/3", "/users/4", "/ok"} {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		handler.ServeHTTP(httptest.NewRecorder(), r.WithContext(context.WithValue(r.Context(), requestIDKey, "req-"+strconv.Itoa(i))))
+	}
+
+	w := httptest.NewRecorder()
+	handleGetErrors(&stats).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/errors", nil))
+	var body []errorSummary
+	testNil(t, json.NewDecoder(w.Body).Decode(&body))
+	testEqual(t, 2, len(body))
+	testEqual(t, "GET /users/{id}", body[0].Route)
+	testEqual(t, http.StatusNotFound, body[0].Status)
+	testEqual(t, 4, body[0].Count)
+	testEqual(t, "req-1,req-3,req-4", strings.Join(body[0].RequestIDs, ","))
+	testEqual(t, "unmatched", body[1].Route)
+	testEqual(t, 1, body[1].Count)
+
+	testEqual(t, 0, len(stats.top(time.Now().Add(errorWindow), 10)))
+}
+
+// TestErrorStatsSummary tests that the summary is due once per window of errors.
+func TestErrorStatsSummary(t *testing.T) {
+	var stats errorStats
+	now := time.Now()
+	key := errorKey{status: http.StatusInternalServerError, route: "GET /users"}
+	testEqual(t, false, stats.record(now, key, "req-1"))
+	testEqual(t, false, stats.record(now.Add(time.Minute), key, "req-2"))
+	testEqual(t, true, stats.record(now.Add(errorWindow), key, "req-3"))
+	testEqual(t, false, stats.record(now.Add(errorWindow+time.Minute), key, "req-4"))
+}
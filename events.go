@@ -0,0 +1,220 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// eventVars counts published events, the outcomes of their deliveries, and the scaling of the workers, served by /debug/vars.
+var eventVars = expvar.NewMap("events")
+
+// eventScaleUpBacklog is the estimated time to drain the queue of an [eventBus] above which a worker is added.
+const eventScaleUpBacklog = 50 * time.Millisecond
+
+// eventBus is an in-process publish/subscribe bus of typed domain events, so that handlers can emit events
+// such as a user signing up without knowing who reacts to them. Subscribers are registered with [subscribe]
+// and events are published with [publish].
+//
+// Synchronous subscribers run in the goroutine of the publisher and their errors are returned to it.
+// Asynchronous subscribers run on a pool of workers, and are dropped if the queue of the pool is full.
+// Their failed deliveries are redelivered and then dead-lettered, see [eventBus.nack].
+// The pool scales between its minimum and maximum size: a worker is added when the queue would take longer than
+// [eventScaleUpBacklog] to drain at the average latency of the deliveries, and removed after idling without any.
+// Panics of a subscriber are recovered and logged without affecting the other subscribers.
+type eventBus struct {
+	log     *slog.Logger
+	metrics *metrics
+	jobs    chan func()
+	wg      sync.WaitGroup
+
+	minWorkers int
+	maxWorkers int
+	idle       time.Duration
+	workers    atomic.Int64
+	latency    atomic.Int64 // moving average of the deliveries in nanoseconds
+
+	maxDeliveries int // deliveries of an asynchronous subscriber before it is dead-lettered, 1 unless set by -event-max-deliveries
+	deadLetters   deadLetters
+
+	mu          sync.RWMutex
+	subscribers map[reflect.Type][]subscriber
+	closed      bool
+}
+
+// subscriber is a subscriber of events of a type registered by [subscribe].
+type subscriber struct {
+	name   string
+	async  bool
+	handle func(ctx context.Context, event any) error
+}
+
+// newEventBus returns an [eventBus] running asynchronous subscribers on between minWorkers and maxWorkers workers,
+// removing workers above minWorkers after idle, and queueing up to queue deliveries.
+// Call Close to wait for the queued deliveries on shutdown.
+func newEventBus(log *slog.Logger, m *metrics, minWorkers, maxWorkers int, idle time.Duration, queue int) *eventBus {
+	b := &eventBus{
+		log: log, metrics: m, jobs: make(chan func(), queue), subscribers: map[reflect.Type][]subscriber{},
+		minWorkers: minWorkers, maxWorkers: max(minWorkers, maxWorkers), idle: idle, maxDeliveries: 1,
+	}
+	eventVars.Set("workers", expvar.Func(func() any { return b.workers.Load() }))
+	for range minWorkers {
+		b.workers.Add(1)
+		b.wg.Add(1)
+		go b.work()
+	}
+	return b
+}
+
+// work runs queued deliveries until the bus is closed, or until it idles while the pool is above its minimum size.
+func (b *eventBus) work() {
+	defer b.wg.Done()
+	idle := time.NewTimer(b.idle)
+	defer idle.Stop()
+	for {
+		select {
+		case job, ok := <-b.jobs:
+			if !ok {
+				return
+			}
+			start := time.Now()
+			job()
+			// NOTE: weighs the latest delivery by 1/8, like the smoothed RTT of TCP
+			latency := b.latency.Load()
+			b.latency.Store(latency + (time.Since(start).Nanoseconds()-latency)/8)
+			if !idle.Stop() {
+				select {
+				case <-idle.C:
+				default:
+				}
+			}
+			idle.Reset(b.idle)
+		case <-idle.C:
+			if workers := b.workers.Load(); workers > int64(b.minWorkers) && b.workers.CompareAndSwap(workers, workers-1) {
+				eventVars.Add("scale_downs", 1)
+				b.log.Info("event workers scaled", slog.Int64("from", workers), slog.Int64("to", workers-1), slog.String("reason", "idle"))
+				return
+			}
+			idle.Reset(b.idle)
+		}
+	}
+}
+
+// scale adds a worker if the queue would take longer than [eventScaleUpBacklog] to drain and the pool is below its maximum size.
+// It is called by [eventBus.enqueue] with the read lock held, so that no worker is added after Close.
+func (b *eventBus) scale() {
+	workers := b.workers.Load()
+	depth := len(b.jobs)
+	backlog := time.Duration(depth) * cmp.Or(time.Duration(b.latency.Load()), time.Millisecond) / time.Duration(max(workers, 1))
+	if workers >= int64(b.maxWorkers) || backlog <= eventScaleUpBacklog || !b.workers.CompareAndSwap(workers, workers+1) {
+		return
+	}
+	eventVars.Add("scale_ups", 1)
+	b.log.Info("event workers scaled", slog.Int64("from", workers), slog.Int64("to", workers+1), slog.String("reason", "backlog"),
+		slog.Int("queue", depth), slog.Duration("backlog", backlog))
+	b.wg.Add(1)
+	go b.work()
+}
+
+// Close stops accepting asynchronous deliveries and waits for the queued ones to be handled.
+func (b *eventBus) Close() {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.jobs)
+	}
+	b.mu.Unlock()
+	b.wg.Wait()
+}
+
+// subscribe registers handle to be called with every event of type E published to the bus.
+// The name identifies the subscriber in logs and metrics. If async is set, handle runs on the workers of the bus
+// with a context that is not canceled with the request, and its errors are logged and redelivered instead of returned,
+// so it acknowledges the event by returning nil, and rejects it as permanently failed with [errPoisonEvent].
+//
+//	type userSignedUp struct{ ID string }
+//	subscribe(bus, "welcome-email", true, func(ctx context.Context, e userSignedUp) error { ... })
+func subscribe[E any](b *eventBus, name string, async bool, handle func(context.Context, E) error) {
+	t := reflect.TypeFor[E]()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers[t] = append(b.subscribers[t], subscriber{
+		name:  name,
+		async: async,
+		handle: func(ctx context.Context, event any) error {
+			return handle(ctx, event.(E))
+		},
+	})
+}
+
+// publish delivers the event to the subscribers of its type, returning the errors of the synchronous subscribers.
+func publish[E any](ctx context.Context, b *eventBus, event E) error {
+	t := reflect.TypeFor[E]()
+	eventVars.Add("published", 1)
+	b.mu.RLock()
+	subscribers := b.subscribers[t]
+	b.mu.RUnlock()
+
+	var errs []error
+	for _, s := range subscribers {
+		if !s.async {
+			if err := b.deliver(ctx, t, s, event); err != nil {
+				errs = append(errs, fmt.Errorf("subscriber %s: %w", s.name, err))
+			}
+			continue
+		}
+		if !b.enqueue(context.WithoutCancel(ctx), t, s, event, 1) {
+			eventVars.Add("dropped", 1)
+			b.log.WarnContext(ctx, "event dropped", slog.String("event", t.String()), slog.String("subscriber", s.name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// enqueue queues the delivery of the event to the asynchronous subscriber as the nth of its deliveries,
+// reporting false if the queue is full or the bus is closed.
+func (b *eventBus) enqueue(ctx context.Context, t reflect.Type, s subscriber, event any, deliveries int) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return false
+	}
+	select {
+	case b.jobs <- func() {
+		if err := b.deliver(ctx, t, s, event); err != nil {
+			b.nack(ctx, t, s, event, deliveries, err)
+		}
+	}:
+		b.scale()
+		return true
+	default:
+		return false
+	}
+}
+
+// deliver calls the subscriber with the event, recovering its panic as an error and recording the outcome.
+func (b *eventBus) deliver(ctx context.Context, t reflect.Type, s subscriber, event any) (err error) {
+	start := time.Now()
+	defer func() {
+		if v := recover(); v != nil {
+			eventVars.Add("panicked", 1)
+			err = fmt.Errorf("panic: %v", v)
+		}
+		if err != nil {
+			eventVars.Add("failed", 1)
+		} else {
+			eventVars.Add("delivered", 1)
+		}
+		tc, _ := traceFrom(ctx)
+		b.metrics.observe("event_subscriber_duration_seconds", "Duration of event subscribers.", durationBuckets,
+			time.Since(start).Seconds(), tc, "event", t.String(), "subscriber", s.name)
+	}()
+	return s.handle(ctx, event)
+}
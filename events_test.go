@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestEventBus tests that events are delivered to the subscribers of their type, isolating panics.
+func TestEventBus(t *testing.T) {
+	type userSignedUp struct{ ID string }
+	type orderPlaced struct{ ID string }
+
+	bus := newEventBus(slog.New(slog.NewTextHandler(io.Discard, nil)), nil, 2, 2, time.Minute, 16)
+	var synced, async atomic.Int64
+	subscribe(bus, "audit", false, func(ctx context.Context, e userSignedUp) error {
+		synced.Add(1)
+		if e.ID == "" {
+			return errors.New("missing ID")
+		}
+		return nil
+	})
+	subscribe(bus, "panicky", false, func(ctx context.Context, e userSignedUp) error {
+		panic("boom")
+	})
+	subscribe(bus, "welcome-email", true, func(ctx context.Context, e userSignedUp) error {
+		async.Add(1)
+		return nil
+	})
+	subscribe(bus, "orders", false, func(ctx context.Context, e orderPlaced) error {
+		t.Error("orders subscriber should not receive users")
+		return nil
+	})
+
+	err := publish(context.Background(), bus, userSignedUp{ID: "42"})
+	testContains(t, "subscriber panicky: panic: boom", err.Error())
+	err = publish(context.Background(), bus, userSignedUp{})
+	testContains(t, "subscriber audit: missing ID", err.Error())
+	bus.Close()
+	testEqual(t, int64(2), synced.Load())
+	testEqual(t, int64(2), async.Load())
+
+	_ = publish(context.Background(), bus, userSignedUp{ID: "43"}) // dropped for async subscribers after Close
+	testEqual(t, int64(3), synced.Load())
+	testEqual(t, int64(2), async.Load())
+}
+
+// TestEventBusScaling tests that the workers scale up with the backlog of the queue and down when idle.
+func TestEventBusScaling(t *testing.T) {
+	type reportRequested struct{}
+
+	bus := newEventBus(slog.New(slog.NewTextHandler(io.Discard, nil)), nil, 1, 4, 10*time.Millisecond, 256)
+	release := make(chan struct{})
+	var running atomic.Int64
+	subscribe(bus, "report", true, func(ctx context.Context, e reportRequested) error {
+		running.Add(1)
+		<-release
+		return nil
+	})
+
+	// NOTE: without any delivery completed, the latency is assumed to be 1ms, so the 4th worker is added above 150 queued
+	for range 256 {
+		_ = publish(context.Background(), bus, reportRequested{})
+	}
+	testEqual(t, int64(4), bus.workers.Load())
+	for running.Load() < 4 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	for bus.workers.Load() > 1 {
+		time.Sleep(time.Millisecond)
+	}
+	testEqual(t, "1", eventVars.Get("workers").String())
+	bus.Close()
+	testEqual(t, int64(256), running.Load())
+}
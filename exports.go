@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// exportJobs runs long-running exports in the background with the asynchronous request, poll, and download pattern,
+// so that clients are not held on a request for minutes and proxies do not time out:
+//
+//	POST /exports                 starts a job, responding with 202 and its URL in the Location header
+//	GET  /exports/{id}            responds with the status of the job, and its download URL once succeeded
+//	GET  /exports/{id}/download   streams the result of the succeeded job
+//
+// [route] registers the handlers with [exportStore] when -store is set, requiring the "exports" scope.
+// Register them with another function writing the export, for example:
+//
+//	jobs := newExportJobs(os.TempDir(), func(ctx context.Context, r *http.Request, w io.Writer) error {
+//		return json.NewEncoder(w).Encode(users)
+//	})
+//	defer jobs.Close()
+//	mux.Handle("POST /exports", handlePostExport(jobs))
+//	mux.Handle("GET /exports/{id}", handleGetExport(jobs))
+//	mux.Handle("GET /exports/{id}/download", handleGetExportDownload(jobs, cfg.stream, m))
+//
+// Jobs run in goroutines and their results are written to files in a local directory,
+// so they are lost on restart. Replace them with a job queue and blob storage when those are needed.
+// At most maxJobs are kept, and finished jobs expire with their results after retention,
+// so that clients polling too late are responded with 404 and clients starting too many with 503.
+type exportJobs struct {
+	dir       string
+	export    exportFunc
+	maxJobs   int
+	retention time.Duration
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+
+	mu   sync.Mutex
+	jobs map[string]*exportJob
+}
+
+// errTooManyExports is returned by [exportJobs.start] when maxJobs are already kept.
+var errTooManyExports = errors.New("too many exports")
+
+// exportFunc writes the export requested by r to w, such as filtered by its query parameters.
+// The body of the request is not available, since the export runs after the response of the request.
+type exportFunc func(ctx context.Context, r *http.Request, w io.Writer) error
+
+// exportJob is the state of a job of [exportJobs].
+type exportJob struct {
+	id       string
+	status   string // pending, running, succeeded, or failed
+	err      error
+	created  time.Time
+	finished time.Time
+}
+
+// newExportJobs returns an [exportJobs] writing the results of export to files in dir,
+// keeping at most 100 jobs whose results expire an hour after they finish.
+// Call Close to cancel the running jobs on shutdown.
+func newExportJobs(dir string, export exportFunc) *exportJobs {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &exportJobs{dir: dir, export: export, maxJobs: 100, retention: time.Hour, ctx: ctx, cancel: cancel, jobs: map[string]*exportJob{}}
+}
+
+// Close cancels the running jobs, waits for them to return, and removes the results of every job.
+func (j *exportJobs) Close() {
+	j.cancel()
+	j.wg.Wait()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for id := range j.jobs {
+		os.Remove(j.path(id))
+	}
+}
+
+// path returns the path of the file holding the result of the job.
+func (j *exportJobs) path(id string) string {
+	return filepath.Join(j.dir, "export-"+id)
+}
+
+// start starts a job exporting the request in the background, returning its ID,
+// or [errTooManyExports] if maxJobs are kept after the expired ones are removed.
+func (j *exportJobs) start(r *http.Request) (string, error) {
+	job := &exportJob{id: newRequestID(), status: "pending", created: time.Now()}
+	j.mu.Lock()
+	j.expire(job.created)
+	if len(j.jobs) >= j.maxJobs {
+		j.mu.Unlock()
+		return "", errTooManyExports
+	}
+	j.jobs[job.id] = job
+	j.mu.Unlock()
+
+	// NOTE: the request is cloned with the context of the jobs, since the original is done once the handler returns
+	r = r.Clone(j.ctx)
+	r.Body = http.NoBody
+	j.wg.Add(1)
+	go func() {
+		defer j.wg.Done()
+		j.update(job.id, "running", nil)
+		err := j.write(r, job.id)
+		if err != nil {
+			slog.ErrorContext(j.ctx, "export failed", slog.String("job", job.id), slog.Any("error", err))
+			j.update(job.id, "failed", err)
+			return
+		}
+		j.update(job.id, "succeeded", nil)
+	}()
+	return job.id, nil
+}
+
+// expire removes the jobs finished longer than retention before now, along with their results.
+// The caller must hold j.mu.
+func (j *exportJobs) expire(now time.Time) {
+	for id, job := range j.jobs {
+		if !job.finished.IsZero() && now.Sub(job.finished) > j.retention {
+			os.Remove(j.path(id))
+			delete(j.jobs, id)
+		}
+	}
+}
+
+// write writes the export to the file of the job, removing it if the export fails.
+func (j *exportJobs) write(r *http.Request, id string) (err error) {
+	f, err := os.Create(j.path(id))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+	return j.export(r.Context(), r, f)
+}
+
+// update sets the status of the job.
+func (j *exportJobs) update(id, status string, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	job := j.jobs[id]
+	job.status, job.err = status, err
+	if status == "succeeded" || status == "failed" {
+		job.finished = time.Now()
+	}
+}
+
+// get returns a copy of the job, reporting false if there is none or it has expired.
+func (j *exportJobs) get(id string) (exportJob, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.expire(time.Now())
+	job, ok := j.jobs[id]
+	if !ok {
+		return exportJob{}, false
+	}
+	return *job, true
+}
+
+// handlePostExport returns an [http.HandlerFunc] that starts an export job, responding with 202 and its URL,
+// or with 503 and the Retry-After header if too many jobs are kept.
+func handlePostExport(jobs *exportJobs) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := jobs.start(r)
+		if err != nil {
+			w.Header().Set("Retry-After", "60")
+			writeProblem(w, r, http.StatusServiceUnavailable, err)
+			return
+		}
+		job, _ := jobs.get(id)
+		w.Header().Set("Location", "/exports/"+id)
+		writeExportJob(w, r, http.StatusAccepted, job)
+	}
+}
+
+// handleGetExport returns an [http.HandlerFunc] that responds with the status of the export job.
+// Unfinished jobs are responded with the Retry-After header, hinting clients when to poll again.
+func handleGetExport(jobs *exportJobs) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, ok := jobs.get(r.PathValue("id"))
+		if !ok {
+			writeProblem(w, r, http.StatusNotFound, fmt.Errorf("export %q not found", r.PathValue("id")))
+			return
+		}
+		if job.finished.IsZero() {
+			w.Header().Set("Retry-After", "1")
+		}
+		writeExportJob(w, r, http.StatusOK, job)
+	}
+}
+
+// handleGetExportDownload returns an [http.HandlerFunc] that streams the result of the succeeded export job, see [stream].
+func handleGetExportDownload(jobs *exportJobs, cfg streamConfig, m *metrics) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, ok := jobs.get(r.PathValue("id"))
+		if !ok {
+			writeProblem(w, r, http.StatusNotFound, fmt.Errorf("export %q not found", r.PathValue("id")))
+			return
+		}
+		if job.status != "succeeded" {
+			writeProblem(w, r, http.StatusConflict, fmt.Errorf("export %q is %s, not ready to download", job.id, job.status))
+			return
+		}
+		f, err := os.Open(jobs.path(job.id))
+		if err != nil {
+			writeProblem(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		defer f.Close()
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "export-"+job.id))
+		if _, err := stream(w, r, f, cfg, m); err != nil {
+			slog.WarnContext(r.Context(), "export download aborted", slog.String("job", job.id), slog.Any("error", err))
+		}
+	}
+}
+
+// writeExportJob writes the status of the job as JSON.
+func writeExportJob(w http.ResponseWriter, r *http.Request, status int, job exportJob) {
+	type responseBody struct {
+		ID          string     `json:"ID"`
+		Status      string     `json:"Status"`
+		Error       string     `json:"Error,omitempty"`
+		Created     time.Time  `json:"Created"`
+		Finished    *time.Time `json:"Finished,omitempty"`
+		DownloadURL string     `json:"DownloadURL,omitempty"`
+	}
+
+	res := responseBody{ID: job.id, Status: job.status, Created: job.created}
+	if !job.finished.IsZero() {
+		res.Finished = &job.finished
+	}
+	if job.status == "succeeded" {
+		res.DownloadURL = "/exports/" + job.id + "/download"
+	}
+	if verbose, _ := r.Context().Value(verboseErrorsKey).(bool); job.err != nil && verbose {
+		res.Error = job.err.Error()
+	}
+	if err := writeBody(w, r, status, res); err != nil {
+		slog.ErrorContext(r.Context(), "failed to write export", slog.Any("error", err))
+	}
+}
+
+// exportStore returns an [exportFunc] writing the keys of st with the prefix query parameter and their values,
+// as a JSON object per line.
+func exportStore(st store) exportFunc {
+	return func(ctx context.Context, r *http.Request, w io.Writer) error {
+		keys, err := st.List(ctx, r.URL.Query().Get("prefix"))
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(w)
+		for _, key := range keys {
+			value, err := st.Get(ctx, key)
+			if errors.Is(err, errNotFound) {
+				continue // deleted since listed
+			}
+			if err != nil {
+				return err
+			}
+			if err := enc.Encode(struct {
+				Key   string
+				Value []byte
+			}{key, value}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
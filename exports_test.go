@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestExportJobs tests that an export is started, polled until it succeeds, and downloaded.
+func TestExportJobs(t *testing.T) {
+	type response struct {
+		ID          string `json:"ID"`
+		Status      string `json:"Status"`
+		DownloadURL string `json:"DownloadURL"`
+	}
+
+	jobs := newExportJobs(t.TempDir(), func(ctx context.Context, r *http.Request, w io.Writer) error {
+		if r.URL.Query().Get("fail") != "" {
+			return errors.New("export failed")
+		}
+		_, err := fmt.Fprintf(w, "id,name\n1,%s\n", r.URL.Query().Get("name"))
+		return err
+	})
+	defer jobs.Close()
+	mux := http.NewServeMux()
+	mux.Handle("POST /exports", handlePostExport(jobs))
+	mux.Handle("GET /exports/{id}", handleGetExport(jobs))
+	mux.Handle("GET /exports/{id}/download", handleGetExportDownload(jobs, streamConfig{}, nil))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	poll := func(query string) response {
+		res, err := http.Post(server.URL+"/exports?"+query, "", nil)
+		testNil(t, err)
+		res.Body.Close()
+		testEqual(t, http.StatusAccepted, res.StatusCode)
+		location := res.Header.Get("Location")
+
+		var body response
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			res, err = http.Get(server.URL + location)
+			testNil(t, err)
+			testNil(t, json.NewDecoder(res.Body).Decode(&body))
+			res.Body.Close()
+			if body.Status == "succeeded" || body.Status == "failed" {
+				break
+			}
+		}
+		return body
+	}
+
+	body := poll("name=gopher")
+	testEqual(t, "succeeded", body.Status)
+	res, err := http.Get(server.URL + body.DownloadURL)
+	testNil(t, err)
+	defer res.Body.Close()
+	testEqual(t, http.StatusOK, res.StatusCode)
+	b, err := io.ReadAll(res.Body)
+	testNil(t, err)
+	testEqual(t, "id,name\n1,gopher\n", string(b))
+
+	body = poll("fail=true")
+	testEqual(t, "failed", body.Status)
+	res, err = http.Get(server.URL + "/exports/" + body.ID + "/download")
+	testNil(t, err)
+	res.Body.Close()
+	testEqual(t, http.StatusConflict, res.StatusCode)
+
+	res, err = http.Get(server.URL + "/exports/unknown")
+	testNil(t, err)
+	res.Body.Close()
+	testEqual(t, http.StatusNotFound, res.StatusCode)
+
+	// finished jobs expire with their results, freeing room for new ones
+	jobs.mu.Lock()
+	jobs.maxJobs, jobs.retention = 2, 0
+	jobs.mu.Unlock()
+	time.Sleep(time.Millisecond)
+	res, err = http.Get(server.URL + "/exports/" + body.ID)
+	testNil(t, err)
+	res.Body.Close()
+	testEqual(t, http.StatusNotFound, res.StatusCode)
+
+	// jobs beyond the cap are rejected until others expire
+	jobs.mu.Lock()
+	jobs.retention = time.Hour
+	jobs.mu.Unlock()
+	for range jobs.maxJobs {
+		poll("name=gopher")
+	}
+	res, err = http.Post(server.URL+"/exports", "", nil)
+	testNil(t, err)
+	res.Body.Close()
+	testEqual(t, http.StatusServiceUnavailable, res.StatusCode)
+	testEqual(t, "60", res.Header.Get("Retry-After"))
+}
+
+// TestExportRoutes tests that the routes export the store to principals granted the exports scope.
+func TestExportRoutes(t *testing.T) {
+	t.Cleanup(func() {
+		for _, pattern := range []string{"POST /exports", "GET /exports/{id}", "GET /exports/{id}/download"} {
+			routes.Delete(pattern)
+		}
+	})
+	st, err := newFileStore(filepath.Join(t.TempDir(), "store.json"))
+	testNil(t, err)
+	testNil(t, st.Put(context.Background(), "users/1", []byte("gopher")))
+	testNil(t, st.Put(context.Background(), "orders/1", []byte("order")))
+	jobs := newExportJobs(t.TempDir(), exportStore(st))
+	defer jobs.Close()
+	cfg, err := parseConfig(io.Discard, []string{"test", "-auth", "apikey", "-api-keys", "ops:key1,dev:key2", "-grant", "ops=exports"})
+	testNil(t, err)
+	var ready atomic.Bool
+	ready.Store(true)
+	server := httptest.NewServer(route(routeDeps{log: slog.New(slog.NewTextHandler(io.Discard, nil)), version: version, cfg: cfg, ready: &ready, admin: &adminState{}, store: st, backups: st, exports: jobs}))
+	defer server.Close()
+
+	send := func(method, path, key string) *http.Response {
+		req, err := http.NewRequest(method, server.URL+path, nil)
+		testNil(t, err)
+		req.Header.Set("X-API-Key", key)
+		res, err := http.DefaultClient.Do(req)
+		testNil(t, err)
+		t.Cleanup(func() { res.Body.Close() })
+		return res
+	}
+
+	testEqual(t, http.StatusForbidden, send(http.MethodPost, "/exports", "key2").StatusCode)
+	res := send(http.MethodPost, "/exports?prefix=users/", "key1")
+	testEqual(t, http.StatusAccepted, res.StatusCode)
+	location := res.Header.Get("Location")
+
+	var body struct{ Status, DownloadURL string }
+	for deadline := time.Now().Add(time.Second); body.Status != "succeeded" && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		testNil(t, json.NewDecoder(send(http.MethodGet, location, "key1").Body).Decode(&body))
+	}
+	testEqual(t, "succeeded", body.Status)
+	res = send(http.MethodGet, body.DownloadURL, "key1")
+	testEqual(t, http.StatusOK, res.StatusCode)
+	b, err := io.ReadAll(res.Body)
+	testNil(t, err)
+	testEqual(t, `{"Key":"users/1","Value":"Z29waGVy"}`, strings.TrimSpace(string(b)))
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+)
+
+// feature is an optional subsystem compiled into the binary unless it is excluded by its build tag,
+// so that minimal binaries can be built with only the features they use, such as:
+//
+//	go build -tags nopprof .
+//
+// Each feature lives in its own file behind a build constraint such as //go:build !nopprof,
+// and registers itself with [registerFeature] in an init function, so that no other file refers to it.
+// Put new optional subsystems such as database or cache clients behind build tags the same way.
+type feature struct {
+	name  string
+	debug func(mux *http.ServeMux) // registers the debug routes of the feature, nil if it has none
+}
+
+// features holds every feature compiled into the binary. It is only written by init functions, so it needs no lock.
+var features []feature
+
+// registerFeature registers the feature compiled into the binary, called by an init function of its file.
+func registerFeature(f feature) {
+	features = append(features, f)
+}
+
+// featureNames returns the sorted names of the features compiled into the binary, reported by /health.
+func featureNames() []string {
+	names := make([]string, 0, len(features))
+	for _, f := range features {
+		names = append(names, f.name)
+	}
+	slices.Sort(names)
+	return names
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// fixture is a seed data file of testdata/fixtures in JSON, so that values keep their types and nesting exactly.
+// Its data maps store keys to values stored as JSON, after the comma-separated fixtures it requires.
+type fixture struct {
+	Requires string                     `json:"requires"`
+	Data     map[string]json.RawMessage `json:"data"`
+}
+
+// loadFixtures seeds the store with the fixtures of the names in testdata/fixtures, loading the fixtures
+// they require first and each fixture once, and rolls the store back when the test ends, see [rollbackStore].
+//
+//	st := newTestStore(t)
+//	loadFixtures(t, st, "orders") // also loads users, required by orders
+func loadFixtures(t testing.TB, st store, names ...string) {
+	t.Helper()
+	rollbackStore(t, st)
+	loaded := map[string]bool{}
+	var load func(name string, loading []string)
+	load = func(name string, loading []string) {
+		t.Helper()
+		if loaded[name] {
+			return
+		}
+		for _, n := range loading {
+			if n == name {
+				t.Fatalf("fixture %s requires itself through %s", name, strings.Join(loading, " -> "))
+			}
+		}
+		f, err := readFixture(name)
+		if err != nil {
+			t.Fatalf("fixture %s: %v", name, err)
+		}
+		for _, required := range strings.Split(f.Requires, ",") {
+			if required = strings.TrimSpace(required); required != "" {
+				load(required, append(loading, name))
+			}
+		}
+		for key, value := range f.Data {
+			if err := st.Put(context.Background(), key, value); err != nil {
+				t.Fatalf("fixture %s: %s: %v", name, key, err)
+			}
+		}
+		loaded[name] = true
+	}
+	for _, name := range names {
+		load(name, nil)
+	}
+}
+
+// readFixture reads the fixture of the name from testdata/fixtures/<name>.json.
+func readFixture(name string) (fixture, error) {
+	var f fixture
+	b, err := os.ReadFile(filepath.Join("testdata", "fixtures", name+".json"))
+	if err != nil {
+		return f, err
+	}
+	return f, json.Unmarshal(b, &f)
+}
+
+// rollbackStore restores the store to its current data when the test ends, removing the keys written by the test
+// and restoring the ones it changed or deleted, so that tests sharing a store, such as a database, stay independent.
+func rollbackStore(t testing.TB, st store) {
+	t.Helper()
+	ctx := context.Background()
+	keys, err := st.List(ctx, "")
+	if err != nil {
+		t.Fatalf("snapshot store: %v", err)
+	}
+	snapshot := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		if snapshot[key], err = st.Get(ctx, key); err != nil {
+			t.Fatalf("snapshot store: %s: %v", key, err)
+		}
+	}
+	t.Cleanup(func() {
+		keys, err := st.List(ctx, "")
+		if err != nil {
+			t.Errorf("rollback store: %v", err)
+			return
+		}
+		for _, key := range keys {
+			if _, ok := snapshot[key]; !ok {
+				if err := st.Delete(ctx, key); err != nil {
+					t.Errorf("rollback store: %s: %v", key, err)
+				}
+			}
+		}
+		for key, value := range snapshot {
+			if current, err := st.Get(ctx, key); err == nil && bytes.Equal(current, value) {
+				continue
+			}
+			if err := st.Put(ctx, key, value); err != nil {
+				t.Errorf("rollback store: %s: %v", key, err)
+			}
+		}
+	})
+}
+
+// newTestStore returns an empty [fileStore] in a temporary directory of the test.
+func newTestStore(t testing.TB) *fileStore {
+	t.Helper()
+	st, err := newFileStore(filepath.Join(t.TempDir(), "store.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+// factory creates entities of type T with valid defaults for tests, stored as JSON under keys of the prefix
+// numbered in sequence, so that tests only spell out the fields they are about.
+//
+//	var users = &factory[testUser]{prefix: "users/", build: func(n int) testUser { return testUser{Name: fmt.Sprintf("user-%d", n)} }}
+//	key, u := users.create(t, st, func(u *testUser) { u.Plan = "pro" })
+type factory[T any] struct {
+	prefix string
+	build  func(n int) T
+	n      atomic.Int64
+}
+
+// create stores a new entity built with the defaults and changed by the mutations, returning its key and value.
+func (f *factory[T]) create(t testing.TB, st store, mutations ...func(*T)) (string, T) {
+	t.Helper()
+	n := int(f.n.Add(1))
+	v := f.build(n)
+	for _, mutate := range mutations {
+		mutate(&v)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := f.prefix + strconv.Itoa(n)
+	if err := st.Put(context.Background(), key, b); err != nil {
+		t.Fatal(err)
+	}
+	return key, v
+}
+
+// testUser is a user entity of tests, created by [testUsers].
+type testUser struct {
+	Name string `json:"name"`
+	Plan string `json:"plan"`
+}
+
+// testUsers creates [testUser] entities on the free plan.
+var testUsers = &factory[testUser]{prefix: "users/test-", build: func(n int) testUser {
+	return testUser{Name: fmt.Sprintf("user-%d", n), Plan: "free"}
+}}
+
+// TestFixtures tests that fixtures load in the order they require each other and roll back when the test ends.
+func TestFixtures(t *testing.T) {
+	st := newTestStore(t)
+	ctx := context.Background()
+	testNil(t, st.Put(ctx, "users/1", []byte(`{"name":"original"}`)))
+
+	t.Run("load", func(t *testing.T) {
+		loadFixtures(t, st, "orders")
+		b, err := st.Get(ctx, "users/1")
+		testNil(t, err)
+		testEqual(t, `{"name": "Kim", "plan": "pro", "active": true}`, string(b))
+		b, err = st.Get(ctx, "orders/2")
+		testNil(t, err)
+		testEqual(t, `{"user": "users/2", "total": 990}`, string(b))
+
+		key, u := testUsers.create(t, st, func(u *testUser) { u.Plan = "pro" })
+		testEqual(t, "pro", u.Plan)
+		b, err = st.Get(ctx, key)
+		testNil(t, err)
+		testContains(t, `"plan":"pro"`, string(b))
+	})
+
+	keys, err := st.List(ctx, "")
+	testNil(t, err)
+	testEqual(t, "users/1", strings.Join(keys, ","))
+	b, err := st.Get(ctx, "users/1")
+	testNil(t, err)
+	testEqual(t, `{"name":"original"}`, string(b))
+}
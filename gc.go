@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// tuneGC sets the GC percent and the soft memory limit of the runtime, set by the -gc-percent and -memory-limit flags,
+// and logs the values in effect, so that the tuning of latency-sensitive deployments is visible at startup.
+// Zero keeps the value of the GOGC and GOMEMLIMIT environment variables respectively.
+func tuneGC(ctx context.Context, log *slog.Logger, percent int, limit int64) {
+	if percent != 0 {
+		debug.SetGCPercent(percent)
+	}
+	if limit > 0 {
+		debug.SetMemoryLimit(limit)
+	}
+	// NOTE: a negative input does not change the memory limit, while the GC percent can only be read by setting it
+	current := debug.SetGCPercent(-1)
+	debug.SetGCPercent(current)
+	memoryLimit := slog.String("memory_limit", "none")
+	if l := debug.SetMemoryLimit(-1); l != math.MaxInt64 {
+		memoryLimit = slog.String("memory_limit", byteSize(l).String())
+		registerLimit("memory_limit", l, nil)
+	}
+	log.InfoContext(ctx, "gc tuned", slog.Int("gc_percent", current), memoryLimit)
+}
+
+// handlePostFreeOSMemory returns an [http.HandlerFunc] that forces a garbage collection
+// and returns as much memory to the operating system as possible with [debug.FreeOSMemory],
+// responding with the bytes released. It stops the world, so avoid calling it under load.
+func handlePostFreeOSMemory() http.HandlerFunc {
+	type responseBody struct {
+		Released uint64 `json:"Released"`
+		Duration string `json:"Duration"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		start := time.Now()
+		debug.FreeOSMemory()
+		duration := time.Since(start)
+		runtime.ReadMemStats(&after)
+
+		res := responseBody{Duration: duration.String()}
+		if after.HeapReleased > before.HeapReleased {
+			res.Released = after.HeapReleased - before.HeapReleased
+		}
+		if err := writeBody(w, r, http.StatusOK, res); err != nil {
+			slog.ErrorContext(r.Context(), "failed to write free OS memory", slog.Any("error", err))
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"runtime/debug"
+	"testing"
+)
+
+// TestTuneGC tests that the GC percent and the memory limit are set and logged.
+func TestTuneGC(t *testing.T) {
+	percent := debug.SetGCPercent(-1)
+	debug.SetGCPercent(percent)
+	limit := debug.SetMemoryLimit(-1)
+	t.Cleanup(func() {
+		debug.SetGCPercent(percent)
+		debug.SetMemoryLimit(limit)
+	})
+
+	var buf bytes.Buffer
+	tuneGC(context.Background(), slog.New(slog.NewJSONHandler(&buf, nil)), 50, 64<<20)
+	testEqual(t, 50, debug.SetGCPercent(50))
+	testEqual(t, int64(64<<20), debug.SetMemoryLimit(-1))
+	testContains(t, `"gc_percent":50,"memory_limit":"64MiB"`, buf.String())
+
+	buf.Reset()
+	debug.SetMemoryLimit(math.MaxInt64)
+	tuneGC(context.Background(), slog.New(slog.NewJSONHandler(&buf, nil)), 0, 0)
+	testEqual(t, 50, debug.SetGCPercent(50))
+	testContains(t, `"memory_limit":"none"`, buf.String())
+}
+
+// TestHandlePostFreeOSMemory tests that the memory is freed and the released bytes are responded.
+func TestHandlePostFreeOSMemory(t *testing.T) {
+	w := httptest.NewRecorder()
+	handlePostFreeOSMemory().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/debug/free-os-memory", nil))
+	testEqual(t, http.StatusOK, w.Code)
+	testContains(t, `"Released":`, w.Body.String())
+}
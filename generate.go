@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// generate runs the generate subcommand, such as "app generate client", instead of the server.
+// It is called by [run] when the first argument is "generate".
+func generate(ctx context.Context, w io.Writer, args []string, version string) error {
+	if len(args) < 3 || args[2] != "client" {
+		return &exitError{code: exitConfig, err: fmt.Errorf("usage: %s generate client [flags]", filepath.Base(args[0]))}
+	}
+	return generateClient(ctx, w, args[2:], version)
+}
+
+// generateClient generates client SDKs from an embedded OpenAPI document, so that consumers always have an SDK
+// matching the API of the build. The Go client is generated by oapi-codegen, and the TypeScript client by
+// openapi-generator if -typescript is set. They are written to versioned directories such as client/v1.2.0/go,
+// along with the document they were generated from.
+//
+// The generators are run as commands rather than linked, so that the server does not depend on them.
+// The defaults fetch them with go run and npx, and can be replaced by installed binaries with the -*-cmd flags.
+func generateClient(ctx context.Context, w io.Writer, args []string, version string) error {
+	fs := flag.NewFlagSet(args[0], flag.ExitOnError)
+	fs.SetOutput(w)
+	doc := fs.String("doc", "openapi", "name of the embedded OpenAPI document to generate the clients of, see /openapi/")
+	out := fs.String("out", "client", "directory to write the versioned client packages to")
+	pkg := fs.String("package", "client", "package name of the Go client")
+	typescript := fs.Bool("typescript", false, "also generate the TypeScript client")
+	goCmd := fs.String("go-cmd", "go run github.com/oapi-codegen/oapi-codegen/v2/cmd/oapi-codegen@v2.4.1", "command running oapi-codegen")
+	tsCmd := fs.String("typescript-cmd", "npx --yes @openapitools/openapi-generator-cli", "command running openapi-generator")
+	if err := fs.Parse(args[1:]); err != nil {
+		return &exitError{code: exitConfig, err: err}
+	}
+	if version == "" {
+		version = "dev"
+	}
+
+	spec, ok := openapiDocs(version)[*doc]
+	if !ok {
+		return &exitError{code: exitConfig, err: fmt.Errorf("OpenAPI document %q not found", *doc)}
+	}
+	dir := filepath.Join(*out, version)
+	if err := os.MkdirAll(filepath.Join(dir, "go"), 0o755); err != nil {
+		return err
+	}
+	specPath := filepath.Join(dir, *doc+".yaml")
+	if err := os.WriteFile(specPath, spec, 0o644); err != nil {
+		return err
+	}
+
+	if err := command(ctx, w, *goCmd, "-generate", "types,client", "-package", *pkg, "-o", filepath.Join(dir, "go", "client.gen.go"), specPath); err != nil {
+		return fmt.Errorf("generating Go client: %w", err)
+	}
+	fmt.Fprintf(w, "generated Go client of %s at %s\n", *doc, filepath.Join(dir, "go"))
+	if *typescript {
+		if err := command(ctx, w, *tsCmd, "generate", "-g", "typescript-fetch", "-i", specPath, "-o", filepath.Join(dir, "typescript")); err != nil {
+			return fmt.Errorf("generating TypeScript client: %w", err)
+		}
+		fmt.Fprintf(w, "generated TypeScript client of %s at %s\n", *doc, filepath.Join(dir, "typescript"))
+	}
+	return nil
+}
+
+// command runs the command line split by spaces with the args appended, writing its output to w.
+func command(ctx context.Context, w io.Writer, line string, args ...string) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return errors.New("empty command")
+	}
+	cmd := exec.CommandContext(ctx, fields[0], append(fields[1:], args...)...)
+	cmd.Stdout, cmd.Stderr = w, w
+	return cmd.Run()
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestGenerateClient tests that the clients are generated from the embedded document into versioned directories.
+func TestGenerateClient(t *testing.T) {
+	out := t.TempDir()
+	var buf strings.Builder
+	err := run(context.Background(), &buf, []string{"app", "generate", "client", "-out", out, "-go-cmd", "echo", "-typescript", "-typescript-cmd", "echo ts"}, "v1.2.3")
+	testNil(t, err)
+
+	spec, err := os.ReadFile(filepath.Join(out, "v1.2.3", "openapi.yaml"))
+	testNil(t, err)
+	testContains(t, "version: v1.2.3", string(spec))
+	testContains(t, "-generate types,client -package client -o "+filepath.Join(out, "v1.2.3", "go", "client.gen.go"), buf.String())
+	testContains(t, "ts generate -g typescript-fetch", buf.String())
+
+	err = run(context.Background(), &buf, []string{"app", "generate", "server"}, "v1.2.3")
+	testEqual(t, exitConfig, err.(*exitError).code)
+	err = run(context.Background(), &buf, []string{"app", "generate", "client", "-doc", "missing"}, "v1.2.3")
+	testEqual(t, exitConfig, err.(*exitError).code)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Serving statuses of HealthCheckResponse of the gRPC health checking protocol.
+const (
+	grpcServing        = 1
+	grpcNotServing     = 2
+	grpcServiceUnknown = 3
+)
+
+// Status codes of gRPC responses, sent in the grpc-status trailer.
+const (
+	grpcOK       = 0
+	grpcInvalid  = 3
+	grpcNotFound = 5
+)
+
+// grpcWatchInterval is how often [handleGRPCHealthWatch] checks for changes of the serving status.
+const grpcWatchInterval = time.Second
+
+// grpcHealthStatus returns the serving status of the service, reflecting /readyz, see [handleGetReadyz].
+// The service is either "" for the whole server or the name of the package, the only services of this server.
+func grpcHealthStatus(ctx context.Context, service string, ready, cordoned *atomic.Bool, schema *storeSchema) (int, bool) {
+	if service != "" && service != "grpc.health.v1.Health" {
+		return grpcServiceUnknown, false
+	}
+	if _, migrated := schema.status(ctx); ready.Load() && !cordoned.Load() && migrated {
+		return grpcServing, true
+	}
+	return grpcNotServing, true
+}
+
+// isHealthCheck reports whether the path is of a health check, /health, /readyz, or the gRPC health service,
+// which the middlewares shedding requests let through, so that probes keep seeing the readiness of the server.
+func isHealthCheck(path string) bool {
+	return path == "/health" || path == "/readyz" || strings.HasPrefix(path, "/grpc.health.v1.Health/")
+}
+
+// handleGRPCHealthCheck returns an [http.HandlerFunc] implementing Check of the standard grpc.health.v1.Health service,
+// so that gRPC load balancers and Kubernetes gRPC probes can health-check the server with the same readiness as /readyz.
+// It is served by the -grpc-health flag, and only reachable over HTTP/2, so -tls-cert must be set.
+// The protocol is small enough to be encoded by hand, without depending on the gRPC libraries.
+func handleGRPCHealthCheck(ready, cordoned *atomic.Bool, schema *storeSchema) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		service, err := readGRPCHealthRequest(r)
+		if err != nil {
+			writeGRPCStatus(w, grpcInvalid, err.Error())
+			return
+		}
+		status, ok := grpcHealthStatus(r.Context(), service, ready, cordoned, schema)
+		if !ok {
+			writeGRPCStatus(w, grpcNotFound, "unknown service "+service)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc+proto")
+		w.Header().Set("Trailer", "Grpc-Status")
+		if _, err := w.Write(grpcHealthResponse(status)); err != nil {
+			slog.ErrorContext(r.Context(), "failed to write grpc health", slog.Any("error", err))
+			return
+		}
+		w.Header().Set("Grpc-Status", strconv.Itoa(grpcOK))
+	}
+}
+
+// handleGRPCHealthWatch returns an [http.HandlerFunc] implementing Watch of the standard grpc.health.v1.Health service,
+// streaming the serving status once and then whenever it changes, until the client or the server goes away.
+// Unknown services are streamed as SERVICE_UNKNOWN instead of failing, as the protocol requires.
+func handleGRPCHealthWatch(ready, cordoned *atomic.Bool, schema *storeSchema, drain *drainer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		service, err := readGRPCHealthRequest(r)
+		if err != nil {
+			writeGRPCStatus(w, grpcInvalid, err.Error())
+			return
+		}
+		closing, done := drain.track()
+		defer done()
+		w.Header().Set("Content-Type", "application/grpc+proto")
+		w.Header().Set("Trailer", "Grpc-Status")
+		rc := http.NewResponseController(w)
+		ticker := time.NewTicker(grpcWatchInterval)
+		defer ticker.Stop()
+		last := -1
+		for {
+			if status, _ := grpcHealthStatus(r.Context(), service, ready, cordoned, schema); status != last {
+				last = status
+				if _, err := w.Write(grpcHealthResponse(status)); err != nil {
+					return
+				}
+				if err := rc.Flush(); err != nil {
+					slog.ErrorContext(r.Context(), "failed to flush grpc health", slog.Any("error", err))
+					return
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-closing:
+				// NOTE: the status is sent first, so that clients stop sending traffic before the stream ends
+				if last != grpcServiceUnknown && last != grpcNotServing {
+					_, _ = w.Write(grpcHealthResponse(grpcNotServing))
+				}
+				w.Header().Set("Grpc-Status", strconv.Itoa(grpcOK))
+				return
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+// readGRPCHealthRequest reads the single length-prefixed HealthCheckRequest message of the request,
+// returning its service field. Unknown fields are skipped, and compressed messages are rejected.
+func readGRPCHealthRequest(r *http.Request) (string, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r.Body, prefix[:]); err != nil {
+		return "", fmt.Errorf("reading message: %w", err)
+	}
+	if prefix[0] != 0 {
+		return "", errors.New("compressed messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > 1024 {
+		return "", fmt.Errorf("message of %d bytes is too large", size)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r.Body, msg); err != nil {
+		return "", fmt.Errorf("reading message: %w", err)
+	}
+
+	var service string
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return "", errors.New("malformed message")
+		}
+		msg = msg[n:]
+		field, wire := key>>3, key&7
+		switch wire {
+		case 0: // varint
+			if _, n = binary.Uvarint(msg); n <= 0 {
+				return "", errors.New("malformed message")
+			}
+		case 1: // 64-bit
+			n = 8
+		case 5: // 32-bit
+			n = 4
+		case 2: // length-delimited
+			size, m := binary.Uvarint(msg)
+			if m <= 0 || size > uint64(len(msg)-m) {
+				return "", errors.New("malformed message")
+			}
+			if field == 1 {
+				service = string(msg[m : m+int(size)])
+			}
+			n = m + int(size)
+		default:
+			return "", fmt.Errorf("unsupported wire type %d", wire)
+		}
+		if n > len(msg) {
+			return "", errors.New("malformed message")
+		}
+		msg = msg[n:]
+	}
+	return service, nil
+}
+
+// grpcHealthResponse returns the length-prefixed HealthCheckResponse message with the serving status.
+func grpcHealthResponse(status int) []byte {
+	return []byte{0, 0, 0, 0, 2, 0x08, byte(status)}
+}
+
+// writeGRPCStatus responds with the gRPC status code and message in the headers without a message,
+// known as a Trailers-Only response.
+func writeGRPCStatus(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/grpc+proto")
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", grpcPercentEncode(msg))
+	w.WriteHeader(http.StatusOK)
+}
+
+// grpcPercentEncode encodes the message for the grpc-message header, escaping bytes outside printable ASCII and '%'.
+func grpcPercentEncode(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
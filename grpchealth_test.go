@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestGRPCHealth tests that the gRPC health service reflects the readiness over HTTP/2,
+// also under maintenance and the rate and concurrency limits, like /readyz.
+func TestGRPCHealth(t *testing.T) {
+	var ready, cordoned atomic.Bool
+	drain := newDrainer()
+	mux := http.NewServeMux()
+	mux.Handle("POST /grpc.health.v1.Health/Check", handleGRPCHealthCheck(&ready, &cordoned, nil))
+	mux.Handle("POST /grpc.health.v1.Health/Watch", handleGRPCHealthWatch(&ready, &cordoned, nil, drain))
+	state := &adminState{}
+	state.maintenance.Store(true)
+	handler := rateLimit(limitConcurrency(mux, concurrencyConfig{limit: 1}, &ready), "default", rateLimitConfig{limit: 1, window: time.Minute}, state)
+	server := httptest.NewUnstartedServer(maintenance(handler, state))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	call := func(method, service string) *http.Response {
+		t.Helper()
+		msg := append([]byte{0x0a, byte(len(service))}, service...)
+		body := append([]byte{0, 0, 0, 0, byte(len(msg))}, msg...)
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/grpc.health.v1.Health/"+method, bytes.NewReader(body))
+		testNil(t, err)
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("TE", "trailers")
+		res, err := server.Client().Do(req)
+		testNil(t, err)
+		testEqual(t, 2, res.ProtoMajor)
+		return res
+	}
+	check := func(service string) (string, string) {
+		t.Helper()
+		res := call("Check", service)
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		testNil(t, err)
+		if status := res.Header.Get("Grpc-Status"); status != "" {
+			return status, string(body)
+		}
+		return res.Trailer.Get("Grpc-Status"), string(body)
+	}
+
+	status, body := check("")
+	testEqual(t, "0", status)
+	testEqual(t, string(grpcHealthResponse(grpcNotServing)), body)
+
+	ready.Store(true)
+	status, body = check("")
+	testEqual(t, "0", status)
+	testEqual(t, string(grpcHealthResponse(grpcServing)), body)
+
+	cordoned.Store(true)
+	status, body = check("grpc.health.v1.Health")
+	testEqual(t, "0", status)
+	testEqual(t, string(grpcHealthResponse(grpcNotServing)), body)
+
+	status, body = check("unknown")
+	testEqual(t, "5", status)
+	testEqual(t, "", body)
+
+	cordoned.Store(false)
+	res := call("Watch", "")
+	defer res.Body.Close()
+	first := make([]byte, 7)
+	_, err := io.ReadFull(res.Body, first)
+	testNil(t, err)
+	testEqual(t, string(grpcHealthResponse(grpcServing)), string(first))
+	drain.close()
+	rest, err := io.ReadAll(res.Body)
+	testNil(t, err)
+	testEqual(t, string(grpcHealthResponse(grpcNotServing)), string(rest))
+	testEqual(t, "0", res.Trailer.Get("Grpc-Status"))
+
+	_, err = readGRPCHealthRequest(httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte{1, 0, 0, 0, 0})))
+	testContains(t, "compressed", err.Error())
+	testEqual(t, "a%25b%0A", grpcPercentEncode("a%b\n"))
+}
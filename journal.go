@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// journal is a ring buffer of the summaries of the last requests, written to disk by [journal.flush]
+// when a handler panics or the server exits with an error, so that post-mortem analysis has context even if logs were lost.
+// It is nil unless the -journal flag is set, and recording into a nil [journal] does nothing.
+type journal struct {
+	path string
+
+	mu      sync.Mutex
+	entries []journalEntry
+	next    int  // index of the entry to overwrite next
+	full    bool // reports whether entries wrapped around
+}
+
+// journalEntry is the summary of a request recorded in the [journal].
+type journalEntry struct {
+	Time      time.Time `json:"Time"`
+	Method    string    `json:"Method"`
+	Path      string    `json:"Path"`
+	Status    int       `json:"Status"`
+	Latency   string    `json:"Latency"`
+	RequestID string    `json:"RequestID"`
+}
+
+// newJournal returns a [journal] keeping the last size requests, flushed to the file at path.
+// It returns nil if path is empty or size is not positive.
+func newJournal(path string, size int) *journal {
+	if path == "" || size <= 0 {
+		return nil
+	}
+	return &journal{path: path, entries: make([]journalEntry, size)}
+}
+
+// record adds the entry to the journal, overwriting the oldest one if it is full.
+func (j *journal) record(e journalEntry) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.entries[j.next] = e
+	j.next = (j.next + 1) % len(j.entries)
+	j.full = j.full || j.next == 0
+}
+
+// snapshot returns the entries from the oldest to the newest, empty if j is nil.
+func (j *journal) snapshot() []journalEntry {
+	if j == nil {
+		return []journalEntry{}
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entries := append([]journalEntry{}, j.entries[:j.next]...)
+	if j.full {
+		entries = append(append([]journalEntry{}, j.entries[j.next:]...), entries...)
+	}
+	return entries
+}
+
+// flush writes the entries from the oldest to the newest to the file of the journal with the reason of the flush.
+// The file is replaced atomically, so that a crash while flushing does not leave a truncated journal behind.
+func (j *journal) flush(reason string) error {
+	if j == nil {
+		return nil
+	}
+	type fileBody struct {
+		Reason  string         `json:"Reason"`
+		Time    time.Time      `json:"Time"`
+		Entries []journalEntry `json:"Entries"`
+	}
+
+	b, err := json.MarshalIndent(fileBody{Reason: reason, Time: time.Now(), Entries: j.snapshot()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(j.path), filepath.Base(j.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), j.path)
+}
+
+// recordJournal is a middleware that records the summary of every request into j,
+// flushing it when the handler panics before the panic is handled by [recovery].
+func recordJournal(next http.Handler, j *journal) http.Handler {
+	if j == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		wr := responseRecorder{ResponseWriter: w}
+		entry := journalEntry{Time: start, Method: r.Method, Path: r.URL.Path, RequestID: requestIDFrom(r.Context())}
+		defer func() {
+			err := recover()
+			entry.Latency = time.Since(start).String()
+			entry.Status = wr.status
+			if err != nil && err != http.ErrAbortHandler {
+				entry.Status = http.StatusInternalServerError
+			}
+			j.record(entry)
+			if err == nil {
+				return
+			}
+			if err != http.ErrAbortHandler {
+				if ferr := j.flush("panic"); ferr != nil {
+					slog.ErrorContext(r.Context(), "failed to flush journal", slog.Any("error", ferr))
+				}
+			}
+			panic(err)
+		}()
+		next.ServeHTTP(&wr, r)
+	})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestJournal tests that the journal keeps the last requests and is flushed when a handler panics.
+func TestJournal(t *testing.T) {
+	type fileBody struct {
+		Reason  string         `json:"Reason"`
+		Entries []journalEntry `json:"Entries"`
+	}
+
+	file := filepath.Join(t.TempDir(), "journal.json")
+	j := newJournal(file, 2)
+	handler := recovery(recordJournal(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/panic" {
+			panic("boom")
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}), j), slog.New(slog.NewTextHandler(io.Discard, nil)), false)
+
+	for _, path := range []string{"/a", "/b", "/c", "/panic"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	b, err := os.ReadFile(file)
+	testNil(t, err)
+	var body fileBody
+	testNil(t, json.Unmarshal(b, &body))
+	testEqual(t, "panic", body.Reason)
+	testEqual(t, 2, len(body.Entries))
+	testEqual(t, "/c", body.Entries[0].Path)
+	testEqual(t, http.StatusNoContent, body.Entries[0].Status)
+	testEqual(t, "/panic", body.Entries[1].Path)
+	testEqual(t, http.StatusInternalServerError, body.Entries[1].Status)
+
+	testNil(t, newJournal("", 10).flush("nothing"))
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// jsonEncoder encodes values as JSON to the writer it is created for, followed by a newline like [json.Encoder].
+type jsonEncoder interface {
+	Encode(v any) error
+}
+
+// newJSONEncoder returns the [jsonEncoder] of the responses written by [writeJSON], encoding/json by default.
+// It is the extension point for a faster encoder such as github.com/bytedance/sonic or github.com/goccy/go-json,
+// which can be swapped in at startup, before any response is written, without touching the handlers:
+//
+//	newJSONEncoder = func(w io.Writer) jsonEncoder { return sonic.ConfigStd.NewEncoder(w) }
+var newJSONEncoder = func(w io.Writer) jsonEncoder { return json.NewEncoder(w) }
+
+// maxPooledBuffer is the capacity above which buffers are not returned to [jsonBuffers],
+// so that a single large response does not pin its memory for the lifetime of the process.
+const maxPooledBuffer = 64 << 10
+
+// jsonBuffer is a buffer with an encoder writing to it, pooled by [jsonBuffers].
+type jsonBuffer struct {
+	bytes.Buffer
+	enc jsonEncoder
+}
+
+// jsonBuffers pools the buffers responses are encoded into by [writeJSON].
+var jsonBuffers = sync.Pool{New: func() any {
+	buf := &jsonBuffer{}
+	buf.enc = newJSONEncoder(&buf.Buffer)
+	return buf
+}}
+
+// writeJSON writes v as a JSON response with the status, encoding it into a pooled buffer first,
+// so that Content-Length is set instead of chunked encoding, and an encoding error is returned
+// before anything is written so that the caller can still respond with an error.
+// The Content-Type defaults to application/json, unless it is set already such as to application/problem+json.
+func writeJSON(w http.ResponseWriter, status int, v any) error {
+	buf := jsonBuffers.Get().(*jsonBuffer)
+	defer func() {
+		if buf.Cap() <= maxPooledBuffer {
+			buf.Reset()
+			jsonBuffers.Put(buf)
+		}
+	}()
+	if err := buf.enc.Encode(v); err != nil {
+		return err
+	}
+
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(status)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// jsonArrayFlushInterval is how often [jsonArray] flushes the elements buffered so far to the client.
+const jsonArrayFlushInterval = 100 * time.Millisecond
+
+// jsonArray writes a large collection as a JSON array streamed element by element, so that list endpoints
+// do not have to hold the whole result set in memory. Elements are buffered and flushed to the client every
+// [streamChunkSize] bytes or [jsonArrayFlushInterval], whichever comes first. Since the status is sent with
+// the first element, an error midway can only abort the response, leaving the client an invalid JSON array.
+//
+//	arr := newJSONArray(w, r)
+//	for rows.Next() {
+//		if err := arr.Encode(row); err != nil {
+//			slog.WarnContext(r.Context(), "list aborted", slog.Any("error", err))
+//			return
+//		}
+//	}
+//	if err := arr.Close(); err != nil { ... }
+type jsonArray struct {
+	w         http.ResponseWriter
+	r         *http.Request
+	rc        *http.ResponseController
+	buf       *bufio.Writer
+	enc       jsonEncoder
+	n         int
+	lastFlush time.Time
+	err       error
+}
+
+// newJSONArray returns a [jsonArray] writing to w, stopping when the context of r is done.
+// The headers are written with the first element, so they can still be set until then.
+func newJSONArray(w http.ResponseWriter, r *http.Request) *jsonArray {
+	buf := bufio.NewWriterSize(w, streamChunkSize)
+	return &jsonArray{w: w, r: r, rc: http.NewResponseController(w), buf: buf, enc: newJSONEncoder(buf)}
+}
+
+// Encode writes v as the next element of the array, returning the error of the first failed element
+// or the error of the context once done, after which the response should be abandoned.
+func (a *jsonArray) Encode(v any) error {
+	if a.err != nil {
+		return a.err
+	}
+	if a.err = a.r.Context().Err(); a.err != nil {
+		return a.err
+	}
+	a.begin()
+	if a.n > 0 {
+		a.buf.WriteByte(',')
+	}
+	if a.err = a.enc.Encode(v); a.err != nil {
+		return a.err
+	}
+	a.n++
+	if a.buf.Buffered() >= streamChunkSize/2 || time.Since(a.lastFlush) >= jsonArrayFlushInterval {
+		a.err = a.flush()
+	}
+	return a.err
+}
+
+// Close ends the array and flushes it, writing an empty array if no element was written.
+func (a *jsonArray) Close() error {
+	if a.err != nil {
+		return a.err
+	}
+	a.begin()
+	a.buf.WriteString("]\n")
+	a.err = a.flush()
+	return a.err
+}
+
+// begin writes the headers and the opening bracket before the first element.
+func (a *jsonArray) begin() {
+	if !a.lastFlush.IsZero() {
+		return
+	}
+	if a.w.Header().Get("Content-Type") == "" {
+		a.w.Header().Set("Content-Type", "application/json")
+	}
+	a.w.WriteHeader(http.StatusOK)
+	a.buf.WriteByte('[')
+	a.lastFlush = time.Now()
+}
+
+// flush writes the buffered elements to the client.
+func (a *jsonArray) flush() error {
+	a.lastFlush = time.Now()
+	if err := a.buf.Flush(); err != nil {
+		return err
+	}
+	if err := a.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
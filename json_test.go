@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestWriteJSON tests that JSON responses are written with Content-Length, and encoding errors before the headers.
+func TestWriteJSON(t *testing.T) {
+	w := httptest.NewRecorder()
+	testNil(t, writeJSON(w, http.StatusCreated, map[string]string{"Name": "kickstart"}))
+	testEqual(t, http.StatusCreated, w.Code)
+	testEqual(t, "application/json", w.Header().Get("Content-Type"))
+	testEqual(t, "21", w.Header().Get("Content-Length"))
+	testEqual(t, "{\"Name\":\"kickstart\"}\n", w.Body.String())
+
+	w = httptest.NewRecorder()
+	w.Header().Set("Content-Type", "application/problem+json")
+	testNil(t, writeJSON(w, http.StatusNotFound, problem{Status: http.StatusNotFound}))
+	testEqual(t, "application/problem+json", w.Header().Get("Content-Type"))
+
+	w = httptest.NewRecorder()
+	testContains(t, "unsupported value", writeJSON(w, http.StatusOK, math.Inf(1)).Error())
+	testEqual(t, false, w.Code != http.StatusOK || w.Body.Len() > 0 || w.Header().Get("Content-Type") != "")
+
+	w = httptest.NewRecorder()
+	large := strings.Repeat("x", 2*maxPooledBuffer)
+	testNil(t, writeJSON(w, http.StatusOK, large))
+	testEqual(t, len(large)+3, w.Body.Len())
+}
+
+// benchmarkBody is a typical small response body of the benchmarks.
+var benchmarkBody = struct {
+	Version string            `json:"Version"`
+	Items   []int             `json:"Items"`
+	Labels  map[string]string `json:"Labels"`
+}{Version: "v1.2.3", Items: []int{1, 2, 3, 4, 5, 6, 7, 8}, Labels: map[string]string{"env": "prod", "region": "eu"}}
+
+// discardWriter is an [http.ResponseWriter] discarding the response, so that the benchmarks only measure encoding.
+type discardWriter struct{ header http.Header }
+
+func (w discardWriter) Header() http.Header         { return w.header }
+func (w discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w discardWriter) WriteHeader(int)             {}
+
+func BenchmarkWriteJSON(b *testing.B) {
+	w := discardWriter{header: http.Header{}}
+	b.ReportAllocs()
+	for range b.N {
+		if err := writeJSON(w, http.StatusOK, benchmarkBody); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncoderJSON(b *testing.B) {
+	w := discardWriter{header: http.Header{}}
+	b.ReportAllocs()
+	for range b.N {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(benchmarkBody); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestJSONArray tests that collections are streamed as valid JSON arrays, and stopped once the request is canceled.
+func TestJSONArray(t *testing.T) {
+	for _, n := range []int{0, 1, 10_000} {
+		w := httptest.NewRecorder()
+		arr := newJSONArray(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		for i := range n {
+			testNil(t, arr.Encode(map[string]int{"ID": i}))
+		}
+		testEqual(t, n > 1000, w.Flushed)
+		testNil(t, arr.Close())
+		var res []map[string]int
+		testNil(t, json.Unmarshal(w.Body.Bytes(), &res))
+		testEqual(t, n, len(res))
+		testEqual(t, "application/json", w.Header().Get("Content-Type"))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := httptest.NewRecorder()
+	arr := newJSONArray(w, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+	testNil(t, arr.Encode(1))
+	cancel()
+	testEqual(t, context.Canceled, arr.Encode(2))
+	testEqual(t, context.Canceled, arr.Close())
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// States of the server reported by [lifecycle.emit].
+const (
+	stateStarting       = "starting"
+	stateReady          = "ready"
+	stateDraining       = "draining"
+	stateStopped        = "stopped"
+	stateConfigReloaded = "config-reloaded" // a runtime setting changed through the admin API, or the config reloaded
+)
+
+// lifecycleEvent is a change of state of the server, published to the [eventBus] and streamed by /admin/lifecycle.
+type lifecycleEvent struct {
+	State  string    `json:"State"`
+	Time   time.Time `json:"Time"`
+	Detail string    `json:"Detail,omitempty"`
+}
+
+// lifecycle emits the changes of state of the server as machine-readable events, so that tooling such as deploy scripts
+// can react to them deterministically instead of parsing free-form logs. Every event is logged as "lifecycle"
+// with its state, published to the bus once it is set, and streamed to the subscribers of [handleGetLifecycle].
+// Emitting to a nil [lifecycle] does nothing.
+type lifecycle struct {
+	log *slog.Logger
+
+	mu          sync.Mutex
+	bus         *eventBus // nil until the bus is created in run
+	last        lifecycleEvent
+	subscribers map[chan lifecycleEvent]struct{}
+}
+
+// newLifecycle returns a [lifecycle] logging to log.
+func newLifecycle(log *slog.Logger) *lifecycle {
+	return &lifecycle{log: log, subscribers: map[chan lifecycleEvent]struct{}{}}
+}
+
+// setBus sets the bus the next events are published to.
+func (l *lifecycle) setBus(bus *eventBus) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.bus = bus
+}
+
+// emit logs the state with the detail, publishes it to the bus, and sends it to the subscribers.
+// Subscribers too slow to receive it miss the event rather than blocking the server.
+func (l *lifecycle) emit(ctx context.Context, state, detail string) {
+	if l == nil {
+		return
+	}
+	event := lifecycleEvent{State: state, Time: time.Now(), Detail: detail}
+	l.log.InfoContext(ctx, "lifecycle", slog.String("state", state), slog.String("detail", detail))
+
+	l.mu.Lock()
+	if state != stateConfigReloaded {
+		l.last = event
+	}
+	bus := l.bus
+	for ch := range l.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+	l.mu.Unlock()
+
+	if bus != nil {
+		if err := publish(ctx, bus, event); err != nil {
+			l.log.ErrorContext(ctx, "failed to publish lifecycle", slog.Any("error", err))
+		}
+	}
+}
+
+// subscribe returns a channel receiving the next events, starting with the current state,
+// and a function to call once done with it.
+func (l *lifecycle) subscribe() (<-chan lifecycleEvent, func()) {
+	ch := make(chan lifecycleEvent, 16)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.last.State != "" {
+		ch <- l.last
+	}
+	l.subscribers[ch] = struct{}{}
+	return ch, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.subscribers, ch)
+	}
+}
+
+// handleGetLifecycle returns an [http.HandlerFunc] streaming the lifecycle events as Server-Sent Events,
+// starting with the current state, until the client goes away or the server shuts down.
+func handleGetLifecycle(l *lifecycle, drain *drainer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		events, unsubscribe := l.subscribe()
+		defer unsubscribe()
+		closing, done := drain.track()
+		defer done()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(200)
+		rc := http.NewResponseController(w)
+		if err := rc.Flush(); err != nil {
+			slog.ErrorContext(r.Context(), "failed to flush lifecycle", slog.Any("error", err))
+			return
+		}
+		for {
+			select {
+			case event := <-events:
+				b, err := json.Marshal(event)
+				if err != nil {
+					slog.ErrorContext(r.Context(), "failed to encode lifecycle", slog.Any("error", err))
+					return
+				}
+				if _, err := fmt.Fprintf(w, "event: lifecycle\ndata: %s\n\n", b); err != nil {
+					return
+				}
+				if err := rc.Flush(); err != nil {
+					return
+				}
+			case <-closing:
+				// NOTE: draining is emitted before the server shuts down, so it is sent before closing
+				for len(events) > 0 {
+					b, _ := json.Marshal(<-events)
+					fmt.Fprintf(w, "event: lifecycle\ndata: %s\n\n", b)
+				}
+				_ = writeSSEClose(w, time.Second)
+				return
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
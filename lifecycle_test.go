@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLifecycle tests that lifecycle events are logged, published to the bus, and streamed to the admin API.
+func TestLifecycle(t *testing.T) {
+	var logs bytes.Buffer
+	lc := newLifecycle(slog.New(slog.NewTextHandler(&logs, nil)))
+	bus := newEventBus(slog.New(slog.NewTextHandler(io.Discard, nil)), nil, 1, 1, time.Minute, 1)
+	defer bus.Close()
+	var published []string
+	subscribe(bus, "test", false, func(_ context.Context, e lifecycleEvent) error {
+		published = append(published, e.State)
+		return nil
+	})
+
+	lc.emit(context.Background(), stateStarting, "v1")
+	lc.setBus(bus)
+	lc.emit(context.Background(), stateReady, "")
+	testContains(t, "msg=lifecycle state=starting detail=v1", logs.String())
+	testEqual(t, "ready", strings.Join(published, ","))
+
+	drain := newDrainer()
+	server := httptest.NewServer(handleAdmin(adminDeps{log: slog.New(slog.NewTextHandler(io.Discard, nil)), state: &adminState{}, token: "secret", lifecycle: lc, drain: drain}))
+	defer server.Close()
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/admin/lifecycle", nil)
+	testNil(t, err)
+	req.Header.Set("Authorization", "Bearer secret")
+	res, err := http.DefaultClient.Do(req)
+	testNil(t, err)
+	defer res.Body.Close()
+	testEqual(t, "text/event-stream", res.Header.Get("Content-Type"))
+	scanner := bufio.NewScanner(res.Body)
+	next := func() string {
+		t.Helper()
+		for scanner.Scan() {
+			if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+				return data
+			}
+		}
+		return ""
+	}
+	testContains(t, `"State":"ready"`, next())
+
+	req, err = http.NewRequest(http.MethodPut, server.URL+"/admin/cordon", strings.NewReader(`{"Enabled": true}`))
+	testNil(t, err)
+	req.Header.Set("Authorization", "Bearer secret")
+	put, err := http.DefaultClient.Do(req)
+	testNil(t, err)
+	put.Body.Close()
+	testContains(t, `"State":"config-reloaded","Time":`, next())
+
+	lc.emit(context.Background(), stateDraining, "")
+	drain.close()
+	testContains(t, `"State":"draining"`, next())
+	testEqual(t, "server shutting down", next())
+	testEqual(t, "ready,config-reloaded,draining", strings.Join(published, ","))
+
+	var none *lifecycle
+	none.emit(context.Background(), stateStopped, "")
+}
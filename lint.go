@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// lintOpenapiDocs checks every embedded OpenAPI document with [lintOpenapi],
+// so that the server fails fast at startup instead of serving a broken spec when -openapi-lint is set.
+func lintOpenapiDocs() error {
+	docs := openapiDocs("")
+	names := make([]string, 0, len(docs))
+	for name := range docs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var errs []error
+	for _, name := range names {
+		errs = append(errs, lintOpenapi(name+".yaml", docs[name]))
+	}
+	return errors.Join(errs...)
+}
+
+// openapiMethods are the keys of operations in the path items of OpenAPI documents.
+var openapiMethods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+// lintOpenapi checks that the OpenAPI document parses as the block style YAML used by the files in api/,
+// and meets basic rules in the spirit of Spectral: openapi, info.title, info.version, and paths are present,
+// and every operation has a unique operationId and at least one response.
+// It reports every violation at once, prefixed by name and the line or operation.
+// It is not a full YAML parser, so flow style collections and multiline strings are not understood.
+func lintOpenapi(name string, doc []byte) error {
+	type operation struct {
+		line      int
+		id        string
+		responses int
+	}
+
+	var errs []error
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", name, fmt.Sprintf(format, args...)))
+	}
+	present := map[string]bool{}
+	operations := map[string]*operation{}
+	var order []string
+	for _, err := range walkOpenapi(doc, func(line int, path []string, value string) {
+		present[strings.Join(path, ".")] = true
+		if len(path) < 3 || path[0] != "paths" || !slices.Contains(openapiMethods, path[2]) {
+			return
+		}
+		op := strings.ToUpper(path[2]) + " " + path[1]
+		if _, ok := operations[op]; !ok {
+			operations[op] = &operation{line: line}
+			order = append(order, op)
+		}
+		switch {
+		case len(path) == 4 && path[3] == "operationId":
+			operations[op].id = value
+		case len(path) == 5 && path[3] == "responses":
+			operations[op].responses++
+		}
+	}) {
+		fail("%s", err)
+	}
+
+	for _, k := range []string{"openapi", "info.title", "info.version", "paths"} {
+		if !present[k] {
+			fail("%s is required", k)
+		}
+	}
+	ids := map[string]string{}
+	for _, op := range order {
+		o := operations[op]
+		if o.id == "" {
+			fail("%s (line %d): operationId is required", op, o.line)
+		} else if other, ok := ids[o.id]; ok {
+			fail("%s (line %d): operationId %q is already used by %s", op, o.line, o.id, other)
+		} else {
+			ids[o.id] = op
+		}
+		if o.responses == 0 {
+			fail("%s (line %d): at least one response is required", op, o.line)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// walkOpenapi calls visit with the path of keys and the unquoted value of every 'key: value' line of the OpenAPI document,
+// parsed as the block style YAML used by the files in api/, returning an error for each line it cannot parse.
+// Items of sequences, such as servers and parameters, are skipped.
+func walkOpenapi(doc []byte, visit func(line int, path []string, value string)) []error {
+	type key struct {
+		indent int
+		name   string
+	}
+
+	var errs []error
+	var stack []key
+	for i, line := range strings.Split(string(doc), "\n") {
+		if before, _, ok := strings.Cut(line, " #"); ok {
+			line = before
+		}
+		trimmed := strings.TrimLeft(line, " ")
+		if strings.TrimSpace(trimmed) == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			errs = append(errs, fmt.Errorf("line %d: tabs are not allowed for indentation", i+1))
+			continue
+		}
+		if strings.HasPrefix(trimmed, "- ") {
+			continue // items of sequences, such as servers and security requirements
+		}
+		k, value, ok := strings.Cut(trimmed, ":")
+		if !ok {
+			errs = append(errs, fmt.Errorf("line %d: expected a 'key: value' pair, got %q", i+1, trimmed))
+			continue
+		}
+		indent := len(line) - len(trimmed)
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		stack = append(stack, key{indent: indent, name: strings.Trim(k, `"'`)})
+
+		path := make([]string, len(stack))
+		for j, k := range stack {
+			path[j] = k.name
+		}
+		visit(i+1, path, strings.Trim(strings.TrimSpace(value), `"'`))
+	}
+	return errs
+}
@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+// TestLintOpenapi tests that the embedded OpenAPI documents pass the lint, and that broken documents are reported.
+// Keep this test so that a broken spec fails CI even if -openapi-lint is disabled.
+func TestLintOpenapi(t *testing.T) {
+	testNil(t, lintOpenapiDocs())
+
+	err := lintOpenapi("broken.yaml", []byte(`openapi: 3.0.0
+info:
+  title: Broken API
+paths:
+  /users:
+    get:
+      operationId: listUsers
+    post:
+      operationId: listUsers
+      responses:
+        201:
+          description: Created
+  /users/{id}:
+    delete:
+      responses:
+        204:
+          description: Deleted
+`))
+	testEqual(t, true, err != nil)
+	testContains(t, "broken.yaml: info.version is required", err.Error())
+	testContains(t, "broken.yaml: GET /users (line 6): at least one response is required", err.Error())
+	testContains(t, `broken.yaml: POST /users (line 8): operationId "listUsers" is already used by GET /users`, err.Error())
+	testContains(t, "broken.yaml: DELETE /users/{id} (line 14): operationId is required", err.Error())
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// listSpec allowlists the fields a route can be sorted and filtered by, see [parseListQuery].
+type listSpec struct {
+	Sort        []string // fields allowed in ?sort=
+	Filter      []string // fields allowed in ?filter[<field>]=
+	DefaultSort string   // sort applied without ?sort=, such as -created_at
+	MaxSize     int      // largest ?page[size]= allowed, also the default size
+}
+
+// sortKey is a field a list is sorted by, descending if Desc.
+type sortKey struct {
+	Field string
+	Desc  bool
+}
+
+// listQuery is the typed form of the sorting, filtering and pagination query parameters of a list route,
+// parsed by [parseListQuery] and applied to the store by [listValues], so that handlers never build queries by hand.
+type listQuery struct {
+	Sort   []sortKey
+	Filter map[string]string // field to the value it must equal
+	Size   int               // items per page
+	Number int               // page number, starting from 1
+}
+
+// parseListQuery parses the query parameters of the request in the JSON:API style, such as
+// ?sort=-created_at,name&filter[status]=active&page[size]=50&page[number]=2, allowing only the fields of spec.
+// Unknown parameters are ignored, while disallowed fields and invalid pages are rejected, to respond with 400.
+func parseListQuery(values url.Values, spec listSpec) (listQuery, error) {
+	q := listQuery{Filter: map[string]string{}, Size: spec.MaxSize, Number: 1}
+	sort := cmp.Or(values.Get("sort"), spec.DefaultSort)
+	for _, field := range strings.Split(sort, ",") {
+		if field == "" {
+			continue
+		}
+		key := sortKey{Field: strings.TrimPrefix(field, "-"), Desc: strings.HasPrefix(field, "-")}
+		if !slices.Contains(spec.Sort, key.Field) {
+			return listQuery{}, fmt.Errorf("cannot sort by %q, must be one of %s", key.Field, strings.Join(spec.Sort, ", "))
+		}
+		q.Sort = append(q.Sort, key)
+	}
+	for param, vs := range values {
+		field, ok := strings.CutPrefix(param, "filter[")
+		if !ok || !strings.HasSuffix(field, "]") {
+			continue
+		}
+		field = strings.TrimSuffix(field, "]")
+		if !slices.Contains(spec.Filter, field) {
+			return listQuery{}, fmt.Errorf("cannot filter by %q, must be one of %s", field, strings.Join(spec.Filter, ", "))
+		}
+		q.Filter[field] = vs[0]
+	}
+	for param, dst := range map[string]*int{"page[size]": &q.Size, "page[number]": &q.Number} {
+		s := values.Get(param)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return listQuery{}, fmt.Errorf("%s must be a positive integer, got %q", param, s)
+		}
+		*dst = n
+	}
+	if q.Size > spec.MaxSize {
+		return listQuery{}, fmt.Errorf("page[size] must be at most %d, got %d", spec.MaxSize, q.Size)
+	}
+	return q, nil
+}
+
+// listValues returns the page of q of the JSON values of the store under the prefix, filtered and sorted by their
+// top-level fields, with the number of values matching the filters across pages. Values that are not JSON objects are skipped.
+// It reads every value under the prefix, which suits the embedded [fileStore]; a database-backed store would translate q
+// into its own query instead, since the fields of q are allowlisted by [parseListQuery].
+func listValues[T any](ctx context.Context, st store, prefix string, q listQuery) ([]T, int, error) {
+	type item struct {
+		fields map[string]any
+		raw    []byte
+	}
+
+	keys, err := st.List(ctx, prefix)
+	if err != nil {
+		return nil, 0, err
+	}
+	items := make([]item, 0, len(keys))
+	for _, key := range keys {
+		raw, err := st.Get(ctx, key)
+		if err != nil {
+			return nil, 0, err
+		}
+		var fields map[string]any
+		if json.Unmarshal(raw, &fields) != nil {
+			continue
+		}
+		matches := true
+		for field, want := range q.Filter {
+			if v, ok := fields[field]; !ok || formatField(v) != want {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			items = append(items, item{fields: fields, raw: raw})
+		}
+	}
+	slices.SortStableFunc(items, func(a, b item) int {
+		for _, key := range q.Sort {
+			c := compareField(a.fields[key.Field], b.fields[key.Field])
+			if key.Desc {
+				c = -c
+			}
+			if c != 0 {
+				return c
+			}
+		}
+		return 0
+	})
+
+	total := len(items)
+	start := total
+	if q.Number-1 <= total/q.Size { // NOTE: checked before multiplying, since huge page numbers would overflow
+		start = min((q.Number-1)*q.Size, total)
+	}
+	page := items[start:min(start+q.Size, total)]
+	res := make([]T, 0, len(page))
+	for _, it := range page {
+		var v T
+		if err := json.Unmarshal(it.raw, &v); err != nil {
+			return nil, 0, err
+		}
+		res = append(res, v)
+	}
+	return res, total, nil
+}
+
+// compareField compares the values of a field decoded from JSON, numbers numerically and others as text,
+// with missing values first.
+func compareField(a, b any) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	if x, ok := a.(float64); ok {
+		if y, ok := b.(float64); ok {
+			return cmp.Compare(x, y)
+		}
+	}
+	return strings.Compare(formatField(a), formatField(b))
+}
+
+// formatField formats the value of a field decoded from JSON as it is written in a query, with numbers in plain
+// decimal notation, such as 1234567 rather than the 1.234567e+06 of [fmt.Sprint], so that filters match them.
+func formatField(v any) string {
+	if f, ok := v.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// listPage is the response body of [handleGetList].
+type listPage[T any] struct {
+	Data   []T `json:"Data"`
+	Total  int `json:"Total"`
+	Size   int `json:"Size"`
+	Number int `json:"Number"`
+}
+
+// handleGetList returns an [http.HandlerFunc] that lists the JSON values of the store under the prefix by the sorting,
+// filtering and pagination of the query parsed with spec, responding with 400 to disallowed fields.
+//
+//	handle(mux, "GET /users", handleGetList[user](st, "users/", listSpec{Sort: []string{"name"}, MaxSize: 100}), routeMeta{Summary: "List users"})
+func handleGetList[T any](st store, prefix string, spec listSpec) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q, err := parseListQuery(r.URL.Query(), spec)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, err)
+			return
+		}
+		values, total, err := listValues[T](r.Context(), st, prefix, q)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to list values", slog.String("prefix", prefix), slog.Any("error", err))
+			writeProblem(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		if err := writeBody(w, r, http.StatusOK, listPage[T]{Data: values, Total: total, Size: q.Size, Number: q.Number}); err != nil {
+			slog.ErrorContext(r.Context(), "failed to write list", slog.Any("error", err))
+		}
+	}
+}
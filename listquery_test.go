@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestParseListQuery tests that sorting, filtering and pagination are parsed, allowing only the fields of the spec.
+func TestParseListQuery(t *testing.T) {
+	spec := listSpec{Sort: []string{"name", "created_at"}, Filter: []string{"status"}, DefaultSort: "-created_at", MaxSize: 50}
+	parse := func(raw string) (listQuery, error) {
+		t.Helper()
+		values, err := url.ParseQuery(raw)
+		testNil(t, err)
+		return parseListQuery(values, spec)
+	}
+
+	q, err := parse("")
+	testNil(t, err)
+	testEqual(t, 1, len(q.Sort))
+	testEqual(t, sortKey{Field: "created_at", Desc: true}, q.Sort[0])
+	testEqual(t, 50, q.Size)
+	testEqual(t, 1, q.Number)
+
+	q, err = parse("sort=name,-created_at&filter[status]=active&page[size]=10&page[number]=3&fields=name")
+	testNil(t, err)
+	testEqual(t, 2, len(q.Sort))
+	testEqual(t, sortKey{Field: "name"}, q.Sort[0])
+	testEqual(t, sortKey{Field: "created_at", Desc: true}, q.Sort[1])
+	testEqual(t, "active", q.Filter["status"])
+	testEqual(t, 10, q.Size)
+	testEqual(t, 3, q.Number)
+
+	for raw, want := range map[string]string{
+		"sort=password":      `cannot sort by "password"`,
+		"filter[role]=admin": `cannot filter by "role"`,
+		"page[size]=51":      "page[size] must be at most 50",
+		"page[size]=0":       "page[size] must be a positive integer",
+		"page[number]=first": "page[number] must be a positive integer",
+		"sort=name%20DESC":   `cannot sort by "name DESC"`,
+	} {
+		_, err := parse(raw)
+		testEqual(t, true, err != nil)
+		testContains(t, want, err.Error())
+	}
+}
+
+// TestListValues tests that values of the store are filtered, sorted and paginated by the query.
+func TestListValues(t *testing.T) {
+	type user struct {
+		Name   string `json:"name"`
+		Status string `json:"status"`
+		Age    int    `json:"age"`
+	}
+	st, err := newFileStore(filepath.Join(t.TempDir(), "store.json"))
+	testNil(t, err)
+	ctx := context.Background()
+	for key, value := range map[string]string{
+		"users/1":  `{"name":"Kim","status":"active","age":9}`,
+		"users/2":  `{"name":"Lee","status":"inactive","age":30}`,
+		"users/3":  `{"name":"Park","status":"active","age":41}`,
+		"users/4":  `{"name":"Choi","status":"active","age":25}`,
+		"users/6":  `{"name":"Jung","status":"banned","age":1234567}`,
+		"users/5":  `"not an object"`,
+		"orders/1": `{"name":"Order","status":"active"}`,
+	} {
+		testNil(t, st.Put(ctx, key, []byte(value)))
+	}
+	names := func(users []user) string {
+		var s []string
+		for _, u := range users {
+			s = append(s, u.Name)
+		}
+		return strings.Join(s, ",")
+	}
+
+	users, total, err := listValues[user](ctx, st, "users/", listQuery{Sort: []sortKey{{Field: "age", Desc: true}}, Filter: map[string]string{"status": "active"}, Size: 2, Number: 1})
+	testNil(t, err)
+	testEqual(t, 3, total)
+	testEqual(t, "Park,Choi", names(users))
+
+	users, _, err = listValues[user](ctx, st, "users/", listQuery{Sort: []sortKey{{Field: "age", Desc: true}}, Filter: map[string]string{"status": "active"}, Size: 2, Number: 2})
+	testNil(t, err)
+	testEqual(t, "Kim", names(users))
+
+	users, total, err = listValues[user](ctx, st, "users/", listQuery{Sort: []sortKey{{Field: "name"}}, Filter: map[string]string{"status": "active"}, Size: 10, Number: 1})
+	testNil(t, err)
+	testEqual(t, 3, total)
+	testEqual(t, "Choi,Kim,Park", names(users))
+
+	users, _, err = listValues[user](ctx, st, "users/", listQuery{Filter: map[string]string{"age": "30"}, Size: 10, Number: 1})
+	testNil(t, err)
+	testEqual(t, "Lee", names(users))
+
+	users, _, err = listValues[user](ctx, st, "users/", listQuery{Filter: map[string]string{"age": "1234567"}, Size: 10, Number: 1})
+	testNil(t, err)
+	testEqual(t, "Jung", names(users))
+
+	users, total, err = listValues[user](ctx, st, "users/", listQuery{Size: 10, Number: 5})
+	testNil(t, err)
+	testEqual(t, 5, total)
+	testEqual(t, 0, len(users))
+
+	values, err := url.ParseQuery("page[size]=50&page[number]=9223372036854775807")
+	testNil(t, err)
+	q, err := parseListQuery(values, listSpec{MaxSize: 50})
+	testNil(t, err)
+	users, _, err = listValues[user](ctx, st, "users/", q)
+	testNil(t, err)
+	testEqual(t, 0, len(users))
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// location identifies where an instance runs, set by the -region, -zone, and -instance flags,
+// so that operators of multi-region deployments can slice logs, traces, and metrics by location.
+// Empty identifiers are left out everywhere.
+type location struct {
+	region   string // such as eu-west-1
+	zone     string // such as eu-west-1a
+	instance string // such as the hostname or the name of the pod
+}
+
+// pairs returns the non-empty identifiers as pairs of names and values, in the order of region, zone, and instance.
+func (l location) pairs() []string {
+	var pairs []string
+	for _, p := range [][2]string{{"region", l.region}, {"zone", l.zone}, {"instance", l.instance}} {
+		if p[1] != "" {
+			pairs = append(pairs, p[0], p[1])
+		}
+	}
+	return pairs
+}
+
+// attrs returns the identifiers as log attributes, added to every log line by [run].
+func (l location) attrs() []slog.Attr {
+	pairs := l.pairs()
+	attrs := make([]slog.Attr, 0, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		attrs = append(attrs, slog.String(pairs[i], pairs[i+1]))
+	}
+	return attrs
+}
+
+// resource returns the identifiers as OTLP resource attributes under the OpenTelemetry semantic conventions,
+// see [newOTLPExporter].
+func (l location) resource() []otlpKeyValue {
+	var attrs []otlpKeyValue
+	for _, a := range []struct{ key, value string }{
+		{"cloud.region", l.region}, {"cloud.availability_zone", l.zone}, {"service.instance.id", l.instance},
+	} {
+		if a.value != "" {
+			attrs = append(attrs, otlpKeyValue{Key: a.key, Value: otlpAnyValue{StringValue: &a.value}})
+		}
+	}
+	return attrs
+}
+
+// servedBy is a middleware that tells clients which location served the request, with the X-Served-By header
+// such as "eu-west-1/eu-west-1a/web-7f9c" and an entry of the Server-Timing header such as `region;desc="eu-west-1"`,
+// which shows up in the network panel of browser devtools next to the durations of [serverTiming].
+// It reveals the topology of the deployment, so it is enabled by -location-headers only.
+func servedBy(next http.Handler, l location, enabled bool) http.Handler {
+	pairs := l.pairs()
+	if !enabled || len(pairs) == 0 {
+		return next
+	}
+	values := make([]string, 0, len(pairs)/2)
+	timings := make([]string, 0, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		values = append(values, pairs[i+1])
+		timings = append(timings, fmt.Sprintf("%s;desc=%q", pairs[i], pairs[i+1]))
+	}
+	servedBy, timing := strings.Join(values, "/"), strings.Join(timings, ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Served-By", servedBy)
+		w.Header().Add("Server-Timing", timing)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestLocation tests that the identifiers of the location are added to logs, metrics, and response headers, leaving out empty ones.
+func TestLocation(t *testing.T) {
+	loc := location{region: "eu-west-1", instance: "web-1"}
+
+	var logs bytes.Buffer
+	slog.New(slog.NewJSONHandler(&logs, nil).WithAttrs(loc.attrs())).Info("hello")
+	testContains(t, `"region":"eu-west-1","instance":"web-1"`, logs.String())
+	testEqual(t, false, strings.Contains(logs.String(), "zone"))
+
+	resource := loc.resource()
+	testEqual(t, 2, len(resource))
+	testEqual(t, "cloud.region", resource[0].Key)
+	testEqual(t, "service.instance.id", resource[1].Key)
+
+	m := newMetrics(false)
+	m.target = loc.pairs()
+	var metrics bytes.Buffer
+	m.write(&metrics)
+	testContains(t, `target_info{region="eu-west-1",instance="web-1"} 1`, metrics.String())
+
+	handler := servedBy(serverTiming(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }), true), loc, true)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	testEqual(t, "eu-west-1/web-1", w.Header().Get("X-Served-By"))
+	timing := strings.Join(w.Header().Values("Server-Timing"), ", ")
+	testContains(t, `region;desc="eu-west-1", instance;desc="web-1", total;dur=`, timing)
+
+	w = httptest.NewRecorder()
+	servedBy(http.NotFoundHandler(), loc, false).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	testEqual(t, "", w.Header().Get("X-Served-By"))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// logOutput is a destination of the logs with its own minimum level, set by the repeatable -log-output flag.
+type logOutput struct {
+	dest  string       // stdout, stderr, syslog, syslog://host:port over UDP, syslog+tcp://host:port, or the path of a file
+	level slog.Leveler // minimum level of the records written to dest, nil to follow -log-level and the admin API
+}
+
+// parseLogOutput parses a [logOutput] in the form of '<dest>[=<level>]', such as 'stdout=info' or '/var/log/app.log=debug'.
+func parseLogOutput(s string) (logOutput, error) {
+	dest, name, ok := strings.Cut(s, "=")
+	if dest == "" {
+		return logOutput{}, fmt.Errorf("invalid log output %q, must be <dest>[=<level>]", s)
+	}
+	out := logOutput{dest: dest}
+	if ok {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(name)); err != nil {
+			return logOutput{}, fmt.Errorf("invalid level of log output %q: %w", s, err)
+		}
+		out.level = level
+	}
+	return out, nil
+}
+
+// levelName returns the name of the level printed by log outputs, AUDIT for [levelAudit] and as [slog.Level.String] otherwise.
+func levelName(l slog.Level) string {
+	if l == levelAudit {
+		return "AUDIT"
+	}
+	return l.String()
+}
+
+// newLogHandler returns the [slog.Handler] of the service writing records in the format to every output,
+// teed by [teeHandler] so that each output filters records by its own minimum level, such as
+// stdout at info, a file at debug, and syslog at warn. Without outputs, it writes to stdout at level.
+// The returned function closes the files and syslog connections of the outputs.
+func newLogHandler(stdout io.Writer, format string, outputs []logOutput, level slog.Leveler) (slog.Handler, func() error, error) {
+	newHandler := func(w io.Writer, level slog.Leveler) slog.Handler {
+		opts := &slog.HandlerOptions{Level: level, ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key != slog.LevelKey || len(groups) > 0 {
+				return a
+			}
+			if l, ok := a.Value.Any().(slog.Level); ok {
+				return slog.String(slog.LevelKey, levelName(l))
+			}
+			return a
+		}}
+		if format == "text" {
+			return slog.NewTextHandler(w, opts)
+		}
+		return slog.NewJSONHandler(w, opts)
+	}
+	if len(outputs) == 0 {
+		return newHandler(stdout, level), func() error { return nil }, nil
+	}
+
+	var closers []io.Closer
+	closeAll := func() error {
+		var errs []error
+		for _, c := range closers {
+			errs = append(errs, c.Close())
+		}
+		return errors.Join(errs...)
+	}
+	tee := make(teeHandler, 0, len(outputs))
+	for _, out := range outputs {
+		level := level
+		if out.level != nil {
+			level = out.level
+		}
+		switch {
+		case out.dest == "stdout":
+			tee = append(tee, newHandler(stdout, level))
+		case out.dest == "stderr":
+			tee = append(tee, newHandler(os.Stderr, level))
+		case out.dest == "syslog" || strings.HasPrefix(out.dest, "syslog://") || strings.HasPrefix(out.dest, "syslog+tcp://"):
+			network, addr := "", ""
+			if scheme, rest, ok := strings.Cut(out.dest, "://"); ok {
+				network, addr = "udp", rest
+				if scheme == "syslog+tcp" {
+					network = "tcp"
+				}
+			}
+			h, c, err := openSyslog(network, addr, func(w io.Writer) slog.Handler { return newHandler(w, level) })
+			if err != nil {
+				closeAll()
+				return nil, nil, fmt.Errorf("log output %s: %w", out.dest, err)
+			}
+			tee, closers = append(tee, h), append(closers, c)
+		default:
+			f, err := os.OpenFile(out.dest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+			if err != nil {
+				closeAll()
+				return nil, nil, fmt.Errorf("log output %s: %w", out.dest, err)
+			}
+			tee, closers = append(tee, newHandler(f, level)), append(closers, f)
+		}
+	}
+	return tee, closeAll, nil
+}
@@ -0,0 +1,15 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"runtime"
+)
+
+// openSyslog returns an error, since log/syslog is not supported on this platform.
+func openSyslog(string, string, func(w io.Writer) slog.Handler) (slog.Handler, io.Closer, error) {
+	return nil, nil, errors.New("syslog is not supported on " + runtime.GOOS)
+}
@@ -0,0 +1,72 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"log/syslog"
+	"sync"
+)
+
+// openSyslog returns a [slog.Handler] sending records formatted by newHandler to the syslog daemon at addr over network,
+// the local one if both are empty, with the syslog priority of the level of each record.
+func openSyslog(network, addr string, newHandler func(w io.Writer) slog.Handler) (slog.Handler, io.Closer, error) {
+	w, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_DAEMON, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	pw := &priorityWriter{w: w}
+	return &syslogHandler{Handler: newHandler(pw), mu: &sync.Mutex{}, pw: pw}, w, nil
+}
+
+// priorityWriter is an [io.Writer] sending each write to syslog with the priority of level.
+type priorityWriter struct {
+	w     *syslog.Writer
+	level slog.Level
+}
+
+// Write implements the [io.Writer] interface.
+func (pw *priorityWriter) Write(p []byte) (int, error) {
+	var err error
+	switch msg := string(p); {
+	case pw.level >= slog.LevelError:
+		err = pw.w.Err(msg)
+	case pw.level >= slog.LevelWarn:
+		err = pw.w.Warning(msg)
+	case pw.level >= slog.LevelInfo:
+		err = pw.w.Info(msg)
+	default:
+		err = pw.w.Debug(msg)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// syslogHandler is a [slog.Handler] writing to a [priorityWriter], setting its level to the one of each record.
+type syslogHandler struct {
+	slog.Handler
+	mu *sync.Mutex // guards pw, shared with the handlers derived by WithAttrs and WithGroup
+	pw *priorityWriter
+}
+
+// Handle implements the [slog.Handler] interface.
+func (h *syslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pw.level = r.Level
+	return h.Handler.Handle(ctx, r)
+}
+
+// WithAttrs implements the [slog.Handler] interface.
+func (h *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &syslogHandler{Handler: h.Handler.WithAttrs(attrs), mu: h.mu, pw: h.pw}
+}
+
+// WithGroup implements the [slog.Handler] interface.
+func (h *syslogHandler) WithGroup(name string) slog.Handler {
+	return &syslogHandler{Handler: h.Handler.WithGroup(name), mu: h.mu, pw: h.pw}
+}
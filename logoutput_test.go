@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestParseLogOutput tests that log outputs are parsed with an optional level.
+func TestParseLogOutput(t *testing.T) {
+	out, err := parseLogOutput("stdout")
+	testNil(t, err)
+	testEqual(t, logOutput{dest: "stdout"}, out)
+	out, err = parseLogOutput("/var/log/app.log=debug")
+	testNil(t, err)
+	testEqual(t, logOutput{dest: "/var/log/app.log", level: slog.LevelDebug}, out)
+	out, err = parseLogOutput("syslog://localhost:514=WARN")
+	testNil(t, err)
+	testEqual(t, logOutput{dest: "syslog://localhost:514", level: slog.LevelWarn}, out)
+
+	for _, s := range []string{"", "=info", "stdout=loud"} {
+		_, err := parseLogOutput(s)
+		testEqual(t, true, err != nil)
+	}
+}
+
+// TestLogOutputs tests that each log output filters records by its own level, following the default level if it has none.
+func TestLogOutputs(t *testing.T) {
+	var stdout bytes.Buffer
+	path := filepath.Join(t.TempDir(), "app.log")
+	var level slog.LevelVar
+	h, closeLogs, err := newLogHandler(&stdout, "json", []logOutput{{dest: "stdout"}, {dest: path, level: slog.LevelDebug}}, &level)
+	testNil(t, err)
+	log := slog.New(h).With(slog.String("service", "api"))
+	log.Debug("cache miss")
+	log.Info("request served")
+	level.Set(slog.LevelWarn)
+	log.Info("request served again")
+	testNil(t, closeLogs())
+
+	testEqual(t, 1, strings.Count(stdout.String(), "\n"))
+	testContains(t, `"msg":"request served","service":"api"`, stdout.String())
+	b, err := os.ReadFile(path)
+	testNil(t, err)
+	testEqual(t, 3, strings.Count(string(b), "\n"))
+	testContains(t, `"level":"DEBUG","msg":"cache miss","service":"api"`, string(b))
+
+	_, _, err = newLogHandler(&stdout, "json", []logOutput{{dest: filepath.Join(t.TempDir(), "missing", "app.log")}}, &level)
+	testEqual(t, true, err != nil)
+}
+
+// TestLogOutputSyslog tests that records are sent to syslog with the priority of their level.
+func TestLogOutputSyslog(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skip("syslog is not supported on " + runtime.GOOS)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	testNil(t, err)
+	defer conn.Close()
+
+	h, closeLogs, err := newLogHandler(&bytes.Buffer{}, "text", []logOutput{{dest: "syslog://" + conn.LocalAddr().String(), level: slog.LevelWarn}}, slog.LevelInfo)
+	testNil(t, err)
+	defer closeLogs()
+	log := slog.New(h)
+	log.Info("ignored")
+	log.Error("disk full", slog.String("path", "/data"))
+
+	buf := make([]byte, 1024)
+	testNil(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, _, err := conn.ReadFrom(buf)
+	testNil(t, err)
+	msg := string(buf[:n])
+	testContains(t, "<27>", msg) // NOTE: LOG_DAEMON (3<<3) | LOG_ERR (3)
+	testContains(t, `msg="disk full" path=/data`, msg)
+}
@@ -2,20 +2,35 @@ package main
 
 import (
 	"bytes"
+	"cmp"
 	"context"
-	_ "embed"
-	"encoding/json"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"embed"
+	"encoding/hex"
+	"errors"
 	"expvar"
 	"flag"
 	"fmt"
 	"io"
 	"log/slog"
+	"math"
+	"math/rand/v2"
+	"net"
 	"net/http"
-	"net/http/pprof"
+	"net/netip"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
 	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -24,15 +39,50 @@ func main() {
 	ctx := context.Background()
 	if err := run(ctx, os.Stdout, os.Args, Version); err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
-		os.Exit(1)
+		code := 1
+		var exitErr *exitError
+		if errors.As(err, &exitErr) {
+			code = exitErr.code
+		}
+		os.Exit(code)
 	}
 }
 
+// Exit codes of the process by the failure returned from [run] as an [exitError], so that orchestration and CI scripts
+// can tell failures apart. Other failures exit with 1, and invalid flags with 2 as [flag.ExitOnError] does.
+const (
+	exitConfig    = 2 // invalid config or OpenAPI documents
+	exitBind      = 3 // the port cannot be listened on
+	exitMigration = 4 // database migrations failed, reserved for services running them before serving
+	exitShutdown  = 5 // the shutdown timed out or was forced by a second signal
+)
+
+// exitError is an error with the exit code of the process, see [exitConfig].
+type exitError struct {
+	code int
+	err  error
+}
+
+// Error implements the error interface.
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
 // Version is set at build time using ldflags.
 // It is optional and can be omitted if not required.
 // Refer to [handleGetHealth] for more information.
 var Version string
 
+// ServiceName is the name of the service, the default of the -service-name flag.
+// Copies of this template should rename it, or set it at build time using ldflags (e.g., 'make build SERVICE_NAME=orders'),
+// so that their logs, metrics, traces, and outbound calls are distinguishable in shared infrastructure.
+var ServiceName = "kickstart"
+
 // run initiates and starts the [http.Server], blocking until the context is canceled by OS signals.
 // It listens on a port specified by the -port flag, defaulting to 8080.
 // This function is inspired by techniques discussed in the [blog post] By Mat Ryer:
@@ -41,53 +91,962 @@ var Version string
 func run(ctx context.Context, w io.Writer, args []string, version string) error {
 	ctx, cancel := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
+	if len(args) > 1 {
+		switch args[1] {
+		case "generate":
+			return generate(ctx, w, args, version)
+		case "backup", "restore":
+			return backupCommand(ctx, w, args)
+		case "openapi-diff":
+			return openapiDiffCommand(ctx, w, args)
+		}
+	}
 
-	var port uint
-	fs := flag.NewFlagSet(args[0], flag.ExitOnError)
-	fs.SetOutput(w)
-	fs.UintVar(&port, "port", 8080, "port for http api")
-	if err := fs.Parse(args[1:]); err != nil {
-		return err
+	cfg, err := parseConfig(w, args)
+	if err != nil {
+		return &exitError{code: exitConfig, err: err}
+	}
+	crash, err := openCrashReport(cfg.crashOutput, cfg.shutdownTelemetry)
+	if err != nil {
+		return &exitError{code: exitConfig, err: err}
+	}
+	defer crash.Close()
+	defer func() {
+		if v := recover(); v != nil {
+			crash.flush(slog.Default(), fmt.Sprintf("panic: %v", v), debug.Stack())
+			panic(v)
+		}
+	}()
+	if cfg.openapiLint {
+		if err := lintOpenapiDocs(); err != nil {
+			return &exitError{code: exitConfig, err: fmt.Errorf("invalid OpenAPI documents:\n%w", err)}
+		}
 	}
 
-	slog.SetDefault(slog.New(slog.NewJSONHandler(w, nil)))
+	admin := &adminState{}
+	admin.level.Set(cfg.logLevel)
+	logHandler, closeLogs, err := newLogHandler(w, cfg.logFormat, cfg.logOutputs, &admin.level)
+	if err != nil {
+		return &exitError{code: exitConfig, err: err}
+	}
+	defer closeLogs()
+	logHandler = logHandler.WithAttrs(append([]slog.Attr{slog.String("service", cfg.serviceName)}, cfg.location.attrs()...))
+	var tlsConfig *tls.Config
+	if cfg.tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.tlsCert, cfg.tlsKey)
+		if err != nil {
+			return &exitError{code: exitConfig, err: err}
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		if cfg.tlsClientCA != "" {
+			pem, err := os.ReadFile(cfg.tlsClientCA)
+			if err != nil {
+				return &exitError{code: exitConfig, err: err}
+			}
+			tlsConfig.ClientCAs = x509.NewCertPool()
+			if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+				return &exitError{code: exitConfig, err: fmt.Errorf("no certificates in %s", cfg.tlsClientCA)}
+			}
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	ln, err := listen(ctx, slog.New(logHandler), fmt.Sprintf(":%d", cfg.port), cfg.bindRetry)
+	if err != nil {
+		return &exitError{code: exitBind, err: err}
+	}
+	var tlsLn net.Listener
+	if tlsConfig != nil {
+		if tlsLn, err = listen(ctx, slog.New(logHandler), fmt.Sprintf(":%d", cfg.tlsPort), cfg.bindRetry); err != nil {
+			ln.Close()
+			return &exitError{code: exitBind, err: err}
+		}
+		tlsLn = watchConns(tlsLn, false)
+	}
+	ln = watchConns(ln, true)
+	var exporter *otlpExporter
+	if cfg.otlpEndpoint != "" {
+		exporter = newOTLPExporter(cfg.otlpEndpoint, cfg.serviceName, version, slog.New(logHandler), cfg.location.resource()...)
+		logHandler = teeHandler{logHandler, &otlpHandler{exporter: exporter, level: &admin.level}}
+	}
+	slog.SetDefault(slog.New(logHandler))
+	lc := newLifecycle(slog.Default())
+	lc.emit(ctx, stateStarting, version)
+	tuneGC(ctx, slog.Default(), cfg.gcPercent, cfg.memoryLimit)
+	var m *metrics
+	if cfg.metrics {
+		m = newMetrics(exporter != nil)
+		m.target = append([]string{"service", cfg.serviceName}, cfg.location.pairs()...)
+	}
+	client := newClient(slog.Default(), userAgent(cfg.serviceName, version), cfg.outboundTimeout, cfg.outboundChaos, m, exporter, cfg.egress)
+	jrn := newJournal(cfg.journalPath, cfg.journalSize)
+	crash.exporter, crash.metrics, crash.journal = exporter, m, jrn
+	var st *fileStore
+	var queried store
+	var exports *exportJobs
+	if cfg.storePath != "" {
+		if st, err = newFileStore(cfg.storePath); err != nil {
+			ln.Close()
+			if tlsLn != nil {
+				tlsLn.Close()
+			}
+			return fmt.Errorf("loading store: %w", err)
+		}
+		// NOTE: the values are encrypted at rest if -encryption-keys is set, while backups copy the ciphertexts as they are
+		var values store = st
+		if cfg.keyring != nil {
+			values = encryptedStore{store: st, keyring: cfg.keyring}
+		}
+		// NOTE: handlers and jobs query the store through logQueries, so that slow queries are logged and counted per route
+		queried = logQueries(values, slog.Default(), cfg.slowQuery)
+		if cfg.storeRestore != "" {
+			if _, err := restoreEmpty(ctx, slog.Default(), st, cfg.storeRestore); err != nil {
+				ln.Close()
+				if tlsLn != nil {
+					tlsLn.Close()
+				}
+				return err
+			}
+		}
+		if cfg.storeMigrate {
+			if _, err := (&storeSchema{st: queried, migrations: storeMigrations}).migrate(ctx, slog.Default()); err != nil {
+				ln.Close()
+				if tlsLn != nil {
+					tlsLn.Close()
+				}
+				return fmt.Errorf("migrating store: %w", err)
+			}
+		}
+		exports = newExportJobs(os.TempDir(), exportStore(queried))
+	}
+	bus := newEventBus(slog.Default(), m, cfg.eventWorkersMin, cfg.eventWorkersMax, cfg.eventWorkerIdle, 1024)
+	bus.maxDeliveries = cfg.eventDeliveries
+	lc.setBus(bus)
+	sched := newScheduler(slog.Default())
+	if st != nil {
+		sched.every("purge-deleted", cfg.softDeleteGrace/10, func(ctx context.Context) error {
+			purged, err := purgeDeleted(ctx, queried, cfg.softDeleteGrace)
+			if purged > 0 {
+				slog.InfoContext(ctx, "purged deleted", slog.Int("keys", purged))
+			}
+			return err
+		})
+	}
+	if cfg.ntpServer != "" {
+		// NOTE: a failed check only logs, so that an unreachable NTP server never prevents startup
+		if err := checkClock(ctx, slog.Default(), cfg.ntpServer, cfg.clockSkew); err != nil {
+			slog.WarnContext(ctx, "failed to check clock", slog.Any("error", err))
+		}
+		sched.every("clock-skew", cfg.clockInterval, func(ctx context.Context) error {
+			return checkClock(ctx, slog.Default(), cfg.ntpServer, cfg.clockSkew)
+		})
+	}
+	rl := newReloader(slog.Default(), args, cfg, lc, func(cfg config) { admin.level.Set(cfg.logLevel) })
+	go rl.watch(ctx)
+	var ready atomic.Bool
+	drain := newDrainer()
+	httpConns := newConnTracker("http")
 	server := &http.Server{
-		Addr:    fmt.Sprintf(":%d", port),
-		Handler: route(slog.Default(), version),
+		Addr: fmt.Sprintf(":%d", cfg.port),
+		Handler: route(routeDeps{
+			log:       slog.Default(),
+			version:   version,
+			cfg:       cfg,
+			outbound:  client.Transport,
+			ready:     &ready,
+			exporter:  exporter,
+			metrics:   m,
+			drain:     drain,
+			journal:   jrn,
+			admin:     admin,
+			bus:       bus,
+			store:     queried,
+			backups:   st,
+			exports:   exports,
+			lifecycle: lc,
+			scheduler: sched,
+			reloader:  rl,
+		}),
+		MaxHeaderBytes: int(cfg.maxHeaderBytes),
+		TLSConfig:      tlsConfig,
+		ConnState:      httpConns.connState,
+		ConnContext:    httpConns.connContext,
 	}
+	server.RegisterOnShutdown(drain.close)
+	registerLimit("max_header_bytes", int64(server.MaxHeaderBytes), nil)
+	servers := []*http.Server{server}
+	conns := map[*http.Server]*connTracker{server: httpConns}
 
+	if tlsLn != nil {
+		// NOTE: the plain HTTP listener only redirects to HTTPS, while the routes are served over TLS
+		redirect := &http.Server{
+			Addr:              server.Addr,
+			Handler:           redirectHTTPS(cfg.tlsPort, cfg.acmeDir),
+			ReadHeaderTimeout: 10 * time.Second,
+			ConnState:         httpConns.connState,
+			ConnContext:       httpConns.connContext,
+		}
+		servers = append(servers, redirect)
+		server.Addr = fmt.Sprintf(":%d", cfg.tlsPort)
+		httpsConns := newConnTracker("https")
+		server.ConnState, server.ConnContext = httpsConns.connState, httpsConns.connContext
+		conns[server], conns[redirect] = httpsConns, httpConns
+		go func() {
+			slog.InfoContext(ctx, "redirect server started", slog.String("addr", redirect.Addr))
+			if err := redirect.Serve(ln); err != nil && err != http.ErrServerClosed {
+				slog.ErrorContext(ctx, "redirect server error", slog.Any("error", err))
+			}
+		}()
+	}
 	go func() {
-		slog.InfoContext(ctx, "server started", slog.String("addr", server.Addr))
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		slog.InfoContext(ctx, "server started", slog.String("version", version), slog.String("addr", server.Addr), slog.String("env", cfg.env), slog.Bool("tls", tlsLn != nil))
+		var err error
+		if tlsLn != nil {
+			err = server.ServeTLS(tlsLn, "", "")
+		} else {
+			err = server.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
 			slog.ErrorContext(ctx, "server error", slog.Any("error", err))
 		}
 	}()
+	warmup(ctx, server.Handler, cfg.warmups)
+	ready.Store(true)
+	slog.InfoContext(ctx, "server ready")
+	lc.emit(ctx, stateReady, "")
 	<-ctx.Done()
+	ready.Store(false)
+	lc.emit(context.WithoutCancel(ctx), stateDraining, "")
 
-	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	if err := server.Shutdown(shutdownCtx); err != nil {
+	// NOTE: a second signal forces the exit, in case the shutdown is stuck
+	force := make(chan os.Signal, 1)
+	signal.Notify(force, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(force)
+	slog.InfoContext(ctx, "server shutting down, send the signal again to force exit", slog.String("grace", cfg.shutdownGrace.String()))
+
+	// stopped emits the stopped event once, either when the shutdown completes or when it is forced
+	var stopOnce sync.Once
+	stopped := func(err error) {
+		stopOnce.Do(func() {
+			detail := ""
+			if err != nil {
+				detail = err.Error()
+			}
+			lc.emit(context.WithoutCancel(ctx), stateStopped, detail)
+		})
+	}
+	done := make(chan error, 1)
+	go func() {
+		err := shutdown(context.Background(), slog.Default(), []shutdownPhase{
+			{name: "http", timeout: cfg.shutdownGrace, stop: func(ctx context.Context) error {
+				var wg sync.WaitGroup
+				errs := make([]error, len(servers))
+				for i, s := range servers {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						if err := s.Shutdown(ctx); err != nil {
+							n := conns[s].forceClose(context.WithoutCancel(ctx), slog.Default())
+							s.Close()
+							errs[i] = fmt.Errorf("shutting down %s, force-closed %d connections: %w", s.Addr, n, err)
+						}
+					}()
+				}
+				wg.Wait()
+				if err := errors.Join(errs...); err != nil {
+					return err
+				}
+				if err := drain.wait(ctx); err != nil {
+					return fmt.Errorf("long-lived connections not closed: %w", err)
+				}
+				return nil
+			}},
+			{name: "telemetry", timeout: cfg.shutdownTelemetry, stop: func(context.Context) error {
+				if exporter != nil {
+					exporter.Close()
+				}
+				return nil
+			}},
+		})
+		// NOTE: stopped is emitted before the workers phase closes the bus, so that its subscribers still receive it
+		stopped(err)
+		err = errors.Join(err, shutdown(context.Background(), slog.Default(), []shutdownPhase{
+			{name: "workers", timeout: cfg.shutdownWorkers, stop: func(context.Context) error {
+				sched.Close()
+				bus.Close()
+				if exports != nil {
+					exports.Close()
+				}
+				return nil
+			}},
+		}))
+		if err != nil {
+			done <- &exitError{code: exitShutdown, err: err}
+			return
+		}
+		done <- nil
+	}()
+	select {
+	case err = <-done:
+	case sig := <-force:
+		slog.WarnContext(ctx, "server forced to exit before shutdown completed", slog.String("signal", sig.String()))
+		err = &exitError{code: exitShutdown, err: fmt.Errorf("forced exit by %s during shutdown", sig)}
+	}
+	if err != nil {
+		stopped(err)
+		crash.flush(slog.Default(), err.Error(), nil)
+		return err
+	}
+	return nil
+}
+
+// listen listens on the TCP address, retrying with exponential backoff for up to window if it fails,
+// such as when the port is still in TIME_WAIT or held by another instance draining during a quick restart.
+// Each failed attempt is logged. It returns the last error once the window is over or the context is done.
+func listen(ctx context.Context, log *slog.Logger, addr string, window time.Duration) (net.Listener, error) {
+	deadline := time.Now().Add(window)
+	backoff := 100 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		ln, err := net.Listen("tcp", addr)
+		if err == nil || time.Now().Add(backoff).After(deadline) {
+			return ln, err
+		}
+		log.WarnContext(ctx, "failed to listen, retrying",
+			slog.String("addr", addr),
+			slog.Int("attempt", attempt),
+			slog.String("backoff", backoff.String()),
+			slog.Any("error", err))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, err
+		}
+		backoff = min(2*backoff, 2*time.Second)
+	}
+}
+
+// redirectHTTPS returns an [http.Handler] that permanently redirects requests to the same URL over HTTPS on tlsPort.
+// If acmeDir is not empty, ACME HTTP-01 challenges under /.well-known/acme-challenge/ are served from it instead,
+// since certificate authorities validate them over plain HTTP. It is the webroot of clients such as certbot.
+func redirectHTTPS(tlsPort uint, acmeDir string) http.Handler {
+	var challenges http.Handler
+	if acmeDir != "" {
+		challenges = http.FileServer(http.Dir(acmeDir))
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if challenges != nil && strings.HasPrefix(r.URL.Path, "/.well-known/acme-challenge/") {
+			challenges.ServeHTTP(w, r)
+			return
+		}
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if tlsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(int(tlsPort)))
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// config holds the settings of the server, parsed from flags by [parseConfig].
+type config struct {
+	port              uint
+	serviceName       string
+	env               string
+	logFormat         string
+	debug             bool
+	debugLimits       debugConfig
+	corsOrigin        string
+	autoMethods       bool
+	verboseErrors     bool
+	allocSampleRate   float64
+	metrics           bool
+	otlpEndpoint      string
+	traceSampler      string
+	traceSamplerArg   float64
+	traceForceLatency time.Duration
+	chaos             chaosConfig
+	outboundTimeout   time.Duration
+	outboundChaos     chaosConfig
+	egress            egressPolicy
+	stream            streamConfig
+	proxies           []proxyRoute
+	proxyBalance      string
+	proxyEjectAfter   int
+	proxyEjectFor     time.Duration
+	proxyRewrites     []proxyRewrite
+	affinitySource    string
+	affinityName      string
+	affinityTTL       time.Duration
+	shutdownGrace     time.Duration
+	shutdownTelemetry time.Duration
+	shutdownWorkers   time.Duration
+	eventWorkersMin   int
+	eventWorkersMax   int
+	eventWorkerIdle   time.Duration
+	eventDeliveries   int
+	maxHeaderBytes    int64
+	bodyReadTimeout   time.Duration
+	abandonTimeout    time.Duration
+	routeLogs         []routeLogRule
+	gcPercent         int
+	memoryLimit       int64
+	journalPath       string
+	journalSize       int
+	crashOutput       string
+	storePath         string
+	storeRestore      string
+	storeMigrate      bool
+	softDeleteGrace   time.Duration
+	slowQuery         time.Duration
+	queryWarnCount    int
+	ntpServer         string
+	clockSkew         time.Duration
+	clockInterval     time.Duration
+	backupTo          string
+	keyring           *keyring
+	auth              []string
+	jwtSecret         string
+	apiKeys           map[string]string
+	grants            map[string][]string
+	tlsClientCA       string
+	adminToken        string
+	adminNetworks     []netip.Prefix
+	openapiLint       bool
+	bindRetry         time.Duration
+	tlsCert           string
+	tlsKey            string
+	tlsPort           uint
+	grpcHealth        bool
+	acmeDir           string
+	warmups           []string
+	headerRules       []headerRule
+	serverTiming      bool
+	rateLimit         rateLimitConfig
+	concurrency       concurrencyConfig
+	trustedNetworks   []netip.Prefix
+	stripHeaders      []string
+	configFile        string
+	logLevel          slog.Level
+	logOutputs        []logOutput
+	dump              []string
+	location          location
+	outboundBudget    outboundBudget
+	locationHeaders   bool
+}
+
+// profiles holds the preset defaults of each environment selected by the -env flag.
+// They only apply to the flags not set explicitly, so every setting can be overridden individually.
+// Production is the default, so that the server behaves safely unless told otherwise.
+var profiles = map[string]map[string]string{
+	"dev":     {"log-format": "text", "debug": "true", "cors-origin": "*", "verbose-errors": "true", "alloc-sample-rate": "1", "openapi-lint": "true", "server-timing": "true"},
+	"staging": {"log-format": "json", "debug": "true", "cors-origin": "*", "verbose-errors": "false", "alloc-sample-rate": "0", "openapi-lint": "true", "server-timing": "true"},
+	"prod":    {"log-format": "json", "debug": "false", "cors-origin": "", "verbose-errors": "false", "alloc-sample-rate": "0", "openapi-lint": "false", "server-timing": "false"},
+}
+
+// parseConfig parses the command line arguments into a [config],
+// applying the defaults of the [profiles] selected by -env to the flags not set explicitly.
+func parseConfig(w io.Writer, args []string) (config, error) {
+	cfg := config{maxHeaderBytes: http.DefaultMaxHeaderBytes}
+	fs := flag.NewFlagSet(args[0], flag.ExitOnError)
+	fs.SetOutput(w)
+	fs.UintVar(&cfg.port, "port", 8080, "port for http api")
+	fs.StringVar(&cfg.serviceName, "service-name", ServiceName, "name of the service in logs, metrics, traces, and the User-Agent of outbound calls")
+	fs.StringVar(&cfg.env, "env", "prod", "environment profile presetting the defaults of other flags (dev, staging, prod)")
+	fs.StringVar(&cfg.logFormat, "log-format", "", "log format, json or text (default depends on -env)")
+	fs.TextVar(&cfg.logLevel, "log-level", slog.LevelInfo, "minimum level of logs, debug, info, warn, or error, reloaded on SIGHUP")
+	fs.Func("log-output", "destination of logs with its own minimum level as <dest>[=<level>], where dest is stdout, stderr, syslog, syslog://host:port, syslog+tcp://host:port, or a file (repeatable, default stdout at -log-level)", func(s string) error {
+		out, err := parseLogOutput(s)
+		cfg.logOutputs = append(cfg.logOutputs, out)
+		return err
+	})
+	fs.StringVar(&cfg.configFile, "config", "", "file of flags as name=value lines, overridden by the command line and read again on SIGHUP (disabled if empty)")
+	fs.BoolVar(&cfg.debug, "debug", false, "expose /debug/ routes (default depends on -env)")
+	fs.BoolVar(&cfg.autoMethods, "auto-methods", true, "answer HEAD for GET routes and OPTIONS with the Allow header for every route instead of 405")
+	fs.StringVar(&cfg.corsOrigin, "cors-origin", "", "allowed CORS origin of OpenAPI documents, and of preflights answered by -auto-methods and the requests following them, none if empty (default depends on -env)")
+	fs.BoolVar(&cfg.verboseErrors, "verbose-errors", false, "include internal error details in responses (default depends on -env)")
+	fs.DurationVar(&cfg.debugLimits.timeout, "debug-timeout", time.Minute, "longest a debug request may take, including CPU profiles and traces")
+	fs.IntVar(&cfg.debugLimits.concurrency, "debug-concurrency", 2, "debug requests served at once")
+	fs.BoolVar(&cfg.debugLimits.gzip, "debug-gzip", false, "compress the text responses of the debug routes")
+	fs.Float64Var(&cfg.allocSampleRate, "alloc-sample-rate", 0, "fraction of requests to account heap allocations of at /debug/allocs, if -debug is set (default depends on -env)")
+	fs.BoolVar(&cfg.metrics, "metrics", false, "serve request metrics at /metrics in the OpenMetrics format, with trace exemplars if -otlp-endpoint is set")
+	fs.StringVar(&cfg.otlpEndpoint, "otlp-endpoint", "", "OTLP/HTTP endpoint to export logs to, such as http://localhost:4318 (disabled if empty)")
+	fs.StringVar(&cfg.traceSampler, "trace-sampler", "parentbased_always_on", "trace sampler, one of "+strings.Join(samplers, ", "))
+	fs.Float64Var(&cfg.traceSamplerArg, "trace-sampler-arg", 1, "ratio of traceidratio samplers, or traces per second of ratelimited samplers")
+	fs.DurationVar(&cfg.traceForceLatency, "trace-force-latency", 0, "keep traces of requests slower than this even if not sampled (0 disables), 5xx are always kept")
+	fs.Float64Var(&cfg.chaos.rate, "chaos-rate", 0, "fraction of requests to inject faults into, for resilience testing (0 disables)")
+	fs.StringVar(&cfg.chaos.prefix, "chaos-path", "/", "path prefix of requests to inject faults into")
+	fs.DurationVar(&cfg.chaos.latency, "chaos-latency", 0, "latency to inject into faulty requests")
+	fs.IntVar(&cfg.chaos.status, "chaos-status", 0, "status to respond to faulty requests with (0 calls the handler)")
+	fs.BoolVar(&cfg.chaos.drop, "chaos-drop", false, "drop the connection of faulty requests without a response")
+	fs.IntVar(&cfg.chaos.burst, "chaos-burst", 1, "number of consecutive requests to inject faults into once triggered")
+	fs.DurationVar(&cfg.outboundTimeout, "outbound-timeout", 10*time.Second, "timeout for outbound requests")
+	fs.IntVar(&cfg.outboundBudget.calls, "outbound-budget-calls", 0, "outbound calls per inbound request before responding 503 (0 disables)")
+	fs.DurationVar(&cfg.outboundBudget.duration, "outbound-budget-time", 0, "total duration of outbound calls per inbound request before responding 503 (0 disables)")
+	fs.Float64Var(&cfg.outboundChaos.rate, "outbound-chaos-rate", 0, "fraction of outbound requests to inject faults into, for dev and test (0 disables)")
+	fs.StringVar(&cfg.outboundChaos.prefix, "outbound-chaos-target", "", "host and path prefix of outbound requests to inject faults into (e.g. api.example.com/users)")
+	fs.DurationVar(&cfg.outboundChaos.latency, "outbound-chaos-latency", 0, "latency to inject into faulty outbound requests, simulating upstream timeouts")
+	fs.IntVar(&cfg.outboundChaos.status, "outbound-chaos-status", 0, "status to respond to faulty outbound requests with (0 sends the request)")
+	fs.BoolVar(&cfg.outboundChaos.drop, "outbound-chaos-drop", false, "fail faulty outbound requests with a connection error")
+	fs.IntVar(&cfg.outboundChaos.burst, "outbound-chaos-burst", 1, "number of consecutive outbound requests to inject faults into once triggered")
+	fs.Var((*byteSize)(&cfg.maxHeaderBytes), "max-header-bytes", "maximum size of request headers, such as 512KB or 1MiB")
+	fs.DurationVar(&cfg.bodyReadTimeout, "body-read-timeout", 30*time.Second, "timeout of each read of request bodies before the client is considered stalled (0 disables)")
+	fs.DurationVar(&cfg.abandonTimeout, "abandon-cleanup-timeout", 5*time.Second, "timeout of the cleanups of requests abandoned by their clients, such as canceling queries and releasing locks")
+	fs.IntVar(&cfg.gcPercent, "gc-percent", 0, "GC percent of the runtime, -1 disables the collector (0 keeps GOGC)")
+	fs.Var((*byteSize)(&cfg.memoryLimit), "memory-limit", "soft memory limit of the runtime, such as 512MiB (0 keeps GOMEMLIMIT)")
+	fs.Var((*byteSize)(&cfg.stream.rate), "stream-rate", "size per second each streamed response is limited to, such as 512KB or 1.5MiB (0 is unlimited)")
+	fs.DurationVar(&cfg.stream.writeTimeout, "stream-write-timeout", 10*time.Second, "timeout to write each chunk of streamed responses before the client is considered stalled")
+	fs.DurationVar(&cfg.shutdownGrace, "shutdown-grace", 10*time.Second, "time to wait on shutdown for requests and long-lived connections notified to close, before cutting them")
+	fs.DurationVar(&cfg.shutdownTelemetry, "shutdown-telemetry-timeout", 5*time.Second, "time to wait on shutdown for the remaining logs and spans to be exported, after -shutdown-grace")
+	fs.IntVar(&cfg.eventWorkersMin, "event-workers-min", 1, "minimum number of workers running asynchronous event subscribers")
+	fs.IntVar(&cfg.eventWorkersMax, "event-workers-max", 4*runtime.GOMAXPROCS(0), "maximum number of workers running asynchronous event subscribers, scaled up by the depth of the queue and the latency of the deliveries")
+	fs.DurationVar(&cfg.eventWorkerIdle, "event-worker-idle", 30*time.Second, "time a worker above -event-workers-min waits for an event delivery before it exits")
+	fs.IntVar(&cfg.eventDeliveries, "event-max-deliveries", 5, "deliveries of an event to a failing asynchronous subscriber before it is dead-lettered, see /admin/dead-letters")
+	fs.DurationVar(&cfg.shutdownWorkers, "shutdown-workers-timeout", 10*time.Second, "time to wait on shutdown for queued asynchronous work such as event deliveries, after -shutdown-telemetry-timeout")
+	fs.StringVar(&cfg.journalPath, "journal", "", "file to write the summaries of the last requests to on panic or fatal exit, for crash forensics (disabled if empty)")
+	fs.IntVar(&cfg.journalSize, "journal-size", 1000, "number of the last requests kept in the journal")
+	fs.StringVar(&cfg.crashOutput, "crash-output", "", "file to append crashes to with their stacks and the final metrics, including fatal errors of any goroutine on Go 1.23+ (disabled if empty)")
+	fs.StringVar(&cfg.storePath, "store", "", "file of the embedded key-value store, backed up and restored at /admin/backup (disabled if empty)")
+	fs.DurationVar(&cfg.softDeleteGrace, "soft-delete-grace", 720*time.Hour, "time soft-deleted keys of the store can be restored for before they are purged")
+	fs.DurationVar(&cfg.slowQuery, "slow-query", 100*time.Millisecond, "queries to the store taking longer than this are logged with the request ID and route (0 disables)")
+	fs.IntVar(&cfg.queryWarnCount, "query-warn-count", 20, "queries to the store a request may issue before it is logged as possible N+1 queries, if -debug is set (0 disables)")
+	fs.Func("ntp-server", "NTP server to check the offset of the host clock against at startup and every -clock-check-interval, such as pool.ntp.org (disabled if empty)", func(s string) error {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			s = net.JoinHostPort(s, "123")
+		}
+		cfg.ntpServer = s
+		return nil
+	})
+	fs.DurationVar(&cfg.clockSkew, "clock-skew-threshold", time.Second, "offset of the host clock from -ntp-server to warn about, since tokens and signed URLs break on skewed clocks")
+	fs.DurationVar(&cfg.clockInterval, "clock-check-interval", 10*time.Minute, "how often to check the offset of the host clock from -ntp-server")
+	fs.StringVar(&cfg.storeRestore, "store-restore", "", "file or http(s) URL of a backup to restore the store from at startup, if the store is empty")
+	fs.BoolVar(&cfg.storeMigrate, "store-migrate", false, "apply the pending migrations of the store at startup, required with -store since its file is read once, so /readyz fails until the instance restarts with it")
+	fs.StringVar(&cfg.backupTo, "backup-to", "", "directory or http(s) URL such as a presigned blob storage URL that POST /admin/backups writes backups to")
+	fs.StringVar(&cfg.adminToken, "admin-token", os.Getenv("ADMIN_TOKEN"), "bearer token of the /admin/ API for runtime toggles, defaulting to $ADMIN_TOKEN (disabled if empty)")
+	fs.Func("admin-network", "network in CIDR notation the /admin/ API is available from, e.g. 10.0.0.0/8 (repeatable, default any)", func(s string) error {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return err
+		}
+		cfg.adminNetworks = append(cfg.adminNetworks, prefix)
+		return nil
+	})
+	fs.BoolVar(&cfg.openapiLint, "openapi-lint", false, "check the embedded OpenAPI documents at startup, failing if they are broken (default depends on -env)")
+	fs.DurationVar(&cfg.bindRetry, "bind-retry", 0, "time to keep retrying with backoff when the port is in use, such as by an instance still draining (0 disables)")
+	fs.StringVar(&cfg.tlsCert, "tls-cert", "", "certificate file to serve HTTPS on -tls-port with, redirecting HTTP on -port to it (disabled if empty)")
+	fs.StringVar(&cfg.tlsKey, "tls-key", "", "private key file of -tls-cert")
+	fs.UintVar(&cfg.tlsPort, "tls-port", 8443, "port for https api if -tls-cert is set")
+	fs.BoolVar(&cfg.grpcHealth, "grpc-health", false, "serve the gRPC health checking protocol reflecting /readyz over HTTP/2, requiring -tls-cert")
+	fs.StringVar(&cfg.acmeDir, "acme-dir", "", "webroot directory to serve ACME HTTP-01 challenges from on -port instead of redirecting them")
+	fs.Func("warmup", "synthetic request to issue before getting ready, in the form of 'GET /path' (repeatable)", func(s string) error {
+		if method, path, ok := strings.Cut(s, " "); !ok || method == "" || !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("warmup %q is not in the form of 'GET /path'", s)
+		}
+		cfg.warmups = append(cfg.warmups, s)
+		return nil
+	})
+	fs.Func("header", "response header rule in the form of '<path-prefix> <status-class> <Name>: <value>' to set or '<path-prefix> <status-class> -<Name>' to remove, e.g. '/static/ 2xx Cache-Control: max-age=3600' (repeatable)", func(s string) error {
+		rule, err := parseHeaderRule(s)
+		if err != nil {
+			return err
+		}
+		cfg.headerRules = append(cfg.headerRules, rule)
+		return nil
+	})
+	fs.Func("route-log", "access log level of the routes under a path prefix in the form of '<path-prefix>=<level>', where level is trace to also log bodies, info, warn for 4xx and 5xx only, error for 5xx only, or off, e.g. '/webhooks/=trace' (repeatable)", func(s string) error {
+		rule, err := parseRouteLogRule(s)
+		if err != nil {
+			return err
+		}
+		cfg.routeLogs = append(cfg.routeLogs, rule)
+		return nil
+	})
+	fs.StringVar(&cfg.location.region, "region", "", "region the instance runs in, such as eu-west-1, added to logs, traces, and metrics (omitted if empty)")
+	fs.StringVar(&cfg.location.zone, "zone", "", "availability zone the instance runs in, such as eu-west-1a, added to logs, traces, and metrics (omitted if empty)")
+	fs.StringVar(&cfg.location.instance, "instance", "", "identifier of the instance, such as the hostname or pod name, added to logs, traces, and metrics (omitted if empty)")
+	fs.BoolVar(&cfg.locationHeaders, "location-headers", false, "tell clients the -region, -zone, and -instance that served them with X-Served-By and Server-Timing headers")
+	fs.BoolVar(&cfg.serverTiming, "server-timing", false, "emit Server-Timing headers with the durations of request phases (default depends on -env)")
+	fs.Int64Var(&cfg.rateLimit.limit, "rate-limit", 0, "requests per window each client IP is limited to, overridable as 'default' through the admin API (0 disables)")
+	fs.DurationVar(&cfg.rateLimit.window, "rate-limit-window", time.Minute, "window of -rate-limit")
+	fs.BoolVar(&cfg.rateLimit.legacyHeaders, "rate-limit-legacy-headers", false, "emit X-RateLimit-* headers instead of the RateLimit-* headers of the IETF draft")
+	fs.Int64Var(&cfg.concurrency.limit, "concurrency-limit", 0, "requests served at once, shedding the others with 503 (0 disables)")
+	fs.DurationVar(&cfg.concurrency.slowStart, "concurrency-slow-start", 0, "window after readiness -concurrency-limit ramps up to full over, starting from a tenth of it (0 disables)")
+	fs.Func("proxy", "route proxied to upstreams in the form of '<path-prefix>=<url>[*weight],...', e.g. '/api/=http://10.0.0.1:8080*3,http://10.0.0.2:8080' (repeatable)", func(s string) error {
+		rt, err := parseProxyRoute(s)
+		if err != nil {
+			return err
+		}
+		cfg.proxies = append(cfg.proxies, rt)
+		return nil
+	})
+	fs.Func("proxy-rewrite", "response rewrite of a -proxy route in the form of '<path-prefix>=<kind>:<from>><to>', where kind is header, status, or json, e.g. '/api/=json:user_name>userName' (repeatable)", func(s string) error {
+		rw, err := parseProxyRewrite(s)
+		if err != nil {
+			return err
+		}
+		cfg.proxyRewrites = append(cfg.proxyRewrites, rw)
+		return nil
+	})
+	fs.Func("affinity", "key pinning the requests of a client to the same upstream of -proxy routes, 'cookie:<name>' issued by the server or 'header:<name>' sent by the client (default disabled)", func(s string) error {
+		var err error
+		cfg.affinitySource, cfg.affinityName, err = parseAffinity(s)
+		return err
+	})
+	fs.DurationVar(&cfg.affinityTTL, "affinity-ttl", time.Hour, "how long -affinity pins a client after its last request")
+	fs.StringVar(&cfg.proxyBalance, "proxy-balance", balanceWeighted, "how -proxy routes balance requests over their upstreams, weighted or least-conn")
+	fs.IntVar(&cfg.proxyEjectAfter, "proxy-eject-after", 5, "consecutive failures of an upstream of -proxy routes to eject it after")
+	fs.DurationVar(&cfg.proxyEjectFor, "proxy-eject-for", 30*time.Second, "how long an upstream of -proxy routes is ejected for")
+	fs.Func("egress-allow", "host, *.domain, or network in CIDR notation outbound requests are restricted to (repeatable, default any but link-local and metadata addresses)", cfg.egress.add)
+	fs.Func("encryption-keys", "keys encrypting the -affinity cookie and the values of -store at rest as id:base64key,..., the first of which encrypts, defaulting to $ENCRYPTION_KEYS", func(s string) (err error) {
+		cfg.keyring, err = parseKeyring(s)
 		return err
+	})
+	fs.Func("auth", "authenticators to chain in order, the first the request has credentials for authenticating it, e.g. mtls,jwt,apikey,anonymous (disabled if empty)", func(s string) error {
+		cfg.auth = strings.Split(s, ",")
+		return nil
+	})
+	fs.StringVar(&cfg.jwtSecret, "jwt-secret", os.Getenv("JWT_SECRET"), "secret of the HS256 JSON Web Tokens of the jwt authenticator, defaulting to $JWT_SECRET")
+	fs.Func("api-keys", "keys of the apikey authenticator as name:key,..., sent in the X-API-Key header, defaulting to $API_KEYS", func(s string) (err error) {
+		cfg.apiKeys, err = parseAPIKeys(s)
+		return err
+	})
+	fs.Func("grant", "scopes granted to an authenticated principal in the form of 'name=scope scope', such as the common name of a client certificate or the name of an API key (repeatable)", func(s string) error {
+		name, scopes, ok := strings.Cut(s, "=")
+		if !ok || name == "" || len(strings.Fields(scopes)) == 0 {
+			return fmt.Errorf("grant %q is not in the form of 'name=scope scope'", s)
+		}
+		if cfg.grants == nil {
+			cfg.grants = map[string][]string{}
+		}
+		cfg.grants[name] = append(cfg.grants[name], strings.Fields(scopes)...)
+		return nil
+	})
+	fs.StringVar(&cfg.tlsClientCA, "tls-client-ca", "", "CA certificates file verifying client certificates of the mtls authenticator, which clients may omit")
+	fs.Func("trusted-network", "network in CIDR notation whose requests keep internal headers, e.g. 10.0.0.0/8 (repeatable, default loopback)", func(s string) error {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return err
+		}
+		cfg.trustedNetworks = append(cfg.trustedNetworks, prefix)
+		return nil
+	})
+	fs.Func("strip-header", "internal request header to strip from untrusted networks, with a trailing * to match a prefix (repeatable, default X-User-ID and X-Internal-*)", func(s string) error {
+		cfg.stripHeaders = append(cfg.stripHeaders, s)
+		return nil
+	})
+	if err := fs.Parse(args[1:]); err != nil {
+		return config{}, err
+	}
+	if cfg.configFile != "" {
+		if err := readConfigFile(fs, cfg.configFile); err != nil {
+			return config{}, err
+		}
+	}
+	if keys := os.Getenv("ENCRYPTION_KEYS"); cfg.keyring == nil && keys != "" {
+		var err error
+		if cfg.keyring, err = parseKeyring(keys); err != nil {
+			return config{}, fmt.Errorf("invalid ENCRYPTION_KEYS: %w", err)
+		}
 	}
+	if keys := os.Getenv("API_KEYS"); cfg.apiKeys == nil && keys != "" {
+		var err error
+		if cfg.apiKeys, err = parseAPIKeys(keys); err != nil {
+			return config{}, fmt.Errorf("invalid API_KEYS: %w", err)
+		}
+	}
+	if cfg.trustedNetworks == nil {
+		cfg.trustedNetworks = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128")}
+	}
+	if cfg.stripHeaders == nil {
+		cfg.stripHeaders = []string{"X-User-ID", "X-Internal-*"}
+	}
+
+	profile, ok := profiles[cfg.env]
+	if !ok {
+		return config{}, fmt.Errorf("unknown env %q, must be one of dev, staging, prod", cfg.env)
+	}
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for name, value := range profile {
+		if set[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return config{}, err
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		return config{}, fmt.Errorf("invalid config:\n%w", err)
+	}
+	cfg.dump = dumpConfig(fs, args[1:])
+	return cfg, nil
+}
+
+// validate checks the ranges of the settings and the options that are mutually exclusive,
+// reporting every violation at once prefixed by its flag, so that misconfiguration fails fast at startup.
+func (cfg config) validate() error {
+	var errs []error
+	check := func(ok bool, flag, format string, args ...any) {
+		if !ok {
+			errs = append(errs, &configError{Flag: flag, Message: fmt.Sprintf(format, args...)})
+		}
+	}
+	check(cfg.port <= 65535, "port", "must be at most 65535, got %d", cfg.port)
+	check(validServiceName(cfg.serviceName), "service-name", "must be letters, digits, '.', '-', or '_', got %q", cfg.serviceName)
+	check(cfg.logFormat == "json" || cfg.logFormat == "text", "log-format", "must be json or text, got %q", cfg.logFormat)
+	check(cfg.allocSampleRate >= 0 && cfg.allocSampleRate <= 1, "alloc-sample-rate", "must be between 0 and 1, got %v", cfg.allocSampleRate)
+	if cfg.otlpEndpoint != "" {
+		u, err := url.Parse(cfg.otlpEndpoint)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "otlp-endpoint", "must be an http or https URL, got %q", cfg.otlpEndpoint)
+	}
+	check(slices.Contains(samplers, cfg.traceSampler), "trace-sampler", "must be one of %s, got %q", strings.Join(samplers, ", "), cfg.traceSampler)
+	if strings.HasSuffix(cfg.traceSampler, "traceidratio") {
+		check(cfg.traceSamplerArg >= 0 && cfg.traceSamplerArg <= 1, "trace-sampler-arg", "must be a ratio between 0 and 1 for %s, got %v", cfg.traceSampler, cfg.traceSamplerArg)
+	}
+	check(cfg.traceSamplerArg >= 0, "trace-sampler-arg", "must not be negative, got %v", cfg.traceSamplerArg)
+	check(cfg.traceForceLatency >= 0, "trace-force-latency", "must not be negative, got %s", cfg.traceForceLatency)
+	for prefix, chaos := range map[string]chaosConfig{"chaos": cfg.chaos, "outbound-chaos": cfg.outboundChaos} {
+		check(chaos.rate >= 0 && chaos.rate <= 1, prefix+"-rate", "must be between 0 and 1, got %v", chaos.rate)
+		check(chaos.latency >= 0, prefix+"-latency", "must not be negative, got %s", chaos.latency)
+		check(chaos.status == 0 || (chaos.status >= 100 && chaos.status <= 599), prefix+"-status", "must be 0 or a status code, got %d", chaos.status)
+		check(chaos.burst >= 1, prefix+"-burst", "must be at least 1, got %d", chaos.burst)
+		check(!chaos.drop || chaos.status == 0, prefix+"-drop", "is mutually exclusive with -%s-status", prefix)
+	}
+	check(cfg.outboundTimeout > 0, "outbound-timeout", "must be positive, got %s", cfg.outboundTimeout)
+	check(cfg.outboundBudget.calls >= 0, "outbound-budget-calls", "must not be negative, got %d", cfg.outboundBudget.calls)
+	check(cfg.outboundBudget.duration >= 0, "outbound-budget-time", "must not be negative, got %s", cfg.outboundBudget.duration)
+	check(cfg.gcPercent >= -1, "gc-percent", "must be -1 or more, got %d", cfg.gcPercent)
+	check(cfg.memoryLimit >= 0, "memory-limit", "must not be negative, got %s", byteSize(cfg.memoryLimit))
+	check(cfg.maxHeaderBytes > 0, "max-header-bytes", "must be positive, got %s", byteSize(cfg.maxHeaderBytes))
+	check(cfg.proxyBalance == balanceWeighted || cfg.proxyBalance == balanceLeastConn, "proxy-balance", "must be weighted or least-conn, got %q", cfg.proxyBalance)
+	check(cfg.proxyEjectAfter > 0, "proxy-eject-after", "must be positive, got %d", cfg.proxyEjectAfter)
+	for _, rw := range cfg.proxyRewrites {
+		check(slices.ContainsFunc(cfg.proxies, func(rt proxyRoute) bool { return rt.prefix == rw.prefix }), "proxy-rewrite", "has no -proxy route %s", rw.prefix)
+	}
+	check(cfg.affinityTTL > 0, "affinity-ttl", "must be positive, got %s", cfg.affinityTTL)
+	check(cfg.proxyEjectFor > 0, "proxy-eject-for", "must be positive, got %s", cfg.proxyEjectFor)
+	check(cfg.abandonTimeout > 0, "abandon-cleanup-timeout", "must be positive, got %s", cfg.abandonTimeout)
+	check(cfg.bodyReadTimeout >= 0, "body-read-timeout", "must not be negative, got %s", cfg.bodyReadTimeout)
+	check(cfg.stream.rate >= 0, "stream-rate", "must not be negative, got %d", cfg.stream.rate)
+	check(cfg.stream.writeTimeout >= 0, "stream-write-timeout", "must not be negative, got %s", cfg.stream.writeTimeout)
+	check((cfg.tlsCert == "") == (cfg.tlsKey == ""), "tls-key", "must be set together with -tls-cert")
+	if cfg.tlsCert != "" {
+		check(cfg.tlsPort <= 65535, "tls-port", "must be at most 65535, got %d", cfg.tlsPort)
+		check(cfg.tlsPort != cfg.port, "tls-port", "must differ from -port, got %d", cfg.tlsPort)
+	}
+	check(cfg.acmeDir == "" || cfg.tlsCert != "", "acme-dir", "requires -tls-cert")
+	for i, method := range cfg.auth {
+		switch method {
+		case authMTLS:
+			check(cfg.tlsClientCA != "", "auth", "mtls requires -tls-client-ca")
+		case authJWT:
+			check(len(cfg.jwtSecret) >= 32, "auth", "jwt requires -jwt-secret of at least 32 bytes")
+		case authAPIKey:
+			check(len(cfg.apiKeys) > 0, "auth", "apikey requires -api-keys")
+		case authAnonymous:
+			check(i == len(cfg.auth)-1, "auth", "anonymous must be the last authenticator")
+		default:
+			check(false, "auth", "unknown authenticator %q, must be one of mtls, jwt, apikey, anonymous", method)
+		}
+	}
+	check(cfg.tlsClientCA == "" || cfg.tlsCert != "", "tls-client-ca", "requires -tls-cert")
+	check(!cfg.grpcHealth || cfg.tlsCert != "", "grpc-health", "requires -tls-cert, since gRPC is only served over HTTP/2")
+	check(cfg.debugLimits.timeout > 0, "debug-timeout", "must be positive, got %s", cfg.debugLimits.timeout)
+	check(cfg.debugLimits.concurrency > 0, "debug-concurrency", "must be positive, got %d", cfg.debugLimits.concurrency)
+	check(cfg.rateLimit.limit >= 0, "rate-limit", "must not be negative, got %d", cfg.rateLimit.limit)
+	check(cfg.rateLimit.window > 0, "rate-limit-window", "must be positive, got %s", cfg.rateLimit.window)
+	check(cfg.concurrency.limit >= 0, "concurrency-limit", "must not be negative, got %d", cfg.concurrency.limit)
+	check(cfg.concurrency.slowStart >= 0, "concurrency-slow-start", "must not be negative, got %s", cfg.concurrency.slowStart)
+	check(cfg.bindRetry >= 0, "bind-retry", "must not be negative, got %s", cfg.bindRetry)
+	check(cfg.shutdownGrace > 0, "shutdown-grace", "must be positive, got %s", cfg.shutdownGrace)
+	check(cfg.shutdownTelemetry > 0, "shutdown-telemetry-timeout", "must be positive, got %s", cfg.shutdownTelemetry)
+	check(cfg.eventWorkersMin > 0, "event-workers-min", "must be positive, got %d", cfg.eventWorkersMin)
+	check(cfg.eventWorkersMax >= cfg.eventWorkersMin, "event-workers-max", "must be at least -event-workers-min %d, got %d", cfg.eventWorkersMin, cfg.eventWorkersMax)
+	check(cfg.eventWorkerIdle > 0, "event-worker-idle", "must be positive, got %s", cfg.eventWorkerIdle)
+	check(cfg.eventDeliveries > 0, "event-max-deliveries", "must be positive, got %d", cfg.eventDeliveries)
+	check(cfg.shutdownWorkers > 0, "shutdown-workers-timeout", "must be positive, got %s", cfg.shutdownWorkers)
+	if cfg.journalPath != "" {
+		check(cfg.journalSize > 0, "journal-size", "must be positive when -journal is set, got %d", cfg.journalSize)
+	}
+	if cfg.storePath != "" {
+		info, err := os.Stat(filepath.Dir(cfg.storePath))
+		check(err == nil && info.IsDir(), "store", "must be in an existing directory, got %q", cfg.storePath)
+	}
+	check(cfg.storeRestore == "" || cfg.storePath != "", "store-restore", "requires -store")
+	check(cfg.clockSkew > 0, "clock-skew-threshold", "must be positive, got %s", cfg.clockSkew)
+	check(cfg.clockInterval >= time.Minute, "clock-check-interval", "must be at least 1m, got %s", cfg.clockInterval)
+	check(cfg.softDeleteGrace >= time.Minute, "soft-delete-grace", "must be at least 1m, got %s", cfg.softDeleteGrace)
+	check(cfg.slowQuery >= 0, "slow-query", "must not be negative, got %s", cfg.slowQuery)
+	check(cfg.queryWarnCount >= 0, "query-warn-count", "must not be negative, got %d", cfg.queryWarnCount)
+	check(cfg.backupTo == "" || cfg.storePath != "", "backup-to", "requires -store")
+	slices.SortFunc(errs, func(a, b error) int { return strings.Compare(a.Error(), b.Error()) })
+	return errors.Join(errs...)
+}
+
+// byteSize is a number of bytes parsed from human-friendly sizes such as "512KB" or "1.5GiB" by its Set method,
+// so that it can be used as a [flag.Value] for size limits. Units are B, KB, MB, GB, and TB in powers of 1000,
+// and KiB, MiB, GiB, and TiB in powers of 1024. A number without a unit is a number of bytes.
+type byteSize int64
+
+// byteUnits are the units of [byteSize], ordered so that no unit is a suffix of the units after it.
+var byteUnits = []struct {
+	name string
+	size float64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"B", 1},
+}
+
+// Set implements the [flag.Value] interface.
+func (b *byteSize) Set(s string) error {
+	number, size := strings.TrimSpace(s), 1.0
+	for _, unit := range byteUnits {
+		if n, ok := strings.CutSuffix(number, unit.name); ok {
+			number, size = strings.TrimSpace(n), unit.size
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(number, 64)
+	if err != nil || f < 0 || math.IsInf(f*size, 0) || f*size > math.MaxInt64 {
+		return fmt.Errorf("invalid size %q, must be a number of bytes or a number with a unit such as 512KB or 1.5GiB", s)
+	}
+	*b = byteSize(f * size)
 	return nil
 }
 
+// String implements the [flag.Value] interface, formatting the size with the largest binary unit dividing it.
+func (b byteSize) String() string {
+	for i := 3; i >= 0; i-- {
+		if unit := byteUnits[i]; b != 0 && int64(b)%int64(unit.size) == 0 {
+			return fmt.Sprintf("%d%s", int64(b)/int64(unit.size), unit.name)
+		}
+	}
+	return fmt.Sprintf("%dB", int64(b))
+}
+
+// routeDeps are the dependencies of [route], built by [run].
+type routeDeps struct {
+	log      *slog.Logger
+	version  string
+	cfg      config
+	outbound http.RoundTripper // of [newClient], for the handlers calling upstream services such as the -proxy routes
+	ready    *atomic.Bool
+	exporter *otlpExporter // nil unless -otlp-endpoint is set
+	metrics  *metrics      // nil unless -metrics is set
+	drain    *drainer      // for the handlers of long-lived connections such as SSE and WebSockets
+	journal  *journal      // nil unless -journal is set
+	admin    *adminState   // for the handlers reading feature flags and rate limits toggled at runtime
+	bus      *eventBus     // for the handlers emitting domain events
+	store    store         // for the handlers persisting data, wrapped by [logQueries], nil unless -store is set
+	backups  *fileStore    // for the admin API backing up and restoring the store, nil unless -store is set
+	exports  *exportJobs   // for the handlers exporting the store in the background, nil unless -store is set
+	// lifecycle emits the changes of state of the server, scheduler runs the background jobs,
+	// and reloader reloads the config on SIGHUP or through the admin API.
+	lifecycle *lifecycle
+	scheduler *scheduler
+	reloader  *reloader
+}
+
 // route sets up and returns an [http.Handler] for all the server routes.
-// It is the single source of truth for all the routes.
+// It is the single source of truth for all the routes. Register them with [handle] to document them at /debug/routes.
 // You can add custom [http.Handler] as needed.
-func route(log *slog.Logger, version string) http.Handler {
+// Pass the dependencies of [routeDeps] on to the handlers needing them.
+func route(d routeDeps) http.Handler {
+	var schema *storeSchema
+	if d.store != nil {
+		schema = &storeSchema{st: d.store, migrations: storeMigrations}
+	}
 	mux := http.NewServeMux()
-	mux.Handle("GET /health", handleGetHealth(version))
-	mux.Handle("GET /openapi.yaml", handleGetOpenapi(version))
-	mux.Handle("/debug/", handleGetDebug())
+	handle(mux, "GET /health", handleGetHealth(d.version), routeMeta{Summary: "Health and build information", Stability: "stable", Cache: cacheNoStore}, d.cfg.routeLogs...)
+	handle(mux, "GET /readyz", handleGetReadyz(d.ready, &d.admin.cordoned, schema), routeMeta{Summary: "Readiness after warmup", Stability: "stable", Cache: cacheNoStore}, d.cfg.routeLogs...)
+	handle(mux, "GET /openapi.yaml", handleGetOpenapi(d.version, d.cfg.corsOrigin), routeMeta{Summary: "Default OpenAPI document", Stability: "stable", Cache: cachePublic(5 * time.Minute)}, d.cfg.routeLogs...)
+	handle(mux, "GET /openapi/{$}", handleGetOpenapiIndex(d.cfg.corsOrigin), routeMeta{Summary: "Index of OpenAPI documents", Stability: "beta"}, d.cfg.routeLogs...)
+	handle(mux, "GET /openapi/{name}", handleGetOpenapi(d.version, d.cfg.corsOrigin), routeMeta{Summary: "OpenAPI document by name", Stability: "beta", Cache: cachePublic(5 * time.Minute)}, d.cfg.routeLogs...)
+	handle(mux, "GET /openapi/routes.yaml", handleGetRoutesOpenapi(d.version, d.cfg.auth), routeMeta{Summary: "OpenAPI document generated from the routes", Stability: "experimental"}, d.cfg.routeLogs...)
+	if d.cfg.grpcHealth {
+		handle(mux, "POST /grpc.health.v1.Health/Check", handleGRPCHealthCheck(d.ready, &d.admin.cordoned, schema), routeMeta{Summary: "gRPC health check", Stability: "beta"}, d.cfg.routeLogs...)
+		handle(mux, "POST /grpc.health.v1.Health/Watch", handleGRPCHealthWatch(d.ready, &d.admin.cordoned, schema, d.drain), routeMeta{Summary: "gRPC health watch", Stability: "beta"}, d.cfg.routeLogs...)
+	}
+	var allocs allocStats
+	var errs errorStats
+	var queries *queryStats
+	if d.cfg.debug {
+		queries = &queryStats{}
+		handle(mux, "/debug/", protectDebug(handleGetDebug(&allocs, &errs, queries), d.cfg.debugLimits), routeMeta{Summary: "pprof, expvars, limits, allocations, errors, queries, routes, and GC controls", Stability: "experimental"}, d.cfg.routeLogs...)
+	}
+	if d.metrics != nil {
+		handle(mux, "GET /metrics", handleGetMetrics(d.metrics), routeMeta{Summary: "Metrics in the OpenMetrics format", Stability: "stable"}, d.cfg.routeLogs...)
+	}
+	for _, rt := range d.cfg.proxies {
+		for _, rw := range d.cfg.proxyRewrites {
+			if rw.prefix == rt.prefix {
+				rt.rewriters = append(rt.rewriters, rw.rewrite)
+			}
+		}
+		pool := newUpstreamPool(rt, d.cfg.proxyBalance, d.cfg.proxyEjectAfter, d.cfg.proxyEjectFor, d.outbound)
+		pool.affinity = newAffinity(d.cfg.affinitySource, d.cfg.affinityName, d.cfg.affinityTTL, d.cfg.keyring)
+		handle(mux, rt.prefix, handleProxy(pool, d.metrics), routeMeta{Summary: fmt.Sprintf("Proxy to %d upstreams", len(rt.upstreams)), Stability: "beta"}, d.cfg.routeLogs...)
+	}
+	if d.exports != nil {
+		handle(mux, "POST /exports", handlePostExport(d.exports), routeMeta{Summary: "Start exporting the store", Scopes: []string{"exports"}, Stability: "experimental", Cache: cacheNoStore}, d.cfg.routeLogs...)
+		handle(mux, "GET /exports/{id}", handleGetExport(d.exports), routeMeta{Summary: "Status of an export", Scopes: []string{"exports"}, Stability: "experimental", Cache: cacheNoStore}, d.cfg.routeLogs...)
+		handle(mux, "GET /exports/{id}/download", handleGetExportDownload(d.exports, d.cfg.stream, d.metrics), routeMeta{Summary: "Download a succeeded export", Scopes: []string{"exports"}, Stability: "experimental", Cache: cacheNoStore}, d.cfg.routeLogs...)
+	}
+	if d.cfg.adminToken != "" {
+		handle(mux, "/admin/", handleAdmin(adminDeps{
+			log:         d.log,
+			state:       d.admin,
+			token:       d.cfg.adminToken,
+			metrics:     d.metrics,
+			store:       d.store,
+			backups:     d.backups,
+			backupTo:    d.cfg.backupTo,
+			lifecycle:   d.lifecycle,
+			drain:       d.drain,
+			diagnostics: handlePostDiagnostics(d.journal, d.cfg.dump),
+			scheduler:   d.scheduler,
+			bus:         d.bus,
+			reloader:    d.reloader,
+		}), routeMeta{Summary: "Runtime toggles", Auth: "bearer", Stability: "beta", Access: accessPolicy{networks: d.cfg.adminNetworks}}, d.cfg.routeLogs...)
+	}
 
-	handler := accesslog(mux, log)
-	handler = recovery(handler, log)
+	var handler http.Handler = mux
+	if d.cfg.autoMethods {
+		handler = autoMethods(handler, mux, d.cfg.corsOrigin)
+	}
+	if d.cfg.debug {
+		handler = accountAllocs(handler, mux, &allocs, d.cfg.allocSampleRate)
+	}
+	if d.store != nil {
+		handler = countQueries(handler, mux, queries, d.log, d.cfg.queryWarnCount)
+	}
+	handler = trackOutbound(handler, d.cfg.outboundBudget)
+	handler = rateLimit(handler, "default", d.cfg.rateLimit, d.admin)
+	handler = limitConcurrency(handler, d.cfg.concurrency, d.ready)
+	handler = maintenance(handler, d.admin)
+	handler = chaos(handler, d.log, d.cfg.chaos)
+	handler = headers(handler, d.cfg.headerRules)
+	handler = authorize(handler, mux)
+	handler = authenticate(handler, newAuthenticators(d.cfg), d.cfg.grants)
+	handler = measure(handler, mux, d.metrics)
+	handler = trackConnRoutes(handler, mux)
+	handler = cleanupAbandoned(handler, d.cfg.abandonTimeout)
+	handler = accesslog(handler, d.log)
+	handler = recordJournal(handler, d.journal)
+	handler = recovery(handler, d.log, d.cfg.verboseErrors)
+	handler = aggregateErrors(handler, mux, &errs, d.log)
+	handler = requestID(handler)
+	handler = tracing(handler, &sampler{name: d.cfg.traceSampler, arg: d.cfg.traceSamplerArg, forceLatency: d.cfg.traceForceLatency}, d.exporter)
+	handler = serverTiming(handler, d.cfg.serverTiming)
+	handler = servedBy(handler, d.cfg.location, d.cfg.locationHeaders)
+	handler = stripUntrusted(handler, d.log, d.cfg.trustedNetworks, d.cfg.stripHeaders)
+	handler = limitBodyStalls(handler, d.cfg.bodyReadTimeout)
 	return handler
 }
 
 // handleGetHealth returns an [http.HandlerFunc] that responds with the health status of the service.
-// It includes the service version, VCS revision, build time, and modified status.
+// It includes the service version, VCS revision, build time, modified status, and the [features] compiled in.
 // The service version can be set at build time using the VERSION variable (e.g., 'make build VERSION=v1.0.0').
 func handleGetHealth(version string) http.HandlerFunc {
 	type responseBody struct {
@@ -96,9 +1055,10 @@ func handleGetHealth(version string) http.HandlerFunc {
 		LastCommitHash string    `json:"LastCommitHash"`
 		LastCommitTime time.Time `json:"LastCommitTime"`
 		DirtyBuild     bool      `json:"DirtyBuild"`
+		Features       []string  `json:"Features"`
 	}
 
-	res := responseBody{Version: version}
+	res := responseBody{Version: version, Features: featureNames()}
 	buildInfo, _ := debug.ReadBuildInfo()
 	for _, kv := range buildInfo.Settings {
 		if kv.Value == "" {
@@ -116,39 +1076,322 @@ func handleGetHealth(version string) http.HandlerFunc {
 
 	up := time.Now()
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(200)
-
 		res.Uptime = time.Since(up).String()
-		if err := json.NewEncoder(w).Encode(res); err != nil {
+		if err := writeBody(w, r, 200, res); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 	}
 }
 
-// handleGetDebug returns an [http.Handler] for debug routes, including pprof and expvar routes.
-func handleGetDebug() http.Handler {
+// handleGetReadyz returns an [http.HandlerFunc] that responds whether the service is ready to serve traffic.
+// Unlike /health, it responds with 503 until [warmup] is done and after shutdown has started,
+// so load balancers only send traffic to an instance that can serve it.
+// It also responds with 503 while cordoned, so that operators can drain a single instance through the admin API,
+// and while the store is at an older schema version than the binary requires, so that a rolling deploy
+// does not send traffic to the new binary before the store is migrated.
+func handleGetReadyz(ready, cordoned *atomic.Bool, schema *storeSchema) http.HandlerFunc {
+	type responseBody struct {
+		Ready    bool          `json:"Ready"`
+		Cordoned bool          `json:"Cordoned"`
+		Schema   *schemaStatus `json:"Schema,omitempty"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		res := responseBody{Cordoned: cordoned.Load()}
+		var migrated bool
+		res.Schema, migrated = schema.status(r.Context())
+		res.Ready = ready.Load() && !res.Cordoned && migrated
+		status := http.StatusOK
+		if !res.Ready {
+			status = http.StatusServiceUnavailable
+		}
+		if err := writeBody(w, r, status, res); err != nil {
+			slog.ErrorContext(r.Context(), "failed to write readyz", slog.Any("error", err))
+		}
+	}
+}
+
+// warmup issues the synthetic requests in the form of "GET /path" through the handler before /readyz goes healthy.
+// This compiles templates, primes caches, and warms up hot paths, reducing latency spikes of the first requests.
+// Failed requests are logged but do not prevent the service from getting ready.
+func warmup(ctx context.Context, handler http.Handler, requests []string) {
+	for _, request := range requests {
+		method, path, _ := strings.Cut(request, " ")
+		r, err := http.NewRequestWithContext(ctx, method, path, nil)
+		if err != nil {
+			slog.WarnContext(ctx, "warmup failed", slog.String("request", request), slog.Any("error", err))
+			continue
+		}
+		r.RemoteAddr = "127.0.0.1:0"
+
+		start := time.Now()
+		w := &warmupWriter{header: http.Header{}}
+		handler.ServeHTTP(w, r)
+		w.status = cmp.Or(w.status, http.StatusOK) // NOTE: handlers writing nothing respond with 200
+		level := slog.LevelInfo
+		if w.status >= 400 {
+			level = slog.LevelWarn
+		}
+		slog.Log(ctx, level, "warmup",
+			slog.String("request", request),
+			slog.Int("status", w.status),
+			slog.String("latency", time.Since(start).String()))
+	}
+}
+
+// warmupWriter is an [http.ResponseWriter] of the requests of [warmup], recording the status and discarding the body.
+type warmupWriter struct {
+	header http.Header
+	status int
+}
+
+// Header implements the [http.ResponseWriter] interface.
+func (ww *warmupWriter) Header() http.Header {
+	return ww.header
+}
+
+// Write implements the [http.ResponseWriter] interface.
+func (ww *warmupWriter) Write(b []byte) (int, error) {
+	if ww.status == 0 {
+		ww.status = http.StatusOK
+	}
+	return len(b), nil
+}
+
+// WriteHeader implements the [http.ResponseWriter] interface.
+func (ww *warmupWriter) WriteHeader(statusCode int) {
+	if ww.status == 0 {
+		ww.status = statusCode
+	}
+}
+
+// handleGetDebug returns an [http.Handler] for debug routes, including expvar routes and the debug routes of [features] such as pprof.
+func handleGetDebug(allocs *allocStats, errs *errorStats, queries *queryStats) http.Handler {
 	mux := http.NewServeMux()
 
-	// NOTE: this route is same as defined in net/http/pprof init function
-	mux.HandleFunc("/debug/pprof/", pprof.Index)
-	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
-	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
-	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
-	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	for _, f := range features {
+		if f.debug != nil {
+			f.debug(mux)
+		}
+	}
 
 	// NOTE: this route is same as defined in expvar init function
 	mux.Handle("/debug/vars", expvar.Handler())
+
+	mux.Handle("GET /debug/limits", handleGetLimits())
+	mux.Handle("GET /debug/allocs", handleGetAllocs(allocs))
+	mux.Handle("GET /debug/errors", handleGetErrors(errs))
+	mux.Handle("GET /debug/queries", handleGetQueries(queries))
+	mux.Handle("GET /debug/routes", handleGetRoutes())
+	mux.Handle("GET /debug/conns", handleGetConns())
+	mux.Handle("GET /debug/deprecations", handleGetDeprecations())
+	mux.Handle("/debug/echo", handleEcho())
+	mux.Handle("GET /debug/delay", handleGetDelay())
+	mux.Handle("POST /debug/free-os-memory", handlePostFreeOSMemory())
 	return mux
 }
 
-// handleGetOpenapi returns an [http.HandlerFunc] that serves the OpenAPI specification YAML file.
-// The file is embedded in the binary using the go:embed directive.
-func handleGetOpenapi(version string) http.HandlerFunc {
-	body := bytes.Replace(openapi, []byte("${{ VERSION }}"), []byte(version), 1)
+// maxEchoBody caps the size of the request bodies echoed by [handleEcho].
+const maxEchoBody = 1 << 20
+
+// handleEcho returns an [http.HandlerFunc] that responds with the request as the server received it,
+// including the headers added or removed by proxies and the client IP resolved from the connection,
+// for diagnosing proxy and header issues. The body is echoed up to [maxEchoBody].
+func handleEcho() http.HandlerFunc {
+	type responseBody struct {
+		Method   string      `json:"Method"`
+		URL      string      `json:"URL"`
+		Proto    string      `json:"Proto"`
+		Host     string      `json:"Host"`
+		ClientIP string      `json:"ClientIP"`
+		Header   http.Header `json:"Header"`
+		Body     string      `json:"Body"`
+	}
+
+	registerLimit("echo_body_bytes", maxEchoBody, nil)
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxEchoBody))
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, fmt.Errorf("failed to read body: %w", err))
+			return
+		}
+		ip := r.RemoteAddr
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			ip = host
+		}
+		res := responseBody{
+			Method:   r.Method,
+			URL:      r.URL.String(),
+			Proto:    r.Proto,
+			Host:     r.Host,
+			ClientIP: ip,
+			Header:   r.Header,
+			Body:     string(body),
+		}
+
+		if err := writeBody(w, r, 200, res); err != nil {
+			slog.ErrorContext(r.Context(), "failed to write echo", slog.Any("error", err))
+		}
+	}
+}
+
+// handleGetDelay returns an [http.HandlerFunc] that responds with 204 after the delay given by ?ms=, up to a minute,
+// for testing timeouts of clients and proxies. It stops early if the client goes away.
+func handleGetDelay() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		ms, err := strconv.Atoi(r.URL.Query().Get("ms"))
+		if err != nil || ms < 0 || ms > 60_000 {
+			writeProblem(w, r, http.StatusBadRequest, errors.New("ms must be a number of milliseconds between 0 and 60000"))
+			return
+		}
+		select {
+		case <-time.After(time.Duration(ms) * time.Millisecond):
+			w.WriteHeader(http.StatusNoContent)
+		case <-r.Context().Done():
+		}
+	}
+}
+
+// handleGetLimits returns an [http.HandlerFunc] that responds with every limit registered by [registerLimit].
+// Each limit includes its current usage and utilization ratio when the usage is tracked.
+func handleGetLimits() http.HandlerFunc {
+	type limitBody struct {
+		Name        string   `json:"Name"`
+		Limit       int64    `json:"Limit"`
+		Used        *int64   `json:"Used,omitempty"`
+		Utilization *float64 `json:"Utilization,omitempty"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		res := []limitBody{}
+		limits.Range(func(key, value any) bool {
+			l := value.(limit)
+			body := limitBody{Name: key.(string), Limit: l.max()}
+			if l.used != nil {
+				used := l.used()
+				utilization := 0.0
+				if body.Limit > 0 {
+					utilization = float64(used) / float64(body.Limit)
+				}
+				body.Used, body.Utilization = &used, &utilization
+			}
+			res = append(res, body)
+			return true
+		})
+		slices.SortFunc(res, func(a, b limitBody) int { return strings.Compare(a.Name, b.Name) })
+
+		if err := writeBody(w, r, 200, res); err != nil {
+			slog.ErrorContext(r.Context(), "failed to write limits", slog.Any("error", err))
+		}
+	}
+}
+
+// limit is a configured limit reported by /debug/limits.
+// used reports the current usage of the limit, and is nil if the usage is not tracked.
+type limit struct {
+	max  func() int64
+	used func() int64
+}
+
+// limits holds every limit registered by [registerLimit], keyed by name.
+var limits sync.Map
+
+// registerLimit registers a limit to be reported by /debug/limits, replacing any limit with the same name.
+// Register rate limits, concurrency caps, body sizes and quotas here so operators can see headroom at a glance.
+func registerLimit(name string, max int64, used func() int64) {
+	registerLimitFunc(name, func() int64 { return max }, used)
+}
+
+// registerLimitFunc is like [registerLimit] for limits changing at runtime, such as through the admin API.
+func registerLimitFunc(name string, max, used func() int64) {
+	limits.Store(name, limit{max: max, used: used})
+}
+
+// routeMeta documents a route registered by [handle], reported by /debug/routes.
+type routeMeta struct {
+	Summary   string // what the route does, in a few words
+	Auth      string // authentication required, such as "bearer", empty if none
+	Stability string // stable, beta, experimental, or deprecated
+
+	Scopes []string     // scopes the principal must be granted, enforced by [authorize]
+	Log    string       // access log level: trace, info, warn, error, or off, empty for info, overridden by -route-log
+	Cache  string       // Cache-Control of the responses set by [cacheControl], such as [cacheNoStore] or [cachePrivate], empty to leave it to the handler
+	Access accessPolicy // when and from where the route is available, enforced by [restrict], available always and from anywhere if zero
+
+	Deprecated time.Time // when the route was deprecated, announced to callers by [deprecate] if set
+	Sunset     time.Time // when the route is going to be removed, optional
+}
+
+// routes holds the metadata of every route registered by [handle], keyed by pattern.
+var routes sync.Map
+
+// handle registers the handler for the pattern in mux, like [http.ServeMux.Handle], with the metadata of the route,
+// so that operational docs such as auth requirements and stability stay next to the code registering the route.
+// Routes with meta.Deprecated set are wrapped by [deprecate], routes with meta.Access set by [restrict],
+// and routes not logged at info by [logRoute],
+// resolving their levels with the -route-log rules, see [routeLogLevel].
+func handle(mux *http.ServeMux, pattern string, handler http.Handler, meta routeMeta, rules ...routeLogRule) {
+	if !meta.Deprecated.IsZero() {
+		handler = deprecate(handler, pattern, meta)
+	}
+	if meta.Cache != "" {
+		handler = cacheControl(handler, meta.Cache)
+	}
+	if len(meta.Access.windows) > 0 || len(meta.Access.networks) > 0 {
+		handler = restrict(handler, meta.Access)
+	}
+	if level := routeLogLevel(pattern, meta, rules); level != slog.LevelInfo {
+		handler = logRoute(handler, level)
+	}
+	mux.Handle(pattern, handler)
+	routes.Store(pattern, meta)
+}
+
+// handleGetRoutes returns an [http.HandlerFunc] that responds with every route registered by [handle] and its metadata.
+func handleGetRoutes() http.HandlerFunc {
+	type routeBody struct {
+		Pattern   string   `json:"Pattern"`
+		Summary   string   `json:"Summary"`
+		Auth      string   `json:"Auth,omitempty"`
+		Scopes    []string `json:"Scopes,omitempty"`
+		Stability string   `json:"Stability"`
+		Cache     string   `json:"Cache,omitempty"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		res := []routeBody{}
+		routes.Range(func(key, value any) bool {
+			meta := value.(routeMeta)
+			res = append(res, routeBody{Pattern: key.(string), Summary: meta.Summary, Auth: meta.Auth, Scopes: meta.Scopes, Stability: meta.Stability, Cache: meta.Cache})
+			return true
+		})
+		slices.SortFunc(res, func(a, b routeBody) int { return strings.Compare(a.Pattern, b.Pattern) })
+
+		if err := writeBody(w, r, 200, res); err != nil {
+			slog.ErrorContext(r.Context(), "failed to write routes", slog.Any("error", err))
+		}
+	}
+}
+
+// handleGetOpenapi returns an [http.HandlerFunc] that serves the OpenAPI specification YAML file
+// named by the {name} path value, or api/openapi.yaml if the route has none.
+// The files are embedded in the binary using the go:embed directive.
+func handleGetOpenapi(version, corsOrigin string) http.HandlerFunc {
+	docs := openapiDocs(version)
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, ok := "openapi", true
+		if r.PathValue("name") != "" {
+			name, ok = strings.CutSuffix(r.PathValue("name"), ".yaml")
+		}
+		body, found := docs[name]
+		if !ok || !found {
+			writeProblem(w, r, http.StatusNotFound, fmt.Errorf("no OpenAPI document named %q", name))
+			return
+		}
 		w.Header().Set("Content-Type", "text/plain")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if corsOrigin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", corsOrigin)
+		}
 		w.WriteHeader(200)
 		if _, err := w.Write(body); err != nil {
 			slog.ErrorContext(r.Context(), "failed to write openapi", slog.Any("error", err))
@@ -156,36 +1399,360 @@ func handleGetOpenapi(version string) http.HandlerFunc {
 	}
 }
 
-// openapi holds the embedded OpenAPI YAML file.
-// Remove this and the api/openapi.yaml file if you prefer not to serve OpenAPI.
+// handleGetOpenapiIndex returns an [http.HandlerFunc] that responds with the names and URLs of the OpenAPI documents.
+func handleGetOpenapiIndex(corsOrigin string) http.HandlerFunc {
+	type responseBody struct {
+		Name string `json:"Name"`
+		URL  string `json:"URL"`
+	}
+
+	res := []responseBody{}
+	for name := range openapiDocs("") {
+		res = append(res, responseBody{Name: name, URL: "/openapi/" + name + ".yaml"})
+	}
+	slices.SortFunc(res, func(a, b responseBody) int { return strings.Compare(a.Name, b.Name) })
+	return func(w http.ResponseWriter, r *http.Request) {
+		if corsOrigin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", corsOrigin)
+		}
+		if err := writeBody(w, r, 200, res); err != nil {
+			slog.ErrorContext(r.Context(), "failed to write openapi index", slog.Any("error", err))
+		}
+	}
+}
+
+// openapiDocs returns the embedded OpenAPI documents by the names of their files without the extension,
+// with the version placeholder replaced.
+func openapiDocs(version string) map[string][]byte {
+	docs := map[string][]byte{}
+	entries, _ := openapi.ReadDir("api") // NOTE: the directory is embedded, so reading it never fails
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".yaml")
+		if !ok {
+			continue
+		}
+		b, _ := openapi.ReadFile("api/" + entry.Name())
+		docs[name] = bytes.Replace(b, []byte("${{ VERSION }}"), []byte(version), 1)
+	}
+	return docs
+}
+
+// openapi holds the embedded OpenAPI YAML files, such as separate documents of public and internal APIs or of API versions.
+// Each api/{name}.yaml file is served at /openapi/{name}.yaml, and api/openapi.yaml also at /openapi.yaml.
+// Remove this and the api directory if you prefer not to serve OpenAPI.
 //
-//go:embed api/openapi.yaml
-var openapi []byte
+//go:embed api/*.yaml
+var openapi embed.FS
+
+// expansion is the parsed form of the ?expand= query parameter.
+// Each key is a relation to embed, and its value holds the nested relations to embed within it.
+// For example, "?expand=author.company,comments" is parsed as {"author": {"company": {}}, "comments": {}}.
+type expansion map[string]expansion
+
+// parseExpand parses the ?expand= query parameter of the request into an [expansion].
+// Relations are separated by commas and nested relations by dots. The parameter may be repeated.
+// It returns an error if a relation is nested deeper than maxDepth,
+// or if allowed is not empty and the relation is not a prefix of one of the allowed relations.
+// Every expanded relation is counted in the "expand" expvar map, see [handleGetDebug].
+//
+//	exp, err := parseExpand(r, 2, "author.company", "comments")
+//	if err != nil {
+//		http.Error(w, err.Error(), http.StatusBadRequest)
+//		return
+//	}
+//	if exp.Has("author") {
+//		post.Author = loadAuthor(ctx, post.AuthorID, exp.Sub("author"))
+//	}
+func parseExpand(r *http.Request, maxDepth int, allowed ...string) (expansion, error) {
+	exp, paths := expansion{}, []string{}
+	for _, param := range r.URL.Query()["expand"] {
+		for _, path := range strings.Split(param, ",") {
+			path = strings.TrimSpace(path)
+			if path == "" {
+				continue
+			}
+			names := strings.Split(path, ".")
+			if len(names) > maxDepth {
+				return nil, fmt.Errorf("expand %q exceeds max depth %d", path, maxDepth)
+			}
+			if len(allowed) > 0 && !slices.ContainsFunc(allowed, func(a string) bool {
+				return a == path || strings.HasPrefix(a, path+".")
+			}) {
+				return nil, fmt.Errorf("expand %q is not allowed", path)
+			}
+			node := exp
+			for _, name := range names {
+				if name == "" {
+					return nil, fmt.Errorf("expand %q has empty relation", path)
+				}
+				if node[name] == nil {
+					node[name] = expansion{}
+				}
+				node = node[name]
+			}
+			paths = append(paths, path)
+		}
+	}
+	for _, path := range paths {
+		expandVars.Add(path, 1)
+	}
+	return exp, nil
+}
+
+// Has reports whether the relation is requested to be expanded.
+func (e expansion) Has(name string) bool {
+	_, ok := e[name]
+	return ok
+}
+
+// Sub returns the nested relations requested within the relation.
+// It returns an empty [expansion] if the relation is not requested.
+func (e expansion) Sub(name string) expansion {
+	if sub, ok := e[name]; ok {
+		return sub
+	}
+	return expansion{}
+}
+
+// expandVars counts how many times each relation is expanded, served by /debug/vars.
+var expandVars = expvar.NewMap("expand")
+
+// problem is the body of an RFC 9457 problem details response, written by [writeProblem].
+// Errors and Stack are extension members only included when verbose errors are enabled, see [recovery].
+type problem struct {
+	Type      string   `json:"type,omitempty"`
+	Title     string   `json:"title"`
+	Status    int      `json:"status"`
+	Detail    string   `json:"detail,omitempty"`
+	Instance  string   `json:"instance,omitempty"`
+	RequestID string   `json:"request_id,omitempty"`
+	Errors    []string `json:"errors,omitempty"`
+	Stack     string   `json:"stack,omitempty"`
+}
+
+// writeProblem writes an application/problem+json response with the status and the request ID.
+// Use it instead of [http.Error] for errors returned to API clients.
+// The detail of 4xx responses is the message of err, since it tells the client what went wrong.
+// 5xx responses only include the detail when verbose errors are enabled (e.g. -env=dev),
+// along with the chain of wrapped errors and the stack trace. Otherwise clients only get the status and request ID
+// to report, so internal details never leak in production.
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, err error) {
+	res := problem{
+		Title:     http.StatusText(status),
+		Status:    status,
+		Instance:  r.URL.Path,
+		RequestID: requestIDFrom(r.Context()),
+	}
+	verbose, _ := r.Context().Value(verboseErrorsKey).(bool)
+	if err != nil && (status < 500 || verbose) {
+		res.Detail = err.Error()
+	}
+	if err != nil && verbose {
+		res.Errors = errorChain(err)
+		res.Stack = string(debug.Stack())
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	if err := writeJSON(w, status, res); err != nil {
+		slog.ErrorContext(r.Context(), "failed to write problem", slog.Any("error", err))
+	}
+}
+
+// errorChain returns the messages of err and every error it wraps, in depth-first order.
+func errorChain(err error) []string {
+	chain := []string{err.Error()}
+	switch e := err.(type) {
+	case interface{ Unwrap() error }:
+		if inner := e.Unwrap(); inner != nil {
+			chain = append(chain, errorChain(inner)...)
+		}
+	case interface{ Unwrap() []error }:
+		for _, inner := range e.Unwrap() {
+			chain = append(chain, errorChain(inner)...)
+		}
+	}
+	return chain
+}
+
+// contextKey is the type of keys for values stored in the request context by middlewares.
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	verboseErrorsKey
+	traceKey
+	logAttrsKey
+	serverTimingKey
+	principalKey
+)
+
+// requestID is a middleware that assigns an ID to every request, stored in the context and the X-Request-ID header.
+// The X-Request-ID header of the request is reused if it looks sane, so that IDs can be correlated across services.
+// It is placed outside of [recovery] so that panics are logged with the request ID.
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if len(id) == 0 || 128 < len(id) || strings.ContainsFunc(id, func(c rune) bool {
+			return !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.')
+		}) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+// newRequestID returns a random 128-bit request ID in hex.
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, _ = crand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestIDFrom returns the request ID assigned by [requestID], or an empty string if there is none.
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
 
 // accesslog is a middleware that logs request and response details,
 // including latency, method, path, query parameters, IP address, response status, and bytes sent.
-func accesslog(next http.Handler, log *slog.Logger) http.Handler {
+// Custom fields can be appended to each entry by the enrichers, or by handlers calling [addLogAttrs].
+// Requests are logged unless their route logs at a higher level than their status, see [routeMeta.Log],
+// where 5xx responses are at error, 4xx at warn, and any other at info.
+func accesslog(next http.Handler, log *slog.Logger, enrichers ...logEnricher) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 		wr := responseRecorder{ResponseWriter: w}
-
+		extra := &logAttrs{}
+		r = r.WithContext(context.WithValue(r.Context(), logAttrsKey, extra))
+		// NOTE: logs in a deferred function so that requests panicking through it are logged too, wherever recovery is
+		defer func() {
+			err := recover()
+			switch {
+			case err != nil && err != http.ErrAbortHandler && wr.status == 0:
+				wr.status = http.StatusInternalServerError
+			case err == nil && wr.status == 0:
+				wr.status = http.StatusOK // NOTE: net/http responds 200 to handlers writing nothing
+			}
+			logAccess(r, &wr, extra, start, log, enrichers)
+			if err != nil {
+				panic(err)
+			}
+		}()
 		next.ServeHTTP(&wr, r)
-
-		log.InfoContext(r.Context(), "accessed",
-			slog.String("latency", time.Since(start).String()),
-			slog.String("method", r.Method),
-			slog.String("path", r.URL.Path),
-			slog.String("query", r.URL.RawQuery),
-			slog.String("ip", r.RemoteAddr),
-			slog.Int("status", wr.status),
-			slog.Int("bytes", wr.numBytes))
 	})
 }
 
+// logAccess writes the access log entry of the request, unless its severity is below the level of its route, see [accesslog].
+func logAccess(r *http.Request, wr *responseRecorder, extra *logAttrs, start time.Time, log *slog.Logger, enrichers []logEnricher) {
+	level := slog.LevelInfo
+	switch {
+	case wr.status >= 500:
+		level = slog.LevelError
+	case wr.status >= 400:
+		level = slog.LevelWarn
+	}
+	extra.mu.Lock()
+	skip := level < extra.level
+	extra.mu.Unlock()
+	if skip {
+		return
+	}
+	attrs := []slog.Attr{
+		slog.String("latency", time.Since(start).String()),
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.String("query", r.URL.RawQuery),
+		slog.String("ip", r.RemoteAddr),
+		slog.String("request_id", requestIDFrom(r.Context())),
+		slog.Int("status", wr.status),
+		slog.Int("bytes", wr.numBytes),
+	}
+	for _, e := range enrichers {
+		attrs = append(attrs, e.Enrich(r, wr.status)...)
+	}
+	extra.mu.Lock()
+	attrs = append(attrs, extra.attrs...)
+	extra.mu.Unlock()
+	log.LogAttrs(r.Context(), slog.LevelInfo, "accessed", attrs...)
+}
+
+// logEnricher appends custom fields to the access log entry of each request, see [accesslog].
+// Implement it to log fields such as the A/B test bucket or the shard of a request without forking the middleware.
+type logEnricher interface {
+	Enrich(r *http.Request, status int) []slog.Attr
+}
+
+// logEnricherFunc is an adapter to allow the use of ordinary functions as [logEnricher].
+type logEnricherFunc func(r *http.Request, status int) []slog.Attr
+
+// Enrich implements the [logEnricher] interface.
+func (f logEnricherFunc) Enrich(r *http.Request, status int) []slog.Attr {
+	return f(r, status)
+}
+
+// logAttrs holds the fields added by [addLogAttrs] during a request, and the access log level of its route set by [logRoute].
+type logAttrs struct {
+	mu    sync.Mutex
+	attrs []slog.Attr
+	level slog.Level
+}
+
+// addLogAttrs appends fields to the access log entry of the request of ctx.
+// Use it from handlers and middlewares that know what the [accesslog] middleware does not,
+// such as the user ID from authentication.
+func addLogAttrs(ctx context.Context, attrs ...slog.Attr) {
+	if extra, ok := ctx.Value(logAttrsKey).(*logAttrs); ok {
+		extra.mu.Lock()
+		extra.attrs = append(extra.attrs, attrs...)
+		extra.mu.Unlock()
+	}
+}
+
+// principal holds the authenticated principal of a request set by [setPrincipal].
+type principal struct {
+	mu     sync.Mutex
+	name   string
+	method string   // set by [setAuthentication]
+	scopes []string // set by [setAuthentication]
+
+	impersonator string // set by [impersonate]
+}
+
+// setPrincipal records who the request of ctx is authenticated as, such as a user ID or "admin",
+// so that panics of the request are logged with it by [recovery]. It is also added to the access log, see [addLogAttrs].
+// Call it from authentication once the credentials are verified.
+func setPrincipal(ctx context.Context, name string) {
+	if p, ok := ctx.Value(principalKey).(*principal); ok {
+		p.mu.Lock()
+		p.name = name
+		p.mu.Unlock()
+	}
+	addLogAttrs(ctx, slog.String("principal", name))
+}
+
+// principalFrom returns the principal set by [setPrincipal], empty if the request is not authenticated.
+func principalFrom(ctx context.Context) string {
+	p, ok := ctx.Value(principalKey).(*principal)
+	if !ok {
+		return ""
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.name
+}
+
 // recovery is a middleware that recovers from panics during HTTP handler execution and logs the error details.
-// It must be the last middleware in the chain to ensure it captures all panics.
-func recovery(next http.Handler, log *slog.Logger) http.Handler {
+// It must be the last middleware in the chain that may panic to ensure it captures all panics.
+// The panic is logged with the request ID, the trace ID, and the principal set by [setPrincipal],
+// so that incidents can be tied to a specific user and trace, not just a path.
+// It also tells [writeProblem] whether to include internal error details in responses by verbose,
+// which is set for all handlers in the chain since they are called through this middleware.
+func recovery(next http.Handler, log *slog.Logger, verbose bool) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), verboseErrorsKey, verbose)
+		r = r.WithContext(context.WithValue(ctx, principalKey, &principal{}))
 		wr := responseRecorder{ResponseWriter: w}
 		defer func() {
 			if err := recover(); err != nil {
@@ -196,16 +1763,24 @@ func recovery(next http.Handler, log *slog.Logger) http.Handler {
 				stack := make([]byte, 1024)
 				n := runtime.Stack(stack, true)
 
+				var traceID string
+				if tc, ok := traceFrom(r.Context()); ok {
+					traceID = fmt.Sprintf("%x", tc.traceID)
+				}
 				log.ErrorContext(r.Context(), "panic!",
 					slog.Any("error", err),
 					slog.String("stack", string(stack[:n])),
 					slog.String("method", r.Method),
 					slog.String("path", r.URL.Path),
 					slog.String("query", r.URL.RawQuery),
-					slog.String("ip", r.RemoteAddr))
+					slog.String("ip", r.RemoteAddr),
+					slog.String("request_id", requestIDFrom(r.Context())),
+					slog.String("trace_id", traceID),
+					slog.String("principal", principalFrom(r.Context())),
+					slog.String("impersonator", impersonatorFrom(r.Context())))
 
 				if wr.status == 0 { // response is not written yet
-					http.Error(w, fmt.Sprintf("%v", err), 500)
+					writeProblem(w, r, http.StatusInternalServerError, fmt.Errorf("panic: %v", err))
 				}
 			}
 		}()
@@ -213,6 +1788,286 @@ func recovery(next http.Handler, log *slog.Logger) http.Handler {
 	})
 }
 
+// chaosConfig configures the [chaos] middleware. The zero value disables it.
+type chaosConfig struct {
+	rate    float64       // fraction of matching requests to inject faults into, between 0 and 1
+	prefix  string        // only requests with this path prefix are affected
+	latency time.Duration // latency added before handling the request
+	status  int           // status to respond with instead of calling the handler, if not zero
+	drop    bool          // closes the connection without any response
+	burst   int           // number of consecutive requests to inject faults into once triggered
+}
+
+// inject reports whether a fault should be injected into the next matching request.
+// remaining holds the number of requests left in the current burst.
+func (c chaosConfig) inject(remaining *atomic.Int64) bool {
+	for n := remaining.Load(); n > 0; n = remaining.Load() {
+		if remaining.CompareAndSwap(n, n-1) {
+			return true
+		}
+	}
+	if rand.Float64() >= c.rate {
+		return false
+	}
+	remaining.Store(int64(c.burst) - 1)
+	return true
+}
+
+// chaos is a middleware that injects latency, errors, or dropped connections into a fraction of requests,
+// so that client retry behavior can be tested against this service.
+// It is disabled unless the -chaos-rate flag is set, and should never be enabled in production.
+func chaos(next http.Handler, log *slog.Logger, cfg chaosConfig) http.Handler {
+	if cfg.rate <= 0 {
+		return next
+	}
+	var remaining atomic.Int64
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, cfg.prefix) || !cfg.inject(&remaining) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		log.WarnContext(r.Context(), "chaos injected",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("latency", cfg.latency.String()),
+			slog.Int("status", cfg.status),
+			slog.Bool("drop", cfg.drop))
+
+		if cfg.latency > 0 {
+			select {
+			case <-time.After(cfg.latency):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		switch {
+		case cfg.drop:
+			conn, _, err := http.NewResponseController(w).Hijack()
+			if err != nil { // hijacking is not supported by HTTP/2
+				http.Error(w, "chaos injected", http.StatusServiceUnavailable)
+				return
+			}
+			conn.Close()
+		case cfg.status != 0:
+			http.Error(w, "chaos injected", cfg.status)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// accessPolicy restricts when and from where a route is available, see [restrict].
+type accessPolicy struct {
+	windows  []timeWindow   // route is available only within one of the windows, or at any time if empty
+	location *time.Location // location of the windows, UTC if nil
+	networks []netip.Prefix // route is available only from the networks, or from any network if empty
+}
+
+// restrict is a middleware that makes a route available only as the [accessPolicy] allows,
+// responding with 403 and a problem response explaining why otherwise. [handle] wraps the routes with routeMeta.Access set,
+// such as the /admin/ API limited to the -admin-network flags. Use it for maintenance or batch-trigger routes, for example:
+//
+//	window, _ := parseTimeWindow("02:00-04:00")
+//	internal := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+//	handle(mux, "POST /batch", handlePostBatch(), routeMeta{Summary: "Trigger the batch", Access: accessPolicy{windows: []timeWindow{window}, networks: internal}})
+//
+// The client address is taken from [http.Request.RemoteAddr], so headers set by proxies are not trusted.
+func restrict(next http.Handler, policy accessPolicy) http.Handler {
+	loc := policy.location
+	if loc == nil {
+		loc = time.UTC
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(policy.windows) > 0 {
+			now := time.Now().In(loc)
+			if !slices.ContainsFunc(policy.windows, func(tw timeWindow) bool { return tw.contains(now) }) {
+				writeProblem(w, r, http.StatusForbidden, fmt.Errorf("available only during %v %s", policy.windows, loc))
+				return
+			}
+		}
+		if len(policy.networks) > 0 {
+			addr, err := netip.ParseAddrPort(r.RemoteAddr)
+			if err != nil || !slices.ContainsFunc(policy.networks, func(p netip.Prefix) bool { return p.Contains(addr.Addr().Unmap()) }) {
+				writeProblem(w, r, http.StatusForbidden, errors.New("available only from internal networks"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// stripUntrusted is a middleware that strips the internal headers from requests arriving from networks other than trusted,
+// so that external clients cannot inject headers set by internal proxies, such as the X-User-ID of an authenticated user.
+// A name ending with * matches every header with the prefix, such as X-Internal-*. Stripped headers are logged.
+// Like [restrict], the client address is taken from [http.Request.RemoteAddr].
+func stripUntrusted(next http.Handler, log *slog.Logger, trusted []netip.Prefix, names []string) http.Handler {
+	if len(names) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr, err := netip.ParseAddrPort(r.RemoteAddr)
+		if err == nil && slices.ContainsFunc(trusted, func(p netip.Prefix) bool { return p.Contains(addr.Addr().Unmap()) }) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var stripped []string
+		for key := range r.Header {
+			if slices.ContainsFunc(names, func(name string) bool {
+				if prefix, ok := strings.CutSuffix(name, "*"); ok {
+					return len(key) >= len(prefix) && strings.EqualFold(key[:len(prefix)], prefix)
+				}
+				return strings.EqualFold(key, name)
+			}) {
+				stripped = append(stripped, key)
+			}
+		}
+		if len(stripped) > 0 {
+			r = r.Clone(r.Context()) // NOTE: the request must not be modified by middlewares
+			for _, key := range stripped {
+				r.Header.Del(key)
+			}
+			slices.Sort(stripped)
+			log.WarnContext(r.Context(), "untrusted headers stripped", slog.Any("headers", stripped), slog.String("ip", r.RemoteAddr))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// timeWindow is a daily time range such as 02:00-04:00, stored as offsets since midnight.
+// A window ending before it starts spans midnight, such as 22:00-02:00.
+type timeWindow struct {
+	start, end time.Duration
+}
+
+// parseTimeWindow parses a time window in the form of "HH:MM-HH:MM".
+func parseTimeWindow(s string) (timeWindow, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return timeWindow{}, fmt.Errorf("time window %q is not in the form of HH:MM-HH:MM", s)
+	}
+	start, err := time.Parse("15:04", from)
+	if err != nil {
+		return timeWindow{}, fmt.Errorf("time window %q: %w", s, err)
+	}
+	end, err := time.Parse("15:04", to)
+	if err != nil {
+		return timeWindow{}, fmt.Errorf("time window %q: %w", s, err)
+	}
+	return timeWindow{start: start.Sub(start.Truncate(24 * time.Hour)), end: end.Sub(end.Truncate(24 * time.Hour))}, nil
+}
+
+// contains reports whether the clock time of t is within the window.
+func (tw timeWindow) contains(t time.Time) bool {
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if tw.start <= tw.end {
+		return tw.start <= offset && offset < tw.end
+	}
+	return tw.start <= offset || offset < tw.end
+}
+
+// String implements the [fmt.Stringer] interface.
+func (tw timeWindow) String() string {
+	midnight := time.Time{}
+	return midnight.Add(tw.start).Format("15:04") + "-" + midnight.Add(tw.end).Format("15:04")
+}
+
+// headerRule is a response header rule applied by the [headers] middleware, parsed by [parseHeaderRule].
+type headerRule struct {
+	prefix string // path prefix of requests the rule applies to
+	class  int    // status class the rule applies to, such as 2 for 2xx, or 0 for any status
+	name   string // canonical name of the header
+	value  string // value to set the header to
+	remove bool   // removes the header instead of setting it
+}
+
+// parseHeaderRule parses a header rule in the form of "<path-prefix> <status-class> <Name>: <value>"
+// to set the header, or "<path-prefix> <status-class> -<Name>" to remove it.
+// The status class is one of 1xx to 5xx, or * for any status.
+func parseHeaderRule(s string) (headerRule, error) {
+	fields := strings.SplitN(strings.TrimSpace(s), " ", 3)
+	if len(fields) != 3 || !strings.HasPrefix(fields[0], "/") {
+		return headerRule{}, fmt.Errorf("header rule %q is not in the form of '<path-prefix> <status-class> <header>'", s)
+	}
+
+	rule := headerRule{prefix: fields[0]}
+	if class := fields[1]; class != "*" {
+		if len(class) != 3 || class[1:] != "xx" || class[0] < '1' || '5' < class[0] {
+			return headerRule{}, fmt.Errorf("header rule %q has invalid status class %q", s, class)
+		}
+		rule.class = int(class[0] - '0')
+	}
+
+	header := strings.TrimSpace(fields[2])
+	if name, ok := strings.CutPrefix(header, "-"); ok {
+		rule.name, rule.remove = http.CanonicalHeaderKey(name), true
+	} else if name, value, ok := strings.Cut(header, ":"); ok {
+		rule.name, rule.value = http.CanonicalHeaderKey(strings.TrimSpace(name)), strings.TrimSpace(value)
+	}
+	if rule.name == "" {
+		return headerRule{}, fmt.Errorf("header rule %q has no header name", s)
+	}
+	return rule, nil
+}
+
+// headers is a middleware that sets or removes response headers by the rules given by -header flags,
+// so that policies like adding Cache-Control to all /static/ responses or stripping the Server header everywhere
+// don't need to touch handler code. Rules are applied in order right before the status is written.
+func headers(next http.Handler, rules []headerRule) http.Handler {
+	if len(rules) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		matched := slices.DeleteFunc(slices.Clone(rules), func(rule headerRule) bool {
+			return !strings.HasPrefix(r.URL.Path, rule.prefix)
+		})
+		if len(matched) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&headerWriter{ResponseWriter: w, rules: matched}, r)
+	})
+}
+
+// headerWriter is a wrapper around [http.ResponseWriter] that applies header rules before writing the status.
+type headerWriter struct {
+	http.ResponseWriter
+	rules       []headerRule
+	wroteHeader bool
+}
+
+// WriteHeader implements the [http.ResponseWriter] interface.
+func (hw *headerWriter) WriteHeader(statusCode int) {
+	if !hw.wroteHeader {
+		hw.wroteHeader = true
+		for _, rule := range hw.rules {
+			if rule.class != 0 && rule.class != statusCode/100 {
+				continue
+			}
+			if rule.remove {
+				hw.Header().Del(rule.name)
+			} else {
+				hw.Header().Set(rule.name, rule.value)
+			}
+		}
+	}
+	hw.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write implements the [http.ResponseWriter] interface.
+func (hw *headerWriter) Write(b []byte) (int, error) {
+	if !hw.wroteHeader {
+		hw.WriteHeader(http.StatusOK)
+	}
+	return hw.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the original [http.ResponseWriter], so that [http.ResponseController] can reach it.
+func (hw *headerWriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
+
 // responseRecorder is a wrapper around [http.ResponseWriter] that records the status and bytes written during the response.
 // It implements the [http.ResponseWriter] interface by embedding the original ResponseWriter.
 type responseRecorder struct {
@@ -237,3 +2092,8 @@ func (re *responseRecorder) WriteHeader(statusCode int) {
 	re.status = statusCode
 	re.ResponseWriter.WriteHeader(statusCode)
 }
+
+// Unwrap returns the original [http.ResponseWriter], so that [http.ResponseController] can reach it.
+func (re *responseRecorder) Unwrap() http.ResponseWriter {
+	return re.ResponseWriter
+}
@@ -3,15 +3,23 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/netip"
 	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -26,6 +34,7 @@ func TestGetHealth(t *testing.T) {
 		Revision string    `json:"vcs.revision"`
 		Time     time.Time `json:"vcs.time"`
 		// Modified bool      `json:"vcs.modified"`
+		Features []string `json:"Features"`
 	}
 
 	// actual http request to the server.
@@ -33,8 +42,22 @@ func TestGetHealth(t *testing.T) {
 	testNil(t, err)
 	testEqual(t, http.StatusOK, res.StatusCode)
 	testEqual(t, "application/json", res.Header.Get("Content-Type"))
-	testNil(t, json.NewDecoder(res.Body).Decode(&response{}))
+	testEqual(t, true, res.Header.Get("X-Request-ID") != "")
+	var body response
+	testNil(t, json.NewDecoder(res.Body).Decode(&body))
 	defer res.Body.Close()
+	// the features follow the build tags, such as no pprof with -tags nopprof
+	testEqual(t, strings.Join(featureNames(), ","), strings.Join(body.Features, ","))
+}
+
+// TestGetReadyz tests the /readyz endpoint.
+// The server is ready once [TestMain] has started it, since no warmup requests are configured.
+func TestGetReadyz(t *testing.T) {
+	res, err := http.Get(endpoint() + "/readyz")
+	testNil(t, err)
+	defer res.Body.Close()
+	testEqual(t, http.StatusOK, res.StatusCode)
+	testEqual(t, "application/json", res.Header.Get("Content-Type"))
 }
 
 // TestGetOpenapi tests the /openapi.yaml endpoint.
@@ -52,6 +75,441 @@ func TestGetOpenapi(t *testing.T) {
 
 	testContains(t, "openapi: 3.0.0", sb.String())
 	testContains(t, "version: "+version, sb.String())
+
+	res, err = http.Get(endpoint() + "/openapi/internal.yaml")
+	testNil(t, err)
+	defer res.Body.Close()
+	testEqual(t, http.StatusOK, res.StatusCode)
+	body, err := io.ReadAll(res.Body)
+	testNil(t, err)
+	testContains(t, "title: Internal API", string(body))
+
+	res, err = http.Get(endpoint() + "/openapi/internal")
+	testNil(t, err)
+	res.Body.Close()
+	testEqual(t, http.StatusNotFound, res.StatusCode)
+}
+
+// TestGetOpenapiIndex tests the /openapi/ endpoint listing every OpenAPI document.
+func TestGetOpenapiIndex(t *testing.T) {
+	type response struct {
+		Name string `json:"Name"`
+		URL  string `json:"URL"`
+	}
+
+	res, err := http.Get(endpoint() + "/openapi/")
+	testNil(t, err)
+	defer res.Body.Close()
+	testEqual(t, http.StatusOK, res.StatusCode)
+	var docs []response
+	testNil(t, json.NewDecoder(res.Body).Decode(&docs))
+	testEqual(t, true, slices.Contains(docs, response{Name: "openapi", URL: "/openapi/openapi.yaml"}))
+	testEqual(t, true, slices.Contains(docs, response{Name: "internal", URL: "/openapi/internal.yaml"}))
+}
+
+// TestGetDebugLimits tests the /debug/limits endpoint.
+func TestGetDebugLimits(t *testing.T) {
+	type response struct {
+		Name  string `json:"Name"`
+		Limit int64  `json:"Limit"`
+	}
+
+	res, err := http.Get(endpoint() + "/debug/limits")
+	testNil(t, err)
+	defer res.Body.Close()
+	testEqual(t, http.StatusOK, res.StatusCode)
+	testEqual(t, "application/json", res.Header.Get("Content-Type"))
+
+	var body []response
+	testNil(t, json.NewDecoder(res.Body).Decode(&body))
+	testEqual(t, true, slices.Contains(body, response{Name: "max_header_bytes", Limit: http.DefaultMaxHeaderBytes}))
+	testEqual(t, true, slices.Contains(body, response{Name: "echo_body_bytes", Limit: maxEchoBody}))
+	testEqual(t, true, slices.ContainsFunc(body, func(r response) bool { return r.Name == "rate_limit_default" }))
+}
+
+// TestGetDebugRoutes tests the /debug/routes endpoint.
+func TestGetDebugRoutes(t *testing.T) {
+	type response struct {
+		Pattern   string `json:"Pattern"`
+		Summary   string `json:"Summary"`
+		Auth      string `json:"Auth"`
+		Stability string `json:"Stability"`
+	}
+
+	res, err := http.Get(endpoint() + "/debug/routes")
+	testNil(t, err)
+	defer res.Body.Close()
+	testEqual(t, http.StatusOK, res.StatusCode)
+	var body []response
+	testNil(t, json.NewDecoder(res.Body).Decode(&body))
+	testEqual(t, true, slices.Contains(body, response{Pattern: "GET /health", Summary: "Health and build information", Stability: "stable"}))
+}
+
+// TestDebugEcho tests the /debug/echo endpoint.
+func TestDebugEcho(t *testing.T) {
+	type response struct {
+		Method   string      `json:"Method"`
+		ClientIP string      `json:"ClientIP"`
+		Header   http.Header `json:"Header"`
+		Body     string      `json:"Body"`
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint()+"/debug/echo?q=1", strings.NewReader("hello"))
+	testNil(t, err)
+	req.Header.Set("X-Forwarded-For", "203.0.113.1")
+	res, err := http.DefaultClient.Do(req)
+	testNil(t, err)
+	defer res.Body.Close()
+	testEqual(t, http.StatusOK, res.StatusCode)
+	var body response
+	testNil(t, json.NewDecoder(res.Body).Decode(&body))
+	testEqual(t, http.MethodPost, body.Method)
+	testEqual(t, true, body.ClientIP == "127.0.0.1" || body.ClientIP == "::1")
+	testEqual(t, "203.0.113.1", body.Header.Get("X-Forwarded-For"))
+	testEqual(t, "hello", body.Body)
+}
+
+// TestGetDebugDelay tests the /debug/delay endpoint.
+func TestGetDebugDelay(t *testing.T) {
+	start := time.Now()
+	res, err := http.Get(endpoint() + "/debug/delay?ms=50")
+	testNil(t, err)
+	res.Body.Close()
+	testEqual(t, http.StatusNoContent, res.StatusCode)
+	testEqual(t, true, time.Since(start) >= 50*time.Millisecond)
+
+	res, err = http.Get(endpoint() + "/debug/delay?ms=-1")
+	testNil(t, err)
+	res.Body.Close()
+	testEqual(t, http.StatusBadRequest, res.StatusCode)
+}
+
+// TestParseExpand tests parsing of the ?expand= query parameter.
+// It does not need the server, so it calls [parseExpand] directly.
+func TestParseExpand(t *testing.T) {
+	r, err := http.NewRequest(http.MethodGet, "/posts?expand=author.company,comments&expand=author", nil)
+	testNil(t, err)
+	exp, err := parseExpand(r, 2, "author.company", "comments")
+	testNil(t, err)
+	testEqual(t, true, exp.Has("author"))
+	testEqual(t, true, exp.Sub("author").Has("company"))
+	testEqual(t, true, exp.Has("comments"))
+	testEqual(t, false, exp.Sub("comments").Has("author"))
+
+	for _, query := range []string{"expand=a.b.c", "expand=author.name", "expand=author..company"} {
+		r, err := http.NewRequest(http.MethodGet, "/posts?"+query, nil)
+		testNil(t, err)
+		_, err = parseExpand(r, 2, "author.company", "a.b.c")
+		testEqual(t, true, err != nil)
+	}
+}
+
+// TestChaos tests that the chaos middleware only injects faults into requests matching the path prefix.
+func TestChaos(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	handler := chaos(ok, slog.New(slog.NewTextHandler(io.Discard, nil)), chaosConfig{
+		rate:    1,
+		prefix:  "/users",
+		latency: time.Millisecond,
+		status:  http.StatusServiceUnavailable,
+	})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users/1", nil))
+	testEqual(t, http.StatusServiceUnavailable, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	testEqual(t, http.StatusOK, w.Code)
+}
+
+// TestRestrict tests that restricted routes respond with 403 problem outside of the access policy.
+func TestRestrict(t *testing.T) {
+	window, err := parseTimeWindow("22:00-02:00")
+	testNil(t, err)
+	testEqual(t, "22:00-02:00", window.String())
+	testEqual(t, true, window.contains(time.Date(2024, 1, 1, 23, 30, 0, 0, time.UTC)))
+	testEqual(t, true, window.contains(time.Date(2024, 1, 1, 1, 59, 0, 0, time.UTC)))
+	testEqual(t, false, window.contains(time.Date(2024, 1, 1, 2, 0, 0, 0, time.UTC)))
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	handler := restrict(ok, accessPolicy{networks: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}})
+
+	r := httptest.NewRequest(http.MethodPost, "/batch", nil)
+	r.RemoteAddr = "10.1.2.3:1234"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	testEqual(t, http.StatusOK, w.Code)
+
+	r.RemoteAddr = "203.0.113.1:1234"
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	testEqual(t, http.StatusForbidden, w.Code)
+	testEqual(t, "application/problem+json", w.Header().Get("Content-Type"))
+	testContains(t, "internal networks", w.Body.String())
+
+	// routes registered by handle are restricted by their metadata, such as the /admin/ API by -admin-network
+	cfg, err := parseConfig(io.Discard, []string{"testapp", "-admin-token", "secret", "-admin-network", "10.0.0.0/8"})
+	testNil(t, err)
+	var ready atomic.Bool
+	handler = route(routeDeps{log: slog.New(slog.NewTextHandler(io.Discard, nil)), version: version, cfg: cfg, ready: &ready, admin: &adminState{}})
+	for addr, status := range map[string]int{"10.1.2.3:1234": http.StatusOK, "203.0.113.1:1234": http.StatusForbidden} {
+		r := httptest.NewRequest(http.MethodGet, "/admin/", nil)
+		r.RemoteAddr = addr
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		testEqual(t, status, w.Code)
+	}
+}
+
+// TestStripUntrusted tests that internal headers are stripped only from requests of untrusted networks.
+func TestStripUntrusted(t *testing.T) {
+	var got http.Header
+	handler := stripUntrusted(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+	}), slog.New(slog.NewTextHandler(io.Discard, nil)), []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, []string{"X-User-ID", "X-Internal-*"})
+
+	r := httptest.NewRequest(http.MethodGet, "/users", nil)
+	r.Header.Set("X-User-ID", "42")
+	r.Header.Set("X-Internal-Role", "admin")
+	r.Header.Set("X-Request-ID", "abc123")
+	r.RemoteAddr = "10.1.2.3:1234"
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	testEqual(t, "42", got.Get("X-User-ID"))
+	testEqual(t, "admin", got.Get("X-Internal-Role"))
+
+	r.RemoteAddr = "203.0.113.1:1234"
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	testEqual(t, "", got.Get("X-User-ID"))
+	testEqual(t, "", got.Get("X-Internal-Role"))
+	testEqual(t, "abc123", got.Get("X-Request-ID"))
+	testEqual(t, "42", r.Header.Get("X-User-ID"))
+}
+
+// TestHeaders tests that header rules are applied by path prefix and status class.
+func TestHeaders(t *testing.T) {
+	var rules []headerRule
+	for _, s := range []string{"/static/ 2xx Cache-Control: max-age=3600", "/ * -Server"} {
+		rule, err := parseHeaderRule(s)
+		testNil(t, err)
+		rules = append(rules, rule)
+	}
+	_, err := parseHeaderRule("/static/ 6xx Cache-Control: no-store")
+	testEqual(t, true, err != nil)
+
+	handler := headers(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "kickstart")
+		if r.URL.Path == "/static/missing.js" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}), rules)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/static/app.js", nil))
+	testEqual(t, "max-age=3600", w.Header().Get("Cache-Control"))
+	testEqual(t, "", w.Header().Get("Server"))
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/static/missing.js", nil))
+	testEqual(t, "", w.Header().Get("Cache-Control"))
+	testEqual(t, "", w.Header().Get("Server"))
+}
+
+// TestParseConfig tests that the -env profile presets the defaults of flags not set explicitly.
+func TestParseConfig(t *testing.T) {
+	cfg, err := parseConfig(io.Discard, []string{"testapp", "--env", "prod", "--debug"})
+	testNil(t, err)
+	testEqual(t, "json", cfg.logFormat)
+	testEqual(t, true, cfg.debug)
+	testEqual(t, "", cfg.corsOrigin)
+	testEqual(t, false, cfg.verboseErrors)
+	testEqual(t, ServiceName, cfg.serviceName)
+
+	cfg, err = parseConfig(io.Discard, []string{"testapp", "--env", "dev", "--log-format", "json"})
+	testNil(t, err)
+	testEqual(t, "json", cfg.logFormat)
+	testEqual(t, "*", cfg.corsOrigin)
+	testEqual(t, true, cfg.verboseErrors)
+
+	_, err = parseConfig(io.Discard, []string{"testapp", "--env", "local"})
+	testEqual(t, true, err != nil)
+
+	_, err = parseConfig(io.Discard, []string{"testapp", "--port", "70000", "--chaos-rate", "2", "--outbound-chaos-drop", "--outbound-chaos-status", "503", "--service-name", ""})
+	testEqual(t, true, err != nil)
+	testContains(t, "-port: must be at most 65535", err.Error())
+	testContains(t, `-service-name: must be letters, digits, '.', '-', or '_', got ""`, err.Error())
+	testContains(t, "-chaos-rate: must be between 0 and 1", err.Error())
+	testContains(t, "-outbound-chaos-drop: is mutually exclusive with -outbound-chaos-status", err.Error())
+}
+
+// TestByteSize tests parsing and formatting human-friendly sizes.
+func TestByteSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		str  string
+	}{
+		{"1024", 1024, "1KiB"},
+		{"512KB", 512_000, "500KiB"},
+		{"1.5GiB", 1536 << 20, "1536MiB"},
+		{"1 MiB", 1 << 20, "1MiB"},
+		{"10B", 10, "10B"},
+		{"0", 0, "0B"},
+	}
+	for _, tc := range tests {
+		var b byteSize
+		testNil(t, b.Set(tc.in))
+		testEqual(t, tc.want, int64(b))
+		testEqual(t, tc.str, b.String())
+	}
+	for _, in := range []string{"", "KB", "-1KB", "1XB", "1e30GB"} {
+		var b byteSize
+		testEqual(t, true, b.Set(in) != nil)
+	}
+
+	cfg, err := parseConfig(io.Discard, []string{"testapp", "--max-header-bytes", "64KiB", "--stream-rate", "1.5MB"})
+	testNil(t, err)
+	testEqual(t, int64(64<<10), cfg.maxHeaderBytes)
+	testEqual(t, int64(1_500_000), cfg.stream.rate)
+}
+
+// TestRunExitCode tests that failures of run carry the exit code of their kind.
+func TestRunExitCode(t *testing.T) {
+	var exitErr *exitError
+	err := run(context.Background(), io.Discard, []string{"testapp", "--chaos-rate", "2"}, version)
+	testEqual(t, true, errors.As(err, &exitErr))
+	testEqual(t, exitConfig, exitErr.code)
+
+	err = run(context.Background(), io.Discard, []string{"testapp", "--port", port(), "--env", "dev"}, version)
+	testEqual(t, true, errors.As(err, &exitErr))
+	testEqual(t, exitBind, exitErr.code)
+}
+
+// TestListen tests that listening is retried until the port is released.
+func TestListen(t *testing.T) {
+	held, err := net.Listen("tcp", "127.0.0.1:0")
+	testNil(t, err)
+	addr := held.Addr().String()
+	time.AfterFunc(150*time.Millisecond, func() { held.Close() })
+
+	var buf strings.Builder
+	ln, err := listen(context.Background(), slog.New(slog.NewTextHandler(&buf, nil)), addr, 2*time.Second)
+	testNil(t, err)
+	ln.Close()
+	testContains(t, "attempt=1", buf.String())
+
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	testNil(t, err)
+	defer busy.Close()
+	_, err = listen(context.Background(), slog.New(slog.NewTextHandler(io.Discard, nil)), busy.Addr().String(), 0)
+	testEqual(t, true, err != nil)
+}
+
+// TestRedirectHTTPS tests that plain HTTP requests are redirected to HTTPS except for ACME challenges.
+func TestRedirectHTTPS(t *testing.T) {
+	dir := t.TempDir()
+	testNil(t, os.MkdirAll(filepath.Join(dir, ".well-known", "acme-challenge"), 0o755))
+	testNil(t, os.WriteFile(filepath.Join(dir, ".well-known", "acme-challenge", "token"), []byte("token.thumbprint"), 0o644))
+
+	tests := []struct {
+		tlsPort  uint
+		target   string
+		status   int
+		location string
+	}{
+		{443, "http://example.com/users?limit=10", http.StatusMovedPermanently, "https://example.com/users?limit=10"},
+		{8443, "http://example.com:8080/users", http.StatusMovedPermanently, "https://example.com:8443/users"},
+		{443, "http://example.com/.well-known/acme-challenge/token", http.StatusOK, ""},
+	}
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		redirectHTTPS(tc.tlsPort, dir).ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.target, nil))
+		testEqual(t, tc.status, w.Code)
+		testEqual(t, tc.location, w.Header().Get("Location"))
+	}
+}
+
+// TestWriteProblem tests that internal error details are only written when verbose errors are enabled.
+func TestWriteProblem(t *testing.T) {
+	err := fmt.Errorf("load user: %w", errors.New("connection refused"))
+	for _, verbose := range []bool{true, false} {
+		r := httptest.NewRequest(http.MethodGet, "/users/1", nil)
+		r = r.WithContext(context.WithValue(r.Context(), verboseErrorsKey, verbose))
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey, "test-request-id"))
+		w := httptest.NewRecorder()
+		writeProblem(w, r, http.StatusInternalServerError, err)
+
+		var body problem
+		testNil(t, json.NewDecoder(w.Body).Decode(&body))
+		testEqual(t, "application/problem+json", w.Header().Get("Content-Type"))
+		testEqual(t, http.StatusInternalServerError, body.Status)
+		testEqual(t, "test-request-id", body.RequestID)
+		if verbose {
+			testEqual(t, err.Error(), body.Detail)
+			testEqual(t, 2, len(body.Errors))
+			testEqual(t, "connection refused", body.Errors[1])
+			testContains(t, "writeProblem", body.Stack)
+		} else {
+			testEqual(t, "", body.Detail)
+			testEqual(t, 0, len(body.Errors))
+			testEqual(t, "", body.Stack)
+		}
+	}
+}
+
+// TestAccesslog tests that enrichers and handlers can append custom fields to the access log entry.
+func TestAccesslog(t *testing.T) {
+	type entry struct {
+		Status int    `json:"status"`
+		Bucket string `json:"bucket"`
+		UserID string `json:"user_id"`
+	}
+
+	var buf strings.Builder
+	handler := accesslog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addLogAttrs(r.Context(), slog.String("user_id", "user-1"))
+		w.WriteHeader(http.StatusCreated)
+	}), slog.New(slog.NewJSONHandler(&buf, nil)), logEnricherFunc(func(r *http.Request, status int) []slog.Attr {
+		return []slog.Attr{slog.String("bucket", r.Header.Get("X-Bucket"))}
+	}))
+
+	r := httptest.NewRequest(http.MethodPost, "/users", nil)
+	r.Header.Set("X-Bucket", "b")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	var got entry
+	testNil(t, json.Unmarshal([]byte(buf.String()), &got))
+	testEqual(t, entry{Status: http.StatusCreated, Bucket: "b", UserID: "user-1"}, got)
+}
+
+// TestRecovery tests that panics are logged with the request ID, the trace ID, and the principal of the request.
+func TestRecovery(t *testing.T) {
+	type entry struct {
+		Message   string `json:"msg"`
+		RequestID string `json:"request_id"`
+		TraceID   string `json:"trace_id"`
+		Principal string `json:"principal"`
+	}
+
+	var buf strings.Builder
+	handler := recovery(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setPrincipal(r.Context(), "user-1")
+		panic("boom")
+	}), slog.New(slog.NewJSONHandler(&buf, nil)), false)
+
+	tc, _ := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	r := httptest.NewRequest(http.MethodGet, "/users", nil)
+	ctx := context.WithValue(context.WithValue(r.Context(), requestIDKey, "req-1"), traceKey, tc)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r.WithContext(ctx))
+	testEqual(t, http.StatusInternalServerError, w.Code)
+
+	var got entry
+	testNil(t, json.Unmarshal([]byte(buf.String()), &got))
+	testEqual(t, entry{Message: "panic!", RequestID: "req-1", TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", Principal: "user-1"}, got)
 }
 
 // TestMain starts the server and runs all the tests.
@@ -62,7 +520,7 @@ func TestMain(m *testing.M) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	args := []string{"testapp", "--port", port()}
+	args := []string{"testapp", "--port", port(), "--env", "dev"}
 	go func() {
 		err := run(ctx, os.Stdout, args, version)
 		if err != nil {
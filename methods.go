@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// probedMethods are the methods [autoMethods] probes mux with to build the Allow header, in the order listed.
+var probedMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+// autoMethods is a middleware that answers HEAD and OPTIONS for every route in mux, enabled by the -auto-methods flag,
+// so that capability checks and CORS preflights get an answer instead of 405.
+//
+// HEAD requests of GET routes run the GET handler with the body discarded, keeping its headers
+// and setting Content-Length to the size of the body it would have written, unless the handler flushes early.
+// OPTIONS requests of routes without their own OPTIONS handler are answered with 204 and the Allow header listing
+// the methods the path is routed for. Preflights also get the CORS headers if -cors-origin is set,
+// and so do the actual cross-origin requests following them, since browsers reject their responses otherwise.
+func autoMethods(next http.Handler, mux *http.ServeMux, corsOrigin string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if corsOrigin != "" && r.Method != http.MethodOptions && r.Header.Get("Origin") != "" {
+			w.Header().Set("Access-Control-Allow-Origin", corsOrigin)
+			w.Header().Add("Vary", "Origin")
+		}
+		switch r.Method {
+		case http.MethodHead:
+			hw := &headWriter{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(hw, r)
+			hw.commit(true)
+		case http.MethodOptions:
+			if _, pattern := mux.Handler(r); pattern != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			allowed := allowedMethods(mux, r)
+			if len(allowed) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			allow := strings.Join(append(allowed, http.MethodOptions), ", ")
+			w.Header().Set("Allow", allow)
+			if corsOrigin != "" && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Set("Access-Control-Allow-Origin", corsOrigin)
+				w.Header().Set("Access-Control-Allow-Methods", allow)
+				if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+					w.Header().Set("Access-Control-Allow-Headers", headers)
+				}
+				w.Header().Set("Access-Control-Max-Age", "600")
+				w.Header().Add("Vary", "Origin")
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// allowedMethods returns the methods of [probedMethods] that the path of the request is routed for in mux.
+func allowedMethods(mux *http.ServeMux, r *http.Request) []string {
+	var allowed []string
+	probe := r.Clone(r.Context())
+	for _, method := range probedMethods {
+		probe.Method = method
+		if _, pattern := mux.Handler(probe); pattern != "" {
+			allowed = append(allowed, method)
+		}
+	}
+	return allowed
+}
+
+// headWriter is a wrapper around [http.ResponseWriter] that discards the body of HEAD responses, counting its bytes,
+// and defers writing the status until the handler is done, so that Content-Length can be set from the count.
+type headWriter struct {
+	http.ResponseWriter
+	status    int
+	numBytes  int
+	committed bool
+}
+
+// WriteHeader implements the [http.ResponseWriter] interface.
+func (hw *headWriter) WriteHeader(statusCode int) {
+	if hw.committed {
+		return
+	}
+	if statusCode < 200 {
+		hw.ResponseWriter.WriteHeader(statusCode) // NOTE: informational responses such as 103 Early Hints are sent as is
+		return
+	}
+	hw.status = statusCode
+}
+
+// Write implements the [http.ResponseWriter] interface.
+func (hw *headWriter) Write(b []byte) (int, error) {
+	hw.numBytes += len(b)
+	return len(b), nil
+}
+
+// FlushError commits the status without Content-Length, since the size of the body is not known yet,
+// and flushes the headers. It is called by [http.ResponseController].
+func (hw *headWriter) FlushError() error {
+	hw.commit(false)
+	return http.NewResponseController(hw.ResponseWriter).Flush()
+}
+
+// commit writes the status, setting Content-Length to the bytes counted if the handler is done and did not set it.
+func (hw *headWriter) commit(done bool) {
+	if hw.committed {
+		return
+	}
+	hw.committed = true
+	if done && hw.numBytes > 0 && hw.Header().Get("Content-Length") == "" {
+		hw.Header().Set("Content-Length", strconv.Itoa(hw.numBytes))
+	}
+	hw.ResponseWriter.WriteHeader(hw.status)
+}
+
+// Unwrap returns the original [http.ResponseWriter], so that [http.ResponseController] can reach it.
+func (hw *headWriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestAutoMethods tests that HEAD and OPTIONS are answered for every route.
+func TestAutoMethods(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /items/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, strings.Repeat("x", 4096))
+	})
+	mux.HandleFunc("DELETE /items/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("OPTIONS /custom", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	server := httptest.NewServer(autoMethods(mux, mux, "https://example.com"))
+	defer server.Close()
+
+	do := func(method, path string, header http.Header) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, server.URL+path, nil)
+		testNil(t, err)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		res, err := http.DefaultClient.Do(req)
+		testNil(t, err)
+		res.Body.Close()
+		return res
+	}
+
+	res := do(http.MethodHead, "/items/1", nil)
+	testEqual(t, http.StatusOK, res.StatusCode)
+	testEqual(t, "4096", res.Header.Get("Content-Length"))
+	testEqual(t, "text/plain", res.Header.Get("Content-Type"))
+
+	res = do(http.MethodOptions, "/items/1", nil)
+	testEqual(t, http.StatusNoContent, res.StatusCode)
+	testEqual(t, "GET, HEAD, DELETE, OPTIONS", res.Header.Get("Allow"))
+	testEqual(t, "", res.Header.Get("Access-Control-Allow-Origin"))
+
+	res = do(http.MethodOptions, "/items/1", http.Header{
+		"Origin":                         {"https://example.com"},
+		"Access-Control-Request-Method":  {"DELETE"},
+		"Access-Control-Request-Headers": {"Authorization"},
+	})
+	testEqual(t, http.StatusNoContent, res.StatusCode)
+	testEqual(t, "https://example.com", res.Header.Get("Access-Control-Allow-Origin"))
+	testEqual(t, "GET, HEAD, DELETE, OPTIONS", res.Header.Get("Access-Control-Allow-Methods"))
+	testEqual(t, "Authorization", res.Header.Get("Access-Control-Allow-Headers"))
+	res = do(http.MethodDelete, "/items/1", http.Header{"Origin": {"https://example.com"}})
+	testEqual(t, http.StatusOK, res.StatusCode)
+	testEqual(t, "https://example.com", res.Header.Get("Access-Control-Allow-Origin"))
+	testEqual(t, "Origin", res.Header.Get("Vary"))
+	testEqual(t, "", do(http.MethodGet, "/items/1", nil).Header.Get("Access-Control-Allow-Origin"))
+
+	testEqual(t, http.StatusTeapot, do(http.MethodOptions, "/custom", nil).StatusCode)
+	testEqual(t, http.StatusNotFound, do(http.MethodOptions, "/missing", nil).StatusCode)
+	testEqual(t, http.StatusMethodNotAllowed, do(http.MethodPost, "/items/1", nil).StatusCode)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metrics holds histograms recorded by middlewares and transports, served by [handleGetMetrics].
+// It is nil unless the -metrics flag is set, and recording into a nil [metrics] does nothing.
+type metrics struct {
+	exemplars bool     // attaches trace IDs of sampled requests to histogram observations
+	target    []string // pairs of label names and values of the target_info metric, such as the [location] of the instance
+
+	mu       sync.Mutex
+	families map[string]*metricFamily
+	largest  []largeResponse // largest recent responses, sorted by size in descending order
+}
+
+// largeResponse is a response kept by [metrics.trackLargest].
+type largeResponse struct {
+	Method    string    `json:"Method"`
+	Route     string    `json:"Route"`
+	Path      string    `json:"Path"`
+	Status    int       `json:"Status"`
+	Bytes     int       `json:"Bytes"`
+	Time      time.Time `json:"Time"`
+	RequestID string    `json:"RequestID"`
+}
+
+// largestKept is the number of the largest recent responses kept by [metrics.trackLargest].
+const largestKept = 10
+
+// largestWindow is how long the largest responses are kept, so that old outliers do not hide recent bloat.
+const largestWindow = time.Hour
+
+// metricFamily is a histogram metric with a series for each set of labels.
+type metricFamily struct {
+	help    string
+	buckets []float64
+	series  map[string]*histogram // keyed by labels formatted as `key="value",...`
+}
+
+// newMetrics returns an empty [metrics].
+// If exemplars is set, observations of sampled requests carry their trace ID as an exemplar,
+// so that operators can jump from a histogram bucket directly to an example trace.
+func newMetrics(exemplars bool) *metrics {
+	return &metrics{exemplars: exemplars, families: map[string]*metricFamily{}}
+}
+
+// durationBuckets are the upper bounds in seconds of duration histogram buckets.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.075, 0.1, 0.25, 0.5, 0.75, 1, 2.5, 5, 7.5, 10}
+
+// sizeBuckets are the upper bounds in bytes of response size histogram buckets.
+var sizeBuckets = []float64{100, 1 << 10, 10 << 10, 100 << 10, 1 << 20, 10 << 20, 100 << 20}
+
+// observe records the value into the series of the labels in the histogram named name,
+// creating it with the help and buckets on the first observation.
+// labels are pairs of label names and values. The trace of tc is kept as an exemplar if it is sampled.
+func (m *metrics) observe(name, help string, buckets []float64, value float64, tc traceContext, labels ...string) {
+	if m == nil {
+		return
+	}
+	var sb strings.Builder
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		fmt.Fprintf(&sb, "%s=%q", labels[i], labels[i+1])
+	}
+	key := sb.String()
+
+	m.mu.Lock()
+	f, ok := m.families[name]
+	if !ok {
+		f = &metricFamily{help: help, buckets: buckets, series: map[string]*histogram{}}
+		m.families[name] = f
+	}
+	h, ok := f.series[key]
+	if !ok {
+		h = newHistogram(f.buckets)
+		f.series[key] = h
+	}
+	m.mu.Unlock()
+
+	var traceID string
+	if m.exemplars && tc.flags&sampledFlag != 0 {
+		traceID = fmt.Sprintf("%x", tc.traceID)
+	}
+	h.observe(value, traceID)
+}
+
+// trackLargest keeps the response if it is among the largest responses of the last [largestWindow].
+func (m *metrics) trackLargest(res largeResponse) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.largest = slices.DeleteFunc(m.largest, func(l largeResponse) bool { return res.Time.Sub(l.Time) > largestWindow })
+	i, _ := slices.BinarySearchFunc(m.largest, res.Bytes, func(l largeResponse, bytes int) int { return bytes - l.Bytes })
+	if i >= largestKept {
+		return
+	}
+	m.largest = slices.Insert(m.largest, i, res)
+	if len(m.largest) > largestKept {
+		m.largest = m.largest[:largestKept]
+	}
+}
+
+// largestResponses returns the largest responses of the last [largestWindow], largest first.
+func (m *metrics) largestResponses() []largeResponse {
+	if m == nil {
+		return []largeResponse{}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cutoff := time.Now().Add(-largestWindow)
+	res := make([]largeResponse, 0, len(m.largest))
+	for _, l := range m.largest {
+		if l.Time.After(cutoff) {
+			res = append(res, l)
+		}
+	}
+	return res
+}
+
+// measure is a middleware that records the duration and the response size of requests by method and route matched in mux,
+// keeping the largest recent responses to spot payload bloat, see [metrics.largestResponses].
+// Methods beyond the standard ones are recorded as other, see [metricMethod].
+func measure(next http.Handler, mux *http.ServeMux, m *metrics) http.Handler {
+	if m == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		_, pattern := mux.Handler(r)
+		if _, path, ok := strings.Cut(pattern, " "); ok {
+			pattern = path
+		}
+		if pattern == "" {
+			pattern = "unmatched"
+		}
+		tc, _ := traceFrom(r.Context())
+		m.observe("http_server_request_duration_seconds", "Duration of HTTP server requests.", durationBuckets,
+			time.Since(start).Seconds(), tc, "method", metricMethod(r.Method), "route", pattern)
+		m.observe("http_server_response_size_bytes", "Size of HTTP server response bodies.", sizeBuckets,
+			float64(rec.numBytes), tc, "method", metricMethod(r.Method), "route", pattern)
+		m.trackLargest(largeResponse{
+			Method:    r.Method,
+			Route:     pattern,
+			Path:      r.URL.Path,
+			Status:    rec.status,
+			Bytes:     rec.numBytes,
+			Time:      start,
+			RequestID: requestIDFrom(r.Context()),
+		})
+	})
+}
+
+// metricMethod returns the method of a request as a label value, or "other" for methods beyond the standard ones,
+// so that clients sending arbitrary methods cannot grow the series of the metrics without bound.
+func metricMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "other"
+}
+
+// handleGetMetrics returns an [http.HandlerFunc] that serves the metrics in the OpenMetrics text format,
+// which can be scraped by Prometheus. Exemplars are only supported by this format, not the classic Prometheus one.
+func handleGetMetrics(m *metrics) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		w.WriteHeader(200)
+		m.write(w)
+	}
+}
+
+// write writes the metrics in the OpenMetrics text format, starting with the target_info metric of the target labels,
+// which Prometheus joins to the other metrics of the target to slice them, such as by region.
+func (m *metrics) write(w io.Writer) {
+	if len(m.target) > 0 {
+		labels := make([]string, 0, len(m.target)/2)
+		for i := 0; i+1 < len(m.target); i += 2 {
+			labels = append(labels, fmt.Sprintf("%s=%q", m.target[i], m.target[i+1]))
+		}
+		fmt.Fprintln(w, "# TYPE target info")
+		fmt.Fprintln(w, "# HELP target Target metadata.")
+		fmt.Fprintf(w, "target_info{%s} 1\n", strings.Join(labels, ","))
+	}
+
+	m.mu.Lock()
+	names := make([]string, 0, len(m.families))
+	for name := range m.families {
+		names = append(names, name)
+	}
+	m.mu.Unlock()
+	slices.Sort(names)
+
+	for _, name := range names {
+		m.mu.Lock()
+		f := m.families[name]
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		m.mu.Unlock()
+		slices.Sort(keys)
+
+		fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+		fmt.Fprintf(w, "# HELP %s %s\n", name, f.help)
+		for _, key := range keys {
+			m.mu.Lock()
+			h := f.series[key]
+			m.mu.Unlock()
+			h.write(w, name, key)
+		}
+	}
+	fmt.Fprintln(w, "# EOF")
+}
+
+// histogram is a histogram of observations keeping the latest exemplar of each bucket.
+type histogram struct {
+	bounds []float64
+
+	mu        sync.Mutex
+	counts    []uint64 // count of each bucket, the last one for +Inf
+	exemplars []exemplar
+	sum       float64
+	count     uint64
+}
+
+// exemplar is an observation linked to the trace it was observed in.
+type exemplar struct {
+	traceID string
+	value   float64
+	time    time.Time
+}
+
+// newHistogram returns an empty [histogram] with the bucket upper bounds.
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds:    bounds,
+		counts:    make([]uint64, len(bounds)+1),
+		exemplars: make([]exemplar, len(bounds)+1),
+	}
+}
+
+// observe records the value, keeping it as the exemplar of its bucket if traceID is not empty.
+func (h *histogram) observe(value float64, traceID string) {
+	i, _ := slices.BinarySearch(h.bounds, value)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.sum += value
+	h.count++
+	if traceID != "" {
+		h.exemplars[i] = exemplar{traceID: traceID, value: value, time: time.Now()}
+	}
+}
+
+// write writes the histogram in the OpenMetrics text format with the name and the labels formatted as `key="value"`.
+func (h *histogram) write(w io.Writer, name, labels string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if labels != "" {
+		labels += ","
+	}
+	var cumulative uint64
+	for i, count := range h.counts {
+		cumulative += count
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = fmt.Sprint(h.bounds[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=%q} %d", name, labels, le, cumulative)
+		if e := h.exemplars[i]; e.traceID != "" {
+			fmt.Fprintf(w, " # {trace_id=%q} %g %.3f", e.traceID, e.value, float64(e.time.UnixMilli())/1000)
+		}
+		fmt.Fprintln(w)
+	}
+	labels = strings.TrimSuffix(labels, ",")
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestMeasure tests that request durations and response sizes are recorded by route with exemplars of sampled traces.
+func TestMeasure(t *testing.T) {
+	m := newMetrics(true)
+	mux := http.NewServeMux()
+	mux.Handle("GET /users/{id}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 1000*len(r.PathValue("id"))))
+	}))
+	mux.Handle("GET /metrics", handleGetMetrics(m))
+	handler := measure(mux, mux, m)
+
+	tc, _ := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	r := httptest.NewRequest(http.MethodGet, "/users/1", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), r.WithContext(context.WithValue(r.Context(), traceKey, tc)))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users/22", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("BREW", "/users/3", nil))
+	largest := m.largestResponses()
+	testEqual(t, "/users/22", largest[0].Path)
+	testEqual(t, 2000, largest[0].Bytes)
+	testEqual(t, "/users/{id}", largest[0].Route)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	testContains(t, "application/openmetrics-text", w.Header().Get("Content-Type"))
+	testContains(t, `http_server_request_duration_seconds_count{method="GET",route="/users/{id}"} 2`, w.Body.String())
+	testContains(t, `# {trace_id="4bf92f3577b34da6a3ce929d0e0e4736"}`, w.Body.String())
+	testContains(t, `http_server_response_size_bytes_bucket{method="GET",route="/users/{id}",le="1024"} 1`, w.Body.String())
+	testContains(t, `http_server_response_size_bytes_sum{method="GET",route="/users/{id}"} 3000`, w.Body.String())
+	testContains(t, `http_server_request_duration_seconds_count{method="other",route="unmatched"} 1`, w.Body.String())
+	testContains(t, "# EOF", w.Body.String())
+}
+
+// TestTrackLargest tests that only the largest recent responses are kept, largest first.
+func TestTrackLargest(t *testing.T) {
+	m := newMetrics(false)
+	now := time.Now()
+	m.trackLargest(largeResponse{Path: "/old", Bytes: 1 << 30, Time: now.Add(-2 * largestWindow)})
+	for i := range largestKept + 5 {
+		m.trackLargest(largeResponse{Path: fmt.Sprint("/", i), Bytes: i, Time: now})
+	}
+
+	largest := m.largestResponses()
+	testEqual(t, largestKept, len(largest))
+	testEqual(t, largestKept+4, largest[0].Bytes)
+	testEqual(t, 5, largest[largestKept-1].Bytes)
+	testEqual(t, 0, len((*metrics)(nil).largestResponses()))
+}
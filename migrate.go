@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+)
+
+// storeVersionKey is the key of the [store] holding the version of its schema, the number of [storeMigrations] applied.
+const storeVersionKey = "meta/schema-version"
+
+// storeMigration migrates the data of the [store] from one version of its schema to the next, such as
+// by rewriting values under a prefix. Keep migrations compatible with the previous binary, since both serve traffic
+// during a rolling deploy, and never reorder or remove them once released.
+type storeMigration struct {
+	name string
+	up   func(ctx context.Context, st store) error
+}
+
+// storeMigrations are the migrations of the store in order, the one at index i migrating version i to i+1,
+// so that the binary requires the store at the version of their count. Append new migrations at the end.
+var storeMigrations []storeMigration
+
+// storeSchema compares the version of the schema of a store against the version the binary requires.
+// Its methods are safe to call on nil, for services without a store, which are always up to date.
+type storeSchema struct {
+	st         store
+	migrations []storeMigration
+}
+
+// schemaStatus is the version of the schema of the store against the required one, reported by /readyz.
+type schemaStatus struct {
+	Current  int    `json:"Current"`
+	Required int    `json:"Required"`
+	Error    string `json:"Error,omitempty"`
+}
+
+// current returns the version of the schema of the store, 0 if it was never migrated.
+func (s *storeSchema) current(ctx context.Context) (int, error) {
+	b, err := s.st.Get(ctx, storeVersionKey)
+	if errors.Is(err, errNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	version, err := strconv.Atoi(string(b))
+	if err != nil {
+		return 0, fmt.Errorf("invalid schema version %q: %w", b, err)
+	}
+	return version, nil
+}
+
+// status returns the version of the schema of the store and whether it is at least the required one,
+// so that an instance of a newer binary is not ready until the store is migrated. A store migrated by a newer binary
+// is still served, since migrations are compatible with the previous binary.
+func (s *storeSchema) status(ctx context.Context) (*schemaStatus, bool) {
+	if s == nil {
+		return nil, true
+	}
+	res := &schemaStatus{Required: len(s.migrations)}
+	current, err := s.current(ctx)
+	if err != nil {
+		res.Error = err.Error()
+		return res, false
+	}
+	res.Current = current
+	return res, current >= res.Required
+}
+
+// migrate applies the migrations the store has not been migrated by yet, recording the version after each,
+// so that a failed migration is retried from where it stopped. It returns the version of the store.
+func (s *storeSchema) migrate(ctx context.Context, log *slog.Logger) (int, error) {
+	version, err := s.current(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for ; version < len(s.migrations); version++ {
+		m := s.migrations[version]
+		if err := m.up(ctx, s.st); err != nil {
+			return version, fmt.Errorf("migration %d %s: %w", version+1, m.name, err)
+		}
+		if err := s.st.Put(ctx, storeVersionKey, []byte(strconv.Itoa(version+1))); err != nil {
+			return version, err
+		}
+		log.InfoContext(ctx, "store migrated", slog.Int("version", version+1), slog.String("migration", m.name))
+	}
+	return version, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// TestStoreSchema tests that readiness fails until the store is migrated to the version the binary requires.
+func TestStoreSchema(t *testing.T) {
+	st, err := newFileStore(filepath.Join(t.TempDir(), "store.json"))
+	testNil(t, err)
+	ctx := context.Background()
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	var ready, cordoned atomic.Bool
+	ready.Store(true)
+	failing := true
+	schema := &storeSchema{st: st, migrations: []storeMigration{
+		{name: "add plans", up: func(ctx context.Context, st store) error { return st.Put(ctx, "plans/free", []byte(`{}`)) }},
+		{name: "rename users", up: func(ctx context.Context, st store) error {
+			if failing {
+				return errors.New("disk full")
+			}
+			return nil
+		}},
+	}}
+	readyz := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handleGetReadyz(&ready, &cordoned, schema).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return w
+	}
+
+	w := readyz()
+	testEqual(t, http.StatusServiceUnavailable, w.Code)
+	testContains(t, `"Schema":{"Current":0,"Required":2}`, w.Body.String())
+	status, _ := grpcHealthStatus(ctx, "", &ready, &cordoned, schema)
+	testEqual(t, grpcNotServing, status)
+
+	version, err := schema.migrate(ctx, log)
+	testContains(t, "migration 2 rename users: disk full", err.Error())
+	testEqual(t, 1, version)
+	testContains(t, `"Schema":{"Current":1,"Required":2}`, readyz().Body.String())
+
+	failing = false
+	version, err = schema.migrate(ctx, log)
+	testNil(t, err)
+	testEqual(t, 2, version)
+	w = readyz()
+	testEqual(t, http.StatusOK, w.Code)
+	testContains(t, `"Schema":{"Current":2,"Required":2}`, w.Body.String())
+	status, _ = grpcHealthStatus(ctx, "", &ready, &cordoned, schema)
+	testEqual(t, grpcServing, status)
+
+	schema.migrations = schema.migrations[:1] // NOTE: the previous binary still serves a store migrated by the newer one
+	testEqual(t, http.StatusOK, readyz().Code)
+
+	testNil(t, st.Put(ctx, storeVersionKey, []byte("two")))
+	w = readyz()
+	testEqual(t, http.StatusServiceUnavailable, w.Code)
+	testContains(t, `invalid schema version`, w.Body.String())
+
+	schema = nil
+	testEqual(t, http.StatusOK, readyz().Code)
+}
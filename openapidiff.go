@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os/exec"
+	"slices"
+	"strings"
+)
+
+// openapiDiffCommand runs the openapi-diff subcommand, such as "app openapi-diff -base v1.2.0", instead of the server.
+// It is called by [run] when the first argument is "openapi-diff". It compares every embedded OpenAPI document
+// with the document of the same name at the base git ref, the latest tag by default, failing with [exitConfig]
+// on breaking changes, so that CI catches them before a release does. Documents new since the base are skipped,
+// and so is the whole comparison if there is no tag to default to, such as before the first release.
+func openapiDiffCommand(ctx context.Context, w io.Writer, args []string) error {
+	fs := flag.NewFlagSet(args[0]+" "+args[1], flag.ExitOnError)
+	fs.SetOutput(w)
+	base := fs.String("base", "", "git ref of the baseline documents, such as the previous release tag (default the latest tag)")
+	if err := fs.Parse(args[2:]); err != nil {
+		return &exitError{code: exitConfig, err: err}
+	}
+	if *base == "" {
+		tag, err := exec.CommandContext(ctx, "git", "describe", "--tags", "--abbrev=0").Output()
+		if err != nil {
+			fmt.Fprintln(w, "skipped, no tag to compare with, set -base to compare with another ref")
+			return nil
+		}
+		*base = strings.TrimSpace(string(tag))
+	}
+
+	docs := openapiDocs("")
+	names := make([]string, 0, len(docs))
+	for name := range docs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var breaking []string
+	for _, name := range names {
+		doc, err := exec.CommandContext(ctx, "git", "show", *base+":api/"+name+".yaml").Output()
+		if err != nil {
+			fmt.Fprintf(w, "skipped %s.yaml, not found at %s\n", name, *base)
+			continue
+		}
+		for _, change := range diffOpenapi(doc, docs[name]) {
+			breaking = append(breaking, name+".yaml: "+change)
+		}
+	}
+	if len(breaking) > 0 {
+		return &exitError{code: exitConfig, err: fmt.Errorf("breaking changes since %s:\n%s", *base, strings.Join(breaking, "\n"))}
+	}
+	fmt.Fprintf(w, "no breaking changes since %s\n", *base)
+	return nil
+}
+
+// diffOpenapi returns the breaking changes from the base to the current OpenAPI document, in the order of the base:
+// removed paths, operations, responses, and schema properties, and changed schema types other than widening integer to number.
+// It compares the documents as parsed by [walkOpenapi], so changes within sequences such as parameters are not detected.
+func diffOpenapi(base, current []byte) []string {
+	type entry struct {
+		path  []string
+		value string
+	}
+	parse := func(doc []byte) ([]entry, map[string]string) {
+		var entries []entry
+		values := map[string]string{}
+		walkOpenapi(doc, func(_ int, path []string, value string) {
+			entries = append(entries, entry{path: path, value: value})
+			values[strings.Join(path, "\x00")] = value
+		})
+		return entries, values
+	}
+	entries, _ := parse(base)
+	_, values := parse(current)
+
+	var changes []string
+	removed := map[string]bool{} // NOTE: only the outermost removed key of a subtree is reported
+	for _, e := range entries {
+		if len(e.path) < 2 || e.path[0] != "paths" {
+			continue
+		}
+		parent := false
+		for i := 2; i < len(e.path); i++ {
+			parent = parent || removed[strings.Join(e.path[:i], "\x00")]
+		}
+		if parent {
+			continue
+		}
+		key := strings.Join(e.path, "\x00")
+		value, ok := values[key]
+		where := e.path[1]
+		if len(e.path) > 2 {
+			where = strings.ToUpper(e.path[2]) + " " + e.path[1]
+		}
+		rest := strings.Join(e.path[min(3, len(e.path)):], ".")
+		switch {
+		case !ok && len(e.path) == 2:
+			changes = append(changes, fmt.Sprintf("path %s removed", where))
+		case !ok && len(e.path) == 3 && slices.Contains(openapiMethods, e.path[2]):
+			changes = append(changes, fmt.Sprintf("%s removed", where))
+		case !ok && len(e.path) == 5 && e.path[3] == "responses":
+			changes = append(changes, fmt.Sprintf("%s: response %s removed", where, e.path[4]))
+		case !ok && len(e.path) > 3 && e.path[len(e.path)-2] == "properties":
+			changes = append(changes, fmt.Sprintf("%s: property %s removed", where, rest))
+		case ok && e.path[len(e.path)-1] == "type" && value != e.value && !(e.value == "integer" && value == "number"):
+			changes = append(changes, fmt.Sprintf("%s: type of %s changed from %s to %s", where, strings.TrimSuffix(rest, ".type"), e.value, value))
+		default:
+			continue
+		}
+		removed[key] = !ok
+	}
+	return changes
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// TestDiffOpenapi tests that breaking changes between OpenAPI documents are reported, and compatible ones are not.
+func TestDiffOpenapi(t *testing.T) {
+	base := []byte(`openapi: 3.0.0
+info:
+  title: API
+  version: v1
+paths:
+  /users:
+    get:
+      operationId: listUsers
+      responses:
+        200:
+          description: Users
+          content:
+            application/json:
+              schema:
+                type: object
+                properties:
+                  id:
+                    type: integer
+                  name:
+                    type: string
+                  score:
+                    type: integer
+        404:
+          description: Not found
+    delete:
+      operationId: deleteUsers
+      responses:
+        204:
+          description: Deleted
+  /orders:
+    get:
+      operationId: listOrders
+      responses:
+        200:
+          description: Orders
+`)
+	current := []byte(`openapi: 3.0.0
+info:
+  title: API
+  version: v2
+paths:
+  /users:
+    get:
+      operationId: listUsers
+      summary: Returns users.
+      responses:
+        200:
+          description: Users
+          content:
+            application/json:
+              schema:
+                type: object
+                properties:
+                  id:
+                    type: string
+                  score:
+                    type: number
+                  email:
+                    type: string
+  /accounts:
+    get:
+      operationId: listAccounts
+      responses:
+        200:
+          description: Accounts
+`)
+	testEqual(t, strings.Join([]string{
+		"GET /users: type of responses.200.content.application/json.schema.properties.id changed from integer to string",
+		"GET /users: property responses.200.content.application/json.schema.properties.name removed",
+		"GET /users: response 404 removed",
+		"DELETE /users removed",
+		"path /orders removed",
+	}, "\n"), strings.Join(diffOpenapi(base, current), "\n"))
+	testEqual(t, 0, len(diffOpenapi(current, current)))
+}
+
+// TestOpenapiCompatibility tests that the embedded OpenAPI documents are compatible with the latest release tag.
+// The comparison is skipped without tags, such as in shallow clones, so run it in CI with the tags fetched.
+func TestOpenapiCompatibility(t *testing.T) {
+	var out bytes.Buffer
+	testNil(t, openapiDiffCommand(context.Background(), &out, []string{"testapp", "openapi-diff"}))
+	if err := exec.Command("git", "describe", "--tags", "--abbrev=0").Run(); err != nil {
+		testContains(t, "skipped, no tag to compare with", out.String())
+		return
+	}
+	testContains(t, "no breaking changes since", out.String())
+}
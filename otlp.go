@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// otlpExporter batches log records and spans and exports them to an OpenTelemetry collector
+// with the OTLP/HTTP JSON protocol, so that logs end up in the same backend as traces and metrics.
+// It only depends on the standard library, and is enabled by the -otlp-endpoint flag.
+type otlpExporter struct {
+	endpoint string
+	client   *http.Client
+	resource []otlpKeyValue
+	log      *slog.Logger // logs export failures without going through the exporter again
+
+	mu      sync.Mutex
+	records []otlpLogRecord
+	spans   []otlpSpan
+	flush   chan struct{} // signals the export loop that a batch is full, buffered so that signals never pile up
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// otlpBatchSize is the number of buffered records that triggers an export before the next interval.
+const otlpBatchSize = 512
+
+// newOTLPExporter returns an [otlpExporter] exporting to endpoint every few seconds until it is closed.
+// The resource attributes of the records are set from the service name and version, followed by the extra ones,
+// such as the [location] of the instance.
+func newOTLPExporter(endpoint, service, version string, log *slog.Logger, extra ...otlpKeyValue) *otlpExporter {
+	host, _ := os.Hostname()
+	e := &otlpExporter{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		resource: append([]otlpKeyValue{
+			{Key: "service.name", Value: otlpAnyValue{StringValue: &service}},
+			{Key: "service.version", Value: otlpAnyValue{StringValue: &version}},
+			{Key: "host.name", Value: otlpAnyValue{StringValue: &host}},
+		}, extra...),
+		log:   log,
+		flush: make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				e.export(context.Background())
+			case <-e.flush:
+				e.export(context.Background())
+			case <-e.done:
+				return
+			}
+		}
+	}()
+	return e
+}
+
+// add buffers the record, signaling the export loop to export the batch right away if it is full.
+func (e *otlpExporter) add(record otlpLogRecord) {
+	e.mu.Lock()
+	e.records = append(e.records, record)
+	full := len(e.records) >= otlpBatchSize
+	e.mu.Unlock()
+	if full {
+		e.signalFlush()
+	}
+}
+
+// addSpan buffers the span, signaling the export loop to export the batch right away if it is full.
+func (e *otlpExporter) addSpan(span otlpSpan) {
+	e.mu.Lock()
+	e.spans = append(e.spans, span)
+	full := len(e.spans) >= otlpBatchSize
+	e.mu.Unlock()
+	if full {
+		e.signalFlush()
+	}
+}
+
+// signalFlush signals the export loop without blocking, so that a burst of records while a slow collector
+// is being exported to only exports once more, rather than starting an export per record.
+func (e *otlpExporter) signalFlush() {
+	select {
+	case e.flush <- struct{}{}:
+	default:
+	}
+}
+
+// export sends all buffered records and spans to the collector.
+func (e *otlpExporter) export(ctx context.Context) {
+	e.mu.Lock()
+	records, spans := e.records, e.spans
+	e.records, e.spans = nil, nil
+	e.mu.Unlock()
+
+	resource := otlpResource{Attributes: e.resource}
+	if len(records) > 0 {
+		e.post(ctx, "/v1/logs", len(records), otlpLogsRequest{ResourceLogs: []otlpResourceLogs{{
+			Resource:  resource,
+			ScopeLogs: []otlpScopeLogs{{Scope: otlpScope{Name: "log/slog"}, LogRecords: records}},
+		}}})
+	}
+	if len(spans) > 0 {
+		e.post(ctx, "/v1/traces", len(spans), otlpTracesRequest{ResourceSpans: []otlpResourceSpans{{
+			Resource:   resource,
+			ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "net/http"}, Spans: spans}},
+		}}})
+	}
+}
+
+// post sends the body of n items encoded in JSON to the path of the collector, logging any failure.
+func (e *otlpExporter) post(ctx context.Context, path string, n int, body any) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		e.log.ErrorContext(ctx, "failed to encode otlp", slog.String("path", path), slog.Any("error", err))
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint+path, bytes.NewReader(b))
+	if err != nil {
+		e.log.ErrorContext(ctx, "failed to export otlp", slog.String("path", path), slog.Any("error", err))
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := e.client.Do(req)
+	if err != nil {
+		e.log.ErrorContext(ctx, "failed to export otlp", slog.String("path", path), slog.Any("error", err), slog.Int("items", n))
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		e.log.ErrorContext(ctx, "failed to export otlp", slog.String("path", path), slog.Int("status", res.StatusCode), slog.Int("items", n))
+	}
+}
+
+// Close stops the periodic export and flushes the remaining records and spans.
+func (e *otlpExporter) Close() {
+	close(e.done)
+	e.wg.Wait()
+	e.export(context.Background())
+}
+
+// otlpHandler is a [slog.Handler] that converts records into OTLP log records for the [otlpExporter].
+// Records written with a request context are correlated to the trace assigned by [tracing].
+// Records below level are dropped like by the other log outputs, defaulting to [slog.LevelInfo] if it is nil.
+type otlpHandler struct {
+	exporter *otlpExporter
+	level    slog.Leveler
+	attrs    []otlpKeyValue
+	group    string // prefix of the attribute keys, joined by dots
+}
+
+// Enabled implements the [slog.Handler] interface.
+func (h *otlpHandler) Enabled(_ context.Context, level slog.Level) bool {
+	if h.level == nil {
+		return level >= slog.LevelInfo
+	}
+	return level >= h.level.Level()
+}
+
+// Handle implements the [slog.Handler] interface.
+func (h *otlpHandler) Handle(ctx context.Context, r slog.Record) error {
+	msg := r.Message
+	record := otlpLogRecord{
+		TimeUnixNano:   strconv.FormatInt(r.Time.UnixNano(), 10),
+		SeverityNumber: int(9 + r.Level), // slog.LevelInfo maps to 9, LevelWarn to 13, LevelError to 17
+		SeverityText:   levelName(r.Level),
+		Body:           otlpAnyValue{StringValue: &msg},
+		Attributes:     append([]otlpKeyValue{}, h.attrs...),
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		record.Attributes = append(record.Attributes, otlpAttrs(h.group, a)...)
+		return true
+	})
+	if tc, ok := traceFrom(ctx); ok {
+		record.TraceID = hex.EncodeToString(tc.traceID[:])
+		record.SpanID = hex.EncodeToString(tc.spanID[:])
+		record.Flags = int(tc.flags)
+	}
+	h.exporter.add(record)
+	return nil
+}
+
+// WithAttrs implements the [slog.Handler] interface.
+func (h *otlpHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = append([]otlpKeyValue{}, h.attrs...)
+	for _, a := range attrs {
+		h2.attrs = append(h2.attrs, otlpAttrs(h.group, a)...)
+	}
+	return &h2
+}
+
+// WithGroup implements the [slog.Handler] interface.
+func (h *otlpHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.group = h.group + name + "."
+	return &h2
+}
+
+// otlpAttrs converts the attribute into OTLP key values, flattening groups into dotted keys.
+func otlpAttrs(prefix string, a slog.Attr) []otlpKeyValue {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		var kvs []otlpKeyValue
+		for _, ga := range v.Group() {
+			kvs = append(kvs, otlpAttrs(prefix+a.Key+".", ga)...)
+		}
+		return kvs
+	}
+
+	var value otlpAnyValue
+	switch v.Kind() {
+	case slog.KindBool:
+		b := v.Bool()
+		value.BoolValue = &b
+	case slog.KindInt64:
+		i := strconv.FormatInt(v.Int64(), 10)
+		value.IntValue = &i
+	case slog.KindUint64:
+		i := strconv.FormatUint(v.Uint64(), 10)
+		value.IntValue = &i
+	case slog.KindFloat64:
+		f := v.Float64()
+		value.DoubleValue = &f
+	default:
+		s := fmt.Sprint(v.Any())
+		value.StringValue = &s
+	}
+	return []otlpKeyValue{{Key: prefix + a.Key, Value: value}}
+}
+
+// teeHandler is a [slog.Handler] that writes records to all of its handlers.
+type teeHandler []slog.Handler
+
+// Enabled implements the [slog.Handler] interface.
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handle implements the [slog.Handler] interface.
+func (t teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range t {
+		if h.Enabled(ctx, r.Level) {
+			if err := h.Handle(ctx, r.Clone()); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// WithAttrs implements the [slog.Handler] interface.
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	t2 := make(teeHandler, len(t))
+	for i, h := range t {
+		t2[i] = h.WithAttrs(attrs)
+	}
+	return t2
+}
+
+// WithGroup implements the [slog.Handler] interface.
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	t2 := make(teeHandler, len(t))
+	for i, h := range t {
+		t2[i] = h.WithGroup(name)
+	}
+	return t2
+}
+
+// The types below are the subset of the OTLP/HTTP JSON encoding of the logs and traces signals used by [otlpExporter].
+// See https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding for the full specification.
+type (
+	otlpLogsRequest struct {
+		ResourceLogs []otlpResourceLogs `json:"resourceLogs"`
+	}
+	otlpResourceLogs struct {
+		Resource  otlpResource    `json:"resource"`
+		ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeLogs struct {
+		Scope      otlpScope       `json:"scope"`
+		LogRecords []otlpLogRecord `json:"logRecords"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpLogRecord struct {
+		TimeUnixNano   string         `json:"timeUnixNano"`
+		SeverityNumber int            `json:"severityNumber"`
+		SeverityText   string         `json:"severityText"`
+		Body           otlpAnyValue   `json:"body"`
+		Attributes     []otlpKeyValue `json:"attributes,omitempty"`
+		TraceID        string         `json:"traceId,omitempty"`
+		SpanID         string         `json:"spanId,omitempty"`
+		Flags          int            `json:"flags,omitempty"`
+	}
+	otlpTracesRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Status            otlpStatus     `json:"status"`
+	}
+	otlpStatus struct {
+		Code int `json:"code,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string       `json:"key"`
+		Value otlpAnyValue `json:"value"`
+	}
+	otlpAnyValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"`
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+	}
+)
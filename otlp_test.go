@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// TestOTLPExporter tests that logs are exported with resource attributes and trace correlation on close.
+func TestOTLPExporter(t *testing.T) {
+	received := make(chan otlpLogsRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpLogsRequest
+		if r.URL.Path != "/v1/logs" || json.NewDecoder(r.Body).Decode(&req) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		received <- req
+	}))
+	defer collector.Close()
+
+	exporter := newOTLPExporter(collector.URL, "testapp", version, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	tc, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	testEqual(t, true, ok)
+	ctx := context.WithValue(context.Background(), traceKey, tc)
+	slog.New(&otlpHandler{exporter: exporter}).With(slog.String("method", "GET")).InfoContext(ctx, "accessed", slog.Int("status", 200))
+	exporter.Close()
+
+	req := <-received
+	testEqual(t, 1, len(req.ResourceLogs))
+	testEqual(t, "service.name", req.ResourceLogs[0].Resource.Attributes[0].Key)
+	testEqual(t, "testapp", *req.ResourceLogs[0].Resource.Attributes[0].Value.StringValue)
+
+	// records follow the level of the other outputs, such as set through the admin API
+	var level slog.LevelVar
+	h := &otlpHandler{exporter: exporter, level: &level}
+	testEqual(t, false, h.Enabled(ctx, slog.LevelDebug))
+	level.Set(slog.LevelDebug)
+	testEqual(t, true, h.Enabled(ctx, slog.LevelDebug))
+	level.Set(slog.LevelError)
+	testEqual(t, false, h.Enabled(ctx, slog.LevelWarn))
+
+	record := req.ResourceLogs[0].ScopeLogs[0].LogRecords[0]
+	testEqual(t, "accessed", *record.Body.StringValue)
+	testEqual(t, 9, record.SeverityNumber)
+	testEqual(t, hex.EncodeToString(tc.traceID[:]), record.TraceID)
+	testEqual(t, 2, len(record.Attributes))
+	testEqual(t, "200", *record.Attributes[1].Value.IntValue)
+}
+
+// TestOTLPExporterBurst tests that a burst of records while the collector is slow exports one batch at a time.
+func TestOTLPExporterBurst(t *testing.T) {
+	var inflight, maxInflight, requests atomic.Int64
+	release := make(chan struct{})
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inflight.Add(1)
+		defer inflight.Add(-1)
+		for m := maxInflight.Load(); n > m && !maxInflight.CompareAndSwap(m, n); m = maxInflight.Load() {
+		}
+		requests.Add(1)
+		<-release
+	}))
+	defer collector.Close()
+
+	exporter := newOTLPExporter(collector.URL, "testapp", version, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	for i := range 4 * otlpBatchSize {
+		exporter.add(otlpLogRecord{TimeUnixNano: strconv.Itoa(i)})
+	}
+	close(release)
+	exporter.Close()
+	testEqual(t, int64(1), maxInflight.Load())
+	testEqual(t, true, requests.Load() <= 3) // the first batch, at most one more signaled, and the flush on close
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	crand "crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// newClient returns an [http.Client] for calling upstream services.
+// Use it instead of [http.DefaultClient] so that every outbound request shares the same timeout,
+// records its latency breakdown into m and exporter, see [timingTransport],
+// forwards the trace context and request ID so that logs of upstream services correlate, and identifies the service
+// with userAgent unless it is empty, see [propagationTransport],
+// only connects to the destinations allowed by egress, see [egressPolicy],
+// charges calls to the outbound budget of the inbound request, see [trackOutbound],
+// and faults can be injected with the -outbound-chaos-* flags in dev and test environments.
+func newClient(log *slog.Logger, userAgent string, timeout time.Duration, chaos chaosConfig, m *metrics, exporter *otlpExporter, egress egressPolicy) *http.Client {
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.DialContext = egress.dialContext(&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second})
+	var transport http.RoundTripper = &propagationTransport{next: base, userAgent: userAgent}
+	if chaos.rate > 0 {
+		transport = &chaosTransport{next: transport, log: log, cfg: chaos}
+	}
+	transport = &timingTransport{next: transport, metrics: m, exporter: exporter}
+	transport = &budgetTransport{next: transport}
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// userAgent returns the User-Agent header of the outbound calls of the service, such as "kickstart/v1.2.3",
+// or the name alone if the version is not set.
+func userAgent(service, version string) string {
+	if version == "" {
+		return service
+	}
+	return service + "/" + version
+}
+
+// validServiceName reports whether the name of the service is non-empty and safe to use as a label value,
+// a resource attribute, and a product token of the User-Agent header.
+func validServiceName(name string) bool {
+	return name != "" && !strings.ContainsFunc(name, func(r rune) bool {
+		return !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '.' || r == '-' || r == '_')
+	})
+}
+
+// propagationTransport is an [http.RoundTripper] that sets the traceparent and X-Request-ID headers of outbound requests
+// from the request context, and the User-Agent header to the user agent, unless they are already set.
+// The trace context is the one of the client span assigned by [timingTransport], so it is forwarded even without an exporter,
+// starting a new trace outside of requests.
+type propagationTransport struct {
+	next      http.RoundTripper
+	userAgent string // such as "kickstart/v1.2.3", see [userAgent]
+}
+
+// RoundTrip implements the [http.RoundTripper] interface.
+func (t *propagationTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tc, traced := traceFrom(req.Context())
+	id := requestIDFrom(req.Context())
+	traced = traced && req.Header.Get("traceparent") == ""
+	identified := id != "" && req.Header.Get("X-Request-ID") == ""
+	agent := t.userAgent != "" && req.Header.Get("User-Agent") == ""
+	if !traced && !identified && !agent {
+		return t.next.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context()) // NOTE: RoundTrip must not modify the request
+	if traced {
+		req.Header.Set("traceparent", tc.String())
+	}
+	if identified {
+		req.Header.Set("X-Request-ID", id)
+	}
+	if agent {
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+	return t.next.RoundTrip(req)
+}
+
+// chaosTransport is an [http.RoundTripper] that injects faults into outbound requests,
+// simulating upstream timeouts, 5xx bursts, and connection errors. See [chaosConfig].
+// The prefix of the config is matched against the host followed by the path of the request.
+type chaosTransport struct {
+	next      http.RoundTripper
+	log       *slog.Logger
+	cfg       chaosConfig
+	remaining atomic.Int64
+}
+
+// RoundTrip implements the [http.RoundTripper] interface.
+func (t *chaosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.HasPrefix(req.URL.Host+req.URL.Path, t.cfg.prefix) || !t.cfg.inject(&t.remaining) {
+		return t.next.RoundTrip(req)
+	}
+
+	t.log.WarnContext(req.Context(), "outbound chaos injected",
+		slog.String("method", req.Method),
+		slog.String("url", req.URL.String()),
+		slog.String("latency", t.cfg.latency.String()),
+		slog.Int("status", t.cfg.status),
+		slog.Bool("drop", t.cfg.drop))
+
+	if t.cfg.latency > 0 {
+		select {
+		case <-time.After(t.cfg.latency):
+		case <-req.Context().Done():
+			closeBody(req)
+			return nil, req.Context().Err()
+		}
+	}
+	switch {
+	case t.cfg.drop:
+		closeBody(req)
+		return nil, fmt.Errorf("chaos injected: connection to %s dropped", req.URL.Host)
+	case t.cfg.status != 0:
+		closeBody(req)
+		body := "chaos injected\n"
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", t.cfg.status, http.StatusText(t.cfg.status)),
+			StatusCode:    t.cfg.status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+			Body:          io.NopCloser(strings.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}, nil
+	default:
+		return t.next.RoundTrip(req)
+	}
+}
+
+// closeBody closes the body of the request, as required by [http.RoundTripper] when it is not sent.
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
+
+// timingTransport is an [http.RoundTripper] that records the latency breakdown of outbound requests
+// (DNS lookup, connection, TLS handshake, and time to first byte) with [httptrace].
+// Phases are recorded as histograms by host at /metrics, and as attributes of a client span
+// exported as a child of the span of the request's trace. The latency is recorded as the outbound phase of [serverTiming].
+type timingTransport struct {
+	next     http.RoundTripper
+	metrics  *metrics
+	exporter *otlpExporter
+}
+
+// RoundTrip implements the [http.RoundTripper] interface.
+func (t *timingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tc, parent := traceFrom(req.Context())
+	if parent {
+		tc.parentID = tc.spanID
+	} else {
+		_, _ = crand.Read(tc.traceID[:])
+	}
+	_, _ = crand.Read(tc.spanID[:])
+
+	var mu sync.Mutex
+	phases := map[string]time.Duration{}
+	starts := map[string]time.Time{}
+	begin := func(phase string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if _, ok := starts[phase]; !ok { // connections may be dialed concurrently, only the first one counts
+			starts[phase] = time.Now()
+		}
+	}
+	end := func(phase string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if _, ok := phases[phase]; !ok {
+			phases[phase] = time.Since(starts[phase])
+		}
+	}
+
+	start := time.Now()
+	starts["ttfb"] = start
+	ctx := httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { begin("dns") },
+		DNSDone:              func(httptrace.DNSDoneInfo) { end("dns") },
+		ConnectStart:         func(string, string) { begin("connect") },
+		ConnectDone:          func(string, string, error) { end("connect") },
+		TLSHandshakeStart:    func() { begin("tls") },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { end("tls") },
+		GotFirstResponseByte: func() { end("ttfb") },
+	})
+	ctx = context.WithValue(ctx, traceKey, tc)
+	res, err := t.next.RoundTrip(req.WithContext(ctx))
+	latency := time.Since(start)
+	recordTiming(req.Context(), "outbound", latency)
+
+	mu.Lock()
+	defer mu.Unlock()
+	host := req.URL.Host
+	for phase, d := range phases {
+		t.metrics.observe("http_client_phase_duration_seconds", "Duration of phases of HTTP client requests.", durationBuckets,
+			d.Seconds(), tc, "host", host, "phase", phase)
+	}
+	if t.exporter != nil && tc.flags&sampledFlag != 0 {
+		t.exporter.addSpan(newClientSpan(tc, req, res, start, latency, phases))
+	}
+	return res, err
+}
+
+// newClientSpan returns an OTLP span of the outbound request with the durations of its phases.
+func newClientSpan(tc traceContext, req *http.Request, res *http.Response, start time.Time, latency time.Duration, phases map[string]time.Duration) otlpSpan {
+	// NOTE: the query and credentials are redacted, since they may carry tokens and signatures of presigned URLs
+	method, host, url := req.Method, req.URL.Host, redactURL(req.URL.String())
+	span := otlpSpan{
+		TraceID:           hex.EncodeToString(tc.traceID[:]),
+		SpanID:            hex.EncodeToString(tc.spanID[:]),
+		Name:              req.Method,
+		Kind:              3, // SPAN_KIND_CLIENT
+		StartTimeUnixNano: strconv.FormatInt(start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(start.Add(latency).UnixNano(), 10),
+		Attributes: []otlpKeyValue{
+			{Key: "http.request.method", Value: otlpAnyValue{StringValue: &method}},
+			{Key: "server.address", Value: otlpAnyValue{StringValue: &host}},
+			{Key: "url.full", Value: otlpAnyValue{StringValue: &url}},
+		},
+	}
+	if tc.parentID != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(tc.parentID[:])
+	}
+	for _, phase := range []string{"dns", "connect", "tls", "ttfb"} {
+		if d, ok := phases[phase]; ok {
+			seconds := d.Seconds()
+			span.Attributes = append(span.Attributes, otlpKeyValue{Key: "http.client." + phase + ".duration", Value: otlpAnyValue{DoubleValue: &seconds}})
+		}
+	}
+	if res == nil || res.StatusCode >= 500 {
+		span.Status.Code = 2 // STATUS_CODE_ERROR
+	}
+	if res != nil {
+		code := strconv.Itoa(res.StatusCode)
+		span.Attributes = append(span.Attributes, otlpKeyValue{Key: "http.response.status_code", Value: otlpAnyValue{IntValue: &code}})
+	}
+	return span
+}
@@ -0,0 +1,24 @@
+//go:build !nopprof
+
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// init registers the pprof debug routes, which pull the profiling runtime and html/template into the binary.
+// Build with -tags nopprof to leave them out.
+func init() {
+	registerFeature(feature{
+		name: "pprof",
+		debug: func(mux *http.ServeMux) {
+			// NOTE: this route is same as defined in net/http/pprof init function
+			mux.HandleFunc("/debug/pprof/", pprof.Index)
+			mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+			mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+			mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+			mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		},
+	})
+}
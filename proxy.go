@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upstreamVars counts the ejections of each upstream by its host, served by /debug/vars.
+var upstreamVars = expvar.NewMap("upstreams")
+
+// Balancing strategies of an [upstreamPool], set by the -proxy-balance flag.
+const (
+	balanceWeighted  = "weighted"   // smooth weighted round-robin, as in nginx
+	balanceLeastConn = "least-conn" // fewest requests in flight relative to the weight
+)
+
+// proxyRoute is a route proxied to a pool of upstreams, set by the -proxy flag.
+// Its rewriters transform the responses of the upstreams in order, set by the -proxy-rewrite flag or appended in code.
+type proxyRoute struct {
+	prefix    string
+	upstreams []*url.URL
+	weights   []int
+	rewriters []responseRewriter
+}
+
+// parseProxyRoute parses a -proxy route in the form of '<path-prefix>=<url>[*weight],...',
+// such as '/api/=http://10.0.0.1:8080*3,http://10.0.0.2:8080'. The weight is 1 if omitted.
+func parseProxyRoute(s string) (proxyRoute, error) {
+	prefix, targets, ok := strings.Cut(s, "=")
+	if !ok || !strings.HasPrefix(prefix, "/") || targets == "" {
+		return proxyRoute{}, fmt.Errorf("proxy %q is not in the form of '<path-prefix>=<url>[*weight],...'", s)
+	}
+	rt := proxyRoute{prefix: prefix}
+	for _, target := range strings.Split(targets, ",") {
+		target, weight, hasWeight := strings.Cut(strings.TrimSpace(target), "*")
+		u, err := url.Parse(target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return proxyRoute{}, fmt.Errorf("proxy %q has an invalid upstream %q, must be an http(s) URL", s, target)
+		}
+		w := 1
+		if hasWeight {
+			if w, err = strconv.Atoi(weight); err != nil || w <= 0 {
+				return proxyRoute{}, fmt.Errorf("proxy %q has an invalid weight %q, must be a positive number", s, weight)
+			}
+		}
+		rt.upstreams = append(rt.upstreams, u)
+		rt.weights = append(rt.weights, w)
+	}
+	return rt, nil
+}
+
+// upstream is a server of an [upstreamPool].
+type upstream struct {
+	url    *url.URL
+	weight int
+	proxy  *httputil.ReverseProxy
+	active atomic.Int64 // requests in flight
+
+	// guarded by the mutex of the pool
+	current      int       // current weight of smooth weighted round-robin
+	failures     int       // consecutive failures
+	ejectedUntil time.Time // when the upstream is picked again after being ejected
+}
+
+// upstreamPool balances the requests of a [proxyRoute] over its upstreams, ejecting an upstream for ejectFor
+// after ejectAfter consecutive failures, that is transport errors and 502, 503, and 504 responses,
+// so that a crashed instance stops receiving traffic without active health checks. If every upstream is ejected,
+// they are all picked anyway, since failing requests is no better than trying an upstream that may have recovered.
+type upstreamPool struct {
+	name       string
+	balance    string
+	ejectAfter int
+	ejectFor   time.Duration
+	affinity   *affinity // nil unless -affinity is set
+
+	mu        sync.Mutex
+	upstreams []*upstream
+}
+
+// newUpstreamPool returns an [upstreamPool] of the route, proxying requests through transport.
+func newUpstreamPool(rt proxyRoute, balance string, ejectAfter int, ejectFor time.Duration, transport http.RoundTripper) *upstreamPool {
+	pool := &upstreamPool{name: rt.prefix, balance: balance, ejectAfter: ejectAfter, ejectFor: ejectFor}
+	for i, target := range rt.upstreams {
+		pool.upstreams = append(pool.upstreams, &upstream{
+			url:    target,
+			weight: rt.weights[i],
+			proxy: &httputil.ReverseProxy{
+				Rewrite: func(pr *httputil.ProxyRequest) {
+					pr.SetURL(target)
+					pr.SetXForwarded()
+					if len(rt.rewriters) > 0 {
+						// NOTE: the transport asks for gzip itself and decompresses it, so that rewriters see plain bodies
+						pr.Out.Header.Del("Accept-Encoding")
+					}
+				},
+				Transport:      transport,
+				ModifyResponse: chainRewriters(rt.rewriters),
+				ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+					slog.WarnContext(r.Context(), "proxy failed", slog.String("upstream", target.Host), slog.Any("error", err))
+					writeProblem(w, r, http.StatusBadGateway, errors.New("upstream unavailable"))
+				},
+			},
+		})
+	}
+	return pool
+}
+
+// pick returns the upstream to send the next request to, the one the affinity key is pinned to if it is not ejected.
+func (p *upstreamPool) pick(key string, now time.Time) *upstream {
+	pinned := p.affinity.target(key, now)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, u := range p.upstreams {
+		if u.url.Host == pinned && !now.Before(u.ejectedUntil) {
+			p.affinity.bind(key, pinned, now)
+			return u
+		}
+	}
+	candidates := make([]*upstream, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		if !now.Before(u.ejectedUntil) {
+			candidates = append(candidates, u)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = p.upstreams
+	}
+
+	var best *upstream
+	switch p.balance {
+	case balanceLeastConn:
+		for _, u := range candidates {
+			// NOTE: compares active/weight without division
+			if best == nil || u.active.Load()*int64(best.weight) < best.active.Load()*int64(u.weight) {
+				best = u
+			}
+		}
+	default:
+		total := 0
+		for _, u := range candidates {
+			u.current += u.weight
+			total += u.weight
+			if best == nil || u.current > best.current {
+				best = u
+			}
+		}
+		best.current -= total
+	}
+	p.affinity.bind(key, best.url.Host, now)
+	return best
+}
+
+// report records the outcome of a request to the upstream, ejecting it after too many consecutive failures.
+func (p *upstreamPool) report(u *upstream, failed bool, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !failed {
+		u.failures = 0
+		return
+	}
+	u.failures++
+	if u.failures >= p.ejectAfter && !now.Before(u.ejectedUntil) {
+		u.ejectedUntil = now.Add(p.ejectFor)
+		u.failures = 0
+		upstreamVars.Add(u.url.Host+".ejections", 1)
+		slog.Warn("upstream ejected", slog.String("pool", p.name), slog.String("upstream", u.url.Host), slog.Duration("for", p.ejectFor))
+	}
+}
+
+// handleProxy returns an [http.HandlerFunc] proxying requests to an upstream of the pool, recording the latency of each
+// upstream into m as the http_upstream_duration_seconds histogram, see [handleGetMetrics].
+func handleProxy(pool *upstreamPool, m *metrics) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u := pool.pick(pool.affinity.key(w, r), time.Now())
+		u.active.Add(1)
+		defer u.active.Add(-1)
+
+		start := time.Now()
+		wr := responseRecorder{ResponseWriter: w}
+		u.proxy.ServeHTTP(&wr, r)
+		latency := time.Since(start)
+
+		failed := wr.status == http.StatusBadGateway || wr.status == http.StatusServiceUnavailable || wr.status == http.StatusGatewayTimeout
+		pool.report(u, failed, time.Now())
+		tc, _ := traceFrom(r.Context())
+		m.observe("http_upstream_duration_seconds", "Duration of proxied requests by upstream.", durationBuckets,
+			latency.Seconds(), tc, "pool", pool.name, "upstream", u.url.Host)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestParseProxyRoute tests parsing the -proxy flag.
+func TestParseProxyRoute(t *testing.T) {
+	rt, err := parseProxyRoute("/api/=http://a:8080*3, https://b")
+	testNil(t, err)
+	testEqual(t, "/api/", rt.prefix)
+	testEqual(t, 2, len(rt.upstreams))
+	testEqual(t, "a:8080", rt.upstreams[0].Host)
+	testEqual(t, 3, rt.weights[0])
+	testEqual(t, "b", rt.upstreams[1].Host)
+	testEqual(t, 1, rt.weights[1])
+
+	for _, s := range []string{"/api/", "api/=http://a", "/api/=", "/api/=ftp://a", "/api/=http://a*0", "/api/=http://a*x"} {
+		if _, err := parseProxyRoute(s); err == nil {
+			t.Errorf("parseProxyRoute(%q) succeeded, want error", s)
+		}
+	}
+}
+
+// TestUpstreamPool tests that the pool balances by weight and ejects failing upstreams.
+func TestUpstreamPool(t *testing.T) {
+	rt, err := parseProxyRoute("/=http://a*5,http://b,http://c")
+	testNil(t, err)
+
+	t.Run("weighted", func(t *testing.T) {
+		pool := newUpstreamPool(rt, balanceWeighted, 2, time.Minute, nil)
+		now := time.Now()
+		picks := make([]string, 0, 7)
+		for range 7 {
+			picks = append(picks, pool.pick("", now).url.Host)
+		}
+		// NOTE: smooth weighted round-robin interleaves the heavier upstream instead of picking it 5 times in a row
+		testEqual(t, "a,a,b,a,c,a,a", strings.Join(picks, ","))
+	})
+
+	t.Run("least-conn", func(t *testing.T) {
+		pool := newUpstreamPool(rt, balanceLeastConn, 2, time.Minute, nil)
+		pool.upstreams[0].active.Store(6)
+		pool.upstreams[1].active.Store(2)
+		pool.upstreams[2].active.Store(1)
+		testEqual(t, "c", pool.pick("", time.Now()).url.Host)
+		pool.upstreams[0].active.Store(4)
+		testEqual(t, "a", pool.pick("", time.Now()).url.Host)
+	})
+
+	t.Run("eject", func(t *testing.T) {
+		pool := newUpstreamPool(rt, balanceWeighted, 2, time.Minute, nil)
+		now := time.Now()
+		a := pool.upstreams[0]
+		pool.report(a, true, now)
+		pool.report(a, false, now)
+		pool.report(a, true, now)
+		testEqual(t, false, now.Before(a.ejectedUntil))
+		pool.report(a, true, now)
+		testEqual(t, true, now.Before(a.ejectedUntil))
+		for range 10 {
+			if pool.pick("", now) == a {
+				t.Fatal("picked an ejected upstream")
+			}
+		}
+		testEqual(t, a, pool.pick("", now.Add(time.Minute)))
+
+		for _, u := range pool.upstreams {
+			u.ejectedUntil = now.Add(time.Minute)
+		}
+		if pool.pick("", now) == nil {
+			t.Fatal("picked nothing when every upstream is ejected")
+		}
+	})
+}
+
+// TestHandleProxy tests proxying requests to upstreams, ejecting the one failing.
+func TestHandleProxy(t *testing.T) {
+	var mu sync.Mutex
+	hits := map[string]int{}
+	upstream := func(name string, status int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			hits[name]++
+			mu.Unlock()
+			testEqual(t, "/api/items", r.URL.Path)
+			w.WriteHeader(status)
+		}))
+	}
+	ok, failing := upstream("ok", http.StatusOK), upstream("failing", http.StatusServiceUnavailable)
+	defer ok.Close()
+	defer failing.Close()
+
+	rt, err := parseProxyRoute("/api/=" + ok.URL + "," + failing.URL)
+	testNil(t, err)
+	m := newMetrics(false)
+	handler := handleProxy(newUpstreamPool(rt, balanceWeighted, 2, time.Minute, http.DefaultTransport), m)
+	for range 10 {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/items", nil))
+	}
+	testEqual(t, 2, hits["failing"])
+	testEqual(t, 8, hits["ok"])
+
+	w := httptest.NewRecorder()
+	handleGetMetrics(m).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	testContains(t, `http_upstream_duration_seconds_count{pool="/api/",upstream="`+strings.TrimPrefix(ok.URL, "http://")+`"} 8`, w.Body.String())
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxRewriteBody caps the size of the response bodies read by [rewriteJSONField], failing larger responses with 502.
+const maxRewriteBody = 1 << 20
+
+// responseRewriter transforms a response of an upstream before it is sent to the client, see [httputil.ReverseProxy.ModifyResponse].
+// Rewriters let a proxied route act as an anti-corruption layer in front of a legacy API, so that clients
+// see the contract of this service instead of the quirks of the upstream. Returning an error fails the request with 502.
+type responseRewriter func(res *http.Response) error
+
+// proxyRewrite is a [responseRewriter] of the routes under a path prefix, set by the -proxy-rewrite flag.
+type proxyRewrite struct {
+	prefix  string
+	rewrite responseRewriter
+}
+
+// parseProxyRewrite parses a -proxy-rewrite rule in the form of '<path-prefix>=<kind>:<from>><to>', one of:
+//
+//	/api/=header:X-Legacy-Id>X-Request-Id  renames a response header, or removes it if to is empty
+//	/api/=status:404>204                   replaces a status code
+//	/api/=json:user_name>userName          renames a JSON field at any depth, or removes it if to is empty
+func parseProxyRewrite(s string) (proxyRewrite, error) {
+	prefix, rule, ok := strings.Cut(s, "=")
+	kind, rule, ok2 := strings.Cut(rule, ":")
+	from, to, ok3 := strings.Cut(rule, ">")
+	if !ok || !ok2 || !ok3 || !strings.HasPrefix(prefix, "/") || from == "" {
+		return proxyRewrite{}, fmt.Errorf("proxy rewrite %q is not in the form of '<path-prefix>=<kind>:<from>><to>'", s)
+	}
+	rw := proxyRewrite{prefix: prefix}
+	switch kind {
+	case "header":
+		rw.rewrite = rewriteHeader(from, to)
+	case "status":
+		f, err1 := strconv.Atoi(from)
+		t, err2 := strconv.Atoi(to)
+		if err1 != nil || err2 != nil || f < 100 || f > 599 || t < 100 || t > 599 {
+			return proxyRewrite{}, fmt.Errorf("proxy rewrite %q must replace a status code with another", s)
+		}
+		rw.rewrite = rewriteStatus(f, t)
+	case "json":
+		rw.rewrite = rewriteJSONField(from, to)
+	default:
+		return proxyRewrite{}, fmt.Errorf("proxy rewrite %q has an unknown kind %q, must be one of header, status, json", s, kind)
+	}
+	return rw, nil
+}
+
+// chainRewriters returns a [responseRewriter] running the rewriters in order, or nil if there are none.
+func chainRewriters(rewriters []responseRewriter) func(res *http.Response) error {
+	if len(rewriters) == 0 {
+		return nil
+	}
+	return func(res *http.Response) error {
+		for _, rewrite := range rewriters {
+			if err := rewrite(res); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// rewriteHeader returns a [responseRewriter] renaming the response header from to to, or removing it if to is empty.
+func rewriteHeader(from, to string) responseRewriter {
+	return func(res *http.Response) error {
+		values := res.Header.Values(from)
+		res.Header.Del(from)
+		if to != "" && len(values) > 0 {
+			res.Header[http.CanonicalHeaderKey(to)] = values
+		}
+		return nil
+	}
+}
+
+// rewriteStatus returns a [responseRewriter] replacing the status code from with to, dropping the body for statuses without one.
+func rewriteStatus(from, to int) responseRewriter {
+	return func(res *http.Response) error {
+		if res.StatusCode != from {
+			return nil
+		}
+		res.StatusCode = to
+		res.Status = fmt.Sprintf("%d %s", to, http.StatusText(to))
+		if to == http.StatusNoContent || to == http.StatusNotModified {
+			res.Body.Close()
+			res.Body = http.NoBody
+			res.ContentLength = 0
+			res.Header.Del("Content-Length")
+			res.Header.Del("Content-Type")
+		}
+		return nil
+	}
+}
+
+// rewriteJSONField returns a [responseRewriter] renaming the field from to to in every object of JSON responses,
+// or removing it if to is empty. Responses that are not JSON, have no body such as those to HEAD requests,
+// or are compressed by the upstream even though the proxy does not ask for it, are left as is.
+func rewriteJSONField(from, to string) responseRewriter {
+	registerLimit("rewrite_body_bytes", maxRewriteBody, nil)
+	return func(res *http.Response) error {
+		mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+		if (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) || res.Header.Get("Content-Encoding") != "" {
+			return nil
+		}
+		if (res.Request != nil && res.Request.Method == http.MethodHead) || res.StatusCode == http.StatusNoContent || res.StatusCode == http.StatusNotModified {
+			return nil
+		}
+		body, err := io.ReadAll(io.LimitReader(res.Body, maxRewriteBody+1))
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+		if len(body) > maxRewriteBody {
+			return fmt.Errorf("response body exceeds %s to rewrite", byteSize(maxRewriteBody))
+		}
+		if len(bytes.TrimSpace(body)) == 0 {
+			res.Body = io.NopCloser(bytes.NewReader(body))
+			return nil
+		}
+
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber() // NOTE: keeps large integers intact
+		var v any
+		if err := dec.Decode(&v); err != nil {
+			return fmt.Errorf("failed to decode response to rewrite: %w", err)
+		}
+		renameJSONField(v, from, to)
+		if body, err = json.Marshal(v); err != nil {
+			return err
+		}
+		res.Body = io.NopCloser(bytes.NewReader(body))
+		res.ContentLength = int64(len(body))
+		res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		return nil
+	}
+}
+
+// renameJSONField renames the field from to to in every object within v, or removes it if to is empty.
+func renameJSONField(v any, from, to string) {
+	switch v := v.(type) {
+	case map[string]any:
+		if value, ok := v[from]; ok {
+			delete(v, from)
+			if to != "" {
+				v[to] = value
+			}
+		}
+		for _, value := range v {
+			renameJSONField(value, from, to)
+		}
+	case []any:
+		for _, value := range v {
+			renameJSONField(value, from, to)
+		}
+	}
+}
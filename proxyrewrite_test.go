@@ -0,0 +1,83 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestParseProxyRewrite tests parsing the -proxy-rewrite flag.
+func TestParseProxyRewrite(t *testing.T) {
+	for _, s := range []string{"/api/=header:X-Old>X-New", "/api/=header:X-Old>", "/api/=status:404>204", "/api/=json:a>b"} {
+		rw, err := parseProxyRewrite(s)
+		testNil(t, err)
+		testEqual(t, "/api/", rw.prefix)
+	}
+	for _, s := range []string{"/api/", "api/=json:a>b", "/api/=json:a", "/api/=json:>b", "/api/=body:a>b", "/api/=status:404>ok", "/api/=status:99>200"} {
+		if _, err := parseProxyRewrite(s); err == nil {
+			t.Errorf("parseProxyRewrite(%q) succeeded, want error", s)
+		}
+	}
+}
+
+// TestProxyRewrite tests that the rewriters of a proxied route transform the responses of its upstreams.
+func TestProxyRewrite(t *testing.T) {
+	legacy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Legacy-Id", "42")
+		w.Header().Set("X-Powered-By", "legacy")
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if r.URL.Path == "/api/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"not found"}`))
+			return
+		}
+		body := []byte(`{"user_name":"kim","id":9007199254740993,"friends":[{"user_name":"lee","password":"x"}]}`)
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			gz.Write(body)
+			return
+		}
+		w.Write(body)
+	}))
+	defer legacy.Close()
+
+	rt, err := parseProxyRoute("/api/=" + legacy.URL)
+	testNil(t, err)
+	for _, s := range []string{"/api/=header:X-Legacy-Id>X-Request-Id", "/api/=header:X-Powered-By>", "/api/=status:404>204", "/api/=json:user_name>userName", "/api/=json:password>"} {
+		rw, err := parseProxyRewrite(s)
+		testNil(t, err)
+		rt.rewriters = append(rt.rewriters, rw.rewrite)
+	}
+	handler := handleProxy(newUpstreamPool(rt, balanceWeighted, 5, time.Minute, http.DefaultTransport), nil)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/users/1", nil))
+	testEqual(t, http.StatusOK, w.Code)
+	testEqual(t, "42", w.Header().Get("X-Request-Id"))
+	testEqual(t, "", w.Header().Get("X-Legacy-Id"))
+	testEqual(t, "", w.Header().Get("X-Powered-By"))
+	body, _ := io.ReadAll(w.Body)
+	testEqual(t, `{"friends":[{"userName":"lee"}],"id":9007199254740993,"userName":"kim"}`, string(body))
+
+	r := httptest.NewRequest(http.MethodGet, "/api/users/1", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	testEqual(t, http.StatusOK, w.Code)
+	testEqual(t, `{"friends":[{"userName":"lee"}],"id":9007199254740993,"userName":"kim"}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodHead, "/api/users/1", nil))
+	testEqual(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/missing", nil))
+	testEqual(t, http.StatusNoContent, w.Code)
+	testEqual(t, 0, w.Body.Len())
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// queryCounterKey is the context key of the [queryCounter] of a request.
+type queryCounterKey struct{}
+
+// queryCounter counts the queries a request issues to the [store], with the route it matched in the mux.
+type queryCounter struct {
+	route string
+	n     atomic.Int64
+}
+
+// queryStats counts the queries to the [store] per route, served by /debug/queries to spot N+1 queries.
+type queryStats struct {
+	mu     sync.Mutex
+	routes map[string]*queryRoute
+}
+
+// queryRoute is the number of queries of the requests to a route, served by /debug/queries.
+type queryRoute struct {
+	Route    string  `json:"Route"`
+	Requests int64   `json:"Requests"`
+	Queries  int64   `json:"Queries"`
+	Average  float64 `json:"Average"`
+	Max      int64   `json:"Max"`
+}
+
+// countQueries is a middleware that counts the queries each request issues to a store wrapped by [logQueries],
+// so that slow queries are logged with the route matched in mux. If stats is not nil, such as with -debug,
+// the counts are recorded per route, and requests issuing more than warnAt queries are logged as possible N+1 queries.
+func countQueries(next http.Handler, mux *http.ServeMux, stats *queryStats, log *slog.Logger, warnAt int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		if pattern == "" {
+			pattern = "unmatched"
+		}
+		c := &queryCounter{route: pattern}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), queryCounterKey{}, c)))
+		if stats == nil {
+			return
+		}
+
+		n := c.n.Load()
+		stats.record(pattern, n)
+		if warnAt > 0 && n > int64(warnAt) {
+			log.WarnContext(r.Context(), "possible N+1 queries",
+				slog.String("route", pattern),
+				slog.Int64("queries", n),
+				slog.String("request_id", requestIDFrom(r.Context())))
+		}
+	})
+}
+
+// record counts the n queries of a request to the route.
+func (s *queryStats) record(route string, n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.routes == nil {
+		s.routes = map[string]*queryRoute{}
+	}
+	q, ok := s.routes[route]
+	if !ok {
+		q = &queryRoute{Route: route}
+		s.routes[route] = q
+	}
+	q.Requests++
+	q.Queries += n
+	q.Max = max(q.Max, n)
+}
+
+// top returns the routes issuing queries, the most queries per request first.
+func (s *queryStats) top() []queryRoute {
+	s.mu.Lock()
+	res := make([]queryRoute, 0, len(s.routes))
+	for _, q := range s.routes {
+		if q.Queries == 0 {
+			continue
+		}
+		r := *q
+		r.Average = float64(r.Queries) / float64(r.Requests)
+		res = append(res, r)
+	}
+	s.mu.Unlock()
+	slices.SortFunc(res, func(a, b queryRoute) int {
+		return cmp.Or(cmp.Compare(b.Average, a.Average), cmp.Compare(a.Route, b.Route))
+	})
+	return res
+}
+
+// handleGetQueries returns an [http.HandlerFunc] that responds with the queries per request of each route counted by [countQueries].
+func handleGetQueries(stats *queryStats) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := writeBody(w, r, 200, stats.top()); err != nil {
+			slog.ErrorContext(r.Context(), "failed to write queries", slog.Any("error", err))
+		}
+	}
+}
+
+// queryLog is a [store] counting the queries of requests for [countQueries] and logging the ones slower than slow.
+type queryLog struct {
+	next store
+	log  *slog.Logger
+	slow time.Duration
+}
+
+// logQueries returns a [store] that counts every query to next in the request context and logs the ones slower than slow
+// with the request ID and route, disabled if slow is 0. Handlers should query the store it returns instead of next.
+func logQueries(next store, log *slog.Logger, slow time.Duration) store {
+	return &queryLog{next: next, log: log, slow: slow}
+}
+
+// observe counts the query of op to the key in the request of ctx, records its duration as the store phase of [serverTiming],
+// and logs it if it took longer than the threshold since start.
+func (q *queryLog) observe(ctx context.Context, op, key string, start time.Time, err error) {
+	route := ""
+	if c, ok := ctx.Value(queryCounterKey{}).(*queryCounter); ok {
+		c.n.Add(1)
+		route = c.route
+	}
+	d := time.Since(start)
+	recordTiming(ctx, "store", d)
+	if q.slow <= 0 || d < q.slow {
+		return
+	}
+	q.log.WarnContext(ctx, "slow query",
+		slog.String("op", op),
+		slog.String("key", key),
+		slog.Duration("duration", d),
+		slog.String("route", route),
+		slog.String("request_id", requestIDFrom(ctx)),
+		slog.Any("error", err))
+}
+
+// Get implements the [store] interface.
+func (q *queryLog) Get(ctx context.Context, key string) ([]byte, error) {
+	start := time.Now()
+	v, err := q.next.Get(ctx, key)
+	q.observe(ctx, "get", key, start, err)
+	return v, err
+}
+
+// Put implements the [store] interface.
+func (q *queryLog) Put(ctx context.Context, key string, value []byte) error {
+	start := time.Now()
+	err := q.next.Put(ctx, key, value)
+	q.observe(ctx, "put", key, start, err)
+	return err
+}
+
+// Delete implements the [store] interface.
+func (q *queryLog) Delete(ctx context.Context, key string) error {
+	start := time.Now()
+	err := q.next.Delete(ctx, key)
+	q.observe(ctx, "delete", key, start, err)
+	return err
+}
+
+// List implements the [store] interface.
+func (q *queryLog) List(ctx context.Context, prefix string) ([]string, error) {
+	start := time.Now()
+	keys, err := q.next.List(ctx, prefix)
+	q.observe(ctx, "list", prefix, start, err)
+	return keys, err
+}
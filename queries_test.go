@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowStore is a [store] taking delay to answer each query.
+type slowStore struct {
+	store
+	delay time.Duration
+}
+
+func (s slowStore) Get(ctx context.Context, key string) ([]byte, error) {
+	time.Sleep(s.delay)
+	return s.store.Get(ctx, key)
+}
+
+// TestQueries tests that queries are counted per route, requests issuing many are logged, and slow ones are logged with their route.
+func TestQueries(t *testing.T) {
+	fs, err := newFileStore(filepath.Join(t.TempDir(), "store.json"))
+	testNil(t, err)
+	var buf bytes.Buffer
+	log := slog.New(slog.NewJSONHandler(&buf, nil))
+	st := logQueries(slowStore{store: fs, delay: time.Millisecond}, log, time.Hour)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /users", func(w http.ResponseWriter, r *http.Request) {
+		keys, _ := st.List(r.Context(), "users/")
+		for _, key := range keys {
+			_, _ = st.Get(r.Context(), key)
+		}
+	})
+	mux.HandleFunc("GET /users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = st.Get(r.Context(), "users/"+r.PathValue("id"))
+	})
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {})
+	var stats queryStats
+	handler := countQueries(mux, mux, &stats, log, 3)
+
+	for i := range 3 {
+		testNil(t, fs.Put(context.Background(), "users/"+strconv.Itoa(i), []byte(`{}`)))
+	}
+	for _, path := range []string{"/users", "/users/1", "/users/2", "/health"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	testContains(t, `"msg":"possible N+1 queries","route":"GET /users","queries":4`, buf.String())
+
+	w := httptest.NewRecorder()
+	handleGetQueries(&stats).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/queries", nil))
+	var body []queryRoute
+	testNil(t, json.NewDecoder(w.Body).Decode(&body))
+	testEqual(t, 2, len(body))
+	testEqual(t, queryRoute{Route: "GET /users", Requests: 1, Queries: 4, Average: 4, Max: 4}, body[0])
+	testEqual(t, queryRoute{Route: "GET /users/{id}", Requests: 2, Queries: 2, Average: 1, Max: 1}, body[1])
+
+	buf.Reset()
+	st = logQueries(slowStore{store: fs, delay: 5 * time.Millisecond}, log, time.Millisecond)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users/1", nil))
+	testContains(t, `"msg":"slow query","op":"get","key":"users/1"`, buf.String())
+	testContains(t, `"route":"GET /users/{id}"`, buf.String())
+
+	// the routes query the store of routeDeps, which run wraps the same way
+	buf.Reset()
+	cfg, err := parseConfig(io.Discard, []string{"test"})
+	testNil(t, err)
+	var ready atomic.Bool
+	ready.Store(true)
+	handler = route(routeDeps{log: log, version: version, cfg: cfg, ready: &ready, admin: &adminState{}, store: st, backups: fs})
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	testContains(t, `"msg":"slow query","op":"get"`, buf.String())
+	testContains(t, `"route":"GET /readyz"`, buf.String())
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxRateLimitClients is the number of clients [rateLimit] counts in a window before evicting the least recently seen.
+const maxRateLimitClients = 65536
+
+// rateLimitConfig configures the [rateLimit] middleware, set by the -rate-limit-* flags. The zero value disables it.
+type rateLimitConfig struct {
+	limit         int64         // requests per window per client, disabled if zero
+	window        time.Duration // length of the fixed windows the requests are counted in
+	legacyHeaders bool          // emits X-RateLimit-* headers instead of the RateLimit-* headers of the IETF draft
+}
+
+// rateLimit is a middleware that limits the requests of each client IP to the limit of the config in fixed windows,
+// responding with 429 and a problem response once the limit is exceeded. The limit can be overridden at runtime
+// under the name through the admin API, see [adminState.rateLimit], also when it is disabled by the config.
+// Health checks are not limited.
+//
+// Every response carries the RateLimit-Limit, RateLimit-Remaining, and RateLimit-Reset headers of
+// the IETF draft "RateLimit header fields for HTTP", so that clients can slow down before being rejected.
+// Clients expecting the legacy X-RateLimit-* names, where the reset is a Unix timestamp, can be served with legacyHeaders.
+//
+// The limit is registered as rate_limit_<name> at /debug/limits, used by the busiest client of the current window.
+func rateLimit(next http.Handler, name string, cfg rateLimitConfig, admin *adminState) http.Handler {
+	counts := newTTLMap[string, int64]("ratelimit."+name, maxRateLimitClients)
+	var peak ratePeak
+	registerLimitFunc("rate_limit_"+name, func() int64 { return admin.rateLimit(name, cfg.limit) }, func() int64 { return peak.load(time.Now()) })
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := admin.rateLimit(name, cfg.limit)
+		if limit <= 0 || isHealthCheck(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		client := r.RemoteAddr
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			client = host
+		}
+
+		now := time.Now()
+		reset := now.Truncate(cfg.window).Add(cfg.window)
+		count := counts.update(client, now, reset.Add(-time.Nanosecond), func(n int64, _ bool) int64 { return n + 1 })
+		peak.observe(reset, count)
+
+		remaining := max(limit-count, 0)
+		seconds := int64(reset.Sub(now).Round(time.Second) / time.Second)
+		if cfg.legacyHeaders {
+			w.Header().Set("X-RateLimit-Limit", strconv.FormatInt(limit, 10))
+			w.Header().Set("X-RateLimit-Remaining", strconv.FormatInt(remaining, 10))
+			w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+		} else {
+			w.Header().Set("RateLimit-Limit", strconv.FormatInt(limit, 10))
+			w.Header().Set("RateLimit-Remaining", strconv.FormatInt(remaining, 10))
+			w.Header().Set("RateLimit-Reset", strconv.FormatInt(seconds, 10))
+		}
+		if count > limit {
+			w.Header().Set("Retry-After", strconv.FormatInt(max(seconds, 1), 10))
+			writeProblem(w, r, http.StatusTooManyRequests, errors.New("rate limit exceeded"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ratePeak is the highest count of a client in the current window of [rateLimit], reported by /debug/limits.
+type ratePeak struct {
+	mu    sync.Mutex
+	reset time.Time // end of the window of count
+	count int64
+}
+
+// observe records the count of a client in the window ending at reset.
+func (p *ratePeak) observe(reset time.Time, count int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case reset.Before(p.reset):
+		return // a request of the previous window recorded late
+	case reset.After(p.reset):
+		p.reset, p.count = reset, 0
+	}
+	p.count = max(p.count, count)
+}
+
+// load returns the highest count of the window at now, or 0 if the window has ended.
+func (p *ratePeak) load(now time.Time) int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !now.Before(p.reset) {
+		return 0
+	}
+	return p.count
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestRateLimit tests that requests over the limit are rejected with the rate limit headers.
+func TestRateLimit(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	admin := &adminState{}
+	handler := rateLimit(ok, "default", rateLimitConfig{limit: 2, window: time.Hour}, admin)
+	do := func(handler http.Handler, remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/users", nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do(handler, "203.0.113.1:1234")
+	testEqual(t, http.StatusOK, w.Code)
+	testEqual(t, "2", w.Header().Get("RateLimit-Limit"))
+	testEqual(t, "1", w.Header().Get("RateLimit-Remaining"))
+	testEqual(t, true, w.Header().Get("RateLimit-Reset") != "")
+	testEqual(t, http.StatusOK, do(handler, "203.0.113.1:5678").Code)
+	w = do(handler, "203.0.113.1:1234")
+	testEqual(t, http.StatusTooManyRequests, w.Code)
+	testEqual(t, "0", w.Header().Get("RateLimit-Remaining"))
+	testEqual(t, true, w.Header().Get("Retry-After") != "")
+	testEqual(t, http.StatusOK, do(handler, "203.0.113.2:1234").Code)
+
+	l, registered := limits.Load("rate_limit_default")
+	testEqual(t, true, registered)
+	testEqual(t, int64(2), l.(limit).max())
+	testEqual(t, int64(3), l.(limit).used()) // the busiest client, counting its rejected request
+
+	admin.rateLimits = map[string]int64{"default": 10}
+	testEqual(t, http.StatusOK, do(handler, "203.0.113.1:1234").Code)
+	testEqual(t, int64(10), l.(limit).max())
+
+	legacy := rateLimit(ok, "legacy", rateLimitConfig{limit: 1, window: time.Hour, legacyHeaders: true}, admin)
+	w = do(legacy, "203.0.113.1:1234")
+	testEqual(t, "1", w.Header().Get("X-RateLimit-Limit"))
+	testEqual(t, "", w.Header().Get("RateLimit-Limit"))
+}
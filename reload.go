@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// configError is a violation of a setting found by [config.validate], reported per flag by reload failures.
+type configError struct {
+	Flag    string `json:"Flag"`
+	Message string `json:"Message"`
+}
+
+// Error implements the error interface.
+func (e *configError) Error() string { return "-" + e.Flag + ": " + e.Message }
+
+// configErrors returns every [configError] wrapped by err, including the ones joined by [config.validate].
+func configErrors(err error) []configError {
+	var res []configError
+	var walk func(err error)
+	walk = func(err error) {
+		switch e := err.(type) {
+		case nil:
+		case *configError:
+			res = append(res, *e)
+		case interface{ Unwrap() []error }:
+			for _, err := range e.Unwrap() {
+				walk(err)
+			}
+		default:
+			walk(errors.Unwrap(err))
+		}
+	}
+	walk(err)
+	return res
+}
+
+// readConfigFile sets the flags of fs from the file at path, one name=value per line, skipping blank lines and # comments.
+// Flags set on the command line take precedence, so that a single run can override the shared file.
+func readConfigFile(fs *flag.FlagSet, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, _ := strings.Cut(line, "=")
+		name = strings.TrimLeft(strings.TrimSpace(name), "-")
+		if set[name] {
+			continue
+		}
+		if err := fs.Set(name, strings.TrimSpace(value)); err != nil {
+			return fmt.Errorf("%s:%d: -%s: %w", path, n, name, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// liveFlags are the flags a reload applies to the running service, while changes of the others take effect on restart.
+var liveFlags = []string{"log-level"}
+
+// reloadStatus is the outcome of the last reload of the config, served by GET /admin/reload.
+type reloadStatus struct {
+	Time     time.Time     `json:"Time"`
+	OK       bool          `json:"OK"`
+	Error    string        `json:"Error,omitempty"`
+	Problems []configError `json:"Problems,omitempty"` // violations per flag of a config that failed validation
+	Applied  []string      `json:"Applied,omitempty"`  // changed flags applied to the running service
+	Pending  []string      `json:"Pending,omitempty"`  // changed flags that take effect on restart
+}
+
+// reloader parses the config again from the command line and -config file on SIGHUP or through the admin API,
+// applying the [liveFlags] of a valid config with apply, and keeping the previous config if it is invalid.
+// Every successful reload is emitted as a config-reloaded event of the lifecycle.
+type reloader struct {
+	log       *slog.Logger
+	args      []string
+	lifecycle *lifecycle
+	apply     func(cfg config)
+
+	mu      sync.Mutex
+	current config
+	status  reloadStatus
+}
+
+// newReloader returns a [reloader] of the config parsed from args at startup, reporting it as the last successful reload.
+func newReloader(log *slog.Logger, args []string, cfg config, lc *lifecycle, apply func(cfg config)) *reloader {
+	return &reloader{log: log, args: args, lifecycle: lc, apply: apply, current: cfg, status: reloadStatus{Time: time.Now(), OK: true}}
+}
+
+// watch reloads the config on every SIGHUP until ctx is done.
+func (rl *reloader) watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			rl.reload(ctx)
+		}
+	}
+}
+
+// reload parses and validates the config again. A valid config replaces the current one, applying the changed [liveFlags],
+// while an invalid one is logged with the violation of each flag and discarded, so that the service keeps serving as before.
+func (rl *reloader) reload(ctx context.Context) reloadStatus {
+	cfg, err := parseConfig(io.Discard, rl.args)
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	status := reloadStatus{Time: time.Now()}
+	if err != nil {
+		status.Error, status.Problems = err.Error(), configErrors(err)
+		rl.status = status
+		rl.log.ErrorContext(ctx, "config reload failed, keeping the previous config", slog.Any("error", err), slog.Any("problems", status.Problems))
+		return status
+	}
+
+	status.OK = true
+	for _, line := range cfg.dump[1:] { // NOTE: the first line is the command line, which does not change
+		if slices.Contains(rl.current.dump, line) {
+			continue
+		}
+		name, _, _ := strings.Cut(strings.TrimPrefix(line, "-"), "=")
+		if slices.Contains(liveFlags, name) {
+			status.Applied = append(status.Applied, name)
+		} else {
+			status.Pending = append(status.Pending, name)
+		}
+	}
+	// NOTE: apply only runs when the log level changed, so that a reload keeps the level set through the admin API
+	if slices.Contains(status.Applied, "log-level") {
+		rl.apply(cfg)
+	}
+	rl.current, rl.status = cfg, status
+	rl.log.InfoContext(ctx, "config reloaded", slog.Any("applied", status.Applied), slog.Any("pending_restart", status.Pending))
+	rl.lifecycle.emit(ctx, stateConfigReloaded, strings.Join(slices.Concat(status.Applied, status.Pending), ","))
+	return status
+}
+
+// lastStatus returns the outcome of the last reload.
+func (rl *reloader) lastStatus() reloadStatus {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.status
+}
+
+// handleGetReload returns an [http.HandlerFunc] that responds with the outcome of the last reload of rl.
+func handleGetReload(rl *reloader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := writeBody(w, r, 200, rl.lastStatus()); err != nil {
+			slog.ErrorContext(r.Context(), "failed to write reload status", slog.Any("error", err))
+		}
+	}
+}
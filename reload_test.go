@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestReload tests that a valid config applies its live flags, while an invalid one is reported per flag and discarded.
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config")
+	write := func(content string) {
+		t.Helper()
+		testNil(t, os.WriteFile(path, []byte(content), 0o600))
+	}
+	write("# shared settings\nlog-level=debug\n-port = 9000\n")
+	args := []string{"app", "-config", path, "-port", "8081"}
+	cfg, err := parseConfig(os.Stderr, args)
+	testNil(t, err)
+	testEqual(t, slog.LevelDebug, cfg.logLevel)
+	testEqual(t, uint(8081), cfg.port)
+
+	var buf bytes.Buffer
+	var level slog.LevelVar
+	level.Set(cfg.logLevel)
+	lc := newLifecycle(slog.New(slog.NewJSONHandler(io.Discard, nil)))
+	events, unsubscribe := lc.subscribe()
+	defer unsubscribe()
+	rl := newReloader(slog.New(slog.NewJSONHandler(&buf, nil)), args, cfg, lc, func(cfg config) { level.Set(cfg.logLevel) })
+	testEqual(t, true, rl.lastStatus().OK)
+
+	write("log-level=warn\nrate-limit=10\n")
+	status := rl.reload(context.Background())
+	testEqual(t, true, status.OK)
+	testEqual(t, "log-level", strings.Join(status.Applied, ","))
+	testEqual(t, "rate-limit", strings.Join(status.Pending, ","))
+	testEqual(t, slog.LevelWarn, level.Level())
+	event := <-events
+	testEqual(t, stateConfigReloaded, event.State)
+	testEqual(t, "log-level,rate-limit", event.Detail)
+
+	write("log-level=error\nrate-limit=-1\nconcurrency-limit=-2\n")
+	status = rl.reload(context.Background())
+	testEqual(t, false, status.OK)
+	testEqual(t, 2, len(status.Problems))
+	testEqual(t, configError{Flag: "rate-limit", Message: "must not be negative, got -1"}, status.Problems[1])
+	testEqual(t, configError{Flag: "concurrency-limit", Message: "must not be negative, got -2"}, status.Problems[0])
+	testEqual(t, slog.LevelWarn, level.Level())
+	testContains(t, `"msg":"config reload failed, keeping the previous config"`, buf.String())
+	testContains(t, `{"Flag":"rate-limit","Message":"must not be negative, got -1"}`, buf.String())
+
+	write("gc-percent=eighty\n")
+	status = rl.reload(context.Background())
+	testEqual(t, false, status.OK)
+	testContains(t, path+":1: -gc-percent: ", status.Error)
+	testEqual(t, 0, len(events)) // failed reloads are not emitted
+
+	w := httptest.NewRecorder()
+	handleGetReload(rl).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/reload", nil))
+	var body reloadStatus
+	testNil(t, json.NewDecoder(w.Body).Decode(&body))
+	testEqual(t, false, body.OK)
+	testEqual(t, status.Error, body.Error)
+
+	write("log-level=info\n")
+	r := httptest.NewRequest(http.MethodPost, "/admin/reload", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	handleAdmin(adminDeps{log: slog.New(slog.NewJSONHandler(&buf, nil)), state: &adminState{}, token: "secret", reloader: rl}).ServeHTTP(w, r)
+	testEqual(t, http.StatusOK, w.Code)
+	testEqual(t, slog.LevelInfo, level.Level())
+	event = <-events
+	testEqual(t, stateConfigReloaded, event.State)
+	testEqual(t, "log-level,rate-limit", event.Detail)
+
+	// a reload without a change of the live flags keeps the level set at runtime, such as through the admin API
+	level.Set(slog.LevelDebug)
+	write("log-level=info\nrate-limit=5\n")
+	status = rl.reload(context.Background())
+	testEqual(t, true, status.OK)
+	testEqual(t, 0, len(status.Applied))
+	testEqual(t, slog.LevelDebug, level.Level())
+	<-events
+
+	// a rejected reload through the admin API is audited, but not emitted
+	write("rate-limit=-1\n")
+	w = httptest.NewRecorder()
+	handleAdmin(adminDeps{log: slog.New(slog.NewJSONHandler(&buf, nil)), state: &adminState{}, token: "secret", lifecycle: lc, reloader: rl}).ServeHTTP(w, r)
+	testEqual(t, http.StatusUnprocessableEntity, w.Code)
+	testEqual(t, 0, len(events))
+	testContains(t, `"setting":"config","old":null,"new":false`, buf.String())
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// Access log levels of routes beyond those of [slog], see [routeMeta.Log].
+const (
+	levelTrace = slog.LevelDebug - 4 // logs every request along with the start of its request and response bodies
+	levelOff   = slog.LevelError + 4 // logs nothing
+)
+
+// traceBodyLimit is how many bytes of the request and response bodies are logged at [levelTrace].
+const traceBodyLimit = 4 << 10
+
+// routeLogRule sets the access log level of the routes under a path prefix, set by the -route-log flag.
+type routeLogRule struct {
+	prefix string
+	level  slog.Level
+}
+
+// parseRouteLogLevel parses the access log level of a route: trace, info, warn, error, or off.
+// Routes at warn or error only log requests failing with 4xx and 5xx or only 5xx.
+func parseRouteLogLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "trace":
+		return levelTrace, nil
+	case "info", "":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	case "off":
+		return levelOff, nil
+	}
+	return 0, fmt.Errorf("unknown route log level %q, must be one of trace, info, warn, error, off", s)
+}
+
+// parseRouteLogRule parses a -route-log rule in the form of '<path-prefix>=<level>', such as '/webhooks/=trace'.
+func parseRouteLogRule(s string) (routeLogRule, error) {
+	prefix, level, ok := strings.Cut(s, "=")
+	if !ok || !strings.HasPrefix(prefix, "/") {
+		return routeLogRule{}, fmt.Errorf("route log %q is not in the form of '<path-prefix>=<level>'", s)
+	}
+	l, err := parseRouteLogLevel(level)
+	return routeLogRule{prefix: prefix, level: l}, err
+}
+
+// routeLogLevel returns the access log level of the route of the pattern: the level of the rule with the longest
+// prefix of its path, or meta.Log otherwise. It panics on an invalid meta.Log, like [http.ServeMux] on invalid patterns.
+func routeLogLevel(pattern string, meta routeMeta, rules []routeLogRule) slog.Level {
+	path := pattern[strings.Index(pattern, "/"):]
+	var rule *routeLogRule
+	for i, r := range rules {
+		if strings.HasPrefix(path, r.prefix) && (rule == nil || len(r.prefix) > len(rule.prefix)) {
+			rule = &rules[i]
+		}
+	}
+	if rule != nil {
+		return rule.level
+	}
+	level, err := parseRouteLogLevel(meta.Log)
+	if err != nil {
+		panic(fmt.Sprintf("route %s: %s", pattern, err))
+	}
+	return level
+}
+
+// logRoute is a middleware setting the access log level of the route to level, resolved by [handle] at registration,
+// so that [accesslog] only compares levels for each request. At [levelTrace], it also adds the start of
+// the request and response bodies to the access log entry, so beware of routes receiving secrets.
+func logRoute(next http.Handler, level slog.Level) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		extra, ok := r.Context().Value(logAttrsKey).(*logAttrs)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		extra.mu.Lock()
+		extra.level = level
+		extra.mu.Unlock()
+		if level > levelTrace {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var reqBody, resBody bytes.Buffer
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.TeeReader(r.Body, &limitedBuffer{buf: &reqBody}), r.Body}
+		}
+		next.ServeHTTP(&traceWriter{ResponseWriter: w, body: limitedBuffer{buf: &resBody}}, r)
+		addLogAttrs(r.Context(), slog.String("request_body", reqBody.String()), slog.String("response_body", resBody.String()))
+	})
+}
+
+// limitedBuffer is an [io.Writer] keeping the first [traceBodyLimit] bytes written to buf and discarding the rest.
+type limitedBuffer struct {
+	buf *bytes.Buffer
+}
+
+// Write implements the [io.Writer] interface.
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.buf.Write(p[:min(len(p), traceBodyLimit-b.buf.Len())])
+	return len(p), nil
+}
+
+// traceWriter is an [http.ResponseWriter] keeping the start of the response body, see [logRoute].
+type traceWriter struct {
+	http.ResponseWriter
+	body limitedBuffer
+}
+
+// Write implements the [http.ResponseWriter] interface.
+func (tw *traceWriter) Write(b []byte) (int, error) {
+	tw.body.Write(b)
+	return tw.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the original [http.ResponseWriter], so that [http.ResponseController] can reach it.
+func (tw *traceWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestRouteLog tests that routes are access logged at the levels of their metadata and the -route-log rules.
+func TestRouteLog(t *testing.T) {
+	cfg, err := parseConfig(io.Discard, []string{"testapp", "--route-log", "/test-route-log/webhooks/=trace", "--route-log", "/test-route-log/=warn"})
+	testNil(t, err)
+
+	mux := http.NewServeMux()
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.URL.Query().Has("fail") {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		w.Write(append([]byte("echo "), body...))
+	})
+	handle(mux, "POST /test-route-log/webhooks/{id}", echo, routeMeta{Summary: "Webhook"}, cfg.routeLogs...)
+	handle(mux, "GET /test-route-log/items", echo, routeMeta{Summary: "Items"}, cfg.routeLogs...)
+	handle(mux, "GET /test-route-metrics", echo, routeMeta{Summary: "Metrics", Log: "off"}, cfg.routeLogs...)
+	handle(mux, "GET /test-route-health", echo, routeMeta{Summary: "Health"}, cfg.routeLogs...)
+	var logs bytes.Buffer
+	handler := accesslog(mux, slog.New(slog.NewTextHandler(&logs, nil)))
+	serve := func(method, target, body string) string {
+		logs.Reset()
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, target, strings.NewReader(body)))
+		return logs.String()
+	}
+
+	testContains(t, `request_body="{\"event\":\"paid\"}" response_body="echo {\"event\":\"paid\"}"`, serve(http.MethodPost, "/test-route-log/webhooks/1", `{"event":"paid"}`))
+	testEqual(t, "", serve(http.MethodGet, "/test-route-log/items", ""))
+	testContains(t, "status=400", serve(http.MethodGet, "/test-route-log/items?fail", ""))
+	testEqual(t, "", serve(http.MethodGet, "/test-route-metrics?fail", ""))
+	testContains(t, "msg=accessed", serve(http.MethodGet, "/test-route-health", ""))
+	testEqual(t, false, strings.Contains(serve(http.MethodGet, "/test-route-health", ""), "request_body"))
+
+	_, err = parseRouteLogRule("/webhooks/=verbose")
+	testContains(t, `unknown route log level "verbose"`, err.Error())
+}
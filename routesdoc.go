@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// securitySchemes are the OpenAPI security schemes of the authenticators of the -auth flag.
+var securitySchemes = []struct {
+	method, name, definition string
+}{
+	{authJWT, "bearer", "      type: http\n      scheme: bearer\n      bearerFormat: JWT\n"},
+	{authAPIKey, "apiKey", "      type: apiKey\n      in: header\n      name: X-API-Key\n"},
+	{authMTLS, "mutualTLS", "      type: mutualTLS\n"},
+}
+
+// handleGetRoutesOpenapi returns an [http.HandlerFunc] that serves an OpenAPI document generated from the routes
+// registered by [handle], so that the scopes declared at registration are reflected into the security requirements
+// of their operations instead of being kept in sync by hand. Every authenticator of methods but anonymous
+// is listed as a security scheme, or every authenticator if methods is empty.
+func handleGetRoutesOpenapi(version string, methods []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(200)
+		if _, err := w.Write(routesOpenapi(version, methods)); err != nil {
+			slog.ErrorContext(r.Context(), "failed to write routes openapi", slog.Any("error", err))
+		}
+	}
+}
+
+// routesOpenapi returns the OpenAPI document of the routes registered by [handle] in the block style YAML of api/.
+// Routes without a method in their pattern, such as "/debug/", are left out.
+func routesOpenapi(version string, methods []string) []byte {
+	type operation struct {
+		method string
+		meta   routeMeta
+	}
+
+	paths := map[string][]operation{}
+	routes.Range(func(key, value any) bool {
+		method, path, ok := strings.Cut(key.(string), " ")
+		if !ok || !strings.HasPrefix(path, "/") {
+			return true
+		}
+		path = strings.ReplaceAll(strings.TrimSuffix(path, "{$}"), "...}", "}")
+		paths[path] = append(paths[path], operation{method: strings.ToLower(method), meta: value.(routeMeta)})
+		return true
+	})
+	var schemes []string
+	for _, s := range securitySchemes {
+		if len(methods) == 0 || slices.Contains(methods, s.method) {
+			schemes = append(schemes, s.name)
+		}
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "openapi: 3.1.0\ninfo:\n  title: Routes\n  version: %q\npaths:\n", cmp.Or(version, "dev"))
+	sortedPaths := make([]string, 0, len(paths))
+	for path := range paths {
+		sortedPaths = append(sortedPaths, path)
+	}
+	slices.Sort(sortedPaths)
+	for _, path := range sortedPaths {
+		fmt.Fprintf(&b, "  %q:\n", path)
+		ops := paths[path]
+		slices.SortFunc(ops, func(a, b operation) int { return strings.Compare(a.method, b.method) })
+		for _, op := range ops {
+			fmt.Fprintf(&b, "    %s:\n", op.method)
+			fmt.Fprintf(&b, "      operationId: %s\n", operationID(op.method, path))
+			fmt.Fprintf(&b, "      summary: %q\n", op.meta.Summary)
+			if !op.meta.Deprecated.IsZero() {
+				b.WriteString("      deprecated: true\n")
+			}
+			if len(op.meta.Scopes) > 0 {
+				b.WriteString("      security:\n")
+				for _, scheme := range schemes {
+					fmt.Fprintf(&b, "        - %s:\n", scheme)
+					for _, scope := range op.meta.Scopes {
+						fmt.Fprintf(&b, "            - %q\n", scope)
+					}
+				}
+			}
+			b.WriteString("      responses:\n        default:\n          description: The response, or problem details on errors.\n")
+			if op.meta.Cache != "" {
+				b.WriteString("          headers:\n            Cache-Control:\n")
+				b.WriteString("              description: Cache policy of successful responses, no-store on errors.\n")
+				fmt.Fprintf(&b, "              schema:\n                type: string\n                example: %q\n", op.meta.Cache)
+			}
+		}
+	}
+	b.WriteString("components:\n  securitySchemes:\n")
+	for _, s := range securitySchemes {
+		if slices.Contains(schemes, s.name) {
+			fmt.Fprintf(&b, "    %s:\n%s", s.name, s.definition)
+		}
+	}
+	return b.Bytes()
+}
+
+// operationID returns the operationId of the operation in camel case, such as deleteUsersId for DELETE /users/{id}.
+func operationID(method, path string) string {
+	id := []rune(method)
+	upper := true
+	for _, c := range path {
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) {
+			upper = true
+			continue
+		}
+		if upper {
+			c = unicode.ToUpper(c)
+			upper = false
+		}
+		id = append(id, c)
+	}
+	return string(id)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// jobVars counts the runs of scheduled jobs and their failures, served by /debug/vars.
+var jobVars = expvar.NewMap("jobs")
+
+// Errors of [scheduler.runNow].
+var (
+	errUnknownJob = errors.New("unknown job")
+	errJobRunning = errors.New("job is already running")
+)
+
+// scheduler runs background jobs periodically, such as purging expired data, until it is closed.
+// Runs of a job never overlap, panics are recovered as failures, and failures are logged and counted
+// without stopping the job. Close cancels the context of the running jobs and waits for them on shutdown.
+type scheduler struct {
+	log    *slog.Logger
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu   sync.Mutex
+	jobs map[string]*scheduledJob
+}
+
+// scheduledJob is a job registered by [scheduler.every], along with the outcome of its last run.
+type scheduledJob struct {
+	name     string
+	interval time.Duration
+	job      func(ctx context.Context) error
+	running  atomic.Bool
+
+	// guarded by the mutex of the scheduler
+	next         time.Time
+	lastRun      time.Time
+	lastDuration time.Duration
+	lastErr      error
+}
+
+// jobStatus is the state of a scheduled job, as served by the admin API.
+type jobStatus struct {
+	Name         string    `json:"Name"`
+	Interval     string    `json:"Interval"`
+	Running      bool      `json:"Running"`
+	NextRun      time.Time `json:"NextRun"`
+	LastRun      time.Time `json:"LastRun"`
+	LastDuration string    `json:"LastDuration,omitempty"`
+	LastError    string    `json:"LastError,omitempty"`
+}
+
+// newScheduler returns a [scheduler] logging the failures of its jobs to log.
+func newScheduler(log *slog.Logger) *scheduler {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &scheduler{log: log, ctx: ctx, cancel: cancel, jobs: map[string]*scheduledJob{}}
+}
+
+// every runs the job named name every interval, the first time after one interval.
+// A tick is skipped if the job is still running, such as when run by [scheduler.runNow].
+//
+//	sched.every("purge-sessions", time.Hour, func(ctx context.Context) error { ... })
+func (s *scheduler) every(name string, interval time.Duration, job func(ctx context.Context) error) {
+	j := &scheduledJob{name: name, interval: interval, job: job, next: time.Now().Add(interval)}
+	s.mu.Lock()
+	s.jobs[name] = j
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				if s.ctx.Err() != nil {
+					return // NOTE: select picks randomly when closed while a tick is pending
+				}
+				s.mu.Lock()
+				j.next = now.Add(interval)
+				s.mu.Unlock()
+				if j.running.CompareAndSwap(false, true) {
+					s.run(j)
+				}
+			case <-s.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// runNow runs the job named name in the background outside of its schedule,
+// failing with [errUnknownJob] if there is no such job and [errJobRunning] if it is running.
+func (s *scheduler) runNow(name string) error {
+	s.mu.Lock()
+	j, ok := s.jobs[name]
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w %q", errUnknownJob, name)
+	}
+	if !j.running.CompareAndSwap(false, true) {
+		return fmt.Errorf("%w %q", errJobRunning, name)
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.run(j)
+	}()
+	return nil
+}
+
+// run runs the job once, recovering its panic and recording the outcome. The job must be marked running by the caller.
+func (s *scheduler) run(j *scheduledJob) {
+	defer j.running.Store(false)
+	start := time.Now()
+	err := func() (err error) {
+		defer func() {
+			if v := recover(); v != nil {
+				err = fmt.Errorf("panic: %v", v)
+			}
+		}()
+		return j.job(s.ctx)
+	}()
+	s.mu.Lock()
+	j.lastRun, j.lastDuration, j.lastErr = start, time.Since(start), err
+	s.mu.Unlock()
+	jobVars.Add(j.name+".runs", 1)
+	if err != nil {
+		jobVars.Add(j.name+".failures", 1)
+		s.log.ErrorContext(s.ctx, "job failed", slog.String("job", j.name), slog.Duration("duration", time.Since(start)), slog.Any("error", err))
+	}
+}
+
+// status returns the state of every job sorted by name, or none if s is nil.
+func (s *scheduler) status() []jobStatus {
+	statuses := []jobStatus{}
+	if s == nil {
+		return statuses
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, j := range s.jobs {
+		st := jobStatus{Name: j.name, Interval: j.interval.String(), Running: j.running.Load(), NextRun: j.next, LastRun: j.lastRun}
+		if !j.lastRun.IsZero() {
+			st.LastDuration = j.lastDuration.String()
+		}
+		if j.lastErr != nil {
+			st.LastError = j.lastErr.Error()
+		}
+		statuses = append(statuses, st)
+	}
+	slices.SortFunc(statuses, func(a, b jobStatus) int { return cmp.Compare(a.Name, b.Name) })
+	return statuses
+}
+
+// Close stops scheduling jobs, cancels the running ones, and waits for them to return.
+func (s *scheduler) Close() {
+	s.cancel()
+	s.wg.Wait()
+}
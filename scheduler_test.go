@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestScheduler tests that jobs run periodically, failures are counted, and Close waits for running jobs.
+func TestScheduler(t *testing.T) {
+	sched := newScheduler(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	runs := make(chan struct{}, 10)
+	sched.every("test-scheduler", time.Millisecond, func(ctx context.Context) error {
+		runs <- struct{}{}
+		<-ctx.Done()
+		return errors.New("canceled")
+	})
+	sched.every("test-scheduler-panic", time.Millisecond, func(context.Context) error { panic("boom") })
+	<-runs
+	for jobVars.Get("test-scheduler-panic.failures") == nil {
+		time.Sleep(time.Millisecond)
+	}
+	sched.Close()
+	testEqual(t, "1", jobVars.Get("test-scheduler.runs").String())
+	testEqual(t, "1", jobVars.Get("test-scheduler.failures").String())
+}
+
+// TestSchedulerJobs tests that the admin API lists the jobs with their last outcome and runs them on demand.
+func TestSchedulerJobs(t *testing.T) {
+	sched := newScheduler(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer sched.Close()
+	release := make(chan struct{})
+	runs := make(chan struct{}, 10)
+	sched.every("test-scheduler-manual", time.Hour, func(ctx context.Context) error {
+		runs <- struct{}{}
+		<-release
+		return errors.New("failed")
+	})
+	admin := handleAdmin(adminDeps{log: slog.New(slog.NewTextHandler(io.Discard, nil)), state: &adminState{}, token: "secret", scheduler: sched})
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, r)
+		return w
+	}
+
+	testEqual(t, http.StatusAccepted, serve(http.MethodPost, "/admin/jobs/test-scheduler-manual/run").Code)
+	<-runs
+	testEqual(t, http.StatusConflict, serve(http.MethodPost, "/admin/jobs/test-scheduler-manual/run").Code)
+	testEqual(t, http.StatusNotFound, serve(http.MethodPost, "/admin/jobs/unknown/run").Code)
+	close(release)
+	for sched.status()[0].Running {
+		time.Sleep(time.Millisecond)
+	}
+
+	var jobs []jobStatus
+	testNil(t, json.NewDecoder(serve(http.MethodGet, "/admin/jobs").Body).Decode(&jobs))
+	testEqual(t, 1, len(jobs))
+	testEqual(t, "test-scheduler-manual", jobs[0].Name)
+	testEqual(t, "1h0m0s", jobs[0].Interval)
+	testEqual(t, "failed", jobs[0].LastError)
+	testEqual(t, false, jobs[0].LastRun.IsZero())
+	testEqual(t, true, jobs[0].NextRun.After(jobs[0].LastRun))
+}
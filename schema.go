@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// errSchemaTooNew is returned by [schema.unmarshal] for payloads written by a newer version of the schema,
+// such as by the previous deploy before a rollback.
+var errSchemaTooNew = errors.New("payload schema is newer than supported")
+
+// versionedPayload is the envelope of a JSON payload tagged with the version of its schema by [schema.marshal].
+type versionedPayload struct {
+	Version int             `json:"Version"`
+	Data    json.RawMessage `json:"Data"`
+}
+
+// schema versions the JSON payloads of type T that outlive a deploy, such as values of a [store] or queued messages,
+// so that they survive changes of T. Payloads are tagged with the current version when written, and migrated
+// from their version on read by the migrations registered with [schema.migrate]. Payloads written without a version,
+// before T was versioned, are read as version 0.
+//
+//	var userSchema = newSchema[user]("user", 2).
+//		migrate(0, renameField("name", "full_name")).
+//		migrate(1, func(data json.RawMessage) (json.RawMessage, error) { ... })
+type schema[T any] struct {
+	name       string
+	version    int
+	migrations map[int]func(data json.RawMessage) (json.RawMessage, error)
+}
+
+// newSchema returns a [schema] of T named name in errors, at the current version.
+func newSchema[T any](name string, version int) *schema[T] {
+	return &schema[T]{name: name, version: version, migrations: map[int]func(json.RawMessage) (json.RawMessage, error){}}
+}
+
+// migrate registers the migration of payloads from the version to the next one, returning s for chaining.
+// It panics if the version is not below the current one, like [http.ServeMux] on invalid patterns.
+func (s *schema[T]) migrate(from int, migration func(data json.RawMessage) (json.RawMessage, error)) *schema[T] {
+	if from < 0 || from >= s.version {
+		panic(fmt.Sprintf("schema %s: migration from version %d, must be between 0 and %d", s.name, from, s.version-1))
+	}
+	s.migrations[from] = migration
+	return s
+}
+
+// marshal encodes v as a payload tagged with the current version.
+func (s *schema[T]) marshal(v T) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(versionedPayload{Version: s.version, Data: data})
+}
+
+// unmarshal decodes the payload, migrating it to the current version first.
+// It fails with [errSchemaTooNew] for payloads of a newer version, and if a migration is missing or fails.
+func (s *schema[T]) unmarshal(b []byte) (T, error) {
+	var v T
+	var payload versionedPayload
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields() // NOTE: tells unversioned payloads of objects apart from envelopes
+	if err := dec.Decode(&payload); err != nil || payload.Data == nil {
+		payload = versionedPayload{Version: 0, Data: b}
+	}
+	if payload.Version > s.version {
+		return v, fmt.Errorf("schema %s: %w: version %d, supported up to %d", s.name, errSchemaTooNew, payload.Version, s.version)
+	}
+	for version := payload.Version; version < s.version; version++ {
+		migration, ok := s.migrations[version]
+		if !ok {
+			return v, fmt.Errorf("schema %s: no migration from version %d", s.name, version)
+		}
+		var err error
+		if payload.Data, err = migration(payload.Data); err != nil {
+			return v, fmt.Errorf("schema %s: migrating from version %d: %w", s.name, version, err)
+		}
+	}
+	if err := json.Unmarshal(payload.Data, &v); err != nil {
+		return v, fmt.Errorf("schema %s: %w", s.name, err)
+	}
+	return v, nil
+}
+
+// renameField returns a migration renaming the top-level field of a JSON object from from to to.
+func renameField(from, to string) func(data json.RawMessage) (json.RawMessage, error) {
+	return func(data json.RawMessage) (json.RawMessage, error) {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return nil, err
+		}
+		if value, ok := fields[from]; ok {
+			delete(fields, from)
+			fields[to] = value
+		}
+		return json.Marshal(fields)
+	}
+}
+
+// getVersioned returns the value of the key in the store, migrated by the schema, or [errNotFound] if it does not exist.
+func getVersioned[T any](ctx context.Context, st store, s *schema[T], key string) (T, error) {
+	b, err := st.Get(ctx, key)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return s.unmarshal(b)
+}
+
+// putVersioned sets the value of the key in the store, tagged with the current version of the schema.
+func putVersioned[T any](ctx context.Context, st store, s *schema[T], key string, v T) error {
+	b, err := s.marshal(v)
+	if err != nil {
+		return err
+	}
+	return st.Put(ctx, key, b)
+}
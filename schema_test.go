@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestSchema tests that payloads are tagged with their version and migrated on read, including unversioned ones.
+func TestSchema(t *testing.T) {
+	type user struct {
+		FullName string `json:"full_name"`
+		Plan     string `json:"plan"`
+	}
+	s := newSchema[user]("user", 2).
+		migrate(0, renameField("name", "full_name")).
+		migrate(1, func(data json.RawMessage) (json.RawMessage, error) {
+			var fields map[string]any
+			if err := json.Unmarshal(data, &fields); err != nil {
+				return nil, err
+			}
+			fields["plan"] = strings.ToLower(fields["plan"].(string))
+			return json.Marshal(fields)
+		})
+
+	st, err := newFileStore(filepath.Join(t.TempDir(), "store.json"))
+	testNil(t, err)
+	ctx := context.Background()
+	testNil(t, putVersioned(ctx, st, s, "users/1", user{FullName: "Kim", Plan: "pro"}))
+	b, _ := st.Get(ctx, "users/1")
+	testEqual(t, `{"Version":2,"Data":{"full_name":"Kim","plan":"pro"}}`, string(b))
+	u, err := getVersioned(ctx, st, s, "users/1")
+	testNil(t, err)
+	testEqual(t, user{FullName: "Kim", Plan: "pro"}, u)
+
+	testNil(t, st.Put(ctx, "users/2", []byte(`{"name":"Lee","plan":"FREE"}`)))
+	u, err = getVersioned(ctx, st, s, "users/2")
+	testNil(t, err)
+	testEqual(t, user{FullName: "Lee", Plan: "free"}, u)
+
+	u, err = s.unmarshal([]byte(`{"Version":1,"Data":{"full_name":"Park","plan":"Team"}}`))
+	testNil(t, err)
+	testEqual(t, user{FullName: "Park", Plan: "team"}, u)
+
+	_, err = s.unmarshal([]byte(`{"Version":3,"Data":{}}`))
+	testEqual(t, true, errors.Is(err, errSchemaTooNew))
+	_, err = newSchema[user]("user", 1).unmarshal([]byte(`{"name":"Lee"}`))
+	testContains(t, "no migration from version 0", err.Error())
+	_, err = getVersioned(ctx, st, s, "users/3")
+	testEqual(t, errNotFound, err)
+}
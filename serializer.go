@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// errUnsupportedMediaType is returned by [decodeBody] for request bodies in a format without a [serializer].
+var errUnsupportedMediaType = errors.New("unsupported media type")
+
+// serializer encodes and decodes values in the format of a media type, registered by [registerSerializer].
+type serializer interface {
+	Encode(w io.Writer, v any) error
+	Decode(r io.Reader, v any) error
+}
+
+// jsonSerializer is the [serializer] of application/json, encoding with [newJSONEncoder].
+type jsonSerializer struct{}
+
+// Encode implements the [serializer] interface.
+func (jsonSerializer) Encode(w io.Writer, v any) error { return newJSONEncoder(w).Encode(v) }
+
+// Decode implements the [serializer] interface.
+func (jsonSerializer) Decode(r io.Reader, v any) error { return json.NewDecoder(r).Decode(v) }
+
+// defaultMediaType is the media type of responses to requests accepting any format or none registered,
+// and of request bodies without a Content-Type.
+const defaultMediaType = "application/json"
+
+// serializers maps media types to their [serializer], read by [decodeBody] and [writeBody] to negotiate the format.
+var serializers = struct {
+	mu     sync.RWMutex
+	byType map[string]serializer
+	types  []string // in the order of registration, the first preferred when the client accepts several equally
+}{byType: map[string]serializer{defaultMediaType: jsonSerializer{}}, types: []string{defaultMediaType}}
+
+// registerSerializer registers the serializer of the media type, so that request bodies in that format are decoded
+// and responses are encoded in it for clients preferring it, without touching the handlers.
+// Call it at startup, such as to add MessagePack, CBOR, or Protobuf with their libraries:
+//
+//	registerSerializer("application/msgpack", msgpackSerializer{})
+func registerSerializer(mediaType string, s serializer) {
+	serializers.mu.Lock()
+	defer serializers.mu.Unlock()
+	if _, ok := serializers.byType[mediaType]; !ok {
+		serializers.types = append(serializers.types, mediaType)
+	}
+	serializers.byType[mediaType] = s
+}
+
+// negotiate returns the media type and [serializer] of the response to the request, preferring the registered
+// media type with the highest quality in the Accept header, and [defaultMediaType] if none is acceptable.
+func negotiate(r *http.Request) (string, serializer) {
+	serializers.mu.RLock()
+	defer serializers.mu.RUnlock()
+	best, bestQ := defaultMediaType, 0.0
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if s, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(s, 64); err != nil {
+				continue
+			}
+		}
+		if q <= bestQ {
+			continue
+		}
+		prefix, wildcard := strings.CutSuffix(mediaType, "*")
+		if mediaType == "*/*" {
+			prefix = ""
+		}
+		if i := slices.IndexFunc(serializers.types, func(t string) bool {
+			return t == mediaType || (wildcard && strings.HasPrefix(t, prefix))
+		}); i >= 0 {
+			best, bestQ = serializers.types[i], q
+		}
+	}
+	return best, serializers.byType[best]
+}
+
+// decodeBody decodes the body of the request into v with the [serializer] of its Content-Type, JSON if unset,
+// returning [errUnsupportedMediaType] for formats without one, to respond with 415.
+func decodeBody(r *http.Request, v any) error {
+	mediaType := defaultMediaType
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(ct); err != nil {
+			return fmt.Errorf("%w: %w", errUnsupportedMediaType, err)
+		}
+	}
+	serializers.mu.RLock()
+	s, ok := serializers.byType[mediaType]
+	serializers.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", errUnsupportedMediaType, mediaType)
+	}
+	return s.Decode(r.Body, v)
+}
+
+// writeBody writes v as a response with the status in the format negotiated with the request by [negotiate].
+// JSON responses are written by [writeJSON], and other formats are likewise encoded into a buffer first,
+// so that Content-Length is set and an encoding error is returned before anything is written.
+func writeBody(w http.ResponseWriter, r *http.Request, status int, v any) error {
+	mediaType, s := negotiate(r)
+	w.Header().Add("Vary", "Accept")
+	if mediaType == defaultMediaType {
+		return writeJSON(w, status, v)
+	}
+	var buf bytes.Buffer
+	if err := s.Encode(&buf, v); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(status)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
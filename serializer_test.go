@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// lineSerializer is a [serializer] of "key=value" lines for a map[string]string, standing in for a format like MsgPack.
+type lineSerializer struct{}
+
+func (lineSerializer) Encode(w io.Writer, v any) error {
+	for k, val := range v.(map[string]string) {
+		if _, err := fmt.Fprintf(w, "%s=%s\n", k, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (lineSerializer) Decode(r io.Reader, v any) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m := v.(*map[string]string)
+	*m = map[string]string{}
+	for _, line := range strings.Fields(string(b)) {
+		k, val, _ := strings.Cut(line, "=")
+		(*m)[k] = val
+	}
+	return nil
+}
+
+// TestSerializer tests that a registered format is negotiated by Accept and decoded by Content-Type, falling back to JSON.
+func TestSerializer(t *testing.T) {
+	serializers.mu.Lock()
+	byType, types := maps.Clone(serializers.byType), slices.Clone(serializers.types)
+	serializers.mu.Unlock()
+	t.Cleanup(func() {
+		serializers.mu.Lock()
+		defer serializers.mu.Unlock()
+		serializers.byType, serializers.types = byType, types
+	})
+	registerSerializer("application/x-lines", lineSerializer{})
+
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", "application/json"},
+		{"*/*", "application/json"},
+		{"text/html", "application/json"},
+		{"application/x-lines", "application/x-lines"},
+		{"application/json;q=0.5, application/x-lines", "application/x-lines"},
+		{"application/json, application/x-lines;q=0.9", "application/json"},
+		{"application/x-lines;q=0", "application/json"},
+		{"application/x-lines;q=0.5, */*;q=0.8", "application/json"},
+		{"application/*", "application/json"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.accept, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Accept", tc.accept)
+			got, _ := negotiate(r)
+			testEqual(t, tc.want, got)
+		})
+	}
+
+	t.Run("write", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept", "application/x-lines")
+		w := httptest.NewRecorder()
+		testNil(t, writeBody(w, r, http.StatusCreated, map[string]string{"name": "kim"}))
+		testEqual(t, http.StatusCreated, w.Code)
+		testEqual(t, "application/x-lines", w.Header().Get("Content-Type"))
+		testEqual(t, "Accept", w.Header().Get("Vary"))
+		testEqual(t, "name=kim\n", w.Body.String())
+	})
+
+	t.Run("decode", func(t *testing.T) {
+		var got map[string]string
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("name=kim"))
+		r.Header.Set("Content-Type", "application/x-lines; charset=utf-8")
+		testNil(t, decodeBody(r, &got))
+		testEqual(t, "kim", got["name"])
+
+		r = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"name":"lee"}`))
+		testNil(t, decodeBody(r, &got))
+		testEqual(t, "lee", got["name"])
+
+		r = httptest.NewRequest(http.MethodPost, "/", strings.NewReader("name: kim"))
+		r.Header.Set("Content-Type", "application/yaml")
+		testEqual(t, true, errors.Is(decodeBody(r, &got), errUnsupportedMediaType))
+	})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// shutdownPhase is a phase of the shutdown sequence run by [shutdown].
+type shutdownPhase struct {
+	name    string
+	timeout time.Duration
+	stop    func(ctx context.Context) error // stops the phase, abandoned if it does not return before the context is done
+}
+
+// shutdown runs the phases in order, each within its own timeout, so that a slow phase cannot eat the time of the next.
+// The sequence of [run] is, each phase timed out by its flag:
+//
+//	http       stops accepting, waits for requests and long-lived connections   -shutdown-grace
+//	telemetry  flushes the remaining logs and spans                             -shutdown-telemetry-timeout
+//	workers    waits for the queued asynchronous event deliveries               -shutdown-workers-timeout
+//
+// Stores such as database pools are closed in a last phase after the workers, since those may still write to them.
+// A failed or timed out phase does not stop the sequence, so that telemetry is flushed and stores are closed anyway.
+// It returns the errors of every failed phase.
+func shutdown(ctx context.Context, log *slog.Logger, phases []shutdownPhase) error {
+	var errs []error
+	for _, p := range phases {
+		start := time.Now()
+		phaseCtx, cancel := context.WithTimeout(ctx, p.timeout)
+		done := make(chan error, 1)
+		go func() { done <- p.stop(phaseCtx) }()
+		var err error
+		select {
+		case err = <-done:
+		case <-phaseCtx.Done():
+			// NOTE: the phase is abandoned if it ignores the context, leaving it to the exit of the process
+			err = phaseCtx.Err()
+		}
+		cancel()
+		if err != nil {
+			log.ErrorContext(ctx, "shutdown phase failed", slog.String("phase", p.name), slog.String("timeout", p.timeout.String()), slog.Any("error", err))
+			errs = append(errs, fmt.Errorf("shutting down %s within %s: %w", p.name, p.timeout, err))
+			continue
+		}
+		log.InfoContext(ctx, "shutdown phase done", slog.String("phase", p.name), slog.String("latency", time.Since(start).String()))
+	}
+	return errors.Join(errs...)
+}
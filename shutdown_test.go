@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestShutdown tests that the phases run in order within their own timeouts, continuing after a failed phase.
+func TestShutdown(t *testing.T) {
+	var buf bytes.Buffer
+	var mu sync.Mutex
+	var order []string
+	phase := func(name string, stop func(ctx context.Context) error) shutdownPhase {
+		return shutdownPhase{name: name, timeout: 50 * time.Millisecond, stop: func(ctx context.Context) error {
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			return stop(ctx)
+		}}
+	}
+
+	err := shutdown(context.Background(), slog.New(slog.NewJSONHandler(&buf, nil)), []shutdownPhase{
+		phase("http", func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}),
+		phase("telemetry", func(ctx context.Context) error {
+			deadline, _ := ctx.Deadline()
+			testEqual(t, true, time.Until(deadline) > 25*time.Millisecond)
+			return nil
+		}),
+		phase("workers", func(context.Context) error { return errors.New("stuck") }),
+	})
+	testEqual(t, true, errors.Is(err, context.DeadlineExceeded))
+	testContains(t, "shutting down http within 50ms", err.Error())
+	testContains(t, "shutting down workers within 50ms: stuck", err.Error())
+	mu.Lock()
+	testEqual(t, "http,telemetry,workers", strings.Join(order, ","))
+	mu.Unlock()
+	testContains(t, `"msg":"shutdown phase done","phase":"telemetry"`, buf.String())
+
+	testNil(t, shutdown(context.Background(), slog.New(slog.NewJSONHandler(&buf, nil)), nil))
+}
+
+// TestGracefulShutdown tests the graceful shutdown contract of the server: once shutting down, new connections are refused
+// while requests in flight complete within -shutdown-grace, and requests outliving it fail the shutdown with [exitShutdown].
+func TestGracefulShutdown(t *testing.T) {
+	t.Run("in-flight completes", func(t *testing.T) {
+		endpoint, stop := startTestServer(t, "-shutdown-grace", "2s")
+		slow := slowRequest(t, endpoint, 500*time.Millisecond)
+
+		errc := stop()
+		waitRefused(t, endpoint)
+		res := <-slow
+		testNil(t, res.err)
+		testEqual(t, http.StatusNoContent, res.status)
+		testNil(t, <-errc)
+	})
+
+	t.Run("grace exceeded", func(t *testing.T) {
+		forced := func() int64 {
+			if v, ok := connVars.Get("http.forced").(*expvar.Int); ok {
+				return v.Value()
+			}
+			return 0
+		}
+		before := forced()
+		endpoint, stop := startTestServer(t, "-shutdown-grace", "100ms")
+		slow := slowRequest(t, endpoint, 2*time.Second)
+
+		start := time.Now()
+		err := <-stop()
+		var exitErr *exitError
+		testEqual(t, true, errors.As(err, &exitErr))
+		testEqual(t, exitShutdown, exitErr.code)
+		testContains(t, "shutting down http within 100ms", err.Error())
+		testEqual(t, true, time.Since(start) < time.Second)
+		testEqual(t, true, (<-slow).err != nil)
+		// NOTE: the phase times out as the connections are force-closed, so they may be counted after run returns
+		for deadline := time.Now().Add(time.Second); forced()-before < 1 && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+		testEqual(t, true, forced()-before >= 1) // NOTE: idle connections of other clients may be force-closed too
+	})
+}
+
+// startTestServer runs the server with the args on a free port until stop is called, returning its endpoint
+// once it is healthy. stop starts the shutdown and returns the channel of the error run returns with.
+func startTestServer(t *testing.T, args ...string) (endpoint string, stop func() <-chan error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	testNil(t, err)
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	ln.Close()
+	endpoint = "http://127.0.0.1:" + port
+
+	defaultLogger := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) }) // NOTE: run sets the default logger to its own
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		// NOTE: the concurrency limiter counts the requests reaching the handlers, which slowRequest waits for
+		errc <- run(ctx, io.Discard, append([]string{"testapp", "--port", port, "--env", "dev", "--concurrency-limit", "100"}, args...), version)
+	}()
+	t.Cleanup(cancel)
+	// NOTE: no keep-alive connection is left open by the polling, which the shutdown would have to close too
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if res, err := client.Get(endpoint + "/readyz"); err == nil {
+			res.Body.Close()
+			if res.StatusCode == http.StatusOK {
+				break
+			}
+		}
+		if time.Since(start) > 2*time.Second {
+			t.Fatalf("server on %s not ready", endpoint)
+		}
+	}
+	return endpoint, func() <-chan error {
+		cancel()
+		return errc
+	}
+}
+
+// slowResult is the outcome of a [slowRequest].
+type slowResult struct {
+	status int
+	err    error
+}
+
+// slowRequest sends a request to the endpoint taking delay to handle, simulating a slow handler with /debug/delay,
+// and returns once the request reached the handler, as counted by the concurrency limiter of [startTestServer].
+func slowRequest(t *testing.T, endpoint string, delay time.Duration) <-chan slowResult {
+	t.Helper()
+	inFlight := func() int64 {
+		if l, ok := limits.Load("concurrency"); ok {
+			return l.(limit).used()
+		}
+		return 0
+	}
+	results := make(chan slowResult, 1)
+	go func() {
+		res, err := http.Get(fmt.Sprintf("%s/debug/delay?ms=%d", endpoint, delay.Milliseconds()))
+		if err != nil {
+			results <- slowResult{err: err}
+			return
+		}
+		res.Body.Close()
+		results <- slowResult{status: res.StatusCode}
+	}()
+	for start := time.Now(); inFlight() < 1; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("request to %s not in flight", endpoint)
+		}
+	}
+	return results
+}
+
+// waitRefused waits for the server of the endpoint to refuse new connections, failing the test after a second.
+func waitRefused(t *testing.T, endpoint string) {
+	t.Helper()
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+		res, err := client.Get(endpoint + "/health")
+		if err != nil {
+			return
+		}
+		res.Body.Close()
+	}
+	t.Fatalf("server on %s still accepts new connections", endpoint)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// trashPrefix is the prefix of the keys soft-deleted values are moved under by [softDelete].
+const trashPrefix = "trash/"
+
+// errUndoExpired is returned by [undoDelete] when the grace period of the soft-deleted key is over.
+var errUndoExpired = errors.New("grace period to undo is over")
+
+// trashEntry is a soft-deleted value with the time it was deleted at, stored under [trashPrefix].
+type trashEntry struct {
+	Key       string    `json:"Key"`
+	DeletedAt time.Time `json:"DeletedAt"`
+	Value     []byte    `json:"Value"`
+}
+
+// softDelete moves the value of the key to the trash, so that it disappears from Get and List of the store
+// but can be restored by [undoDelete] until the grace period is over and [purgeDeleted] removes it for good.
+// It returns [errNotFound] if the key does not exist.
+//
+//	if err := softDelete(r.Context(), st, "users/"+id); errors.Is(err, errNotFound) { ... }
+//	w.Header().Set("Link", "</users/"+id+"/undo>; rel=\"undo\"")
+func softDelete(ctx context.Context, st store, key string) error {
+	value, err := st.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	entry, err := json.Marshal(trashEntry{Key: key, DeletedAt: time.Now(), Value: value})
+	if err != nil {
+		return err
+	}
+	// NOTE: the trash is written first, so that a failure in between leaves the value in both places rather than none
+	if err := st.Put(ctx, trashPrefix+key, entry); err != nil {
+		return err
+	}
+	return st.Delete(ctx, key)
+}
+
+// undoDelete restores the value of the key soft-deleted by [softDelete] within the grace period,
+// returning [errNotFound] if it is not in the trash and [errUndoExpired] if the grace period is over.
+func undoDelete(ctx context.Context, st store, key string, grace time.Duration) error {
+	b, err := st.Get(ctx, trashPrefix+key)
+	if err != nil {
+		return err
+	}
+	var entry trashEntry
+	if err := json.Unmarshal(b, &entry); err != nil {
+		return fmt.Errorf("invalid trash entry %s: %w", key, err)
+	}
+	if time.Since(entry.DeletedAt) > grace {
+		return errUndoExpired
+	}
+	if err := st.Put(ctx, key, entry.Value); err != nil {
+		return err
+	}
+	return st.Delete(ctx, trashPrefix+key)
+}
+
+// purgeDeleted removes the values soft-deleted longer than the grace period ago for good,
+// returning the number of keys purged. It is run by the "purge-deleted" job of the [scheduler].
+func purgeDeleted(ctx context.Context, st store, grace time.Duration) (int, error) {
+	keys, err := st.List(ctx, trashPrefix)
+	if err != nil {
+		return 0, err
+	}
+	var purged int
+	var errs []error
+	for _, key := range keys {
+		b, err := st.Get(ctx, key)
+		if errors.Is(err, errNotFound) {
+			continue // NOTE: restored since listed
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		var entry trashEntry
+		// NOTE: entries that cannot be decoded are purged too, since they can never be restored
+		if err := json.Unmarshal(b, &entry); err == nil && time.Since(entry.DeletedAt) <= grace {
+			continue
+		}
+		if err := st.Delete(ctx, key); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		purged++
+	}
+	return purged, errors.Join(errs...)
+}
+
+// trashListSpec allowlists listing the trash at GET /admin/trash by the key and the time of deletion.
+var trashListSpec = listSpec{Sort: []string{"DeletedAt", "Key"}, Filter: []string{"Key"}, DefaultSort: "-DeletedAt", MaxSize: 100}
+
+// handlePostUndo returns an [http.HandlerFunc] restoring the value soft-deleted under the prefix and the {id} path value,
+// responding with 204, 404 if there is nothing to restore, or 410 if the grace period is over.
+//
+//	handle(mux, "POST /users/{id}/undo", handlePostUndo(st, "users/", cfg.softDeleteGrace), routeMeta{Summary: "Undo deleting a user"})
+func handlePostUndo(st store, prefix string, grace time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if id == "" || strings.Contains(id, "/") {
+			writeProblem(w, r, http.StatusBadRequest, errors.New("invalid id"))
+			return
+		}
+		switch err := undoDelete(r.Context(), st, prefix+id, grace); {
+		case errors.Is(err, errNotFound):
+			writeProblem(w, r, http.StatusNotFound, fmt.Errorf("%s is not deleted", id))
+		case errors.Is(err, errUndoExpired):
+			writeProblem(w, r, http.StatusGone, err)
+		case err != nil:
+			slog.ErrorContext(r.Context(), "failed to undo delete", slog.String("key", prefix+id), slog.Any("error", err))
+			writeProblem(w, r, http.StatusInternalServerError, err)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestSoftDelete tests that soft-deleted keys can be restored within the grace period and are purged after it.
+func TestSoftDelete(t *testing.T) {
+	ctx := context.Background()
+	st, err := newFileStore(filepath.Join(t.TempDir(), "store.json"))
+	testNil(t, err)
+	testNil(t, st.Put(ctx, "users/1", []byte("alice")))
+	testNil(t, st.Put(ctx, "users/2", []byte("bob")))
+
+	testNil(t, softDelete(ctx, st, "users/1"))
+	testEqual(t, errNotFound, softDelete(ctx, st, "users/3"))
+	keys, err := st.List(ctx, "users/")
+	testNil(t, err)
+	testEqual(t, 1, len(keys))
+
+	mux := http.NewServeMux()
+	mux.Handle("POST /users/{id}/undo", handlePostUndo(st, "users/", time.Hour))
+	serve := func(id string) int {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/users/"+id+"/undo", nil))
+		return w.Code
+	}
+	testEqual(t, http.StatusNoContent, serve("1"))
+	value, err := st.Get(ctx, "users/1")
+	testNil(t, err)
+	testEqual(t, "alice", string(value))
+	testEqual(t, http.StatusNotFound, serve("1"))
+
+	testNil(t, softDelete(ctx, st, "users/1"))
+	old, err := json.Marshal(trashEntry{DeletedAt: time.Now().Add(-2 * time.Hour), Value: []byte("bob")})
+	testNil(t, err)
+	testNil(t, st.Put(ctx, trashPrefix+"users/2", old))
+	testNil(t, st.Delete(ctx, "users/2"))
+	testEqual(t, http.StatusGone, serve("2"))
+
+	admin := handleAdmin(adminDeps{log: slog.New(slog.NewTextHandler(io.Discard, nil)), state: &adminState{}, token: "secret", store: st})
+	list := func(query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/admin/trash?"+query, nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, r)
+		return w
+	}
+	w := list("page[size]=1")
+	testEqual(t, http.StatusOK, w.Code)
+	testContains(t, `"Key":"users/1"`, w.Body.String())
+	testContains(t, `"Total":2`, w.Body.String())
+	testEqual(t, http.StatusBadRequest, list("sort=Value").Code)
+
+	purged, err := purgeDeleted(ctx, st, time.Hour)
+	testNil(t, err)
+	testEqual(t, 1, purged)
+	testEqual(t, http.StatusNotFound, serve("2"))
+	testEqual(t, http.StatusNoContent, serve("1"))
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// errNotFound is returned by a [store] when the key does not exist.
+var errNotFound = errors.New("not found")
+
+// errInvalidBackup is returned by [fileStore.restore] when the backup cannot be decoded, as opposed to failing to persist it.
+var errInvalidBackup = errors.New("invalid backup")
+
+// store is a key-value store persisting the data of the service, with values encoded by the handlers such as in JSON.
+// Handlers depend on this interface, so that the embedded [fileStore] of single-binary deployments
+// can be replaced by a store backed by a database server such as PostgreSQL as the service grows.
+type store interface {
+	// Get returns the value of the key, or [errNotFound] if it does not exist.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Put sets the value of the key.
+	Put(ctx context.Context, key string, value []byte) error
+	// Delete removes the key, doing nothing if it does not exist.
+	Delete(ctx context.Context, key string) error
+	// List returns the sorted keys with the prefix.
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// fileStore is a [store] embedded in the process, keeping every value in memory and persisting them to a single file,
+// so that tiny deployments can persist data without any external dependency. Every write replaces the file atomically,
+// so it suits small data sets written rarely, such as settings. It is nil unless the -store flag is set.
+type fileStore struct {
+	path string
+
+	mu   sync.RWMutex
+	data map[string][]byte
+}
+
+// newFileStore returns a [fileStore] persisting to the file at path, loading its data if the file exists.
+func newFileStore(path string) (*fileStore, error) {
+	s := &fileStore{path: path, data: map[string][]byte{}}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&s.data); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Get implements the [store] interface.
+func (s *fileStore) Get(_ context.Context, key string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, ok := s.data[key]
+	if !ok {
+		return nil, errNotFound
+	}
+	return slices.Clone(value), nil
+}
+
+// Put implements the [store] interface.
+func (s *fileStore) Put(_ context.Context, key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data := maps.Clone(s.data)
+	data[key] = slices.Clone(value)
+	return s.persist(data)
+}
+
+// Delete implements the [store] interface.
+func (s *fileStore) Delete(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data[key]; !ok {
+		return nil
+	}
+	data := maps.Clone(s.data)
+	delete(data, key)
+	return s.persist(data)
+}
+
+// List implements the [store] interface.
+func (s *fileStore) List(_ context.Context, prefix string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := []string{}
+	for key := range s.data {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys, nil
+}
+
+// backup writes every value of the store to w, in the format read by [fileStore.restore].
+func (s *fileStore) backup(w io.Writer) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return json.NewEncoder(w).Encode(s.data)
+}
+
+// restore replaces every value of the store with the backup read from r, returning the number of keys restored.
+// The store is left unchanged if the backup is invalid, reported as [errInvalidBackup], or cannot be persisted.
+func (s *fileStore) restore(r io.Reader) (int, error) {
+	data := map[string][]byte{}
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		return 0, fmt.Errorf("%w: %w", errInvalidBackup, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(data), s.persist(data)
+}
+
+// persist replaces the file of the store with data atomically and then the data in memory,
+// so that neither changes if the write fails. It must be called with the lock held.
+func (s *fileStore) persist(data map[string][]byte) error {
+	f, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := json.NewEncoder(f).Encode(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), s.path); err != nil {
+		return err
+	}
+	s.data = data
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestFileStore tests that values are persisted to the file and loaded back.
+func TestFileStore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "store.json")
+	s, err := newFileStore(path)
+	testNil(t, err)
+	testNil(t, s.Put(ctx, "users/1", []byte(`{"Name":"a"}`)))
+	testNil(t, s.Put(ctx, "users/2", []byte(`{"Name":"b"}`)))
+	testNil(t, s.Put(ctx, "settings", []byte(`{}`)))
+	testNil(t, s.Delete(ctx, "users/2"))
+	testNil(t, s.Delete(ctx, "missing"))
+
+	s, err = newFileStore(path)
+	testNil(t, err)
+	value, err := s.Get(ctx, "users/1")
+	testNil(t, err)
+	testEqual(t, `{"Name":"a"}`, string(value))
+	_, err = s.Get(ctx, "users/2")
+	testEqual(t, true, errors.Is(err, errNotFound))
+	keys, err := s.List(ctx, "users/")
+	testNil(t, err)
+	testEqual(t, "users/1", strings.Join(keys, ","))
+}
+
+// TestAdminBackup tests that the store is backed up and restored through the admin API.
+func TestAdminBackup(t *testing.T) {
+	ctx := context.Background()
+	s, err := newFileStore(filepath.Join(t.TempDir(), "store.json"))
+	testNil(t, err)
+	testNil(t, s.Put(ctx, "users/1", []byte("a")))
+	admin := handleAdmin(adminDeps{log: slog.New(slog.NewTextHandler(io.Discard, nil)), state: &adminState{}, token: "secret", backups: s})
+	do := func(method, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/admin/backup", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do(http.MethodGet, "")
+	testEqual(t, http.StatusOK, w.Code)
+	backup := w.Body.String()
+	testNil(t, s.Put(ctx, "users/2", []byte("b")))
+	testEqual(t, http.StatusBadRequest, do(http.MethodPut, "not json").Code)
+	testEqual(t, http.StatusNoContent, do(http.MethodPut, backup).Code)
+	keys, err := s.List(ctx, "")
+	testNil(t, err)
+	testEqual(t, "users/1", strings.Join(keys, ","))
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/admin/backup", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	handleAdmin(adminDeps{log: slog.New(slog.NewTextHandler(io.Discard, nil)), state: &adminState{}, token: "secret"}).ServeHTTP(w, r)
+	testEqual(t, http.StatusNotFound, w.Code)
+}
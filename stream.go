@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// streamConfig configures how [stream] writes responses, set by the -stream-* flags.
+type streamConfig struct {
+	rate         int64         // bytes per second per response, unlimited if zero
+	writeTimeout time.Duration // deadline to write each chunk, refreshed per chunk
+}
+
+// streamChunkSize is the size of chunks written by [stream].
+const streamChunkSize = 32 << 10
+
+// streamVars counts streamed responses, bytes, and stalled clients, served by /debug/vars.
+var streamVars = expvar.NewMap("stream")
+
+// stream copies src to the response in chunks with backpressure, for proxy and download routes.
+// Each chunk is rate limited by a token bucket per response, flushed to the client,
+// and must be written within the write timeout, which is refreshed per chunk,
+// so that a stalled client is disconnected instead of holding the handler forever.
+// The throughput of each response is recorded into m, see [handleGetMetrics].
+//
+//	res, err := client.Do(req)
+//	if err != nil { ... }
+//	defer res.Body.Close()
+//	w.Header().Set("Content-Type", res.Header.Get("Content-Type"))
+//	if _, err := stream(w, r, res.Body, cfg.stream, m); err != nil {
+//		slog.WarnContext(r.Context(), "stream aborted", slog.Any("error", err))
+//	}
+func stream(w http.ResponseWriter, r *http.Request, src io.Reader, cfg streamConfig, m *metrics) (int64, error) {
+	rc := http.NewResponseController(w)
+	defer func() { _ = rc.SetWriteDeadline(time.Time{}) }()
+	var bucket *tokenBucket
+	if cfg.rate > 0 {
+		bucket = newTokenBucket(float64(cfg.rate), float64(max(cfg.rate, streamChunkSize)))
+	}
+
+	streamVars.Add("streams", 1)
+	start := time.Now()
+	buf := make([]byte, streamChunkSize)
+	var written int64
+	var err error
+	for {
+		n, rerr := src.Read(buf)
+		if n > 0 {
+			if bucket != nil {
+				if err = bucket.wait(r.Context(), float64(n)); err != nil {
+					break
+				}
+			}
+			if cfg.writeTimeout > 0 {
+				if err = rc.SetWriteDeadline(time.Now().Add(cfg.writeTimeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+					break
+				}
+			}
+			var wn int
+			wn, err = w.Write(buf[:n])
+			written += int64(wn)
+			if err == nil {
+				err = rc.Flush()
+				if errors.Is(err, http.ErrNotSupported) {
+					err = nil
+				}
+			}
+			if err != nil {
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					streamVars.Add("stalled", 1)
+				}
+				break
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			err = rerr
+			break
+		}
+	}
+
+	streamVars.Add("bytes", written)
+	if elapsed := time.Since(start).Seconds(); elapsed > 0 {
+		tc, _ := traceFrom(r.Context())
+		m.observe("http_stream_throughput_bytes_per_second", "Throughput of streamed responses.", throughputBuckets,
+			float64(written)/elapsed, tc)
+	}
+	return written, err
+}
+
+// throughputBuckets are the upper bounds in bytes per second of throughput histogram buckets, from 1KiB/s to 1GiB/s.
+var throughputBuckets = []float64{1 << 10, 16 << 10, 256 << 10, 1 << 20, 16 << 20, 256 << 20, 1 << 30}
+
+// tokenBucket is a token bucket refilled at rate tokens per second, holding at most burst tokens.
+type tokenBucket struct {
+	rate, burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full [tokenBucket].
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// reserve takes n tokens, returning how long to wait until they are available.
+// The tokens may go negative, so that waiting callers are served in order.
+func (b *tokenBucket) reserve(n float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// wait blocks until n tokens are taken from the bucket or the context is done.
+func (b *tokenBucket) wait(ctx context.Context, n float64) error {
+	d := b.reserve(n)
+	if d == 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestStream tests that streamed responses are complete and rate limited.
+func TestStream(t *testing.T) {
+	body := strings.Repeat("a", 3*streamChunkSize)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = stream(w, r, strings.NewReader(body), streamConfig{rate: 20 * streamChunkSize, writeTimeout: time.Second}, nil)
+	}))
+	defer server.Close()
+
+	start := time.Now()
+	res, err := http.Get(server.URL)
+	testNil(t, err)
+	defer res.Body.Close()
+	got, err := io.ReadAll(res.Body)
+	testNil(t, err)
+	testEqual(t, len(body), len(got))
+	testEqual(t, true, time.Since(start) < time.Second) // the burst of the bucket covers the whole body
+
+	// the rate is tested on the bucket directly, so that the test does not need to wait for it
+
+	bucket := newTokenBucket(1000, 100)
+	testEqual(t, time.Duration(0), bucket.reserve(100))
+	testEqual(t, true, bucket.reserve(100) > 50*time.Millisecond)
+}
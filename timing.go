@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// timings holds the durations of the phases of a request recorded by [startTiming], see [serverTiming].
+type timings struct {
+	mu     sync.Mutex
+	names  []string // names in the order they are first recorded
+	phases map[string]time.Duration
+}
+
+// serverTiming is a middleware that emits the Server-Timing header with the durations of the phases of the request,
+// recorded by middlewares and handlers with [startTiming], followed by the total duration until the response is written.
+// The queries to the store wrapped by [logQueries] and the calls through [newClient] are recorded as the store and outbound phases.
+// The durations show up in the network panel of browser devtools, so that frontend engineers can see backend breakdowns.
+// It reveals internals of the service, so it is enabled by -server-timing outside of prod only.
+func serverTiming(next http.Handler, enabled bool) http.Handler {
+	if !enabled {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tm := &timings{phases: map[string]time.Duration{}}
+		tw := &timingWriter{ResponseWriter: w, timings: tm, start: time.Now()}
+		next.ServeHTTP(tw, r.WithContext(context.WithValue(r.Context(), serverTimingKey, tm)))
+	})
+}
+
+// startTiming starts timing the phase of the request, returning the function to stop it.
+// Phases with the same name are summed. It does nothing if [serverTiming] is not enabled.
+//
+//	stop := startTiming(r.Context(), "db")
+//	users, err := store.ListUsers(r.Context())
+//	stop()
+func startTiming(ctx context.Context, name string) (stop func()) {
+	tm, ok := ctx.Value(serverTimingKey).(*timings)
+	if !ok {
+		return func() {}
+	}
+	start := time.Now()
+	var once sync.Once
+	return func() {
+		once.Do(func() { tm.record(name, time.Since(start)) })
+	}
+}
+
+// recordTiming adds the duration d to the phase of the request, for callers that measure it already, like [startTiming].
+func recordTiming(ctx context.Context, name string, d time.Duration) {
+	if tm, ok := ctx.Value(serverTimingKey).(*timings); ok {
+		tm.record(name, d)
+	}
+}
+
+// record adds the duration d to the phase of the name.
+func (tm *timings) record(name string, d time.Duration) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if _, ok := tm.phases[name]; !ok {
+		tm.names = append(tm.names, name)
+	}
+	tm.phases[name] += d
+}
+
+// timingWriter is an [http.ResponseWriter] adding the Server-Timing header right before the response header is written,
+// next to the entries set by other middlewares such as [servedBy].
+type timingWriter struct {
+	http.ResponseWriter
+	timings *timings
+	start   time.Time
+	written bool
+}
+
+// WriteHeader implements the [http.ResponseWriter] interface.
+func (tw *timingWriter) WriteHeader(statusCode int) {
+	if !tw.written {
+		tw.written = true
+		tw.Header().Add("Server-Timing", tw.timings.header(time.Since(tw.start)))
+	}
+	tw.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write implements the [http.ResponseWriter] interface.
+func (tw *timingWriter) Write(b []byte) (int, error) {
+	if !tw.written {
+		tw.WriteHeader(http.StatusOK)
+	}
+	return tw.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the original [http.ResponseWriter], so that [http.ResponseController] can reach it.
+func (tw *timingWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// header formats the phases and the total duration as the value of the Server-Timing header,
+// such as "db;dur=12.3, render;dur=4.5, total;dur=20.1" in milliseconds.
+func (tm *timings) header(total time.Duration) string {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	metrics := make([]string, 0, len(tm.names)+1)
+	for _, name := range tm.names {
+		metrics = append(metrics, fmt.Sprintf("%s;dur=%.1f", name, float64(tm.phases[name].Microseconds())/1000))
+	}
+	metrics = append(metrics, fmt.Sprintf("total;dur=%.1f", float64(total.Microseconds())/1000))
+	return strings.Join(metrics, ", ")
+}
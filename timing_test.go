@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestServerTiming tests that the durations of phases are emitted in the Server-Timing header.
+func TestServerTiming(t *testing.T) {
+	handler := serverTiming(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for range 2 {
+			stop := startTiming(r.Context(), "db")
+			time.Sleep(time.Millisecond)
+			stop()
+		}
+		stop := startTiming(r.Context(), "render")
+		stop()
+		_, _ = w.Write([]byte("ok"))
+	}), true)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	metrics := strings.Split(w.Header().Get("Server-Timing"), ", ")
+	testEqual(t, 3, len(metrics))
+	db, err := strconv.ParseFloat(strings.TrimPrefix(metrics[0], "db;dur="), 64)
+	testNil(t, err)
+	testEqual(t, true, db >= 2) // both phases are summed
+	testEqual(t, true, strings.HasPrefix(metrics[1], "render;dur="))
+	testEqual(t, true, strings.HasPrefix(metrics[2], "total;dur="))
+
+	stop := startTiming(httptest.NewRequest(http.MethodGet, "/", nil).Context(), "db")
+	stop()
+
+	// the store and outbound calls are timed without instrumenting the handler
+	fs, err := newFileStore(filepath.Join(t.TempDir(), "store.json"))
+	testNil(t, err)
+	st := logQueries(fs, slog.New(slog.NewTextHandler(io.Discard, nil)), 0)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	client := newClient(slog.New(slog.NewTextHandler(io.Discard, nil)), "", time.Second, chaosConfig{}, nil, nil, egressPolicy{})
+	handler = serverTiming(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = st.Get(r.Context(), "users/1")
+		req, _ := http.NewRequestWithContext(r.Context(), http.MethodGet, upstream.URL, nil)
+		if res, err := client.Do(req); err == nil {
+			res.Body.Close()
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}), true)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	testContains(t, "store;dur=", w.Header().Get("Server-Timing"))
+	testContains(t, "outbound;dur=", w.Header().Get("Server-Timing"))
+}
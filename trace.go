@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// traceContext is the W3C trace context of a request, assigned by the [tracing] middleware.
+type traceContext struct {
+	traceID  [16]byte
+	spanID   [8]byte // span ID of this service handling the request
+	parentID [8]byte // span ID of the caller, zero if the trace is started by this service
+	flags    byte
+}
+
+// sampledFlag is the trace flag set when the trace is sampled.
+const sampledFlag = 0x01
+
+// tracing is a middleware that continues the trace of the traceparent header of the request,
+// or starts a new trace if there is none, storing the [traceContext] in the request context.
+// Logs written with the request context are correlated to the trace, see [otlpHandler].
+//
+// Whether the trace is sampled is decided by the [sampler] when the request starts.
+// If exporter is not nil, a server span is exported for sampled requests when they end,
+// and for the requests the sampler forces to keep, such as errors and slow requests.
+func tracing(next http.Handler, smp *sampler, exporter *otlpExporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		tc, parent := parseTraceparent(r.Header.Get("traceparent"))
+		if parent {
+			tc.parentID = tc.spanID
+		} else {
+			_, _ = crand.Read(tc.traceID[:])
+		}
+		_, _ = crand.Read(tc.spanID[:])
+		tc.flags &^= sampledFlag
+		if smp.sample(tc, parent) {
+			tc.flags |= sampledFlag
+		}
+
+		wr := responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(&wr, r.WithContext(context.WithValue(r.Context(), traceKey, tc)))
+
+		latency := time.Since(start)
+		if exporter == nil || (tc.flags&sampledFlag == 0 && !smp.force(wr.status, latency)) {
+			return
+		}
+		exporter.addSpan(newServerSpan(tc, r, wr.status, start, latency))
+	})
+}
+
+// newServerSpan returns an OTLP span of the request handled by this service.
+func newServerSpan(tc traceContext, r *http.Request, status int, start time.Time, latency time.Duration) otlpSpan {
+	method, path, code := r.Method, r.URL.Path, strconv.Itoa(status)
+	span := otlpSpan{
+		TraceID:           hex.EncodeToString(tc.traceID[:]),
+		SpanID:            hex.EncodeToString(tc.spanID[:]),
+		Name:              r.Method,
+		Kind:              2, // SPAN_KIND_SERVER
+		StartTimeUnixNano: strconv.FormatInt(start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(start.Add(latency).UnixNano(), 10),
+		Attributes: []otlpKeyValue{
+			{Key: "http.request.method", Value: otlpAnyValue{StringValue: &method}},
+			{Key: "url.path", Value: otlpAnyValue{StringValue: &path}},
+			{Key: "http.response.status_code", Value: otlpAnyValue{IntValue: &code}},
+		},
+	}
+	if tc.parentID != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(tc.parentID[:])
+	}
+	if status >= 500 {
+		span.Status.Code = 2 // STATUS_CODE_ERROR
+	}
+	return span
+}
+
+// sampler decides whether a trace is sampled, configured by the -trace-sampler flags.
+// The names of the samplers follow the OTEL_TRACES_SAMPLER environment variable of OpenTelemetry:
+//   - always_on, always_off: samples every trace or none.
+//   - traceidratio: samples the ratio of traces given by the argument, deterministically by trace ID.
+//   - ratelimited: samples at most the number of traces per second given by the argument.
+//   - parentbased_always_on, parentbased_always_off, parentbased_traceidratio, parentbased_ratelimited:
+//     follows the sampling decision of the caller if there is one, or the sampler after the prefix otherwise.
+type sampler struct {
+	name         string
+	arg          float64
+	forceLatency time.Duration // requests slower than this are kept even if not sampled, disabled if zero
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// samplers is the set of sampler names accepted by -trace-sampler.
+var samplers = []string{
+	"always_on", "always_off", "traceidratio", "ratelimited",
+	"parentbased_always_on", "parentbased_always_off", "parentbased_traceidratio", "parentbased_ratelimited",
+}
+
+// sample reports whether the trace should be sampled when the request starts.
+// parent reports whether the trace context is propagated from the caller.
+func (s *sampler) sample(tc traceContext, parent bool) bool {
+	name, parentBased := strings.CutPrefix(s.name, "parentbased_")
+	if parentBased && parent {
+		return tc.flags&sampledFlag != 0
+	}
+	switch name {
+	case "always_on":
+		return true
+	case "traceidratio":
+		// NOTE: the lower 8 bytes of the trace ID are random as required by W3C trace context level 2
+		return float64(binary.BigEndian.Uint64(tc.traceID[8:])) < s.arg*math.MaxUint64
+	case "ratelimited":
+		return s.take()
+	default:
+		return false
+	}
+}
+
+// take takes a token from the token bucket refilled by arg tokens per second, reporting whether it succeeded.
+func (s *sampler) take() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if !s.last.IsZero() {
+		s.tokens = min(s.arg, s.tokens+now.Sub(s.last).Seconds()*s.arg)
+	} else {
+		s.tokens = s.arg
+	}
+	s.last = now
+	if s.tokens < 1 {
+		return false
+	}
+	s.tokens--
+	return true
+}
+
+// force is the tail-based hook reporting whether a request should be kept even if its trace is not sampled,
+// so that interesting traces are always kept. By default, it keeps 5xx responses and requests slower than -trace-force-latency.
+// Change this function to keep other kinds of requests.
+func (s *sampler) force(status int, latency time.Duration) bool {
+	return status >= 500 || (s.forceLatency > 0 && latency >= s.forceLatency)
+}
+
+// parseTraceparent parses the traceparent header in the form of "00-<trace-id>-<parent-id>-<flags>".
+// The parent ID is stored as the span ID of the returned trace context.
+// It reports false if the header is missing or malformed.
+func parseTraceparent(s string) (traceContext, bool) {
+	var tc traceContext
+	parts := strings.Split(s, "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceContext{}, false
+	}
+	flags := make([]byte, 1)
+	if _, err := hex.Decode(tc.traceID[:], []byte(parts[1])); err != nil || tc.traceID == [16]byte{} {
+		return traceContext{}, false
+	}
+	if _, err := hex.Decode(tc.spanID[:], []byte(parts[2])); err != nil || tc.spanID == [8]byte{} {
+		return traceContext{}, false
+	}
+	if _, err := hex.Decode(flags, []byte(parts[3])); err != nil {
+		return traceContext{}, false
+	}
+	tc.flags = flags[0]
+	return tc, true
+}
+
+// String returns the trace context in the form of the traceparent header.
+func (tc traceContext) String() string {
+	return fmt.Sprintf("00-%x-%x-%02x", tc.traceID, tc.spanID, tc.flags)
+}
+
+// traceFrom returns the [traceContext] assigned by [tracing], reporting false if there is none.
+func traceFrom(ctx context.Context) (traceContext, bool) {
+	tc, ok := ctx.Value(traceKey).(traceContext)
+	return tc, ok
+}
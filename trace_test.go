@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestSampler tests the head sampling decisions of the samplers.
+func TestSampler(t *testing.T) {
+	sampled, _ := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	unsampled, _ := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+
+	testEqual(t, true, (&sampler{name: "always_on"}).sample(unsampled, true))
+	testEqual(t, false, (&sampler{name: "always_off"}).sample(sampled, true))
+	testEqual(t, false, (&sampler{name: "parentbased_always_on"}).sample(unsampled, true))
+	testEqual(t, true, (&sampler{name: "parentbased_always_off"}).sample(sampled, true))
+	testEqual(t, true, (&sampler{name: "parentbased_always_on"}).sample(unsampled, false))
+	testEqual(t, true, (&sampler{name: "traceidratio", arg: 1}).sample(unsampled, false))
+	testEqual(t, false, (&sampler{name: "traceidratio", arg: 0}).sample(unsampled, false))
+
+	limited := &sampler{name: "ratelimited", arg: 1}
+	testEqual(t, true, limited.sample(unsampled, false))
+	testEqual(t, false, limited.sample(unsampled, false))
+}
+
+// TestTracing tests that unsampled traces are only exported when the request fails.
+func TestTracing(t *testing.T) {
+	exporter := newOTLPExporter("http://localhost:0", "testapp", version, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer exporter.Close()
+
+	handler := tracing(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tc, ok := traceFrom(r.Context())
+		testEqual(t, true, ok)
+		testEqual(t, byte(0), tc.flags&sampledFlag)
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}), &sampler{name: "always_off", forceLatency: time.Minute}, exporter)
+
+	r := httptest.NewRequest(http.MethodGet, "/ok", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/fail", nil))
+
+	exporter.mu.Lock()
+	defer exporter.mu.Unlock()
+	testEqual(t, 1, len(exporter.spans))
+	testEqual(t, "500", *exporter.spans[0].Attributes[2].Value.IntValue)
+	testEqual(t, 2, exporter.spans[0].Status.Code)
+}
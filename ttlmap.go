@@ -0,0 +1,127 @@
+package main
+
+import (
+	"container/list"
+	"expvar"
+	"sync"
+	"time"
+)
+
+// ttlMapVars counts the hits, misses, expirations, and evictions of each [ttlMap] by its name, served by /debug/vars.
+var ttlMapVars = expvar.NewMap("ttlmap")
+
+// ttlMap is a map of entries expiring at their own time and bounded to a size by evicting the least recently used,
+// shared by the features keeping short-lived state in memory, such as the entries of a [cache], the bindings of
+// an [affinity], and the counters of [rateLimit], so that each of them does not roll its own map, lock, and sweep.
+// Expired entries are dropped when they are looked up or evicted, so memory is bounded by the size rather than by time.
+type ttlMap[K comparable, V any] struct {
+	name    string
+	maxSize int
+
+	mu      sync.Mutex
+	entries map[K]*list.Element // of *ttlEntry[K, V]
+	lru     *list.List          // front is the most recently used
+}
+
+// ttlEntry is an entry of a [ttlMap].
+type ttlEntry[K comparable, V any] struct {
+	key     K
+	value   V
+	expires time.Time
+}
+
+// newTTLMap returns a [ttlMap] named name in [ttlMapVars], holding at most maxSize entries.
+func newTTLMap[K comparable, V any](name string, maxSize int) *ttlMap[K, V] {
+	return &ttlMap[K, V]{name: name, maxSize: maxSize, entries: map[K]*list.Element{}, lru: list.New()}
+}
+
+// get returns the value of the key and whether it is present and not expired at now, marking it as recently used.
+func (m *ttlMap[K, V]) get(key K, now time.Time) (V, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.lookup(key, now)
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	return e.value, true
+}
+
+// put sets the value of the key until expires, evicting the least recently used entry if the map is full.
+func (m *ttlMap[K, V]) put(key K, value V, expires time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.store(key, value, expires)
+}
+
+// update sets the value of the key to the one fn returns from its current value, or the zero value and false
+// if it is absent or expired at now, keeping its expiry if present, or expiring at expires otherwise.
+// fn runs under the lock of the map, so updates such as incrementing a counter are atomic.
+func (m *ttlMap[K, V]) update(key K, now, expires time.Time, fn func(value V, ok bool) V) V {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.lookup(key, now); ok {
+		e.value = fn(e.value, true)
+		return e.value
+	}
+	var zero V
+	value := fn(zero, false)
+	m.store(key, value, expires)
+	return value
+}
+
+// delete removes the key.
+func (m *ttlMap[K, V]) delete(key K) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if el, ok := m.entries[key]; ok {
+		m.remove(el)
+	}
+}
+
+// len returns the number of entries, including the expired ones not dropped yet.
+func (m *ttlMap[K, V]) len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.entries)
+}
+
+// lookup returns the entry of the key if it is not expired at now, counting the hit or miss. m.mu must be held.
+func (m *ttlMap[K, V]) lookup(key K, now time.Time) (*ttlEntry[K, V], bool) {
+	el, ok := m.entries[key]
+	if !ok {
+		ttlMapVars.Add(m.name+".misses", 1)
+		return nil, false
+	}
+	e := el.Value.(*ttlEntry[K, V])
+	if now.After(e.expires) {
+		m.remove(el)
+		ttlMapVars.Add(m.name+".expirations", 1)
+		ttlMapVars.Add(m.name+".misses", 1)
+		return nil, false
+	}
+	m.lru.MoveToFront(el)
+	ttlMapVars.Add(m.name+".hits", 1)
+	return e, true
+}
+
+// store sets the entry of the key, evicting the least recently used entry if the map is full. m.mu must be held.
+func (m *ttlMap[K, V]) store(key K, value V, expires time.Time) {
+	if el, ok := m.entries[key]; ok {
+		e := el.Value.(*ttlEntry[K, V])
+		e.value, e.expires = value, expires
+		m.lru.MoveToFront(el)
+		return
+	}
+	m.entries[key] = m.lru.PushFront(&ttlEntry[K, V]{key: key, value: value, expires: expires})
+	for len(m.entries) > m.maxSize {
+		m.remove(m.lru.Back())
+		ttlMapVars.Add(m.name+".evictions", 1)
+	}
+}
+
+// remove removes the entry of the element. m.mu must be held.
+func (m *ttlMap[K, V]) remove(el *list.Element) {
+	m.lru.Remove(el)
+	delete(m.entries, el.Value.(*ttlEntry[K, V]).key)
+}
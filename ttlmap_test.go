@@ -0,0 +1,51 @@
+package main
+
+import (
+	"expvar"
+	"testing"
+	"time"
+)
+
+// TestTTLMap tests that entries expire at their own time and the least recently used one is evicted once the map is full.
+func TestTTLMap(t *testing.T) {
+	m := newTTLMap[string, int]("test", 2)
+	now := time.Now()
+	stat := func(name string) int64 {
+		v, _ := ttlMapVars.Get("test." + name).(*expvar.Int)
+		if v == nil {
+			return 0
+		}
+		return v.Value()
+	}
+	hits, misses, evictions, expirations := stat("hits"), stat("misses"), stat("evictions"), stat("expirations")
+
+	m.put("a", 1, now.Add(time.Minute))
+	m.put("b", 2, now.Add(time.Second))
+	v, ok := m.get("a", now)
+	testEqual(t, true, ok)
+	testEqual(t, 1, v)
+
+	m.put("c", 3, now.Add(time.Minute))
+	testEqual(t, 2, m.len())
+	_, ok = m.get("b", now)
+	testEqual(t, false, ok)
+	_, ok = m.get("c", now.Add(2*time.Minute))
+	testEqual(t, false, ok)
+	testEqual(t, 1, m.len())
+
+	for i := range 3 {
+		testEqual(t, i+1, m.update("n", now, now.Add(time.Second), func(n int, _ bool) int { return n + 1 }))
+	}
+	testEqual(t, 1, m.update("n", now.Add(2*time.Second), now.Add(time.Minute), func(n int, ok bool) int {
+		testEqual(t, false, ok)
+		return n + 1
+	}))
+	m.delete("n")
+	_, ok = m.get("n", now)
+	testEqual(t, false, ok)
+
+	testEqual(t, int64(3), stat("hits")-hits)
+	testEqual(t, int64(5), stat("misses")-misses)
+	testEqual(t, int64(1), stat("evictions")-evictions)
+	testEqual(t, int64(2), stat("expirations")-expirations)
+}